@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	auditDSCmd.Flags().StringP("zones", "d", "", "Directory with the signed zone files to audit")
+	auditDSCmd.Flags().String("ds", "", "File with the DS records published in the parent zones, in zone file format")
+}
+
+var auditDSCmd = &cobra.Command{
+	Use:   "audit-ds",
+	Short: "Checks that the KSKs of a directory of signed zones match their published DS records.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, _ := cmd.Flags().GetString("zones")
+		dsPath, _ := cmd.Flags().GetString("ds")
+
+		if len(dir) == 0 {
+			return fmt.Errorf("zones directory not specified")
+		}
+		if len(dsPath) == 0 {
+			return fmt.Errorf("DS file path not specified")
+		}
+		if err := signer.FilesExist(dir, dsPath); err != nil {
+			return err
+		}
+
+		dsFile, err := os.Open(dsPath)
+		if err != nil {
+			return err
+		}
+		defer dsFile.Close()
+		dsRecords, err := signer.ReadDSRecords(dsFile)
+		if err != nil {
+			return fmt.Errorf("cannot read DS records: %s", err)
+		}
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		zoneFiles := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				zoneFiles = append(zoneFiles, filepath.Join(dir, entry.Name()))
+			}
+		}
+		results, err := signer.AuditDS(zoneFiles, dsRecords)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, result := range results {
+			Log.Printf("%s (%s): %s, KSKs %v, %d matching and %d unmatched DS records",
+				result.Zone, result.File, result.Status, result.KSKTags, len(result.Matched), len(result.Unmatched))
+			if result.Status != signer.AuditMatch {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d zones have no DS record matching their KSKs", failed, len(results))
+		}
+		Log.Printf("All the zones match their DS records.")
+		return nil
+	},
+}
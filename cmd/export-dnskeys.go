@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+)
+
+func init() {
+	exportDNSKEYsCmd.Flags().StringP("zone", "z", "", "Zone name")
+	exportDNSKEYsCmd.Flags().StringP("output", "o", "", "Output file for the DNSKEY records (by default, the standard output)")
+	exportDNSKEYsCmd.Flags().StringP("algorithm", "a", "RSASHA256", "DNSSEC algorithm of the keys (RSASHA256, RSASHA512, ECDSAP256SHA256, ECDSAP384SHA384 or ED25519)")
+	exportDNSKEYsCmd.Flags().Uint32("ttl", 3600, "TTL of the DNSKEY records")
+	exportDNSKEYsCmd.Flags().Bool("ds", false, "Writes the DS records of the KSK too, with SHA-256 and SHA-384 digests")
+	exportDNSKEYsCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file")
+	exportDNSKEYsCmd.Flags().String("hsm-config", "", "Full path to a JSON HSM config file (replaces p11lib, user-key and key-label)")
+	exportDNSKEYsCmd.Flags().StringP("user-key", "k", "1234", "HSM User Login Key (default is 1234)")
+	addPINFlags(exportDNSKEYsCmd)
+	addTokenFlags(exportDNSKEYsCmd)
+	exportDNSKEYsCmd.Flags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer Key")
+}
+
+var exportDNSKEYsCmd = &cobra.Command{
+	Use:   "export-dnskeys",
+	Short: "Writes the DNSKEY records of the keys of a zone stored in the HSM, without signing it",
+	RunE: func(cmd *cobra.Command, _ []string) (err error) {
+		zone := viper.GetString("zone")
+		out := viper.GetString("output")
+		p11lib := viper.GetString("p11lib")
+		hsmConfigPath := viper.GetString("hsm-config")
+
+		if len(zone) == 0 {
+			return fmt.Errorf("zone not specified")
+		}
+		if len(p11lib) == 0 && len(hsmConfigPath) == 0 {
+			return fmt.Errorf("p11lib not specified")
+		}
+		algorithm, err := signer.ParseAlgorithm(viper.GetString("algorithm"))
+		if err != nil {
+			return err
+		}
+
+		s, err := openSession(cmd)
+		if err != nil {
+			return err
+		}
+		defer s.End()
+		dnskeys, err := s.GetDNSKEYs(zone, algorithm, viper.GetUint32("ttl"))
+		if err != nil {
+			return err
+		}
+
+		var writer io.Writer = os.Stdout
+		if len(out) > 0 {
+			file, err := os.Create(out)
+			if err != nil {
+				return fmt.Errorf("couldn't create out file in path %s: %s", out, err)
+			}
+			defer file.Close()
+			writer = file
+		}
+		rrs := make(signer.RRArray, 0, len(dnskeys))
+		for _, dnskey := range dnskeys {
+			role := "ZSK"
+			if dnskey.Flags&dns.SEP != 0 {
+				role = "KSK"
+			}
+			if _, err := fmt.Fprintf(writer, "; %s, key tag %d\n%s\n", role, dnskey.KeyTag(), dnskey); err != nil {
+				return err
+			}
+			rrs = append(rrs, dnskey)
+		}
+		if viper.GetBool("ds") {
+			for _, ds := range signer.KSKDSRecords(zone, rrs, signer.DSDigestTypes) {
+				if _, err := fmt.Fprintln(writer, ds); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
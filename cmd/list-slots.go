@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	listSlotsCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file")
+}
+
+var listSlotsCmd = &cobra.Command{
+	Use:   "list-slots",
+	Short: "Lists the slots with a token of the PKCS#11 library, with the label and serial number of their tokens",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p11lib, _ := cmd.Flags().GetString("p11lib")
+
+		if len(p11lib) == 0 {
+			return fmt.Errorf("p11lib not specified")
+		}
+		if err := signer.FilesExist(p11lib); err != nil {
+			return err
+		}
+		slots, err := signer.ListSlots(p11lib)
+		if err != nil {
+			return err
+		}
+		if len(slots) == 0 {
+			return fmt.Errorf("no slots with a token found")
+		}
+		for _, slot := range slots {
+			fmt.Println(slot)
+		}
+		return nil
+	},
+}
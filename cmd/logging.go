@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+)
+
+// Logger logs the events of the signer (as the keys created and the progress of the signatures) with the format
+// and level of the log-format and log-level flags. It is set by initLogging before each command runs.
+var Logger signer.Logger
+
+// initLogging sets Logger following the log-format (text or json) and log-level flags. With the json format, the
+// messages of the commands written into Log are JSON objects too, so the whole output can be sent to a log collector.
+func initLogging() error {
+	level, err := signer.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return err
+	}
+	switch format := viper.GetString("log-format"); strings.ToLower(format) {
+	case "text":
+		Log.SetOutput(os.Stderr)
+		Logger = signer.NewStdLogger(Log, level)
+	case "json":
+		logger := signer.NewJSONLogger(os.Stderr, level)
+		Log.SetOutput(jsonWriter{logger})
+		Logger = logger
+	default:
+		return fmt.Errorf("unknown log format %s (it should be text or json)", format)
+	}
+	return nil
+}
+
+// jsonWriter writes each line of the messages of Log as a message of a signer.Logger. The lines starting with
+// "Error: " or "Warning: " are logged as errors or warnings, and the others as informative messages.
+type jsonWriter struct {
+	logger signer.Logger
+}
+
+// Write logs the lines of p.
+func (w jsonWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "Error: "):
+			w.logger.Error(strings.TrimPrefix(line, "Error: "))
+		case strings.HasPrefix(line, "Warning: "):
+			w.logger.Warn(strings.TrimPrefix(line, "Warning: "))
+		default:
+			w.logger.Info(line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// addPINFlags adds the flags reading the HSM user PIN from an environment variable, a file or a prompt, so it does
+// not end up in the shell history and the process listings as the value of user-key.
+func addPINFlags(cmd *cobra.Command) {
+	cmd.Flags().String("pin-env", "", "Environment variable with the HSM user PIN (replaces user-key)")
+	cmd.Flags().String("pin-file", "", "File with the HSM user PIN (replaces user-key)")
+	cmd.Flags().Bool("pin-prompt", false, "Asks the HSM user PIN in the terminal, without echo (replaces user-key)")
+}
+
+// userPIN returns the provider of the HSM user PIN selected by the flags of the command, or the user-key if none of
+// them is set. It returns an error if more than one is set.
+func userPIN(cmd *cobra.Command) (signer.PINProvider, error) {
+	var providers []signer.PINProvider
+	if cmd.Flags().Changed("user-key") {
+		providers = append(providers, signer.StaticPIN(viper.GetString("user-key")))
+	}
+	if env := viper.GetString("pin-env"); len(env) > 0 {
+		providers = append(providers, signer.EnvPIN(env))
+	}
+	if path := viper.GetString("pin-file"); len(path) > 0 {
+		providers = append(providers, signer.FilePIN(path))
+	}
+	if viper.GetBool("pin-prompt") {
+		providers = append(providers, &signer.PromptPIN{})
+	}
+	switch len(providers) {
+	case 0:
+		return signer.StaticPIN(viper.GetString("user-key")), nil
+	case 1:
+		return providers[0], nil
+	}
+	return nil, fmt.Errorf("only one of user-key, pin-env, pin-file and pin-prompt can be set")
+}
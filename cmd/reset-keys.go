@@ -10,7 +10,13 @@ import (
 func init() {
 	resetKeysCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file")
 	resetKeysCmd.Flags().StringP("user-key", "k", "1234", "HSM User Login Key (default is 1234)")
+	addPINFlags(resetKeysCmd)
+	addTokenFlags(resetKeysCmd)
 	resetKeysCmd.Flags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer Key")
+	resetKeysCmd.Flags().StringP("zone", "z", "", "Only deletes the keys of this zone (following the key label)")
+	resetKeysCmd.Flags().String("role", "", "Only deletes the keys of this role: zsk or ksk")
+	resetKeysCmd.Flags().Uint16("key-tag", 0, "Only deletes the key pair with this key tag")
+	resetKeysCmd.Flags().BoolP("dry-run", "n", false, "Lists the keys that would be deleted, without deleting them")
 	viper.BindPFlag("p11lib", resetKeysCmd.Flags().Lookup("p11lib"))
 	viper.BindPFlag("user-key", resetKeysCmd.Flags().Lookup("user-key"))
 	viper.BindPFlag("key-label", resetKeysCmd.Flags().Lookup("key-label"))
@@ -18,7 +24,7 @@ func init() {
 
 var resetKeysCmd = &cobra.Command{
 	Use:   "reset-keys",
-	Short: "Deletes all the keys registered in the HSM with specified key label",
+	Short: "Deletes all the keys registered in the HSM with specified key label, or only the ones of a zone, role or key tag",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		p11lib, _ := cmd.Flags().GetString("p11lib")
 
@@ -26,20 +32,46 @@ var resetKeysCmd = &cobra.Command{
 			return fmt.Errorf("p11lib not specified")
 		}
 
-		key := viper.GetString("user-key")
 		label := viper.GetString("key-label")
 		if err := signer.FilesExist(p11lib); err != nil {
 			return err
 		}
-		s, err := signer.NewSession(p11lib, key, label, Log)
+		token, err := tokenSelector(cmd)
+		if err != nil {
+			return err
+		}
+		pin, err := userPIN(cmd)
+		if err != nil {
+			return err
+		}
+		s, err := signer.NewSessionWithToken(p11lib, token, pin, label, Log)
 		if err != nil {
 			return err
 		}
 		defer s.End()
-		if err := s.DestroyAllKeys(); err != nil {
+		s.Log = Logger
+		filter := signer.KeyFilter{
+			Label:  label,
+			Zone:   viper.GetString("zone"),
+			Role:   viper.GetString("role"),
+			KeyTag: uint16(viper.GetUint("key-tag")),
+		}
+		dryRun := viper.GetBool("dry-run")
+		keys, err := s.DestroyKeys(filter, dryRun)
+		if err != nil {
 			return err
 		}
-		Log.Printf("All keys destroyed.")
+		if len(keys) == 0 {
+			return fmt.Errorf("no keys found")
+		}
+		if dryRun {
+			for _, key := range keys {
+				Log.Printf("Would delete %s", key)
+			}
+			Log.Printf("%d keys would be deleted.", len(keys))
+			return nil
+		}
+		Log.Printf("%d keys destroyed.", len(keys))
 		return nil
 	},
 }
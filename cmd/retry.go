@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// addRetryFlags adds the flags of the retries of the HSM operations failing with transient errors, and of the
+// reconnections of the lost sessions, as the ones of network-attached HSMs.
+func addRetryFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("retries", 1, "Attempts of the HSM operations failing with transient errors (as CKR_DEVICE_ERROR), and reconnections of a lost session")
+	cmd.Flags().Duration("retry-delay", signer.DefaultRetryDelay, "Delay before retrying a failed HSM operation, doubled after each retry")
+	cmd.Flags().Duration("retry-max-delay", 0, "Maximum delay between retries of a failed HSM operation (by default, it is not limited)")
+}
+
+// retryPolicy returns the retry policy set by the flags of the command.
+func retryPolicy() signer.RetryPolicy {
+	return signer.RetryPolicy{
+		MaxAttempts: viper.GetInt("retries"),
+		BaseDelay:   viper.GetDuration("retry-delay"),
+		MaxDelay:    viper.GetDuration("retry-max-delay"),
+	}
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"time"
+)
+
+func init() {
+	rolloverCmd.Flags().StringP("file", "f", "", "Full path to zone file to be signed")
+	rolloverCmd.Flags().StringP("output", "o", "", "Output for the signed zone file")
+	rolloverCmd.Flags().StringP("zone", "z", "", "Zone name")
+	rolloverCmd.Flags().String("state", "", "JSON file with the state of the rollover, updated after each signature")
+	rolloverCmd.Flags().Bool("start", false, "Starts a new ZSK rollover, generating the new ZSK")
+	rolloverCmd.Flags().String("strategy", "pre-publish", "How the new ZSK is introduced when the rollover starts: pre-publish or double-signature")
+	rolloverCmd.Flags().Duration("propagation-delay", 0, "Time for the signed zone to reach the secondary servers, waited in each phase besides the TTLs")
+	rolloverCmd.Flags().StringP("algorithm", "a", "RSASHA256", "DNSSEC algorithm of the keys (RSASHA256, RSASHA512, ECDSAP256SHA256, ECDSAP384SHA384 or ED25519)")
+	rolloverCmd.Flags().Int("zsk-bits", 0, "Size in bits of the new RSA ZSK (by default, 1024)")
+	rolloverCmd.Flags().Uint32("dnskey-ttl", 0, "TTL of the DNSKEY RRset (by default, the minimum TTL of the SOA)")
+	rolloverCmd.Flags().BoolP("nsec3", "3", false, "Use NSEC3 instead of NSEC (default: NSEC)")
+	rolloverCmd.Flags().BoolP("opt-out", "x", false, "Use NSEC3 with opt-out")
+	rolloverCmd.Flags().String("existing-dnskeys", "error", "What to do with the DNSKEYs already in the zone: error, replace or preserve")
+	rolloverCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file")
+	rolloverCmd.Flags().String("hsm-config", "", "Full path to a JSON HSM config file (replaces p11lib, user-key and key-label)")
+	rolloverCmd.Flags().StringP("user-key", "k", "1234", "HSM User Login Key (default is 1234)")
+	addPINFlags(rolloverCmd)
+	addTokenFlags(rolloverCmd)
+	addRetryFlags(rolloverCmd)
+	rolloverCmd.Flags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer Key")
+}
+
+var rolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Signs a DNS Zone during a ZSK rollover, moving the rollover to its next phase when it is ready",
+	RunE: func(cmd *cobra.Command, _ []string) (err error) {
+		zone := viper.GetString("zone")
+		filepath := viper.GetString("file")
+		out := viper.GetString("output")
+		statePath := viper.GetString("state")
+		p11lib := viper.GetString("p11lib")
+		hsmConfigPath := viper.GetString("hsm-config")
+
+		if len(filepath) == 0 {
+			return fmt.Errorf("input file path not specified")
+		}
+		if len(out) == 0 {
+			return fmt.Errorf("output file path not specified")
+		}
+		if len(zone) == 0 {
+			return fmt.Errorf("zone not specified")
+		}
+		if len(statePath) == 0 {
+			return fmt.Errorf("rollover state file path not specified")
+		}
+		if len(p11lib) == 0 && len(hsmConfigPath) == 0 {
+			return fmt.Errorf("p11lib not specified")
+		}
+
+		var state *signer.RolloverState
+		if stateFile, err := os.Open(statePath); err == nil {
+			state, err = signer.ReadRolloverState(stateFile)
+			stateFile.Close()
+			if err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if viper.GetBool("start") {
+			if state != nil && state.Started() && state.Phase != signer.RolloverNone {
+				return fmt.Errorf("the ZSK rollover of zone %s is in the %s phase, it cannot start again", state.Zone, state.Phase)
+			}
+			strategy, err := signer.ParseRolloverStrategy(viper.GetString("strategy"))
+			if err != nil {
+				return err
+			}
+			state = signer.NewRolloverState(zone, strategy, viper.GetDuration("propagation-delay"))
+		} else if state == nil {
+			return fmt.Errorf("there is no rollover state in %s, use --start to start a ZSK rollover", statePath)
+		}
+
+		signArgs := &signer.SignArgs{
+			Zone:      zone,
+			ZSKBits:   viper.GetInt("zsk-bits"),
+			DNSKEYTTL: viper.GetUint32("dnskey-ttl"),
+			NSEC3:     viper.GetBool("nsec3"),
+			OptOut:    viper.GetBool("opt-out"),
+			Retry:     retryPolicy(),
+		}
+		if signArgs.Algorithm, err = signer.ParseAlgorithm(viper.GetString("algorithm")); err != nil {
+			return err
+		}
+		if signArgs.ExistingDNSKEYs, err = signer.ParseDNSKEYPolicy(viper.GetString("existing-dnskeys")); err != nil {
+			return err
+		}
+
+		if len(hsmConfigPath) > 0 {
+			if _, err := signer.LoadHSMConfig(hsmConfigPath); err != nil {
+				return err
+			}
+		} else if err := signer.FilesExist(p11lib); err != nil {
+			return err
+		}
+		if err := signer.FilesExist(filepath); err != nil {
+			return err
+		}
+		file, err := os.Open(filepath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		signArgs.File = file
+		writer, err := os.Create(out)
+		if err != nil {
+			return fmt.Errorf("couldn't create out file in path %s: %s", out, err)
+		}
+		defer writer.Close()
+		signArgs.Output = writer
+
+		s, err := openSession(cmd)
+		if err != nil {
+			return err
+		}
+		defer s.End()
+
+		if _, err := s.Rollover(&signer.SessionSignArgs{SignArgs: signArgs}, state); err != nil {
+			return err
+		}
+		stateFile, err := os.Create(statePath)
+		if err != nil {
+			return fmt.Errorf("couldn't create rollover state file in path %s: %s", statePath, err)
+		}
+		defer stateFile.Close()
+		if err := state.WriteJSON(stateFile); err != nil {
+			return fmt.Errorf("cannot write rollover state: %s", err)
+		}
+		if state.Phase == signer.RolloverNone {
+			Log.Printf("File signed successfully. The ZSK rollover ended.")
+		} else {
+			Log.Printf("File signed successfully in the %s phase of the ZSK rollover (verify it with --rollover %s). The next phase can begin at %s.",
+				state.Phase, state.Phase, state.Ready.Format(time.RFC3339))
+		}
+		return nil
+	},
+}
@@ -13,9 +13,17 @@ var cfgFile string
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is /etc/hsm-tools/config.toml)")
+	rootCmd.PersistentFlags().String("log-format", "text", "Format of the log messages: text or json (a JSON object per line)")
+	rootCmd.PersistentFlags().String("log-level", "debug", "Minimum level of the log messages of the signer: debug, info, warn or error")
 	rootCmd.AddCommand(signCmd)
 	rootCmd.AddCommand(verifyCmd)
 	rootCmd.AddCommand(resetKeysCmd)
+	rootCmd.AddCommand(unsignCmd)
+	rootCmd.AddCommand(auditDSCmd)
+	rootCmd.AddCommand(rolloverCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(exportDNSKEYsCmd)
+	rootCmd.AddCommand(listSlotsCmd)
 	Log = log.New(os.Stderr, "", 0)
 }
 
@@ -27,6 +35,14 @@ var rootCmd = &cobra.Command{
 	Long: `Allows to sign a DNS zone using a PKCS#11 device.
 	
 	For more information, visit "https://github.com/niclabs/hsm-tools".`,
+	// Some flags (as file or zone) are shared by many commands, so they are bound again
+	// to the running command's flags, or the values of the last bound command would be used.
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+		return initLogging()
+	},
 }
 
 func Execute() {
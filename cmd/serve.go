@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func init() {
+	serveCmd.Flags().StringP("zone", "z", "", "Zone name")
+	serveCmd.Flags().String("axfr", "", "Hidden primary server (host:port) the zone to sign is transferred from")
+	serveCmd.Flags().String("tsig", "", "TSIG key for the zone transfers and NOTIFY messages, as [algorithm:]name:secret")
+	serveCmd.Flags().String("tsig-file", "", "Full path to a BIND key file with the TSIG key for the zone transfers and NOTIFY messages (replaces tsig)")
+	serveCmd.Flags().String("listen", ":53", "Address (host:port) where the signed zone is served with AXFR")
+	serveCmd.Flags().String("metrics-listen", "", "If set, address (host:port) where the Prometheus metrics of the signatures are served on /metrics")
+	serveCmd.Flags().String("notify", "", "Comma separated secondary servers (host:port) notified when the zone is signed")
+	serveCmd.Flags().Duration("refresh", 0, "How often the serial of the hidden primary is checked (by default, the refresh interval of its SOA)")
+	serveCmd.Flags().StringP("output", "o", "", "If set, the signed zone is written to this file too")
+	serveCmd.Flags().StringP("algorithm", "a", "RSASHA256", "DNSSEC algorithm of the keys (RSASHA256, RSASHA512, ECDSAP256SHA256, ECDSAP384SHA384 or ED25519)")
+	serveCmd.Flags().BoolP("create-keys", "c", false, "Creates the keys if they don't exist")
+	serveCmd.Flags().BoolP("nsec3", "3", false, "Use NSEC3 instead of NSEC (default: NSEC)")
+	serveCmd.Flags().BoolP("opt-out", "x", false, "Use NSEC3 with opt-out")
+	serveCmd.Flags().String("existing-dnskeys", "error", "What to do with the DNSKEYs already in the zone: error, replace or preserve")
+	serveCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file")
+	serveCmd.Flags().String("hsm-config", "", "Full path to a JSON HSM config file (replaces p11lib, user-key and key-label)")
+	serveCmd.Flags().StringP("user-key", "k", "1234", "HSM User Login Key (default is 1234)")
+	addPINFlags(serveCmd)
+	addTokenFlags(serveCmd)
+	addRetryFlags(serveCmd)
+	serveCmd.Flags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer Key")
+	serveCmd.Flags().String("zsk-file", "", "Full path to a PEM file with the private key of the ZSK, to sign without an HSM (needs --ksk-file)")
+	serveCmd.Flags().String("ksk-file", "", "Full path to a PEM file with the private key of the KSK, to sign without an HSM (needs --zsk-file)")
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Transfers a DNS Zone from a hidden primary, signs it and serves it to the secondaries with AXFR, signing it again when it changes",
+	RunE: func(cmd *cobra.Command, _ []string) (err error) {
+		zone := dns.Fqdn(viper.GetString("zone"))
+		master := viper.GetString("axfr")
+		p11lib := viper.GetString("p11lib")
+		hsmConfigPath := viper.GetString("hsm-config")
+		zskFile := viper.GetString("zsk-file")
+		kskFile := viper.GetString("ksk-file")
+		out := viper.GetString("output")
+
+		if zone == "." {
+			return fmt.Errorf("zone not specified")
+		}
+		if len(master) == 0 {
+			return fmt.Errorf("hidden primary not specified (use --axfr)")
+		}
+		if (len(zskFile) == 0) != (len(kskFile) == 0) {
+			return fmt.Errorf("--zsk-file and --ksk-file must be used together")
+		}
+		if len(p11lib) == 0 && len(hsmConfigPath) == 0 && len(zskFile) == 0 {
+			return fmt.Errorf("p11lib not specified")
+		}
+		tsigKey, err := tsigKeyFlags()
+		if err != nil {
+			return err
+		}
+		algorithm, err := signer.ParseAlgorithm(viper.GetString("algorithm"))
+		if err != nil {
+			return err
+		}
+		policy, err := signer.ParseDNSKEYPolicy(viper.GetString("existing-dnskeys"))
+		if err != nil {
+			return err
+		}
+
+		// sign signs the zone with the keys of the files or of the HSM.
+		var sign func(args *signer.SignArgs) error
+		if len(zskFile) > 0 {
+			if err := signer.FilesExist(zskFile, kskFile); err != nil {
+				return err
+			}
+			fileKey := &signer.FileKey{ZSKfile: zskFile, KSKfile: kskFile, Logger: Logger}
+			sign = func(args *signer.SignArgs) error {
+				_, err := fileKey.Sign(args)
+				return err
+			}
+		} else {
+			s, err := openSession(cmd)
+			if err != nil {
+				return err
+			}
+			defer s.End()
+			sign = func(args *signer.SignArgs) error {
+				_, err := s.Sign(&signer.SessionSignArgs{SignArgs: args})
+				return err
+			}
+		}
+
+		// Without a TSIG key, only the hidden primary can notify the zone.
+		server := &signer.TransferServer{Key: tsigKey, Primaries: []string{master}, Log: Logger}
+		if notify := viper.GetString("notify"); len(notify) > 0 {
+			for _, secondary := range strings.Split(notify, ",") {
+				server.Secondaries = append(server.Secondaries, strings.TrimSpace(secondary))
+			}
+		}
+
+		metrics := &signer.PrometheusMetrics{}
+		if metricsAddr := viper.GetString("metrics-listen"); len(metricsAddr) > 0 {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			go func() {
+				if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+					Log.Printf("Error: cannot serve the metrics on %s: %s", metricsAddr, err)
+				}
+			}()
+			Log.Printf("Serving metrics on %s/metrics.", metricsAddr)
+		}
+
+		// transferAndSign transfers the zone from the hidden primary, signs it and serves it.
+		// It returns the serial and the refresh interval of the zone in the hidden primary.
+		createKeys := viper.GetBool("create-keys")
+		transferAndSign := func() (uint32, time.Duration, error) {
+			rrs, err := signer.TransferZone(master, zone, tsigKey)
+			if err != nil {
+				return 0, 0, err
+			}
+			soa := rrs[0].(*dns.SOA)
+			serial, refresh := soa.Serial, time.Duration(soa.Refresh)*time.Second
+			args := &signer.SignArgs{
+				Zone:            zone,
+				RRs:             rrs,
+				Output:          ioutil.Discard,
+				Algorithm:       algorithm,
+				CreateKeys:      createKeys,
+				NSEC3:           viper.GetBool("nsec3"),
+				OptOut:          viper.GetBool("opt-out"),
+				ExistingDNSKEYs: policy,
+				Retry:           retryPolicy(),
+				Metrics:         metrics,
+			}
+			if len(out) > 0 {
+				writer, err := os.Create(out)
+				if err != nil {
+					return 0, 0, fmt.Errorf("couldn't create out file in path %s: %s", out, err)
+				}
+				defer writer.Close()
+				args.Output = writer
+			}
+			if err := sign(args); err != nil {
+				metrics.ObserveFailure(zone)
+				return 0, 0, err
+			}
+			metrics.ObserveSignedZone(args)
+			// The keys are created once, and reused by the following signatures.
+			createKeys = false
+			if err := server.SetZone(zone, args.RRs); err != nil {
+				return 0, 0, err
+			}
+			Log.Printf("Zone %s signed and served (serial %d in the hidden primary).", zone, serial)
+			return serial, refresh, nil
+		}
+
+		// The server listens before the first signature, so the secondaries notified can transfer the zone.
+		notified := make(chan struct{}, 1)
+		server.OnNotify = func(name string) {
+			if strings.EqualFold(dns.Fqdn(name), zone) {
+				select {
+				case notified <- struct{}{}:
+				default:
+				}
+			}
+		}
+		if err := server.Listen(viper.GetString("listen")); err != nil {
+			return err
+		}
+		defer server.Close()
+		Log.Printf("Serving zone %s on %s.", zone, server.Addr())
+
+		serial, refresh, err := transferAndSign()
+		if err != nil {
+			return err
+		}
+		if interval := viper.GetDuration("refresh"); interval > 0 {
+			refresh = interval
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		for {
+			var tick <-chan time.Time
+			if refresh > 0 {
+				tick = time.After(refresh)
+			}
+			select {
+			case <-stop:
+				Log.Printf("Stopped serving zone %s", zone)
+				return nil
+			case <-notified:
+			case <-tick:
+			}
+			// A NOTIFY can be repeated or arrive before the change is visible, so the zone is only transferred
+			// if the serial of the hidden primary is not the one signed last.
+			current, err := signer.ZoneSerial(master, zone, tsigKey)
+			if err != nil {
+				Log.Printf("Cannot check the serial of the hidden primary: %s", err)
+				continue
+			}
+			if current == serial {
+				continue
+			}
+			// A failed signature keeps the last signed zone in service.
+			newSerial, newRefresh, err := transferAndSign()
+			if err != nil {
+				Log.Printf("Cannot sign the new version of zone %s: %s", zone, err)
+				continue
+			}
+			serial = newSerial
+			if viper.GetDuration("refresh") <= 0 {
+				refresh = newRefresh
+			}
+		}
+	},
+}
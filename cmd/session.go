@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// openSession opens the HSM session set by the flags of the command, with the HSM config file of hsm-config or else
+// with p11lib, the token and PIN flags and key-label. The caller must end the session.
+func openSession(cmd *cobra.Command) (*signer.Session, error) {
+	var s *signer.Session
+	if hsmConfigPath := viper.GetString("hsm-config"); len(hsmConfigPath) > 0 {
+		hsmConfig, err := signer.LoadHSMConfig(hsmConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		if s, err = signer.NewSessionFromConfig(hsmConfig, Log); err != nil {
+			return nil, err
+		}
+	} else {
+		p11lib := viper.GetString("p11lib")
+		if err := signer.FilesExist(p11lib); err != nil {
+			return nil, err
+		}
+		token, err := tokenSelector(cmd)
+		if err != nil {
+			return nil, err
+		}
+		pin, err := userPIN(cmd)
+		if err != nil {
+			return nil, err
+		}
+		if s, err = signer.NewSessionWithToken(p11lib, token, pin, viper.GetString("key-label"), Log); err != nil {
+			return nil, err
+		}
+	}
+	s.Log = Logger
+	return s, nil
+}
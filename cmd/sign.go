@@ -5,7 +5,9 @@ import (
 	"github.com/niclabs/hsm-tools/signer"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -14,32 +16,129 @@ var args signer.SignArgs
 func init() {
 	signCmd.Flags().StringP("file", "f", "", "Full path to zone file to be signed")
 	signCmd.Flags().StringP("output", "o", "", "Output for the signed zone file")
+	signCmd.Flags().String("axfr", "", "Transfers the zone to sign from this master server (host:port) instead of reading a file")
+	signCmd.Flags().String("tsig", "", "TSIG key for the zone transfer and the updates, as [algorithm:]name:secret")
+	signCmd.Flags().String("tsig-file", "", "Full path to a BIND key file with the TSIG key for the zone transfer and the updates (replaces tsig)")
+	signCmd.Flags().String("update", "", "Sends the DNSSEC records to this server (host:port) as DNS UPDATE messages")
 	signCmd.Flags().StringP("zone", "z", "", "Zone name")
 	signCmd.Flags().BoolP("create-keys", "c", false, "Creates a new pair of keys, outdating all valid keys.")
+	signCmd.Flags().Bool("create-zsk", false, "Creates a new ZSK, outdating the valid ZSK and reusing the KSK (as in a ZSK rollover)")
+	signCmd.Flags().Bool("create-ksk", false, "Creates a new KSK, outdating the valid KSK and reusing the ZSK (as in a KSK rollover)")
+	signCmd.Flags().Int("zsk-bits", 0, "Size in bits of the RSA ZSKs created (by default, 1024)")
+	signCmd.Flags().Int("ksk-bits", 0, "Size in bits of the RSA KSKs created (by default, 2048)")
+	signCmd.Flags().StringP("algorithm", "a", "RSASHA256", "DNSSEC algorithm of the keys (RSASHA256, RSASHA512, ECDSAP256SHA256, ECDSAP384SHA384 or ED25519), or a comma separated list of algorithms to sign with all of them (as during an algorithm rollover)")
 	signCmd.Flags().BoolP("nsec3", "3", false, "Use NSEC3 instead of NSEC (default: NSEC)")
+	signCmd.Flags().String("nsec3-salt", "", "NSEC3 salt as a hex string (- for no salt), instead of a random one, so the NSEC3 chain can be reproduced")
+	signCmd.Flags().Int("nsec3-salt-length", signer.DefaultNSEC3SaltLength, "Length in octets of the random NSEC3 salts (0 for no salt, as RFC 9276 recommends)")
+	signCmd.Flags().Int("nsec3-iterations", signer.DefaultNSEC3Iterations, "Additional iterations of the NSEC3 hash (RFC 9276 recommends 0)")
 	signCmd.Flags().BoolP("opt-out", "x", false, "Use NSEC3 with opt-out")
 	signCmd.Flags().StringP("expiration-date", "e", "", "Expiration Date, in YYYYMMDD format. Default is one more year from now.")
+	signCmd.Flags().Duration("ksk-expiration", 0, "Validity of the DNSKEY RRSIGs (as 2160h), instead of the expiration date. They cannot expire before the other RRSIGs")
+	signCmd.Flags().Duration("zsk-expiration", 0, "Validity of the RRSIGs of the other RRsets (as 720h), instead of the expiration date")
+	signCmd.Flags().DurationP("expiration-jitter", "j", 0, "Randomly moves back each RRSIG expiration up to this duration (SOA and DNSKEY signatures are not moved)")
+	signCmd.Flags().Duration("inception-offset", 0, "Moves back the RRSIG inceptions this duration (as 1h), to tolerate resolvers with clocks behind")
+	signCmd.Flags().Duration("min-validity", time.Hour, "Warns if the RRSIGs can expire less than this duration after their inception (0 disables the check)")
+	signCmd.Flags().Bool("strict-validity", false, "Fails, instead of warning, if the RRSIGs can expire before the minimum validity")
+	signCmd.Flags().String("digest", "host", "Where the signed data is digested: host (signed by the HSM with CKM_RSA_PKCS or CKM_ECDSA) or hsm (digested and signed by the HSM, as with CKM_SHA256_RSA_PKCS)")
+	signCmd.Flags().String("existing-dnskeys", "error", "What to do with the DNSKEY records already in the zone: error, replace or preserve")
+	signCmd.Flags().String("out-of-zone", "error", "What to do with the records whose owner is not in the zone: error or drop (with a warning)")
+	signCmd.Flags().Bool("multi-signer", false, "Signs the zone as one of many signers (RFC8901 Model 2), keeping its DNSKEYs and the valid RRSIGs of the other signers")
+	signCmd.Flags().Bool("ignore-coverage", false, "Only warns, instead of failing, if an RRset of the signed zone has no RRSIG")
+	signCmd.Flags().String("cds", "none", "CDS and CDNSKEY records published for automated DS updates: none (the ones of the zone are signed as they are), publish (the ones of the KSKs) or delete (to go insecure)")
+	signCmd.Flags().Bool("zonemd", false, "Adds a ZONEMD record with the SHA-384 digest of the signed zone (RFC8976)")
+	signCmd.Flags().Int("concurrency", 1, "Number of RRsets signed at the same time, each one in its own HSM session")
+	signCmd.Flags().Bool("continue-on-error", false, "Leaves the RRsets that cannot be signed without RRSIGs and reports all of them at the end, instead of failing at the first one")
+	signCmd.Flags().Int("max-response-size", signer.DefaultMaxResponseSize, "Warns if the largest DNSSEC response of the signed zone exceeds this size in bytes")
+	addRetryFlags(signCmd)
+	signCmd.Flags().Duration("refresh-window", 0, "Re-signs an already signed zone, making again only the RRSIGs expiring within this duration (as 72h), and updating the serial only if one changes")
+	signCmd.Flags().Duration("dnskey-reuse-window", 0, "Keeps the RRSIGs of the DNSKEY RRset of an already signed zone if it did not change and they expire after this duration (as 168h), so the KSK is not used")
+	signCmd.Flags().String("offline-ksk", "", "Full path to a zone file with the DNSKEY RRset and its RRSIGs made by KSKs kept offline, published instead of signing the RRset (the KSKs are not needed)")
+	signCmd.Flags().Uint32("dnskey-ttl", 0, "TTL of the DNSKEY RRset (by default, the minimum TTL of the SOA)")
+	signCmd.Flags().String("format", "text", "Format of the signed zone: text (a zone file) or wire (length-prefixed records in wire format)")
+	signCmd.Flags().String("order", "canonical", "Order of the records in the output: canonical or bind (the layout of named-compilezone)")
+	signCmd.Flags().String("data-digest", "", "Writes the digest of the signed zone data (without the SOA serial and the RRSIG timestamps) in hex to this file, to detect changes between signatures")
+	signCmd.Flags().String("ds-output", "", "Writes the DS records of the KSKs (SHA-256 and SHA-384 digests) to this file, to submit them to the parent zone")
+	signCmd.Flags().String("metadata", "", "Writes a JSON summary of the DNSSEC data of the signed zone (keys, DS records, NSEC3 parameters, signature validity and record counts) to this file")
+	signCmd.Flags().Uint32("default-ttl", 0, "TTL of the records without one before the first record with a TTL, if the zone has no $TTL directive (as written by older tools)")
+	signCmd.Flags().Bool("preserve-text", false, "Writes the zone file text (with comments and directives) followed by the DNSSEC records, instead of rewriting the zone")
+	signCmd.Flags().String("serial", "increment", "SOA serial of the signed zone: increment, keep, unixtime, date (YYYYMMDDnn) or a serial number")
+	signCmd.Flags().Bool("skip-validation", false, "Signs the zone without checking it for CNAME, DNAME and glue problems")
+	signCmd.Flags().Bool("stream", false, "Signs a zone file sorted in canonical order name by name, without loading it in memory (it needs NSEC and --skip-validation)")
+	signCmd.Flags().BoolP("dry-run", "n", false, "Parses the zone and shows what would be signed, without using the HSM")
 	signCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file")
+	signCmd.Flags().String("zsk-file", "", "Full path to a PEM file with the private key of the ZSK, to sign without an HSM (needs --ksk-file)")
+	signCmd.Flags().String("ksk-file", "", "Full path to a PEM file with the private key of the KSK, to sign without an HSM (needs --zsk-file, and it is not used with --offline-ksk)")
+	signCmd.Flags().String("hsm-config", "", "Full path to a JSON HSM config file (replaces p11lib, user-key and key-label)")
 	signCmd.Flags().StringP("user-key", "k", "1234", "HSM User Login Key (default is 1234)")
+	addPINFlags(signCmd)
+	addTokenFlags(signCmd)
 	signCmd.Flags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer Key")
 
 	viper.BindPFlag("p11lib", signCmd.Flags().Lookup("p11lib"))
+	viper.BindPFlag("zsk-file", signCmd.Flags().Lookup("zsk-file"))
+	viper.BindPFlag("ksk-file", signCmd.Flags().Lookup("ksk-file"))
+	viper.BindPFlag("hsm-config", signCmd.Flags().Lookup("hsm-config"))
 	viper.BindPFlag("user-key", signCmd.Flags().Lookup("user-key"))
 	viper.BindPFlag("key-label", signCmd.Flags().Lookup("key-label"))
 
 	viper.BindPFlag("file", signCmd.Flags().Lookup("file"))
 	viper.BindPFlag("output", signCmd.Flags().Lookup("output"))
+	viper.BindPFlag("axfr", signCmd.Flags().Lookup("axfr"))
+	viper.BindPFlag("tsig", signCmd.Flags().Lookup("tsig"))
+	viper.BindPFlag("tsig-file", signCmd.Flags().Lookup("tsig-file"))
+	viper.BindPFlag("update", signCmd.Flags().Lookup("update"))
 	viper.BindPFlag("zone", signCmd.Flags().Lookup("zone"))
 	viper.BindPFlag("create-keys", signCmd.Flags().Lookup("create-keys"))
+	viper.BindPFlag("create-zsk", signCmd.Flags().Lookup("create-zsk"))
+	viper.BindPFlag("create-ksk", signCmd.Flags().Lookup("create-ksk"))
+	viper.BindPFlag("zsk-bits", signCmd.Flags().Lookup("zsk-bits"))
+	viper.BindPFlag("ksk-bits", signCmd.Flags().Lookup("ksk-bits"))
+	viper.BindPFlag("algorithm", signCmd.Flags().Lookup("algorithm"))
 	viper.BindPFlag("nsec3", signCmd.Flags().Lookup("nsec3"))
+	viper.BindPFlag("nsec3-salt", signCmd.Flags().Lookup("nsec3-salt"))
+	viper.BindPFlag("nsec3-salt-length", signCmd.Flags().Lookup("nsec3-salt-length"))
+	viper.BindPFlag("nsec3-iterations", signCmd.Flags().Lookup("nsec3-iterations"))
 	viper.BindPFlag("opt-out", signCmd.Flags().Lookup("opt-out"))
 	viper.BindPFlag("expiration-date", signCmd.Flags().Lookup("expiration-date"))
+	viper.BindPFlag("digest", signCmd.Flags().Lookup("digest"))
+	viper.BindPFlag("existing-dnskeys", signCmd.Flags().Lookup("existing-dnskeys"))
+	viper.BindPFlag("out-of-zone", signCmd.Flags().Lookup("out-of-zone"))
+	viper.BindPFlag("multi-signer", signCmd.Flags().Lookup("multi-signer"))
+	viper.BindPFlag("ignore-coverage", signCmd.Flags().Lookup("ignore-coverage"))
+	viper.BindPFlag("cds", signCmd.Flags().Lookup("cds"))
+	viper.BindPFlag("zonemd", signCmd.Flags().Lookup("zonemd"))
+	viper.BindPFlag("concurrency", signCmd.Flags().Lookup("concurrency"))
+	viper.BindPFlag("continue-on-error", signCmd.Flags().Lookup("continue-on-error"))
+	viper.BindPFlag("max-response-size", signCmd.Flags().Lookup("max-response-size"))
+	viper.BindPFlag("retries", signCmd.Flags().Lookup("retries"))
+	viper.BindPFlag("retry-delay", signCmd.Flags().Lookup("retry-delay"))
+	viper.BindPFlag("retry-max-delay", signCmd.Flags().Lookup("retry-max-delay"))
+	viper.BindPFlag("format", signCmd.Flags().Lookup("format"))
+	viper.BindPFlag("refresh-window", signCmd.Flags().Lookup("refresh-window"))
+	viper.BindPFlag("dnskey-reuse-window", signCmd.Flags().Lookup("dnskey-reuse-window"))
+	viper.BindPFlag("dnskey-ttl", signCmd.Flags().Lookup("dnskey-ttl"))
+	viper.BindPFlag("default-ttl", signCmd.Flags().Lookup("default-ttl"))
+	viper.BindPFlag("order", signCmd.Flags().Lookup("order"))
+	viper.BindPFlag("data-digest", signCmd.Flags().Lookup("data-digest"))
+	viper.BindPFlag("ds-output", signCmd.Flags().Lookup("ds-output"))
+	viper.BindPFlag("metadata", signCmd.Flags().Lookup("metadata"))
+	viper.BindPFlag("preserve-text", signCmd.Flags().Lookup("preserve-text"))
+	viper.BindPFlag("serial", signCmd.Flags().Lookup("serial"))
+	viper.BindPFlag("skip-validation", signCmd.Flags().Lookup("skip-validation"))
+	viper.BindPFlag("stream", signCmd.Flags().Lookup("stream"))
+	viper.BindPFlag("dry-run", signCmd.Flags().Lookup("dry-run"))
+	viper.BindPFlag("expiration-jitter", signCmd.Flags().Lookup("expiration-jitter"))
+	viper.BindPFlag("ksk-expiration", signCmd.Flags().Lookup("ksk-expiration"))
+	viper.BindPFlag("zsk-expiration", signCmd.Flags().Lookup("zsk-expiration"))
+	viper.BindPFlag("inception-offset", signCmd.Flags().Lookup("inception-offset"))
+	viper.BindPFlag("min-validity", signCmd.Flags().Lookup("min-validity"))
+	viper.BindPFlag("strict-validity", signCmd.Flags().Lookup("strict-validity"))
 }
 
 var signCmd = &cobra.Command{
 	Use:   "sign",
 	Short: "Signs a DNS Zone using the provided PKCS#11 library",
-	RunE: func(cmd *cobra.Command, _ []string) error {
+	RunE: func(cmd *cobra.Command, _ []string) (err error) {
 
 		zone := viper.GetString("zone")
 		createKeys := viper.GetBool("create-keys")
@@ -50,37 +149,137 @@ var signCmd = &cobra.Command{
 		filepath := viper.GetString("file")
 		out := viper.GetString("output")
 		p11lib := viper.GetString("p11lib")
-		key := viper.GetString("user-key")
-		label := viper.GetString("key-label")
 		expDateStr := viper.GetString("expiration-date")
 
-		if len(filepath) == 0 {
+		master := viper.GetString("axfr")
+		if len(filepath) == 0 && len(master) == 0 {
 			return fmt.Errorf("input file path not specified")
 		}
+		if len(filepath) > 0 && len(master) > 0 {
+			return fmt.Errorf("input file path and AXFR master cannot be used at the same time")
+		}
 		if len(zone) == 0 {
 			return fmt.Errorf("zone not specified")
 		}
-		if len(out) == 0 {
+		dryRun := viper.GetBool("dry-run")
+		updateServer := viper.GetString("update")
+		if !dryRun && len(out) == 0 && len(updateServer) == 0 {
 			return fmt.Errorf("output file path not specified")
 		}
-		if len(p11lib) == 0 {
+		// The streamed zone is not kept in memory, so the options that need it after the signature cannot be used.
+		if viper.GetBool("stream") && (dryRun || len(master) > 0 || len(updateServer) > 0 || len(viper.GetString("data-digest")) > 0) {
+			return fmt.Errorf("--stream cannot be used with --dry-run, --axfr, --update or --data-digest")
+		}
+		hsmConfigPath := viper.GetString("hsm-config")
+		zskFile := viper.GetString("zsk-file")
+		kskFile := viper.GetString("ksk-file")
+		offlineKSK := viper.GetString("offline-ksk")
+		if len(zskFile) == 0 && len(kskFile) > 0 || len(zskFile) > 0 && len(kskFile) == 0 && len(offlineKSK) == 0 {
+			return fmt.Errorf("--zsk-file and --ksk-file must be used together (unless the KSK is offline)")
+		}
+		if !dryRun && len(p11lib) == 0 && len(hsmConfigPath) == 0 && len(zskFile) == 0 {
 			return fmt.Errorf("p11lib not specified")
 		}
 
 		args.Zone = zone
 		args.CreateKeys = createKeys
+		args.CreateZSK = viper.GetBool("create-zsk")
+		args.CreateKSK = viper.GetBool("create-ksk")
+		args.ZSKBits = viper.GetInt("zsk-bits")
+		args.KSKBits = viper.GetInt("ksk-bits")
 		args.NSEC3 = nsec3
 		args.OptOut = optOut
-
-		if err := signer.FilesExist(p11lib, filepath); err != nil {
+		args.NSEC3Salt = viper.GetString("nsec3-salt")
+		// In SignArgs, zero is the default and negative values mean none.
+		if args.NSEC3Iterations = viper.GetInt("nsec3-iterations"); args.NSEC3Iterations == 0 {
+			args.NSEC3Iterations = -1
+		}
+		if len(args.NSEC3Salt) == 0 {
+			if args.NSEC3SaltLength = viper.GetInt("nsec3-salt-length"); args.NSEC3SaltLength == 0 {
+				args.NSEC3SaltLength = -1
+			}
+		}
+		args.ExpirationJitter = viper.GetDuration("expiration-jitter")
+		args.KSKSignExpDuration = viper.GetDuration("ksk-expiration")
+		args.ZSKSignExpDuration = viper.GetDuration("zsk-expiration")
+		args.InceptionOffset = viper.GetDuration("inception-offset")
+		args.MinValidity = viper.GetDuration("min-validity")
+		args.StrictValidity = viper.GetBool("strict-validity")
+		args.DryRun = dryRun
+		args.SkipValidation = viper.GetBool("skip-validation")
+		args.Stream = viper.GetBool("stream")
+		args.IgnoreCoverage = viper.GetBool("ignore-coverage")
+		args.ContinueOnError = viper.GetBool("continue-on-error")
+		args.Concurrency = viper.GetInt("concurrency")
+		args.MultiSigner = viper.GetBool("multi-signer")
+		args.ZONEMD = viper.GetBool("zonemd")
+		args.RefreshWindow = viper.GetDuration("refresh-window")
+		args.DNSKEYReuseWindow = viper.GetDuration("dnskey-reuse-window")
+		args.DNSKEYTTL = viper.GetUint32("dnskey-ttl")
+		args.PreserveText = viper.GetBool("preserve-text")
+		args.DefaultTTL = viper.GetUint32("default-ttl")
+		args.MaxResponseSize = viper.GetInt("max-response-size")
+		args.Retry = retryPolicy()
+		for _, name := range strings.Split(viper.GetString("algorithm"), ",") {
+			alg, err := signer.ParseAlgorithm(strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			args.Algorithms = append(args.Algorithms, alg)
+		}
+		args.Algorithm = args.Algorithms[0]
+		if args.Serial, args.SerialValue, err = signer.ParseSerialPolicy(viper.GetString("serial")); err != nil {
+			return err
+		}
+		if args.Digest, err = signer.ParseDigestMode(viper.GetString("digest")); err != nil {
+			return err
+		}
+		if args.Order, err = signer.ParseOutputOrder(viper.GetString("order")); err != nil {
+			return err
+		}
+		if args.Format, err = signer.ParseOutputFormat(viper.GetString("format")); err != nil {
+			return err
+		}
+		if args.ExistingDNSKEYs, err = signer.ParseDNSKEYPolicy(viper.GetString("existing-dnskeys")); err != nil {
+			return err
+		}
+		if args.OutOfZone, err = signer.ParseOutOfZonePolicy(viper.GetString("out-of-zone")); err != nil {
+			return err
+		}
+		if args.CDS, err = signer.ParseCDSMode(viper.GetString("cds")); err != nil {
 			return err
 		}
-		file, err := os.Open(filepath)
+		if len(offlineKSK) > 0 {
+			file, err := os.Open(offlineKSK)
+			if err != nil {
+				return fmt.Errorf("cannot open offline DNSKEY file: %s", err)
+			}
+			args.OfflineKSK, err = signer.ReadOfflineKSK(zone, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		tsigKey, err := tsigKeyFlags()
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		args.File = file
+		if len(master) > 0 {
+			if args.RRs, err = signer.TransferZone(master, zone, tsigKey); err != nil {
+				return err
+			}
+		} else {
+			if err := signer.FilesExist(filepath); err != nil {
+				return err
+			}
+			file, err := os.Open(filepath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			args.File = file
+		}
 
 		if len(expDateStr) > 0 {
 			parsedDate, err := time.Parse("20160102", expDateStr)
@@ -90,6 +289,42 @@ var signCmd = &cobra.Command{
 			args.SignExpDate = parsedDate
 		}
 
+		if dryRun {
+			plan, err := signer.PlanSign(&args)
+			if err != nil {
+				return err
+			}
+			Log.Printf("Zone: %s", plan.Zone)
+			Log.Printf("RRsets to sign: %d", plan.RRSets)
+			Log.Printf("RRSIGs to create: %d", plan.RRSigs)
+			Log.Printf("Record types: %s", strings.Join(plan.Types, " "))
+			Log.Printf("Delegations and glue (not signed): %s", strings.Join(plan.Skipped, " "))
+			if plan.NSEC3 {
+				Log.Printf("NSEC3 records: %d (opt-out: %t)", plan.DenialRecords, plan.OptOut)
+			} else {
+				Log.Printf("NSEC records: %d", plan.DenialRecords)
+			}
+			Log.Printf("Dry run finished, nothing was signed.")
+			return nil
+		}
+
+		if len(zskFile) > 0 {
+			if len(offlineKSK) > 0 && len(kskFile) == 0 {
+				err = signer.FilesExist(zskFile)
+			} else {
+				err = signer.FilesExist(zskFile, kskFile)
+			}
+			if err != nil {
+				return err
+			}
+		} else if len(hsmConfigPath) > 0 {
+			if _, err := signer.LoadHSMConfig(hsmConfigPath); err != nil {
+				return err
+			}
+		} else if err := signer.FilesExist(p11lib); err != nil {
+			return err
+		}
+
 		if len(out) > 0 {
 			writer, err := os.Create(out)
 			if err != nil {
@@ -97,43 +332,101 @@ var signCmd = &cobra.Command{
 			}
 			defer writer.Close()
 			args.Output = writer
+		} else if len(updateServer) > 0 {
+			args.Output = ioutil.Discard
 		} else {
 			args.Output = os.Stdout
 		}
 
+		if dsPath := viper.GetString("ds-output"); len(dsPath) > 0 {
+			dsWriter, err := os.Create(dsPath)
+			if err != nil {
+				return fmt.Errorf("couldn't create DS file in path %s: %s", dsPath, err)
+			}
+			defer dsWriter.Close()
+			args.DSOutput = dsWriter
+		}
+		if metadataPath := viper.GetString("metadata"); len(metadataPath) > 0 {
+			metadataWriter, err := os.Create(metadataPath)
+			if err != nil {
+				return fmt.Errorf("couldn't create metadata file in path %s: %s", metadataPath, err)
+			}
+			defer metadataWriter.Close()
+			args.MetadataOutput = metadataWriter
+		}
 
-                /* READ ZONE */
-		args.RRs, err = signer.ReadAndParseZone(&args, true)
-	        if err != nil {
-        	        return err
-        	}
-
-		/* 
-		SIGNATURE: PKCS11 CASE 
-                */
-
-		/* INIT */
-		s, err := signer.NewSession(p11lib, key, label, Log)
-		if err != nil {
-			return err
+		// The updates are the differences between the zone in the server and the signed zone,
+		// so the input zone is kept.
+		var serverRRs signer.RRArray
+		if len(updateServer) > 0 {
+			if args.File != nil {
+				if args.RRs, err = signer.ReadAndParseZone(&args, false); err != nil {
+					return err
+				}
+				args.File = nil
+			}
+			serverRRs = args.RRs
 		}
-		defer s.End()
 
-		/* ADD NSEC or NSEC3 */
-		signer.AddNSEC13(&args)
+		if len(zskFile) > 0 {
+			/*
+			SIGNATURE: FILE CASE
+			*/
+			fileKey := &signer.FileKey{ZSKfile: zskFile, KSKfile: kskFile, Logger: Logger}
+			if _, err := fileKey.Sign(&args); err != nil {
+				return err
+			}
+		} else {
+			/* 
+			SIGNATURE: PKCS11 CASE 
+			*/
+
+			/* INIT */
+			s, err := openSession(cmd)
+			if err != nil {
+				return err
+			}
+			defer s.End()
 
-		args := signer.SessionSignArgs{SignArgs:&args,}
-		/* GET KEYS */
-        	err = s.GetKeys(&args)
-        	if err != nil {
-                	return err
-        	}
+			args := signer.SessionSignArgs{SignArgs:&args,}
 
-		/* SIGN MY ANGLE OF MUSIC! */
-		if _, err := s.Sign(&args); err != nil {
-			return err
+			/* SIGN MY ANGLE OF MUSIC! */
+			if _, err := s.Sign(&args); err != nil {
+				return err
+			}
 		}
 		Log.Printf("File signed successfully.")
+
+		if digestPath := viper.GetString("data-digest"); len(digestPath) > 0 {
+			digest := fmt.Sprintf("%x\n", args.RRs.DataDigest())
+			if err := ioutil.WriteFile(digestPath, []byte(digest), 0644); err != nil {
+				return fmt.Errorf("cannot write data digest in path %s: %s", digestPath, err)
+			}
+		}
+
+		if len(updateServer) > 0 {
+			msgs := signer.UpdateMessages(zone, serverRRs, args.RRs, 0)
+			if err := signer.SendUpdates(updateServer, msgs, tsigKey); err != nil {
+				return err
+			}
+			Log.Printf("Zone updated in %s (%d messages).", updateServer, len(msgs))
+		}
 		return nil
 	},
 }
+
+// tsigKeyFlags returns the TSIG key of the tsig-file or tsig flags, or nil if none is set.
+func tsigKeyFlags() (*signer.TSIGKey, error) {
+	if path := viper.GetString("tsig-file"); len(path) > 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open TSIG key file: %s", err)
+		}
+		defer file.Close()
+		return signer.ReadTSIGKey(file)
+	}
+	if tsig := viper.GetString("tsig"); len(tsig) > 0 {
+		return signer.ParseTSIGKey(tsig)
+	}
+	return nil, nil
+}
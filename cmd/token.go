@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// addTokenFlags adds the flags selecting the token of the session by slot ID, serial number or label, for the
+// libraries with many tokens (as the partitions of an HSM, which often share their label).
+func addTokenFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint("slot", 0, "Slot ID of the HSM token (by default, the first slot with a token)")
+	cmd.Flags().String("token-serial", "", "Serial number of the HSM token")
+	cmd.Flags().String("token-label", "", "Label of the HSM token, which must match only one token")
+}
+
+// tokenSelector returns the selector of the token set by the flags of the command. The slot is only set if its flag
+// is used, since 0 is a valid slot ID. It returns an error if more than one flag is used.
+func tokenSelector(cmd *cobra.Command) (signer.TokenSelector, error) {
+	selector := signer.TokenSelector{
+		Serial: viper.GetString("token-serial"),
+		Label:  viper.GetString("token-label"),
+	}
+	if cmd.Flags().Changed("slot") {
+		slot := viper.GetUint("slot")
+		selector.Slot = &slot
+	}
+	return selector, selector.Validate()
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/niclabs/hsm-tools/signer"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	unsignCmd.Flags().StringP("file", "f", "", "Full path to the signed zone file")
+	unsignCmd.Flags().StringP("output", "o", "", "Output for the unsigned zone file")
+	unsignCmd.Flags().StringP("zone", "z", "", "Zone name")
+}
+
+var unsignCmd = &cobra.Command{
+	Use:   "unsign",
+	Short: "Removes the DNSSEC records of a signed zone file.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filepath, _ := cmd.Flags().GetString("file")
+		out, _ := cmd.Flags().GetString("output")
+		zone, _ := cmd.Flags().GetString("zone")
+
+		if len(filepath) == 0 {
+			return fmt.Errorf("input file path not specified")
+		}
+		if len(out) == 0 {
+			return fmt.Errorf("output file path not specified")
+		}
+		if len(zone) == 0 {
+			return fmt.Errorf("zone not specified")
+		}
+		if err := signer.FilesExist(filepath); err != nil {
+			return err
+		}
+
+		file, err := os.Open(filepath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		outFile, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer outFile.Close()
+
+		if err := signer.Unsign(file, outFile, zone); err != nil {
+			return err
+		}
+		Log.Printf("Zone unsigned successfully.")
+		return nil
+	},
+}
@@ -2,17 +2,30 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/miekg/dns"
 	"github.com/niclabs/hsm-tools/signer"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
 	"os"
+	"time"
 )
 
 func init() {
 	verifyCmd.Flags().StringP("file", "f", "", "Full path to zone file to be verified")
-	signCmd.Flags().StringP("zone", "z", "", "Zone name")
+	verifyCmd.Flags().StringP("zone", "z", "", "Zone name")
+	verifyCmd.Flags().Uint16("ksk-tag", 0, "Key tag of the key that must sign the DNSKEY RRset")
+	verifyCmd.Flags().Uint16("zsk-tag", 0, "Key tag of the key that must sign the other RRsets")
+	verifyCmd.Flags().String("rollover", "none", "Phase of the key rollover of the zone: none, pre-publish, post-publish (DNSKEYs not signing are accepted) or double-signature (each RRset must be signed by all the signing keys)")
+	verifyCmd.Flags().Bool("check-policy", false, "Report deprecated algorithms, small RSA keys and too many NSEC3 iterations, failing on deprecated algorithms")
+	verifyCmd.Flags().Duration("expiration-warning", 72*time.Hour, "Warns about the RRsets whose RRSIGs expire within this duration (0 disables the warning)")
 	viper.BindPFlag("file", verifyCmd.Flags().Lookup("file"))
 	viper.BindPFlag("zone", verifyCmd.Flags().Lookup("zone"))
+	viper.BindPFlag("ksk-tag", verifyCmd.Flags().Lookup("ksk-tag"))
+	viper.BindPFlag("zsk-tag", verifyCmd.Flags().Lookup("zsk-tag"))
+	viper.BindPFlag("rollover", verifyCmd.Flags().Lookup("rollover"))
+	viper.BindPFlag("check-policy", verifyCmd.Flags().Lookup("check-policy"))
+	viper.BindPFlag("expiration-warning", verifyCmd.Flags().Lookup("expiration-warning"))
 }
 
 var verifyCmd = &cobra.Command{
@@ -39,10 +52,52 @@ var verifyCmd = &cobra.Command{
 			return err
 		}
 
-		if err := signer.VerifyFile(zone, file, Log); err != nil {
+		defer file.Close()
+
+		rollover, err := signer.ParseRolloverPhase(viper.GetString("rollover"))
+		if err != nil {
+			return err
+		}
+		result, err := signer.VerifyZone(&signer.VerifyArgs{
+			Zone:   zone,
+			File:   file,
+			Log:    Logger,
+			KSKTag: uint16(viper.GetUint("ksk-tag")),
+			ZSKTag: uint16(viper.GetUint("zsk-tag")),
+			Rollover: rollover,
+			ExpirationWarning: viper.GetDuration("expiration-warning"),
+		})
+		if err != nil {
+			return err
+		}
+		Log.Printf("RRsets: %d valid, %d expired, %d invalid, %d unsigned.", result.Count(signer.RRsetValid),
+			result.Count(signer.RRsetExpired), result.Count(signer.RRsetInvalid), result.Count(signer.RRsetUnsigned))
+		for _, rrset := range result.Expiring {
+			Log.Printf("Warning: the RRSIGs of %s %s expire on %s", rrset.Name, dns.Type(rrset.Type), rrset.Expiration.Format("2006-01-02 15:04:05"))
+		}
+		if err := result.Err(); err != nil {
 			return err
 		}
 		Log.Printf("File verified successfully.")
+		if viper.GetBool("check-policy") {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			rrs, err := signer.ReadAndParseZone(&signer.SignArgs{Zone: zone, File: file}, false)
+			if err != nil {
+				return err
+			}
+			var errors int
+			for _, violation := range signer.CheckPolicy(rrs, signer.DefaultPolicy) {
+				Log.Printf("Policy %s", violation)
+				if violation.Severity == signer.SeverityError {
+					errors++
+				}
+			}
+			if errors > 0 {
+				return fmt.Errorf("zone %s violates the DNSSEC policy (%d errors)", zone, errors)
+			}
+		}
 		return nil
 	},
 }
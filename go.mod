@@ -1,10 +1,10 @@
 module github.com/niclabs/hsm-tools
 
-go 1.12
+go 1.14
 
 require (
 	github.com/magiconair/properties v1.8.1 // indirect
-	github.com/miekg/dns v1.1.9
+	github.com/miekg/dns v1.1.50
 	github.com/miekg/pkcs11 v1.0.2
 	github.com/pelletier/go-toml v1.4.0 // indirect
 	github.com/spf13/afero v1.2.2 // indirect
@@ -12,9 +12,5 @@ require (
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/viper v1.4.0
 	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4 // indirect
-	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80 // indirect
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
-	golang.org/x/sys v0.0.0-20190812172437-4e8604ab3aff // indirect
-	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 )
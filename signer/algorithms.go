@@ -0,0 +1,237 @@
+package signer
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultAlgorithm is the DNSSEC algorithm used when SignArgs does not specify one.
+const DefaultAlgorithm = dns.RSASHA256
+
+// Mechanism couples a PKCS#11 mechanism with its name, used in error messages.
+type Mechanism struct {
+	Type uint   // PKCS#11 mechanism
+	Name string // Mechanism name
+}
+
+// PKCS#11 3.0 EdDSA key type and mechanisms, not defined by miekg/pkcs11.
+const (
+	ckkECEdwards           = 0x40   // CKK_EC_EDWARDS
+	ckmECEdwardsKeyPairGen = 0x1055 // CKM_EC_EDWARDS_KEY_PAIR_GEN
+	ckmEdDSA               = 0x1057 // CKM_EDDSA
+)
+
+// Algorithm describes how the keys of a DNSSEC algorithm are generated in the HSM and how they sign.
+type Algorithm struct {
+	Number     uint8       // DNSSEC algorithm number (https://www.iana.org/assignments/dns-sec-alg-numbers/dns-sec-alg-numbers.xhtml)
+	KeyType    uint        // PKCS#11 key type
+	KeyGen     Mechanism   // Key pair generation mechanism
+	Sign       Mechanism   // Signing mechanism of the digests (DigestHost)
+	DigestSign Mechanism   // Digesting and signing mechanism of the data (DigestHSM)
+	Hash       crypto.Hash // Digest used by the algorithm. It is zero for EdDSA, which signs the data without digesting it
+	ECParams   []byte      // DER encoded curve OID, only for ECDSA and EdDSA algorithms
+	ZSKBits    int         // ZSK size in bits (for ECDSA algorithms, the curve size)
+	KSKBits    int         // KSK size in bits (for ECDSA algorithms, the curve size)
+}
+
+// algorithms contains the DNSSEC algorithms supported by the signer.
+var algorithms = map[uint8]*Algorithm{
+	dns.RSASHA256: {
+		Number:     dns.RSASHA256,
+		KeyType:    pkcs11.CKK_RSA,
+		KeyGen:     Mechanism{pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, "CKM_RSA_PKCS_KEY_PAIR_GEN"},
+		Sign:       Mechanism{pkcs11.CKM_RSA_PKCS, "CKM_RSA_PKCS"},
+		DigestSign: Mechanism{pkcs11.CKM_SHA256_RSA_PKCS, "CKM_SHA256_RSA_PKCS"},
+		Hash:       crypto.SHA256,
+		ZSKBits:    1024,
+		KSKBits:    2048,
+	},
+	// The RRset digest is computed by miekg/dns before signing, so RSASHA512 signs it with CKM_RSA_PKCS
+	// and a SHA512 DigestInfo, which produces the same signatures as CKM_SHA512_RSA_PKCS.
+	dns.RSASHA512: {
+		Number:     dns.RSASHA512,
+		KeyType:    pkcs11.CKK_RSA,
+		KeyGen:     Mechanism{pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, "CKM_RSA_PKCS_KEY_PAIR_GEN"},
+		Sign:       Mechanism{pkcs11.CKM_RSA_PKCS, "CKM_RSA_PKCS"},
+		DigestSign: Mechanism{pkcs11.CKM_SHA512_RSA_PKCS, "CKM_SHA512_RSA_PKCS"},
+		Hash:       crypto.SHA512,
+		ZSKBits:    1024,
+		KSKBits:    2048,
+	},
+	dns.ECDSAP256SHA256: {
+		Number:     dns.ECDSAP256SHA256,
+		KeyType:    pkcs11.CKK_EC,
+		KeyGen:     Mechanism{pkcs11.CKM_EC_KEY_PAIR_GEN, "CKM_EC_KEY_PAIR_GEN"},
+		Sign:       Mechanism{pkcs11.CKM_ECDSA, "CKM_ECDSA"},
+		DigestSign: Mechanism{pkcs11.CKM_ECDSA_SHA256, "CKM_ECDSA_SHA256"},
+		Hash:       crypto.SHA256,
+		ECParams:   []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}, // prime256v1 (1.2.840.10045.3.1.7)
+		ZSKBits:    256,
+		KSKBits:    256,
+	},
+	dns.ECDSAP384SHA384: {
+		Number:     dns.ECDSAP384SHA384,
+		KeyType:    pkcs11.CKK_EC,
+		KeyGen:     Mechanism{pkcs11.CKM_EC_KEY_PAIR_GEN, "CKM_EC_KEY_PAIR_GEN"},
+		Sign:       Mechanism{pkcs11.CKM_ECDSA, "CKM_ECDSA"},
+		DigestSign: Mechanism{pkcs11.CKM_ECDSA_SHA384, "CKM_ECDSA_SHA384"},
+		Hash:       crypto.SHA384,
+		ECParams:   []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}, // secp384r1 (1.3.132.0.34)
+		ZSKBits:    384,
+		KSKBits:    384,
+	},
+	// EdDSA signs the whole data, so both digest modes use CKM_EDDSA. Tokens without PKCS#11 3.0 support
+	// (as SoftHSM before 2.6) do not list the mechanisms, so CheckDigestMode rejects the algorithm.
+	dns.ED25519: {
+		Number:     dns.ED25519,
+		KeyType:    ckkECEdwards,
+		KeyGen:     Mechanism{ckmECEdwardsKeyPairGen, "CKM_EC_EDWARDS_KEY_PAIR_GEN"},
+		Sign:       Mechanism{ckmEdDSA, "CKM_EDDSA"},
+		DigestSign: Mechanism{ckmEdDSA, "CKM_EDDSA"},
+		ECParams:   []byte{0x06, 0x03, 0x2b, 0x65, 0x70}, // id-Ed25519 (1.3.101.112)
+		ZSKBits:    256,
+		KSKBits:    256,
+	},
+}
+
+// GetAlgorithm returns the description of a DNSSEC algorithm, or an error if the signer does not support it.
+// If number is zero, it returns the DefaultAlgorithm.
+func GetAlgorithm(number uint8) (*Algorithm, error) {
+	if number == 0 {
+		number = DefaultAlgorithm
+	}
+	alg, ok := algorithms[number]
+	if !ok {
+		return nil, fmt.Errorf("algorithm %s (%d) is not supported", algorithmName(number), number)
+	}
+	return alg, nil
+}
+
+// ParseAlgorithm returns the DNSSEC algorithm number of an algorithm mnemonic (as RSASHA256)
+// or number, or an error if the signer does not support it.
+func ParseAlgorithm(name string) (uint8, error) {
+	number, ok := dns.StringToAlgorithm[strings.ToUpper(name)]
+	if !ok {
+		n, err := strconv.ParseUint(name, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("unknown algorithm %s", name)
+		}
+		number = uint8(n)
+	}
+	if _, err := GetAlgorithm(number); err != nil {
+		return 0, err
+	}
+	return number, nil
+}
+
+// String returns the algorithm mnemonic, as defined by miekg/dns.
+func (alg *Algorithm) String() string {
+	return dns.AlgorithmToString[alg.Number]
+}
+
+// IsECDSA returns true if the algorithm uses ECDSA keys.
+func (alg *Algorithm) IsECDSA() bool {
+	return alg.KeyType == pkcs11.CKK_EC
+}
+
+// IsEdDSA returns true if the algorithm uses EdDSA keys.
+func (alg *Algorithm) IsEdDSA() bool {
+	return alg.KeyType == ckkECEdwards
+}
+
+// SignMechanism returns the signing mechanism used by the algorithm with the digest mode provided.
+func (alg *Algorithm) SignMechanism(mode DigestMode) Mechanism {
+	if mode == DigestHSM {
+		return alg.DigestSign
+	}
+	return alg.Sign
+}
+
+// CheckAlgorithm returns an error if the token of the session does not provide the mechanisms
+// needed to generate keys and sign with the algorithm. The error names the algorithm and the missing mechanism.
+func (session *Session) CheckAlgorithm(alg *Algorithm) error {
+	return session.CheckDigestMode(alg, DigestHost)
+}
+
+// CheckDigestMode is like CheckAlgorithm, but it checks the signing mechanism of the digest mode provided.
+func (session *Session) CheckDigestMode(alg *Algorithm, mode DigestMode) error {
+	available, err := session.mechanisms()
+	if err != nil {
+		return err
+	}
+	for _, needed := range []Mechanism{alg.KeyGen, alg.SignMechanism(mode)} {
+		if !available[needed.Type] {
+			return fmt.Errorf("algorithm %s (%d) is not supported by the HSM with %s digests: mechanism %s is not available", alg, alg.Number, mode, needed.Name)
+		}
+	}
+	return nil
+}
+
+// CheckKeySize returns an error if the token of the session cannot generate RSA keys of the algorithm with the size
+// provided (in bits), or sign with them with the digest mode provided, following the key sizes of the mechanisms
+// reported by the token. ECDSA and EdDSA keys have the size of their curve, so they are not checked.
+func (session *Session) CheckKeySize(alg *Algorithm, mode DigestMode, bits int) error {
+	if len(alg.ECParams) > 0 {
+		return nil
+	}
+	if session == nil || session.Ctx == nil {
+		return fmt.Errorf("session not initialized")
+	}
+	info, err := session.sessionInfo()
+	if err != nil {
+		return fmt.Errorf("cannot get session info: %s", err)
+	}
+	for _, needed := range []Mechanism{alg.KeyGen, alg.SignMechanism(mode)} {
+		mechanism, err := session.Ctx.GetMechanismInfo(info.SlotID, []*pkcs11.Mechanism{pkcs11.NewMechanism(needed.Type, nil)})
+		if err != nil {
+			return fmt.Errorf("cannot get info of mechanism %s: %s", needed.Name, err)
+		}
+		// Some tokens do not report the key sizes, leaving them as zero.
+		if mechanism.MaxKeySize > 0 && (uint(bits) < mechanism.MinKeySize || uint(bits) > mechanism.MaxKeySize) {
+			return fmt.Errorf("%s keys of %d bits are not supported by the HSM: mechanism %s supports keys of %d to %d bits", alg, bits, needed.Name, mechanism.MinKeySize, mechanism.MaxKeySize)
+		}
+	}
+	return nil
+}
+
+// SupportedAlgorithms returns the numbers of the DNSSEC algorithms of the signer that the token of the session
+// can generate keys and sign with (as CheckAlgorithm checks them), in increasing order.
+func (session *Session) SupportedAlgorithms() ([]uint8, error) {
+	available, err := session.mechanisms()
+	if err != nil {
+		return nil, err
+	}
+	supported := make([]uint8, 0, len(algorithms))
+	for number, alg := range algorithms {
+		if available[alg.KeyGen.Type] && available[alg.Sign.Type] {
+			supported = append(supported, number)
+		}
+	}
+	sort.Slice(supported, func(i, j int) bool { return supported[i] < supported[j] })
+	return supported, nil
+}
+
+// mechanisms returns the types of the mechanisms provided by the token of the session.
+func (session *Session) mechanisms() (map[uint]bool, error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	info, err := session.sessionInfo()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get session info: %s", err)
+	}
+	mechanisms, err := session.Ctx.GetMechanismList(info.SlotID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get mechanism list: %s", err)
+	}
+	available := make(map[uint]bool)
+	for _, m := range mechanisms {
+		available[m.Mechanism] = true
+	}
+	return available, nil
+}
@@ -0,0 +1,137 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"os"
+	"strings"
+)
+
+// AuditStatus is the result of checking the DS records of a zone against its KSKs.
+type AuditStatus int
+
+const (
+	AuditMatch    AuditStatus = iota // A DS record of the zone matches one of its KSKs
+	AuditMismatch                    // The zone has DS records, but none of them matches one of its KSKs
+	AuditMissing                     // The zone has no DS records
+)
+
+// String returns the name of the audit status.
+func (status AuditStatus) String() string {
+	switch status {
+	case AuditMatch:
+		return "match"
+	case AuditMismatch:
+		return "mismatch"
+	default:
+		return "missing"
+	}
+}
+
+// AuditResult is the result of checking the DS records of a signed zone file.
+type AuditResult struct {
+	File      string      // Path of the signed zone file
+	Zone      string      // Zone name (the owner of its SOA record)
+	Status    AuditStatus // Whether the zone has a DS matching one of its KSKs
+	KSKTags   []uint16    // Key tags of the KSKs (the DNSKEYs with the SEP flag) at the apex of the zone
+	Matched   []*dns.DS   // DS records matching a KSK
+	Unmatched []*dns.DS   // DS records matching no KSK, as the ones left in the parent zone after a rollover
+}
+
+// AuditDS checks that the KSKs at the apex of each signed zone file match the DS records published for the zone
+// in dsRecords, whose keys are the zone names. A DS matches a KSK if its key tag, algorithm and digest are the
+// ones of the DS computed from the KSK with the same digest type. The zone name of each file is the owner of its
+// SOA record. It returns an error if a file cannot be read or parsed, or has no SOA record.
+// It does not need an HSM session, so it can be used to check the zones before and after a KSK rollover.
+func AuditDS(zoneFiles []string, dsRecords map[string][]*dns.DS) ([]AuditResult, error) {
+	published := make(map[string][]*dns.DS, len(dsRecords))
+	for zone, records := range dsRecords {
+		name := dns.CanonicalName(zone)
+		published[name] = append(published[name], records...)
+	}
+	results := make([]AuditResult, 0, len(zoneFiles))
+	for _, path := range zoneFiles {
+		result, err := auditZoneFile(path, published)
+		if err != nil {
+			return nil, fmt.Errorf("cannot audit zone file %s: %s", path, err)
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// auditZoneFile checks the KSKs of a signed zone file against the DS records published for its zone.
+func auditZoneFile(path string, published map[string][]*dns.DS) (*AuditResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rrs, err := ReadAndParseZone(&SignArgs{File: file}, false)
+	if err != nil {
+		return nil, err
+	}
+	zone := ""
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			zone = dns.CanonicalName(rr.Header().Name)
+			break
+		}
+	}
+	if len(zone) == 0 {
+		return nil, fmt.Errorf("the zone has no SOA record")
+	}
+	result := &AuditResult{File: path, Zone: zone, Status: AuditMissing}
+	var ksks []*dns.DNSKEY
+	for _, rr := range rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok && key.Flags&dns.SEP != 0 && strings.EqualFold(key.Hdr.Name, zone) {
+			ksks = append(ksks, key)
+			result.KSKTags = append(result.KSKTags, key.KeyTag())
+		}
+	}
+	for _, ds := range published[zone] {
+		if matchesKSK(zone, ds, ksks) {
+			result.Matched = append(result.Matched, ds)
+		} else {
+			result.Unmatched = append(result.Unmatched, ds)
+		}
+	}
+	switch {
+	case len(result.Matched) > 0:
+		result.Status = AuditMatch
+	case len(result.Unmatched) > 0:
+		result.Status = AuditMismatch
+	}
+	return result, nil
+}
+
+// matchesKSK returns true if the DS record is the DS of one of the KSKs of the zone.
+func matchesKSK(zone string, ds *dns.DS, ksks []*dns.DNSKEY) bool {
+	for _, ksk := range ksks {
+		if ksk.KeyTag() != ds.KeyTag || ksk.Algorithm != ds.Algorithm {
+			continue
+		}
+		if expected := DSFromDNSKEY(zone, ksk, ds.DigestType); expected != nil && strings.EqualFold(expected.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDSRecords parses the DS records in reader, in zone file format, and returns them by zone name (their owner),
+// as AuditDS takes them. Other records are ignored, so the file can be a dump of the parent zone.
+func ReadDSRecords(reader io.Reader) (map[string][]*dns.DS, error) {
+	records := make(map[string][]*dns.DS)
+	parser := dns.NewZoneParser(reader, "", "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if ds, ok := rr.(*dns.DS); ok {
+			name := dns.CanonicalName(ds.Hdr.Name)
+			records[name] = append(records[name], ds)
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// TSIGKey is a key used to authenticate zone transfers (RFC8945), in both directions: the transfers from a master
+// (TransferZone) and to the secondaries (TransferServer), and the NOTIFY and UPDATE messages. It can be read from
+// the dig -y format (ParseTSIGKey), a BIND key file (ReadTSIGKey) or JSON.
+type TSIGKey struct {
+	Name      string `json:"name"`      // Key name
+	Algorithm string `json:"algorithm"` // Algorithm name, as hmac-sha256. If empty, dns.HmacSHA256 is used.
+	Secret    string `json:"secret"`    // Base64 encoded secret
+}
+
+// tsigAlgorithms are the TSIG algorithms supported by miekg/dns (RFC8945 6), as names of the Algorithm of a TSIGKey.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// ParseTSIGKey parses a TSIG key in the [algorithm:]name:secret format used by dig -y, and checks it (see TSIGKey.Check).
+func ParseTSIGKey(str string) (*TSIGKey, error) {
+	var key *TSIGKey
+	switch parts := strings.Split(str, ":"); len(parts) {
+	case 2:
+		key = &TSIGKey{Name: parts[0], Secret: parts[1]}
+	case 3:
+		key = &TSIGKey{Algorithm: parts[0], Name: parts[1], Secret: parts[2]}
+	default:
+		return nil, fmt.Errorf("invalid TSIG key %s (it should be [algorithm:]name:secret)", str)
+	}
+	if err := key.Check(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// tsigKeyFile matches the key statements of the TSIG key files of BIND (as written by tsig-keygen): the key name,
+// followed by the algorithm and secret statements in any order.
+var tsigKeyFile = regexp.MustCompile(`(?s)key\s+"?([^"\s{]+)"?\s*\{(.*?)\}\s*;`)
+var tsigKeyStatement = regexp.MustCompile(`(algorithm|secret)\s+"?([^";\s]+)"?\s*;`)
+
+// ReadTSIGKey reads the first TSIG key of a key file in the format of BIND (as written by tsig-keygen or
+// dnssec-keygen), and checks it (see TSIGKey.Check), so the secret is not written in the command line:
+//
+//	key "transfer" {
+//	    algorithm hmac-sha256;
+//	    secret "c2VjcmV0IGZvciB0aGUgdGVzdHM=";
+//	};
+func ReadTSIGKey(reader io.Reader) (*TSIGKey, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TSIG key: %s", err)
+	}
+	match := tsigKeyFile.FindSubmatch(data)
+	if match == nil {
+		return nil, fmt.Errorf("no TSIG key statement found")
+	}
+	key := &TSIGKey{Name: string(match[1])}
+	for _, statement := range tsigKeyStatement.FindAllSubmatch(match[2], -1) {
+		if string(statement[1]) == "algorithm" {
+			key.Algorithm = string(statement[2])
+		} else {
+			key.Secret = string(statement[2])
+		}
+	}
+	if err := key.Check(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Check returns an error if the key has no name, its secret is not valid base64 or its algorithm is not one of
+// hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512 (names are case-insensitive, and can end with a dot).
+func (key *TSIGKey) Check() error {
+	if len(strings.Trim(key.Name, ".")) == 0 {
+		return fmt.Errorf("TSIG key without name")
+	}
+	if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || len(key.Secret) == 0 {
+		return fmt.Errorf("TSIG key %s has an invalid base64 secret", key.Name)
+	}
+	if _, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(key.Algorithm), ".")]; !ok && len(key.Algorithm) > 0 {
+		return fmt.Errorf("TSIG key %s uses unsupported algorithm %s (it should be hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512)", key.Name, key.Algorithm)
+	}
+	return nil
+}
+
+// checkTSIG checks the key (see TSIGKey.Check), if it is not nil.
+func checkTSIG(key *TSIGKey) error {
+	if key == nil {
+		return nil
+	}
+	return key.Check()
+}
+
+// sign adds a TSIG record with the key to the message, signed when it is sent.
+// It returns the secrets map used by miekg/dns clients to sign messages and verify responses.
+func (key *TSIGKey) sign(msg *dns.Msg) map[string]string {
+	msg.SetTsig(dns.Fqdn(key.Name), key.algorithm(), 300, 0)
+	return key.secrets()
+}
+
+// algorithm returns the name of the algorithm of the key in TSIG records, hmac-sha256 by default.
+func (key *TSIGKey) algorithm() string {
+	if algorithm, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(key.Algorithm), ".")]; ok {
+		return algorithm
+	}
+	return dns.HmacSHA256
+}
+
+// secrets returns the secrets map with the key, used by miekg/dns clients and servers.
+func (key *TSIGKey) secrets() map[string]string {
+	return map[string]string{dns.Fqdn(key.Name): key.Secret}
+}
+
+// TransferZone requests the zone to the master server (as 192.0.2.1:53) with AXFR and returns its RRs,
+// without the trailing SOA. The transfer can span many messages. If key is not nil, the request is signed with it
+// and the TSIG records of the responses are verified. It returns an error if the transfer fails, if a response
+// fails TSIG verification, or if the transfer does not start and end with the SOA of the zone.
+func TransferZone(master, zone string, key *TSIGKey) (RRArray, error) {
+	if err := checkTSIG(key); err != nil {
+		return nil, err
+	}
+	zone = dns.Fqdn(zone)
+	msg := new(dns.Msg)
+	msg.SetAxfr(zone)
+	transfer := &dns.Transfer{}
+	if key != nil {
+		transfer.TsigSecret = key.sign(msg)
+	}
+	envelopes, err := transfer.In(msg, master)
+	if err != nil {
+		return nil, fmt.Errorf("cannot transfer zone %s from %s: %s", zone, master, err)
+	}
+	rrs := make(RRArray, 0)
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			// Drain the channel, so the transfer goroutine ends.
+			for range envelopes {
+			}
+			return nil, fmt.Errorf("cannot transfer zone %s from %s: %s", zone, master, envelope.Error)
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	if len(rrs) < 2 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		return nil, fmt.Errorf("transfer of zone %s from %s does not start and end with a SOA record", zone, master)
+	}
+	if !strings.EqualFold(rrs[0].Header().Name, zone) {
+		return nil, fmt.Errorf("transfer from %s returned zone %s instead of %s", master, rrs[0].Header().Name, zone)
+	}
+	return rrs[:len(rrs)-1], nil
+}
@@ -0,0 +1,179 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// CDSMode defines the CDS and CDNSKEY records (RFC7344) published at the apex of the signed zone, so the parents
+// supporting automated DS maintenance (RFC8078) follow the KSK rollovers of the zone without a manual update.
+type CDSMode int
+
+const (
+	CDSNone    CDSMode = iota // The CDS and CDNSKEY records of the zone, if it has any, are signed as the other records
+	CDSPublish                // The CDS (with a SHA-256 digest) and CDNSKEY records of the KSKs replace the ones of the zone
+	CDSDelete                 // The delete CDS and CDNSKEY records (RFC8078 4) replace the ones of the zone, so the parent removes its DS records and the zone goes insecure
+)
+
+// cdsModes maps the names of the CDS modes to their values.
+var cdsModes = map[string]CDSMode{
+	"none":    CDSNone,
+	"publish": CDSPublish,
+	"delete":  CDSDelete,
+}
+
+// ParseCDSMode returns the CDS mode with the name provided (none, publish or delete).
+func ParseCDSMode(name string) (CDSMode, error) {
+	mode, ok := cdsModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown CDS mode %s (it should be none, publish or delete)", name)
+	}
+	return mode, nil
+}
+
+// cdsTypes are the types of the records published with a CDS mode other than CDSNone.
+var cdsTypes = map[uint16]bool{
+	dns.TypeCDS:     true,
+	dns.TypeCDNSKEY: true,
+}
+
+// removeCDS removes the CDS and CDNSKEY records at the apex of the zone from args.RRs if args.CDS is not CDSNone,
+// because they are replaced by the ones of the mode.
+func (args *SignArgs) removeCDS() {
+	if args.CDS == CDSNone {
+		return
+	}
+	rrs := make(RRArray, 0, len(args.RRs))
+	for _, rr := range args.RRs {
+		if !cdsTypes[rr.Header().Rrtype] || !strings.EqualFold(rr.Header().Name, args.Zone) {
+			rrs = append(rrs, rr)
+		}
+	}
+	args.RRs = rrs
+}
+
+// cdsRecords returns the CDS and CDNSKEY records of the zone following args.CDS, for the KSKs provided, with the
+// TTL of the DNSKEYs. It returns nil if args.CDS is CDSNone.
+func (args *SignArgs) cdsRecords(ksks []*KeyPair) RRArray {
+	header := dns.RR_Header{Name: args.Zone, Class: dns.ClassINET, Ttl: args.dnskeyTTL()}
+	switch args.CDS {
+	case CDSPublish:
+		rrs := make(RRArray, 0, 2*len(ksks))
+		for _, ksk := range ksks {
+			ds := DSFromDNSKEY(args.Zone, ksk.DNSKEY, dns.SHA256)
+			ds.Hdr.Ttl = header.Ttl
+			cdnskey := ksk.DNSKEY.ToCDNSKEY()
+			cdnskey.Hdr = header
+			cdnskey.Hdr.Rrtype = dns.TypeCDNSKEY
+			rrs = append(rrs, ds.ToCDS(), cdnskey)
+		}
+		return rrs
+	case CDSDelete:
+		cds := &dns.CDS{DS: dns.DS{Hdr: header, Digest: "00"}}
+		cds.Hdr.Rrtype = dns.TypeCDS
+		cdnskey := &dns.CDNSKEY{DNSKEY: dns.DNSKEY{Hdr: header, Protocol: 3, PublicKey: "AA=="}}
+		cdnskey.Hdr.Rrtype = dns.TypeCDNSKEY
+		return RRArray{cds, cdnskey}
+	default:
+		return nil
+	}
+}
+
+// addCDS adds the CDS and CDNSKEY records of the KSKs (see cdsRecords) to args.RRs, and their types to the NSEC or
+// NSEC3 record of the apex, which was made before the keys were known. It does nothing if args.CDS is CDSNone.
+func (args *SignArgs) addCDS(ksks []*KeyPair) error {
+	rrs := args.cdsRecords(ksks)
+	if len(rrs) == 0 {
+		return nil
+	}
+	owner := args.Zone
+	if args.NSEC3 {
+		var param *dns.NSEC3PARAM
+		for _, rr := range args.RRs {
+			if x, ok := rr.(*dns.NSEC3PARAM); ok && strings.EqualFold(x.Hdr.Name, args.Zone) {
+				param = x
+			}
+		}
+		if param == nil {
+			return fmt.Errorf("zone %s has no NSEC3PARAM record to publish its CDS records", args.Zone)
+		}
+		owner = dns.HashName(args.Zone, param.Hash, param.Iterations, param.Salt) + "." + args.Zone
+	}
+	denial, found := "NSEC", false
+	if args.NSEC3 {
+		denial = "NSEC3"
+	}
+	for _, rr := range args.RRs {
+		var bitmap *[]uint16
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			bitmap = &x.TypeBitMap
+		case *dns.NSEC3:
+			bitmap = &x.TypeBitMap
+		default:
+			continue
+		}
+		if !strings.EqualFold(rr.Header().Name, owner) {
+			continue
+		}
+		*bitmap = withTypes(*bitmap, dns.TypeCDS, dns.TypeCDNSKEY)
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("zone %s has no %s record at its apex to publish its CDS records", args.Zone, denial)
+	}
+	args.RRs = append(args.RRs, rrs...)
+	sort.Sort(args.RRs)
+	return nil
+}
+
+// withTypes returns the sorted type bitmap with the types provided.
+func withTypes(bitmap []uint16, types ...uint16) []uint16 {
+	set := make(map[uint16]bool)
+	for _, t := range append(bitmap, types...) {
+		set[t] = true
+	}
+	sorted := make([]uint16, 0, len(set))
+	for t := range set {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// signCDS returns the RRSIGs of the CDS and CDNSKEY RRsets at the apex of sets made with the KSKs, which sign them
+// besides the ZSKs because they must be signed by a key of the DS RRset of the parent (RFC7344 4.1). They expire as
+// the RRSIGs of the DNSKEY RRset, and they are kept or refreshed as them. It does nothing if args.CDS is CDSNone,
+// so the CDS records of the zone are only signed by the ZSKs.
+func (args *SignArgs) signCDS(sets RRSet, ksks []*KeyPair) (RRArray, error) {
+	if args.CDS == CDSNone {
+		return nil, nil
+	}
+	window := args.DNSKEYReuseWindow
+	if window <= 0 {
+		window = args.RefreshWindow
+	}
+	rrSigs := make(RRArray, 0)
+	for _, set := range sets {
+		if !cdsTypes[set[0].Header().Rrtype] || !strings.EqualFold(set[0].Header().Name, args.Zone) {
+			continue
+		}
+		if sigs := args.reusableSignatures(set, ksks, window); sigs != nil {
+			rrSigs = append(rrSigs, sigs...)
+			continue
+		}
+		sigs := make([]*dns.RRSIG, 0, len(ksks))
+		for _, ksk := range ksks {
+			sigs = append(sigs, args.newRRSIG(ksk.DNSKEY, dns.TypeDNSKEY, set[0].Header().Ttl))
+		}
+		signed, err := signRRSIGs(set, sigs, ksks)
+		if err != nil {
+			return nil, fmt.Errorf("cannot sign the %s RRset with the KSK: %s", dns.Type(set[0].Header().Rrtype), err)
+		}
+		rrSigs = append(rrSigs, signed...)
+		args.Refreshed += len(signed)
+	}
+	return rrSigs, nil
+}
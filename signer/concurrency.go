@@ -0,0 +1,141 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// signRRSets signs the RRsets of sets not in reused with the ZSKs, as signRRSet, using args.Concurrency goroutines.
+// With a Session, each goroutine but the first one signs with a session of args.workers, because a PKCS#11 session
+// runs one operation at a time. It returns the RRSIGs and the error of each RRset in the positions of sets, so the
+// signed zone does not depend on the order in which the goroutines finish. If an RRset fails and it cannot be left
+// without RRSIGs (see SignArgs.ContinueOnError), the RRsets not started yet are not signed. The progress and the
+// latency of the signature are logged every 10 percent of the RRsets.
+func (args *SignArgs) signRRSets(sets RRSet, reused map[int]RRArray, zsks []*KeyPair, log Logger) ([]RRArray, []error) {
+	// The RRSIGs are created in order, so their expirations do not depend on the goroutines.
+	rrSigs := make([][]*dns.RRSIG, len(sets))
+	for i, set := range sets {
+		if _, ok := reused[i]; !ok {
+			rrSigs[i] = args.newRRSIGs(set, zsks)
+		}
+	}
+	progress := newProgress(log, args.Zone, len(sets)-len(reused))
+	workers := args.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	signed := make([]RRArray, len(sets))
+	errs := make([]error, len(sets))
+	jobs := make(chan int)
+	var stop int32
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		keys := zsks
+		if w > 0 && w <= len(args.workers) {
+			keys = withSession(zsks, args.workers[w-1])
+		}
+		wg.Add(1)
+		go func(keys []*KeyPair) {
+			defer wg.Done()
+			for i := range jobs {
+				if atomic.LoadInt32(&stop) != 0 {
+					continue
+				}
+				start := time.Now()
+				signed[i], errs[i] = signRRSIGs(sets[i], rrSigs[i], keys)
+				progress.add(time.Since(start))
+				if errs[i] != nil && (!args.ContinueOnError || !recoverable(sets[i])) {
+					atomic.StoreInt32(&stop, 1)
+				}
+			}
+		}(keys)
+	}
+	for i := range sets {
+		if rrSigs[i] != nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return signed, errs
+}
+
+// withSession returns the key pairs signing with the HSM keys of zsks in the session provided. The key pairs
+// that do not sign with an HSM are returned as they are, because their keys can sign concurrently.
+func withSession(zsks []*KeyPair, session *Session) []*KeyPair {
+	pairs := make([]*KeyPair, len(zsks))
+	for i, zsk := range zsks {
+		signer, ok := zsk.Signer.(RRSigner)
+		if !ok {
+			pairs[i] = zsk
+			continue
+		}
+		signer.Session = session
+		pairs[i] = &KeyPair{DNSKEY: zsk.DNSKEY, Signer: signer}
+		if zsk.SignData != nil {
+			pairs[i].SignData = signer.SignData
+		}
+	}
+	return pairs
+}
+
+// openWorkers opens n sessions in the slot of the session and logs into them, so the RRsets can be signed with
+// the keys of the session concurrently (see SignArgs.Concurrency). The PKCS#11 calls of all the sessions are
+// counted in metrics, if it is not nil. It only works with sessions created by NewSession, NewSessionWithContext,
+// NewSessionFromConfig or a Signer.
+func (session *Session) openWorkers(n int, metrics Metrics) ([]*Session, error) {
+	if !session.opened {
+		return nil, fmt.Errorf("session was not opened by the signer, so it cannot open the sessions to sign concurrently")
+	}
+	if metrics != nil {
+		metrics = &lockedMetrics{Metrics: metrics}
+		session.metrics = metrics
+	}
+	workers := make([]*Session, 0, n)
+	for i := 0; i < n; i++ {
+		worker, err := NewSessionWithContext(session.Ctx, session.slot, session.pin, session.Label, nil)
+		if err != nil {
+			closeWorkers(workers)
+			return nil, fmt.Errorf("cannot open session %d to sign concurrently: %s", i+2, err)
+		}
+		worker.Log = session.Log
+		worker.metrics = metrics
+		workers = append(workers, worker)
+	}
+	return workers, nil
+}
+
+// closeWorkers closes the sessions opened by openWorkers, without logging out.
+func closeWorkers(workers []*Session) {
+	for _, worker := range workers {
+		if err := worker.End(); err != nil {
+			worker.logger().Warn("cannot close session", "error", err)
+		}
+	}
+}
+
+// lockedMetrics counts the PKCS#11 calls of sessions signing concurrently, calling IncHSMCalls of Metrics
+// from one goroutine at a time.
+type lockedMetrics struct {
+	Metrics
+	mutex sync.Mutex
+}
+
+// IncHSMCalls reports the calls to the metrics.
+func (metrics *lockedMetrics) IncHSMCalls(n int) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.Metrics.IncHSMCalls(n)
+}
+
+// ObserveHSMSignature reports the latency of a signature to the metrics, if they implement SignatureMetrics.
+func (metrics *lockedMetrics) ObserveHSMSignature(d time.Duration) {
+	if signatureMetrics, ok := metrics.Metrics.(SignatureMetrics); ok {
+		metrics.mutex.Lock()
+		defer metrics.mutex.Unlock()
+		signatureMetrics.ObserveHSMSignature(d)
+	}
+}
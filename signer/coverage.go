@@ -0,0 +1,86 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// CoverageReport lists the signature problems of a signed zone: the authoritative RRsets without RRSIGs
+// and the RRSIGs which do not cover any RRset of the zone.
+type CoverageReport struct {
+	Unsigned []string // Authoritative RRsets without RRSIGs, as "name type"
+	Orphans  []string // RRSIGs without an RRset, as "name type covered"
+}
+
+// Complete returns true if every authoritative RRset has an RRSIG and every RRSIG covers an RRset.
+func (report *CoverageReport) Complete() bool {
+	return len(report.Unsigned) == 0 && len(report.Orphans) == 0
+}
+
+// String returns a description of the problems of the report.
+func (report *CoverageReport) String() string {
+	problems := make([]string, 0, 2)
+	if len(report.Unsigned) > 0 {
+		problems = append(problems, fmt.Sprintf("RRsets without RRSIGs: %s", strings.Join(report.Unsigned, ", ")))
+	}
+	if len(report.Orphans) > 0 {
+		problems = append(problems, fmt.Sprintf("RRSIGs without RRsets: %s", strings.Join(report.Orphans, ", ")))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// CoverageReport groups the RRs of the array in RRsets and matches them with their RRSIGs by owner name, class
+// and type covered. The delegations and their glue records are classified as when signing, so they are not
+// expected to have RRSIGs. The array must be sorted.
+func (rrArray RRArray) CoverageReport(zone string) *CoverageReport {
+	zone = dns.Fqdn(zone)
+	nsNames := getAllNSNames(rrArray)
+	key := func(name string, class, rrType uint16) string {
+		return fmt.Sprintf("%s %s %s", strings.ToLower(dns.Fqdn(name)), dns.Class(class), dns.Type(rrType))
+	}
+	signed := make(map[string]bool)
+	for _, rr := range rrArray {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signed[key(sig.Hdr.Name, sig.Hdr.Class, sig.TypeCovered)] = true
+		}
+	}
+	report := &CoverageReport{
+		Unsigned: make([]string, 0),
+		Orphans:  make([]string, 0),
+	}
+	rrsets := make(map[string]bool)
+	for _, rrs := range rrArray.CreateRRSet(zone, true) {
+		h := rrs[0].Header()
+		if h.Rrtype == dns.TypeRRSIG || !dns.IsSubDomain(zone, h.Name) {
+			continue
+		}
+		k := key(h.Name, h.Class, h.Rrtype)
+		rrsets[k] = true
+		if isSignable(rrs[0], zone, nsNames) && !signed[k] {
+			report.Unsigned = append(report.Unsigned, fmt.Sprintf("%s %s", h.Name, dns.Type(h.Rrtype)))
+		}
+	}
+	for _, rr := range rrArray {
+		if sig, ok := rr.(*dns.RRSIG); ok && !rrsets[key(sig.Hdr.Name, sig.Hdr.Class, sig.TypeCovered)] {
+			report.Orphans = append(report.Orphans, fmt.Sprintf("%s %s", sig.Hdr.Name, dns.Type(sig.TypeCovered)))
+		}
+	}
+	report.Orphans = uniqueStrings(report.Orphans)
+	return report
+}
+
+// checkCoverage returns an error if the signed zone in args.RRs has RRsets without RRSIGs or RRSIGs without
+// RRsets, or only logs a warning if args.IgnoreCoverage is true or partial is true (because some RRsets
+// could not be signed, and they are reported as RRSetErrors).
+func checkCoverage(args *SignArgs, partial bool, log Logger) error {
+	report := args.RRs.CoverageReport(args.Zone)
+	if report.Complete() {
+		return nil
+	}
+	if args.IgnoreCoverage || partial {
+		log.Warn(fmt.Sprintf("the signed zone has incomplete signature coverage: %s", report), "zone", args.Zone)
+		return nil
+	}
+	return fmt.Errorf("the signed zone %s has incomplete signature coverage: %s", args.Zone, report)
+}
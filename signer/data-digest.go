@@ -0,0 +1,64 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/miekg/dns"
+	"sort"
+)
+
+// DataDigest returns a SHA-256 digest of the data of the signed zone, which only changes if the zone content
+// changes, so two signatures of the same zone with the same keys have the same digest.
+// It hashes the RRs in canonical form and order (RFC4034 6), without the fields that change every time a zone is
+// signed: the SOA serial and the inception, expiration and signature of the RRSIGs (which depends on them).
+// The NSEC3 and NSEC3PARAM records, and the RRSIGs covering them, are not hashed either, because they depend on
+// the random salt, and the names and types they hash are already covered by the other records. Neither are the
+// ZONEMD records and their RRSIGs, because their digest covers the RRSIGs.
+func (rrArray RRArray) DataDigest() []byte {
+	wires := make([][]byte, 0, len(rrArray))
+	for _, rr := range rrArray {
+		rr = dataRR(rr)
+		if rr == nil {
+			continue
+		}
+		wire, _, err := packRR(rr)
+		if err != nil {
+			// The RR cannot be packed, but its text is stable too.
+			wire = []byte(rr.String())
+		}
+		wires = append(wires, wire)
+	}
+	sort.Slice(wires, func(i, j int) bool {
+		return bytes.Compare(wires[i], wires[j]) < 0
+	})
+	h := sha256.New()
+	for i, wire := range wires {
+		if i > 0 && bytes.Equal(wire, wires[i-1]) {
+			continue
+		}
+		h.Write(wire)
+	}
+	return h.Sum(nil)
+}
+
+// dataRR returns a copy of the RR in canonical form without the fields left out of DataDigest,
+// or nil if the RR is not hashed.
+func dataRR(rr dns.RR) dns.RR {
+	switch x := rr.(type) {
+	case *dns.NSEC3, *dns.NSEC3PARAM, *dns.ZONEMD:
+		return nil
+	case *dns.RRSIG:
+		if x.TypeCovered == dns.TypeNSEC3 || x.TypeCovered == dns.TypeNSEC3PARAM || x.TypeCovered == dns.TypeZONEMD {
+			return nil
+		}
+	}
+	rr = canonicalCopy(rr)
+	switch x := rr.(type) {
+	case *dns.SOA:
+		x.Serial = 0
+	case *dns.RRSIG:
+		x.SignerName = dns.CanonicalName(x.SignerName)
+		x.Inception, x.Expiration, x.Signature = 0, 0, ""
+	}
+	return rr
+}
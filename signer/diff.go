@@ -0,0 +1,233 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"sort"
+	"strings"
+)
+
+// IncrementalDiff compares two versions of a signed zone and returns the RRs that must be deleted from the old
+// version and the RRs that must be added to it to obtain the new one, as in an IXFR (RFC1995) or a dynamic update.
+// Changed RRSIGs, NSEC/NSEC3 records and TTLs appear as a deletion and an addition.
+// Following IXFR, deleted starts with the old SOA and added starts with the new SOA, if both zones have one.
+func IncrementalDiff(oldRRs, newRRs RRArray) (deleted, added RRArray) {
+	oldKeys := make(map[string]bool)
+	for _, rr := range oldRRs {
+		oldKeys[rrKey(rr)] = true
+	}
+	newKeys := make(map[string]bool)
+	for _, rr := range newRRs {
+		newKeys[rrKey(rr)] = true
+	}
+	deleted = diffRRs(oldRRs, newKeys)
+	added = diffRRs(newRRs, oldKeys)
+	if len(deleted) > 0 || len(added) > 0 {
+		// IXFR requires both SOAs to delimit the changes, even if the SOA did not change.
+		deleted = soaFirst(deleted, oldRRs)
+		added = soaFirst(added, newRRs)
+	}
+	return deleted, added
+}
+
+// diffRRs returns the RRs of the array whose key is not in keys.
+func diffRRs(rrArray RRArray, keys map[string]bool) RRArray {
+	diff := make(RRArray, 0)
+	for _, rr := range rrArray {
+		if !keys[rrKey(rr)] {
+			diff = append(diff, rr)
+		}
+	}
+	return diff
+}
+
+// soaFirst moves the SOA of diff to its first position. If diff has no SOA, the SOA of zone is used.
+func soaFirst(diff, zone RRArray) RRArray {
+	var soa dns.RR
+	rest := make(RRArray, 0, len(diff))
+	for _, rr := range diff {
+		if rr.Header().Rrtype == dns.TypeSOA && soa == nil {
+			soa = rr
+		} else {
+			rest = append(rest, rr)
+		}
+	}
+	if soa == nil {
+		for _, rr := range zone {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				soa = rr
+				break
+			}
+		}
+	}
+	if soa == nil {
+		return rest
+	}
+	return append(RRArray{soa}, rest...)
+}
+
+// rrKey returns a string identifying the RR, with its owner name lowercased, because names are case insensitive.
+func rrKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Name = strings.ToLower(dns.Fqdn(rr.Header().Name))
+	return rr.String()
+}
+
+// RRSetChange is an RRset of the zone that is only in one of two versions of it, or has other RRs in each one.
+type RRSetChange struct {
+	Name string  // Owner name of the RRset
+	Type uint16  // Type of the RRset
+	Old  RRArray // RRs of the RRset in the old version of the zone, or nil if it was added
+	New  RRArray // RRs of the RRset in the new version of the zone, or nil if it was removed
+}
+
+// ZoneDiff are the semantic differences between two versions of a signed zone, as returned by DiffZones.
+type ZoneDiff struct {
+	Added       []RRSetChange // RRsets only in the new version
+	Removed     []RRSetChange // RRsets only in the old version
+	Modified    []RRSetChange // RRsets with other RRs or TTLs in each version
+	OldSerial   uint32        // SOA serial of the old version
+	NewSerial   uint32        // SOA serial of the new version
+	KeysAdded   []*dns.DNSKEY // DNSKEYs at the apex only in the new version
+	KeysRemoved []*dns.DNSKEY // DNSKEYs at the apex only in the old version
+	DSAdded     []*dns.DS     // SHA-256 DS records of the KSKs only in the new version, to publish in the parent zone
+	DSRemoved   []*dns.DS     // SHA-256 DS records of the KSKs only in the old version, to remove from the parent zone
+}
+
+// DataChanged returns true if the data of the zone changed, beyond its serial, its signatures and its keys.
+func (diff ZoneDiff) DataChanged() bool {
+	return len(diff.Added) > 0 || len(diff.Removed) > 0 || len(diff.Modified) > 0
+}
+
+// KeysChanged returns true if the DNSKEYs at the apex of the zone changed.
+func (diff ZoneDiff) KeysChanged() bool {
+	return len(diff.KeysAdded) > 0 || len(diff.KeysRemoved) > 0
+}
+
+// DiffZones parses two versions of a signed zone and returns their differences at the data level: the RRsets added,
+// removed or modified, compared as DataDigest does (in canonical form and without the SOA serial), and the changes of
+// the DNSKEYs at the apex and of the DS records of its KSKs. The RRSIG, NSEC, NSEC3, NSEC3PARAM and ZONEMD records
+// are left out, because they change on each signature or follow the data, so a zone signed again has no data
+// differences.
+func DiffZones(a, b io.Reader, zone string) (ZoneDiff, error) {
+	var diff ZoneDiff
+	oldRRs, err := ReadAndParseZone(&SignArgs{Zone: zone, File: a}, false)
+	if err != nil {
+		return diff, fmt.Errorf("cannot read the old version of zone %s: %s", zone, err)
+	}
+	newRRs, err := ReadAndParseZone(&SignArgs{Zone: zone, File: b}, false)
+	if err != nil {
+		return diff, fmt.Errorf("cannot read the new version of zone %s: %s", zone, err)
+	}
+	oldSets, oldKeys := dataRRSets(oldRRs, zone)
+	newSets, newKeys := dataRRSets(newRRs, zone)
+	for key, set := range newSets {
+		old, ok := oldSets[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, RRSetChange{Name: set[0].Header().Name, Type: set[0].Header().Rrtype, New: set})
+		case !sameData(old, set):
+			diff.Modified = append(diff.Modified, RRSetChange{Name: set[0].Header().Name, Type: set[0].Header().Rrtype, Old: old, New: set})
+		}
+	}
+	for key, set := range oldSets {
+		if _, ok := newSets[key]; !ok {
+			diff.Removed = append(diff.Removed, RRSetChange{Name: set[0].Header().Name, Type: set[0].Header().Rrtype, Old: set})
+		}
+	}
+	for _, changes := range [][]RRSetChange{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(changes, func(i, j int) bool {
+			if cmp := CompareNames(changes[i].Name, changes[j].Name); cmp != 0 {
+				return cmp < 0
+			}
+			return changes[i].Type < changes[j].Type
+		})
+	}
+	diff.OldSerial = zoneSerial(oldRRs)
+	diff.NewSerial = zoneSerial(newRRs)
+	diff.KeysAdded, diff.DSAdded = keyChanges(zone, newKeys, oldKeys)
+	diff.KeysRemoved, diff.DSRemoved = keyChanges(zone, oldKeys, newKeys)
+	return diff, nil
+}
+
+// dataRRSets returns the RRsets of the zone compared by DiffZones, by their rrSetKey, and the DNSKEYs at its apex.
+func dataRRSets(rrs RRArray, zone string) (map[string]RRArray, []*dns.DNSKEY) {
+	sets := make(map[string]RRArray)
+	keys := make([]*dns.DNSKEY, 0)
+	for _, rr := range rrs {
+		switch x := rr.(type) {
+		case *dns.RRSIG, *dns.NSEC, *dns.NSEC3, *dns.NSEC3PARAM, *dns.ZONEMD:
+			continue
+		case *dns.DNSKEY:
+			if strings.EqualFold(dns.Fqdn(x.Hdr.Name), dns.Fqdn(zone)) {
+				keys = append(keys, x)
+				continue
+			}
+		}
+		key := rrSetKey(rr.Header().Name, rr.Header().Rrtype)
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, keys
+}
+
+// sameData returns true if both RRsets have the same RRs and TTLs, compared as DataDigest compares them.
+func sameData(a, b RRArray) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	wires := make(map[string]int)
+	for _, rr := range a {
+		wires[dataKey(rr)]++
+	}
+	for _, rr := range b {
+		key := dataKey(rr)
+		if wires[key] == 0 {
+			return false
+		}
+		wires[key]--
+	}
+	return true
+}
+
+// dataKey returns the RR in the canonical form hashed by DataDigest, as a string.
+func dataKey(rr dns.RR) string {
+	rr = dataRR(rr)
+	wire, _, err := packRR(rr)
+	if err != nil {
+		return rr.String()
+	}
+	return string(wire)
+}
+
+// keyChanges returns the keys only in keys and not in others (whatever their TTL), and the SHA-256 DS records of the KSKs among them.
+func keyChanges(zone string, keys, others []*dns.DNSKEY) ([]*dns.DNSKEY, []*dns.DS) {
+	var changed []*dns.DNSKEY
+	var dss []*dns.DS
+	for _, key := range keys {
+		found := false
+		for _, other := range others {
+			found = found || dns.IsDuplicate(key, other)
+		}
+		if found {
+			continue
+		}
+		changed = append(changed, key)
+		if key.Flags&dns.SEP != 0 {
+			if ds := DSFromDNSKEY(zone, key, dns.SHA256); ds != nil {
+				dss = append(dss, ds)
+			}
+		}
+	}
+	return changed, dss
+}
+
+// zoneSerial returns the serial of the first SOA of the RRs, or zero if they have none.
+func zoneSerial(rrs RRArray) uint32 {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial
+		}
+	}
+	return 0
+}
@@ -0,0 +1,220 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// DigestMode defines where the data covered by the RRSIGs is digested before being signed.
+type DigestMode int
+
+const (
+	DigestHost DigestMode = iota // The signer digests the data and the HSM signs the digest with the raw mechanism of the algorithm (as CKM_RSA_PKCS)
+	DigestHSM                    // The HSM digests and signs the data with the combined mechanism of the algorithm (as CKM_SHA256_RSA_PKCS)
+)
+
+// ParseDigestMode returns the digest mode with the name provided: host or hsm.
+func ParseDigestMode(name string) (DigestMode, error) {
+	switch strings.ToLower(name) {
+	case "host":
+		return DigestHost, nil
+	case "hsm":
+		return DigestHSM, nil
+	default:
+		return DigestHost, fmt.Errorf("unknown digest mode %s (it should be host or hsm)", name)
+	}
+}
+
+// String returns the name of the digest mode.
+func (mode DigestMode) String() string {
+	if mode == DigestHSM {
+		return "hsm"
+	}
+	return "host"
+}
+
+// sign signs the RRset with the key pair, filling the fields of the RRSIG as dns.RRSIG.Sign does.
+// If the key pair has a SignData function, the data covered by the RRSIG is passed to it without being digested.
+func (kp *KeyPair) sign(sig *dns.RRSIG, rrset RRArray) error {
+	if kp.SignData == nil {
+		return sig.Sign(kp.Signer, rrset)
+	}
+	if len(rrset) == 0 {
+		return fmt.Errorf("empty RRset")
+	}
+	h0 := rrset[0].Header()
+	sig.Hdr.Rrtype = dns.TypeRRSIG
+	sig.Hdr.Name = h0.Name
+	sig.Hdr.Class = h0.Class
+	if sig.OrigTtl == 0 {
+		sig.OrigTtl = h0.Ttl
+	}
+	sig.TypeCovered = h0.Rrtype
+	sig.Labels = uint8(dns.CountLabel(h0.Name))
+	if strings.HasPrefix(h0.Name, "*") {
+		sig.Labels--
+	}
+	data, err := signatureData(sig, rrset)
+	if err != nil {
+		return err
+	}
+	signature, err := kp.SignData(data)
+	if err != nil {
+		return err
+	}
+	sig.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// signatureData returns the data covered by an RRSIG (RFC4034 3.1.8.1): its RDATA without the signature,
+// followed by the RRs of the RRset in canonical form and order (RFC4034 6), without duplicates.
+func signatureData(sig *dns.RRSIG, rrset RRArray) ([]byte, error) {
+	signerName := make([]byte, 255)
+	n, err := dns.PackDomainName(dns.CanonicalName(sig.SignerName), signerName, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 18, 18+n)
+	binary.BigEndian.PutUint16(data[0:], sig.TypeCovered)
+	data[2] = sig.Algorithm
+	data[3] = sig.Labels
+	binary.BigEndian.PutUint32(data[4:], sig.OrigTtl)
+	binary.BigEndian.PutUint32(data[8:], sig.Expiration)
+	binary.BigEndian.PutUint32(data[12:], sig.Inception)
+	binary.BigEndian.PutUint16(data[16:], sig.KeyTag)
+	data = append(data, signerName[:n]...)
+
+	type wireRR struct {
+		wire  []byte
+		rdata []byte
+	}
+	wires := make([]wireRR, 0, len(rrset))
+	for _, rr := range rrset {
+		wire, rdata, err := packRR(canonicalRR(rr, sig))
+		if err != nil {
+			return nil, err
+		}
+		wires = append(wires, wireRR{wire: wire, rdata: rdata})
+	}
+	sort.Slice(wires, func(i, j int) bool {
+		return bytes.Compare(wires[i].rdata, wires[j].rdata) < 0
+	})
+	for i, w := range wires {
+		if i > 0 && bytes.Equal(w.wire, wires[i-1].wire) {
+			continue
+		}
+		data = append(data, w.wire...)
+	}
+	return data, nil
+}
+
+// packRR returns the RR in uncompressed wire format, and the part of it with its RDATA.
+func packRR(rr dns.RR) (wire, rdata []byte, err error) {
+	wire = make([]byte, dns.Len(rr)+1)
+	off, err := dns.PackRR(rr, wire, 0, nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	wire = wire[:off]
+	// The RDATA starts after the owner name, type, class, TTL and RDATA length.
+	_, nameEnd, err := dns.UnpackDomainName(wire, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wire, wire[nameEnd+10:], nil
+}
+
+// sortCanonical sorts the RRs of an RRset by their RDATA in canonical form (RFC4034 6.3), packing each RR once,
+// so the RRset is sorted in O(n log n) before it is signed, and signing it and checking its RRSIGs find it
+// already in canonical order. The RRs that cannot be packed are left first, and fail when the RRset is signed.
+func (rrArray RRArray) sortCanonical() {
+	type keyedRR struct {
+		rr    dns.RR
+		rdata []byte
+	}
+	keyed := make([]keyedRR, len(rrArray))
+	for i, rr := range rrArray {
+		_, rdata, _ := packRR(canonicalCopy(rr))
+		keyed[i] = keyedRR{rr, rdata}
+	}
+	sort.SliceStable(keyed, func(i, j int) bool {
+		return bytes.Compare(keyed[i].rdata, keyed[j].rdata) < 0
+	})
+	for i, k := range keyed {
+		rrArray[i] = k.rr
+	}
+}
+
+// canonicalCopy returns a copy of the RR in canonical form, as canonicalRR, but keeping its owner name and TTL.
+func canonicalCopy(rr dns.RR) dns.RR {
+	// With the maximum number of labels, the owner name is kept, even if it is a wildcard.
+	return canonicalRR(rr, &dns.RRSIG{OrigTtl: rr.Header().Ttl, Labels: 255})
+}
+
+// canonicalRR returns a copy of the RR in the canonical form used for signing it with the RRSIG (RFC4034 6.2):
+// lowercase owner name (or the wildcard name the RRSIG was made for), lowercase domain names in the RDATA of the
+// types listed in RFC4034 6.2 (excluding HINFO, RFC6840 5.1) and the original TTL of the RRSIG.
+// The RDATA of other types is signed as packed: the hex fields (as the ones of TLSA and SSHFP) are binary,
+// so their case does not matter, and the CAA tags keep their case, because RFC4034 6.2 does not lowercase them.
+func canonicalRR(rr dns.RR, sig *dns.RRSIG) dns.RR {
+	rr = dns.Copy(rr)
+	h := rr.Header()
+	h.Ttl = sig.OrigTtl
+	labels := dns.SplitDomainName(h.Name)
+	if len(labels) > int(sig.Labels) {
+		h.Name = "*." + strings.Join(labels[len(labels)-int(sig.Labels):], ".") + "."
+	}
+	h.Name = dns.CanonicalName(h.Name)
+	switch x := rr.(type) {
+	case *dns.NS:
+		x.Ns = dns.CanonicalName(x.Ns)
+	case *dns.MD:
+		x.Md = dns.CanonicalName(x.Md)
+	case *dns.MF:
+		x.Mf = dns.CanonicalName(x.Mf)
+	case *dns.CNAME:
+		x.Target = dns.CanonicalName(x.Target)
+	case *dns.SOA:
+		x.Ns = dns.CanonicalName(x.Ns)
+		x.Mbox = dns.CanonicalName(x.Mbox)
+	case *dns.MB:
+		x.Mb = dns.CanonicalName(x.Mb)
+	case *dns.MG:
+		x.Mg = dns.CanonicalName(x.Mg)
+	case *dns.MR:
+		x.Mr = dns.CanonicalName(x.Mr)
+	case *dns.PTR:
+		x.Ptr = dns.CanonicalName(x.Ptr)
+	case *dns.MINFO:
+		x.Rmail = dns.CanonicalName(x.Rmail)
+		x.Email = dns.CanonicalName(x.Email)
+	case *dns.MX:
+		x.Mx = dns.CanonicalName(x.Mx)
+	case *dns.RP:
+		x.Mbox = dns.CanonicalName(x.Mbox)
+		x.Txt = dns.CanonicalName(x.Txt)
+	case *dns.AFSDB:
+		x.Hostname = dns.CanonicalName(x.Hostname)
+	case *dns.RT:
+		x.Host = dns.CanonicalName(x.Host)
+	case *dns.SIG:
+		x.SignerName = dns.CanonicalName(x.SignerName)
+	case *dns.PX:
+		x.Map822 = dns.CanonicalName(x.Map822)
+		x.Mapx400 = dns.CanonicalName(x.Mapx400)
+	case *dns.NAPTR:
+		x.Replacement = dns.CanonicalName(x.Replacement)
+	case *dns.KX:
+		x.Exchanger = dns.CanonicalName(x.Exchanger)
+	case *dns.SRV:
+		x.Target = dns.CanonicalName(x.Target)
+	case *dns.DNAME:
+		x.Target = dns.CanonicalName(x.Target)
+	}
+	return rr
+}
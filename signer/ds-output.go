@@ -0,0 +1,46 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// DSDigestTypes are the digest types of the DS records written into SignArgs.DSOutput: SHA-256, which every
+// validator must support (RFC8624 3.3), and SHA-384.
+var DSDigestTypes = []uint8{dns.SHA256, dns.SHA384}
+
+// KSKDSRecords returns the DS records of the KSKs (the DNSKEYs with the SEP flag) at the apex of the zone, with each
+// digest type provided, in the order of the keys in rrs. The DS records have the TTL of the DNSKEYs, so they can be
+// added to the parent zone as they are, or given to the registrar.
+func KSKDSRecords(zone string, rrs RRArray, digestTypes []uint8) []*dns.DS {
+	zone = dns.Fqdn(zone)
+	records := make([]*dns.DS, 0)
+	for _, rr := range rrs {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.Flags&dns.SEP == 0 || !strings.EqualFold(key.Hdr.Name, zone) {
+			continue
+		}
+		for _, digestType := range digestTypes {
+			if ds := DSFromDNSKEY(zone, key, digestType); ds != nil {
+				records = append(records, ds)
+			}
+		}
+	}
+	return records
+}
+
+// writeDSRecords writes the DS records of the KSKs in the RRs of the signed zone (see KSKDSRecords) into
+// args.DSOutput, one per line in zone file format, with the digest types of DSDigestTypes.
+func (args *SignArgs) writeDSRecords(rrs RRArray) error {
+	records := KSKDSRecords(args.Zone, rrs, DSDigestTypes)
+	if len(records) == 0 {
+		return fmt.Errorf("zone %s has no KSK to write its DS records", args.Zone)
+	}
+	for _, ds := range records {
+		if _, err := fmt.Fprintln(args.DSOutput, ds.String()); err != nil {
+			return fmt.Errorf("cannot write DS records of zone %s: %s", args.Zone, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+package signer
+
+import "time"
+
+// SetStartTime makes the signatures start at the time provided, until the function returned is called, so the tests
+// can compute the values depending on the time of the signature (as the date serials) from the same time.
+func SetStartTime(start time.Time) (restore func()) {
+	timeNow = func() time.Time { return start }
+	return func() { timeNow = time.Now }
+}
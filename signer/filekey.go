@@ -1,22 +1,152 @@
 package signer
 
 import (
-/*
-        "encoding/base64"
-        "encoding/binary"
-        "fmt"
-        "github.com/miekg/dns"
-        "io"
-        "sort"
-        "time"
-*/
-        "log"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"math/big"
 )
 
+// FileKey signs zones like Session, but with a ZSK and a KSK read from PEM files instead of an HSM, so zones can
+// be signed in CI tests or in small deployments without one. The files have a private key each, in PKCS#8
+// ("PRIVATE KEY"), PKCS#1 ("RSA PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY") format, as written by openssl genpkey.
+// Encrypted keys are not supported. The files are read on each signature, so the keys can be replaced between them.
 type FileKey struct {
-  ZSKfile	string
-  KSKfile	string
-  Log    *log.Logger          // Logger (for output)
+	ZSKfile string      // Path of the PEM file with the private key of the ZSK
+	KSKfile string      // Path of the PEM file with the private key of the KSK. It can be empty if the KSK is offline (see SignArgs.OfflineKSK).
+	Log     *log.Logger // Logger (for output). If nil, the messages are discarded.
+	Logger  Logger      // If not nil, it is used instead of Log, as a JSONLogger
 }
 
+// Sign parses the zone file, adds its NSEC or NSEC3 records, signs the zone with the keys of the files and outputs
+// the result into args.Output, as SoftSession.Sign. It returns the DS of the KSK. The algorithm of the keys must be
+// args.Algorithm (RSASHA256 by default), and the keys cannot be created, so CreateKeys, CreateZSK and CreateKSK
+// must be false.
+func (fileKey *FileKey) Sign(args *SignArgs) (*dns.DS, error) {
+	log := fileKey.Logger
+	if log == nil {
+		log = newLogger(fileKey.Log)
+	}
+	return SignWithKeys(args, fileKey, log)
+}
+
+// KeyPairs returns the ZSK and the KSK read from the files, if they are keys of the algorithm.
+func (fileKey *FileKey) KeyPairs(args *SignArgs, alg *Algorithm) (zsk, ksk *KeyPair, err error) {
+	if args.createKeys(false) || args.createKeys(true) {
+		return nil, nil, fmt.Errorf("keys read from files cannot be created by the signer")
+	}
+	if zsk, err = readKeyPair(args, alg, fileKey.ZSKfile, 256); err != nil {
+		return nil, nil, err
+	}
+	if len(fileKey.KSKfile) == 0 && len(args.OfflineKSK) > 0 {
+		return zsk, nil, nil
+	}
+	if ksk, err = readKeyPair(args, alg, fileKey.KSKfile, 257); err != nil {
+		return nil, nil, err
+	}
+	return zsk, ksk, nil
+}
+
+// readKeyPair returns the key pair of the private key in the PEM file, with a DNSKEY of the zone with the flags provided.
+func readKeyPair(args *SignArgs, alg *Algorithm, path string, flags uint16) (*KeyPair, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %s", err)
+	}
+	signer, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file %s: %s", path, err)
+	}
+	keyBytes, err := PublicKeyBytes(alg, signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("cannot use key file %s: %s", path, err)
+	}
+	pair := &KeyPair{
+		DNSKEY: CreateNewDNSKEY(args.Zone, flags, alg.Number, args.dnskeyTTL(), base64.StdEncoding.EncodeToString(keyBytes)),
+		Signer: signer,
+	}
+	if args.Digest == DigestHSM {
+		pair.SignData = softSignData(signer, alg)
+	}
+	return pair, nil
+}
+
+// ParsePrivateKeyPEM returns the first RSA, ECDSA or Ed25519 private key of the PEM data, in PKCS#8, PKCS#1 or SEC 1
+// format. Other blocks (as the "EC PARAMETERS" written by openssl ecparam) are skipped.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, fmt.Errorf("encrypted private keys are not supported")
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+			return key.(crypto.Signer), nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("no private key found in PEM data")
+}
 
+// PublicKeyBytes returns the public key in the DNSKEY format of the algorithm: RFC3110 for RSA, RFC6605 for ECDSA
+// and RFC8080 for Ed25519. It returns an error if the key cannot be used with the algorithm, as an ECDSA key over
+// the curve of another algorithm.
+func PublicKeyBytes(alg *Algorithm, pub crypto.PublicKey) ([]byte, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if alg.IsECDSA() || alg.IsEdDSA() {
+			break
+		}
+		exponent := big.NewInt(int64(key.E)).Bytes()
+		var keyBytes []byte
+		if len(exponent) < 256 {
+			keyBytes = append(keyBytes, byte(len(exponent)))
+		} else {
+			// Exponents longer than 255 bytes have their length in the two bytes after a zero (RFC3110 2).
+			keyBytes = append(keyBytes, 0, 0, 0)
+			binary.BigEndian.PutUint16(keyBytes[1:], uint16(len(exponent)))
+		}
+		keyBytes = append(keyBytes, exponent...)
+		return append(keyBytes, key.N.Bytes()...), nil
+	case *ecdsa.PublicKey:
+		size := (alg.ZSKBits + 7) / 8
+		if !alg.IsECDSA() || key.Curve.Params().BitSize != alg.ZSKBits {
+			break
+		}
+		keyBytes := make([]byte, 2*size)
+		x, y := key.X.Bytes(), key.Y.Bytes()
+		copy(keyBytes[size-len(x):size], x)
+		copy(keyBytes[2*size-len(y):], y)
+		return keyBytes, nil
+	case ed25519.PublicKey:
+		if !alg.IsEdDSA() {
+			break
+		}
+		return append([]byte{}, key...), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil, fmt.Errorf("%T key cannot be used with algorithm %s", pub, alg)
+}
@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// DefaultKeyLabel is the key label used when an HSMConfig does not specify one.
+const DefaultKeyLabel = "HSM-tools"
+
+// HSMConfig contains the parameters needed to open a session in an HSM, so many jobs can share them.
+// The PIN can be written in the configuration, or read from a file, an environment variable or a prompt.
+// The token is selected by slot ID, token serial number or token label. If none of them is set, the first slot with
+// a token is used.
+type HSMConfig struct {
+	Module      string       `json:"module"`       // Full path to the PKCS#11 library
+	Slot        *uint        `json:"slot"`         // Slot ID of the token
+	TokenSerial string       `json:"token_serial"` // Serial number of the token
+	TokenLabel  string       `json:"token_label"`  // Label of the token, which must match only one token
+	PIN         string       `json:"pin"`          // User PIN
+	PINFile     string       `json:"pin_file"`     // File with the user PIN
+	PINEnv      string       `json:"pin_env"`      // Environment variable with the user PIN
+	PINPrompt   bool         `json:"pin_prompt"`   // If true, the user PIN is asked in the terminal, without echo
+	KeyLabel    string       `json:"key_label"`    // Label of the keys. If empty, DefaultKeyLabel is used.
+	KeyTemplate *KeyTemplate `json:"key_template"` // Attributes of the generated keys. If nil, DefaultKeyTemplate is used. Its fields not set take the default values.
+	KeySelector *KeySelector `json:"key_selector"` // If not nil, the signing keys are selected by label and ID (in hex) instead of being generated
+}
+
+// LoadHSMConfig reads and validates the JSON HSM configuration in the file provided.
+func LoadHSMConfig(path string) (*HSMConfig, error) {
+	if err := FilesExist(path); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadHSMConfig(file)
+}
+
+// ReadHSMConfig reads and validates a JSON HSM configuration. Unknown fields are an error.
+func ReadHSMConfig(reader io.Reader) (*HSMConfig, error) {
+	config := &HSMConfig{}
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("cannot parse HSM config: %s", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate returns an error if the module does not exist, if there is not exactly one PIN source,
+// if more than one of the slot, the token serial and the token label are set or if the key template or the key
+// selector are invalid.
+// It sets the default key label if it is empty.
+func (config *HSMConfig) Validate() error {
+	if len(config.Module) == 0 {
+		return fmt.Errorf("invalid HSM config: module not specified")
+	}
+	if err := FilesExist(config.Module); err != nil {
+		return fmt.Errorf("invalid HSM config: %s", strings.TrimSpace(err.Error()))
+	}
+	sources := 0
+	for _, source := range []string{config.PIN, config.PINFile, config.PINEnv} {
+		if len(source) > 0 {
+			sources++
+		}
+	}
+	if config.PINPrompt {
+		sources++
+	}
+	if sources != 1 {
+		return fmt.Errorf("invalid HSM config: exactly one of pin, pin_file, pin_env and pin_prompt should be set")
+	}
+	if err := config.tokenSelector().Validate(); err != nil {
+		return fmt.Errorf("invalid HSM config: only one of slot, token_serial and token_label can be set")
+	}
+	if len(config.KeyLabel) == 0 {
+		config.KeyLabel = DefaultKeyLabel
+	}
+	if config.KeyTemplate != nil {
+		if err := config.KeyTemplate.Validate(); err != nil {
+			return fmt.Errorf("invalid HSM config: %s", err)
+		}
+	}
+	if config.KeySelector != nil {
+		if err := config.KeySelector.Validate(); err != nil {
+			return fmt.Errorf("invalid HSM config: %s", err)
+		}
+	}
+	return nil
+}
+
+// PINProvider returns the provider of the user PIN of the configuration, or nil if it has no PIN source.
+func (config *HSMConfig) PINProvider() PINProvider {
+	switch {
+	case len(config.PIN) > 0:
+		return StaticPIN(config.PIN)
+	case len(config.PINFile) > 0:
+		return FilePIN(config.PINFile)
+	case len(config.PINEnv) > 0:
+		return EnvPIN(config.PINEnv)
+	case config.PINPrompt:
+		return &PromptPIN{}
+	}
+	return nil
+}
+
+// GetPIN returns the user PIN, reading it from its file, environment variable or prompt if needed.
+// Trailing whitespace is removed from PINs read from files.
+func (config *HSMConfig) GetPIN() (string, error) {
+	provider := config.PINProvider()
+	if provider == nil {
+		return "", fmt.Errorf("PIN not specified")
+	}
+	return provider.PIN()
+}
+
+// NewSessionFromConfig creates a new session with the parameters of the HSM configuration.
+// As with NewSession, the library is loaded by the session and finalized when it ends.
+func NewSessionFromConfig(config *HSMConfig, log *log.Logger) (*Session, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	pin, err := config.GetPIN()
+	if err != nil {
+		return nil, err
+	}
+	p, err := initContext(config.Module)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := config.tokenSelector().findSlot(p)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, err
+	}
+	session, err := NewSessionWithContext(p, slot, pin, config.KeyLabel, log)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, err
+	}
+	session.KeyTemplate = config.KeyTemplate
+	session.KeySelector = config.KeySelector
+	session.ownsCtx = true
+	return session, nil
+}
+
+// tokenSelector returns the selector of the token of the configuration.
+func (config *HSMConfig) tokenSelector() TokenSelector {
+	return TokenSelector{Slot: config.Slot, Serial: config.TokenSerial, Label: config.TokenLabel}
+}
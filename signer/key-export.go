@@ -0,0 +1,55 @@
+package signer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+)
+
+// GetDNSKEYs returns the DNSKEYs of the valid ZSK and KSK of the zone stored in the HSM for the algorithm (or
+// DefaultAlgorithm, if it is zero), with the TTL provided, without signing anything, so the keys can be given to
+// the parent zone or to monitoring tools. The keys are found as in Sign, with the key template or the key selector
+// of the session, and it is an error if they are missing. If the token has the new ZSK of a rollover, its DNSKEY
+// is returned after the ZSK. The KSK is always the last one.
+func (session *Session) GetDNSKEYs(zone string, algorithm uint8, ttl uint32) ([]*dns.DNSKEY, error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	alg, err := GetAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	zone = dns.Fqdn(zone)
+	keys, err := session.searchKeys(alg, zone)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.checkKeys(alg, zone, keys, false); err != nil {
+		return nil, err
+	}
+	public := []*Key{keys.PublicZSK}
+	flags := []uint16{dns.ZONE}
+	if session.KeySelector == nil {
+		label, _, nextID := session.rolloverIDs(zone)
+		next, err := session.findKey(keyCriteria{class: pkcs11.CKO_PUBLIC_KEY, alg: alg, label: label, id: nextID})
+		if err != nil {
+			return nil, err
+		}
+		if next != nil {
+			public = append(public, next)
+			flags = append(flags, dns.ZONE)
+		}
+	}
+	public = append(public, keys.PublicKSK)
+	flags = append(flags, dns.ZONE|dns.SEP)
+	dnskeys := make([]*dns.DNSKEY, 0, len(public))
+	for i, key := range public {
+		keyBytes, err := session.getPublicKeyBytes(alg, key.Handle)
+		if err != nil {
+			return nil, err
+		}
+		dnskeys = append(dnskeys, CreateNewDNSKEY(zone, flags[i], alg.Number, ttl, base64.StdEncoding.EncodeToString(keyBytes)))
+	}
+	return dnskeys, nil
+}
@@ -0,0 +1,133 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"math/big"
+	"time"
+)
+
+// ImportKey creates in the HSM the public and private key objects of an RSA or ECDSA key pair generated elsewhere
+// (or restored from a backup), with the label and ID provided and the security attributes of the key template of
+// the session. The keys are valid for a year from today. Sign uses them as the keys it generates, so to find them
+// the label and ID must be the ones of the key template for the zone and role of the key: with the default
+// template, the key label of the session and "zsk" or "ksk". ECDSA keys must use a curve of a supported algorithm.
+// It returns an error if the public key does not match the private key, or if the HSM does not permit importing
+// the key, as when its policy forbids creating private keys or the requested attributes.
+func (session *Session) ImportKey(priv crypto.PrivateKey, pub crypto.PublicKey, label, id string) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if session == nil || session.Ctx == nil {
+		return 0, 0, fmt.Errorf("session not initialized")
+	}
+	keyType, publicAttrs, privateAttrs, err := importAttributes(priv, pub)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot import key %s: %s", id, err)
+	}
+	template := session.keyTemplate()
+	publicTemplate, privateTemplate := template.keyPairTemplates(keyType, label, id, time.Now().AddDate(1, 0, 0), publicAttrs)
+	privateTemplate = append(privateTemplate, privateAttrs...)
+
+	pubKey, err := session.Ctx.CreateObject(session.Handle, publicTemplate)
+	if err != nil {
+		return 0, 0, importError("public", id, err)
+	}
+	privKey, err := session.Ctx.CreateObject(session.Handle, privateTemplate)
+	if err != nil {
+		if e := session.Ctx.DestroyObject(session.Handle, pubKey); e != nil {
+			session.logger().Error("Cannot destroy public key of a failed import", "error", e)
+		}
+		return 0, 0, importError("private", id, err)
+	}
+	if err := session.checkKeyTemplate(template, privKey); err != nil {
+		for _, handle := range []pkcs11.ObjectHandle{pubKey, privKey} {
+			if e := session.Ctx.DestroyObject(session.Handle, handle); e != nil {
+				session.logger().Error("Cannot destroy key imported without the key template", "error", e)
+			}
+		}
+		return 0, 0, fmt.Errorf("%s key pair imported without the key template: %s", id, err)
+	}
+	return pubKey, privKey, nil
+}
+
+// importError explains the errors returned by the HSM when a key object cannot be created because of its policy.
+func importError(class, id string, err error) error {
+	for _, code := range []uint{pkcs11.CKR_ACTION_PROHIBITED, pkcs11.CKR_TEMPLATE_INCONSISTENT, pkcs11.CKR_ATTRIBUTE_VALUE_INVALID, pkcs11.CKR_ATTRIBUTE_READ_ONLY} {
+		if isPKCS11Error(err, code) {
+			return fmt.Errorf("cannot import %s %s key: the HSM does not permit importing it with the attributes of the key template: %s", id, class, err)
+		}
+	}
+	return fmt.Errorf("cannot import %s %s key: %s", id, class, err)
+}
+
+// importAttributes returns the PKCS#11 key type and the attributes with the key material of the key pair.
+func importAttributes(priv crypto.PrivateKey, pub crypto.PublicKey) (keyType uint, public, private []*pkcs11.Attribute, err error) {
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok || rsaPub.N.Cmp(key.N) != 0 || rsaPub.E != key.E {
+			return 0, nil, nil, fmt.Errorf("public key does not match the RSA private key")
+		}
+		if len(key.Primes) != 2 {
+			return 0, nil, nil, fmt.Errorf("RSA keys with %d primes are not supported", len(key.Primes))
+		}
+		key.Precompute()
+		exponent := big.NewInt(int64(key.E)).Bytes()
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent),
+		}
+		private = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, key.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, key.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, key.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, key.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, key.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, key.Precomputed.Qinv.Bytes()),
+		}
+		return pkcs11.CKK_RSA, public, private, nil
+	case *ecdsa.PrivateKey:
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok || ecPub.Curve != key.Curve || ecPub.X.Cmp(key.X) != 0 || ecPub.Y.Cmp(key.Y) != 0 {
+			return 0, nil, nil, fmt.Errorf("public key does not match the ECDSA private key")
+		}
+		ecParams, err := curveParams(key.Curve)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		// CKA_EC_POINT is the DER encoding of the uncompressed point as an OCTET STRING.
+		point, err := asn1.Marshal(elliptic.Marshal(key.Curve, key.X, key.Y))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		value := key.D.Bytes()
+		value = append(make([]byte, size-len(value)), value...)
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}
+		private = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+		}
+		return pkcs11.CKK_EC, public, private, nil
+	default:
+		return 0, nil, nil, fmt.Errorf("unsupported private key type %T (it should be RSA or ECDSA)", priv)
+	}
+}
+
+// curveParams returns the DER encoded OID of the curve, if an ECDSA algorithm of the signer uses it.
+func curveParams(curve elliptic.Curve) ([]byte, error) {
+	for _, alg := range algorithms {
+		if alg.IsECDSA() && alg.ZSKBits == curve.Params().BitSize {
+			return alg.ECParams, nil
+		}
+	}
+	return nil, fmt.Errorf("curve %s is not used by a supported algorithm", curve.Params().Name)
+}
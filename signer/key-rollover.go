@@ -0,0 +1,375 @@
+package signer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+	"io"
+	"strings"
+	"time"
+)
+
+// RolloverStrategy defines how the new ZSK of a ZSK rollover is introduced (RFC6781 4.1.1).
+type RolloverStrategy int
+
+const (
+	PrePublishRollover      RolloverStrategy = iota // The new DNSKEY is published before it signs, and the old one stays published after it stops signing (RFC6781 4.1.1.1)
+	DoubleSignatureRollover                         // The new DNSKEY is published and signs with the old one, until the old one is removed (RFC6781 4.1.1.2)
+)
+
+// rolloverStrategies maps the names of the rollover strategies to their values.
+var rolloverStrategies = map[string]RolloverStrategy{
+	"pre-publish":      PrePublishRollover,
+	"double-signature": DoubleSignatureRollover,
+}
+
+// ParseRolloverStrategy returns the rollover strategy with the name provided (pre-publish or double-signature).
+func ParseRolloverStrategy(name string) (RolloverStrategy, error) {
+	strategy, ok := rolloverStrategies[strings.ToLower(name)]
+	if !ok {
+		return PrePublishRollover, fmt.Errorf("unknown rollover strategy %s (it should be pre-publish or double-signature)", name)
+	}
+	return strategy, nil
+}
+
+// String returns the name of the rollover strategy.
+func (strategy RolloverStrategy) String() string {
+	if strategy == DoubleSignatureRollover {
+		return "double-signature"
+	}
+	return "pre-publish"
+}
+
+// MarshalText encodes the rollover strategy as its name.
+func (strategy RolloverStrategy) MarshalText() ([]byte, error) {
+	return []byte(strategy.String()), nil
+}
+
+// UnmarshalText decodes a rollover strategy from its name.
+func (strategy *RolloverStrategy) UnmarshalText(text []byte) (err error) {
+	*strategy, err = ParseRolloverStrategy(string(text))
+	return err
+}
+
+// RolloverState is the state of the ZSK rollover of a zone, kept between its signatures (as in a JSON file, see
+// ReadRolloverState and WriteJSON), so each signature moves the rollover to its next phase once the records cached
+// during the current one expired. With the pre-publish strategy, the new DNSKEY is published while the old ZSK signs,
+// and after the DNSKEY TTL, the new ZSK signs while the old DNSKEY stays published (the post-publish phase). With the
+// double-signature strategy, the new DNSKEY is published and both ZSKs sign. The rollover ends after the largest TTL
+// of the zone, when the new ZSK signs alone.
+type RolloverState struct {
+	Zone     string           `json:"zone"`     // Zone of the rollover
+	Strategy RolloverStrategy `json:"strategy"` // How the new ZSK is introduced
+	Phase    RolloverPhase    `json:"phase"`    // Phase of the rollover, or none if it did not start or it ended
+	Since    time.Time        `json:"since"`    // When the phase began. It is zero if the rollover did not start.
+	Ready    time.Time        `json:"ready"`    // When the next phase can begin, after the records cached during this one expire
+	Delay    time.Duration    `json:"delay"`    // Time for the signed zone to reach the secondary servers (in nanoseconds), added to the TTLs waited in each phase
+}
+
+// NewRolloverState returns the state of a ZSK rollover of the zone that did not start.
+func NewRolloverState(zone string, strategy RolloverStrategy, delay time.Duration) *RolloverState {
+	return &RolloverState{
+		Zone:     dns.Fqdn(zone),
+		Strategy: strategy,
+		Delay:    delay,
+	}
+}
+
+// ReadRolloverState decodes a rollover state written by WriteJSON. Unknown fields are an error.
+func ReadRolloverState(reader io.Reader) (*RolloverState, error) {
+	state := &RolloverState{}
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(state); err != nil {
+		return nil, fmt.Errorf("cannot read rollover state: %s", err)
+	}
+	if len(state.Zone) == 0 {
+		return nil, fmt.Errorf("invalid rollover state: zone cannot be empty")
+	}
+	return state, nil
+}
+
+// WriteJSON writes the rollover state into writer as indented JSON.
+func (state *RolloverState) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(state)
+}
+
+// Started returns true if the rollover started, even if it already ended.
+func (state *RolloverState) Started() bool {
+	return !state.Since.IsZero()
+}
+
+// NextPhase returns the phase of the rollover for a signature at the time provided: the first phase of the strategy
+// if the rollover did not start, the next phase if the current one is ready to change (none, if the rollover ends),
+// or the current phase otherwise.
+func (state *RolloverState) NextPhase(now time.Time) RolloverPhase {
+	switch {
+	case !state.Started() && state.Strategy == DoubleSignatureRollover:
+		return RolloverDoubleSignature
+	case !state.Started():
+		return RolloverPrePublish
+	case state.Phase == RolloverNone || now.Before(state.Ready):
+		return state.Phase
+	case state.Phase == RolloverPrePublish:
+		return RolloverPostPublish
+	default:
+		return RolloverNone
+	}
+}
+
+// wait returns how long the records of the signed zone are cached: the DNSKEY TTL in the pre-publish phase, because
+// the new DNSKEY must be cached before it signs, and the largest TTL of the zone in the others, because the RRSIGs
+// of the old ZSK must expire before its DNSKEY is removed. Delay is added to it.
+func (state *RolloverState) wait(rrs RRArray) time.Duration {
+	var ttl uint32
+	for _, rr := range rrs {
+		dnskey := rr.Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(rr.Header().Name, state.Zone)
+		if state.Phase == RolloverPrePublish && !dnskey {
+			continue
+		}
+		if rr.Header().Ttl > ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl)*time.Second + state.Delay
+}
+
+// Rollover moves the ZSK rollover in state to the phase of a signature now (see RolloverState.NextPhase) and signs
+// the zone with the keys of that phase, as Sign, updating state once the zone is signed. When the rollover starts,
+// the new ZSK is generated with the label of the ZSK of the zone and its ID followed by -next (see KeyTemplate), or
+// it is reused if the token has it already (as when the state of a previous start was not kept). When it ends, the
+// old ZSK is expired and the new one takes its ID, so Sign uses it later. If that failed in the middle, as when the
+// connection of the HSM is lost, the next signature of the state finishes it and signs with the new ZSK, because the
+// old one cannot sign anymore. A rollover that ended only signs the zone.
+// The zone is signed with a single algorithm, and the keys cannot be created nor selected with a key selector.
+func (session *Session) Rollover(args *SessionSignArgs, state *RolloverState) (ds *dns.DS, err error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	if !strings.EqualFold(dns.Fqdn(state.Zone), dns.Fqdn(args.Zone)) {
+		return nil, fmt.Errorf("the rollover state is of zone %s, not of zone %s", state.Zone, args.Zone)
+	}
+	algs, err := args.signingAlgorithms()
+	if err != nil {
+		return nil, err
+	}
+	if len(algs) != 1 {
+		return nil, fmt.Errorf("a ZSK rollover signs the zone with one algorithm, not %d", len(algs))
+	}
+	if session.KeySelector != nil || args.createKeys(false) || args.createKeys(true) {
+		return nil, fmt.Errorf("the keys of a ZSK rollover cannot be created by the signature nor selected with a key selector")
+	}
+	if args.DryRun {
+		return nil, fmt.Errorf("a ZSK rollover cannot be a dry run, because it changes the keys of the HSM")
+	}
+	if state.Started() && state.Phase == RolloverNone {
+		session.logger().Info("The ZSK rollover ended, signing with the current keys", "zone", args.Zone)
+		return session.Sign(args)
+	}
+	now := time.Now()
+	next := *state
+	if next.Phase = state.NextPhase(now); next.Phase != state.Phase || !state.Started() {
+		next.Since = now
+		next.Ready = now
+	}
+	if next.Phase == RolloverNone {
+		interrupted, err := session.endInterrupted(args.Zone, algs[0])
+		if err != nil {
+			return nil, err
+		}
+		if interrupted {
+			session.logger().Warn("The end of the ZSK rollover was interrupted, ending it before signing", "zone", args.Zone)
+			if err := session.endRollover(args.Zone, algs[0]); err != nil {
+				return nil, err
+			}
+			if ds, err = session.Sign(args); err != nil {
+				if _, partial := err.(RRSetErrors); !partial {
+					return nil, err
+				}
+			}
+			session.logger().Info("ZSK rollover", "zone", args.Zone, "strategy", next.Strategy, "phase", next.Phase, "ready", next.Ready)
+			*state = next
+			return ds, err
+		}
+	}
+	var created []pkcs11.ObjectHandle
+	if !state.Started() {
+		if created, err = session.startRollover(args, algs[0]); err != nil {
+			return nil, err
+		}
+	}
+	args.rollover = &next
+	defer func() {
+		args.rollover = nil
+	}()
+	ds, err = session.Sign(args)
+	if _, partial := err.(RRSetErrors); err != nil && !partial {
+		for _, handle := range created {
+			if e := session.Ctx.DestroyObject(session.Handle, handle); e != nil {
+				session.logger().Error("Cannot destroy the new ZSK of the rollover", "error", e)
+			}
+		}
+		return nil, err
+	}
+	if next.Phase == RolloverNone {
+		if e := session.endRollover(args.Zone, algs[0]); e != nil {
+			return nil, e
+		}
+	} else if ready := next.Since.Add(next.wait(args.RRs)); ready.After(next.Ready) {
+		next.Ready = ready
+	}
+	session.logger().Info("ZSK rollover", "zone", args.Zone, "strategy", next.Strategy, "phase", next.Phase, "ready", next.Ready)
+	*state = next
+	return ds, err
+}
+
+// rolloverIDs returns the label of the keys of the zone, the ID of its ZSK and the ID of the new ZSK of a rollover.
+func (session *Session) rolloverIDs(zone string) (label string, zskID, nextID []byte) {
+	template := session.keyTemplate()
+	label = template.format(template.Label, session.Label, zone, "")
+	id := template.format(template.ID, session.Label, zone, "zsk")
+	return label, []byte(id), []byte(id + "-next")
+}
+
+// startRollover generates the new ZSK of the rollover, unless the token has it already, and returns the handles of
+// the keys it generated (none, if it was in the token).
+func (session *Session) startRollover(args *SessionSignArgs, alg *Algorithm) ([]pkcs11.ObjectHandle, error) {
+	label, _, nextID := session.rolloverIDs(args.Zone)
+	existing, err := session.findKey(keyCriteria{class: pkcs11.CKO_PRIVATE_KEY, alg: alg, label: label, id: nextID})
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		session.logger().Info("Reusing the new ZSK of the rollover found in the token", "zone", args.Zone)
+		return nil, nil
+	}
+	bits, err := args.keyBits(alg, false)
+	if err != nil {
+		return nil, err
+	}
+	session.logger().Info("generating the new zsk of the rollover", "algorithm", alg)
+	var public, private pkcs11.ObjectHandle
+	err = args.Retry.Do(session.logger(), "zsk generation", func() (err error) {
+		_, public, private, err = session.generateKey(alg, bits, dns.ZONE, label, string(nextID))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	session.logger().Info("Key created", "zone", args.Zone, "role", "new zsk", "algorithm", alg, "bits", bits)
+	return []pkcs11.ObjectHandle{public, private}, nil
+}
+
+// nextZSK returns the public and private keys of the new ZSK of the rollover of the zone.
+func (session *Session) nextZSK(zone string, alg *Algorithm) (public, private *Key, err error) {
+	label, _, nextID := session.rolloverIDs(zone)
+	keys := make([]*Key, 2)
+	for i, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_PRIVATE_KEY} {
+		criteria := keyCriteria{class: class, alg: alg, label: label, id: nextID}
+		if keys[i], err = session.findKey(criteria); err != nil {
+			return nil, nil, err
+		}
+		if keys[i] == nil {
+			return nil, nil, fmt.Errorf("no valid %s for the new ZSK of the rollover", criteria)
+		}
+	}
+	return keys[0], keys[1], nil
+}
+
+// rolloverZSK returns the ZSK signing the zone in the phase of args.rollover, given the current ZSK of the zone, and
+// adds the DNSKEYs published without signing to the DNSKEY RRset: the new one in the pre-publish phase and the old
+// one in the post-publish phase. In the double-signature phase, the new ZSK signs in args.rolloverZSKs too, and when
+// the rollover ends (the phase is none), the new ZSK signs alone.
+func (session *Session) rolloverZSK(args *SessionSignArgs, alg *Algorithm, zsk *KeyPair) (*KeyPair, error) {
+	public, private, err := session.nextZSK(args.Zone, alg)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := session.getPublicKeyBytes(alg, public.Handle)
+	if err != nil {
+		return nil, err
+	}
+	dnskey := CreateNewDNSKEY(args.Zone, 256, alg.Number, args.dnskeyTTL(), base64.StdEncoding.EncodeToString(keyBytes))
+	next := session.keyPair(args, alg, dnskey, public.Handle, private.Handle)
+	switch args.rollover.Phase {
+	case RolloverPrePublish:
+		args.preservedKeys = append(args.preservedKeys, next.DNSKEY)
+		return zsk, nil
+	case RolloverDoubleSignature:
+		args.rolloverZSKs = []*KeyPair{next}
+		return zsk, nil
+	case RolloverPostPublish:
+		args.preservedKeys = append(args.preservedKeys, zsk.DNSKEY)
+	}
+	args.Zsk = next.DNSKEY
+	return next, nil
+}
+
+// endRollover expires the old ZSK of the zone and gives its ID to the new ZSK, so it is the ZSK found by Sign from now
+// on. Each key is changed by a different PKCS#11 call, so it can be run again if it was interrupted (see
+// endInterrupted): the old keys still valid are expired first, and then the new keys still having the ID of the
+// rollover get the ID of the ZSK, so no key of the new ZSK has that ID while a key of the old one can sign.
+func (session *Session) endRollover(zone string, alg *Algorithm) error {
+	label, zskID, nextID := session.rolloverIDs(zone)
+	classes := []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_PRIVATE_KEY}
+	next := make([]*Key, 0, len(classes))
+	for _, class := range classes {
+		key, err := session.findKey(keyCriteria{class: class, alg: alg, label: label, id: nextID})
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			next = append(next, key)
+		}
+	}
+	if len(next) == 0 {
+		return fmt.Errorf("no valid key of the new ZSK of the rollover")
+	}
+	if len(next) == len(classes) {
+		// No new key has the ID yet, so the valid keys with it are the ones of the old ZSK.
+		for _, class := range classes {
+			old, err := session.findKey(keyCriteria{class: class, alg: alg, label: label, id: zskID})
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				continue
+			}
+			if err := session.ExpireKey(old.Handle); err != nil {
+				return fmt.Errorf("cannot expire the old ZSK of the rollover: %s", err)
+			}
+		}
+	}
+	for _, key := range next {
+		session.countHSMCalls(1)
+		if err := session.Ctx.SetAttributeValue(session.Handle, key.Handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, zskID)}); err != nil {
+			return fmt.Errorf("cannot give the ID of the old ZSK to the new one: %s", err)
+		}
+	}
+	session.logger().Info("ZSK rollover ended, the old ZSK was expired", "zone", zone)
+	return nil
+}
+
+// endInterrupted returns true if the end of the rollover of the zone was interrupted (see endRollover): a key of the
+// ZSK of the zone is not valid anymore, but a key of the new ZSK still has the ID of the rollover.
+func (session *Session) endInterrupted(zone string, alg *Algorithm) (bool, error) {
+	label, zskID, nextID := session.rolloverIDs(zone)
+	expired, pending := false, false
+	for _, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_PRIVATE_KEY} {
+		current, err := session.findKey(keyCriteria{class: class, alg: alg, label: label, id: zskID})
+		if err != nil {
+			return false, err
+		}
+		next, err := session.findKey(keyCriteria{class: class, alg: alg, label: label, id: nextID})
+		if err != nil {
+			return false, err
+		}
+		expired = expired || current == nil
+		pending = pending || next != nil
+	}
+	return expired && pending, nil
+}
@@ -0,0 +1,216 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+	"time"
+)
+
+// KeySelector selects existing signing keys by their exact CKA_ID values, for tokens with many unrelated objects
+// or with keys created by other tools. Each key is searched by CKA_CLASS, CKA_KEY_TYPE, CKA_LABEL and CKA_ID
+// together, and exactly one valid public and one valid private key must match each ID, so the signature fails
+// instead of using the wrong key. The selected keys are never generated, so CreateKeys cannot be used with it.
+type KeySelector struct {
+	Label string // CKA_LABEL of the keys. If empty, the label of the key template is used.
+	ZSKID []byte // CKA_ID of the ZSK pair
+	KSKID []byte // CKA_ID of the KSK pair
+}
+
+// UnmarshalJSON decodes a key selector with the label and the IDs in hex, as
+// {"label": "dnssec", "zsk_id": "0a01", "ksk_id": "0a02"}. Unknown fields are an error.
+func (selector *KeySelector) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Label string `json:"label"`
+		ZSKID string `json:"zsk_id"`
+		KSKID string `json:"ksk_id"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	zskID, err := hex.DecodeString(fields.ZSKID)
+	if err != nil {
+		return fmt.Errorf("invalid zsk_id %s: %s", fields.ZSKID, err)
+	}
+	kskID, err := hex.DecodeString(fields.KSKID)
+	if err != nil {
+		return fmt.Errorf("invalid ksk_id %s: %s", fields.KSKID, err)
+	}
+	*selector = KeySelector{Label: fields.Label, ZSKID: zskID, KSKID: kskID}
+	return nil
+}
+
+// Validate returns an error if an ID is empty, or if both IDs are the same.
+func (selector *KeySelector) Validate() error {
+	if len(selector.ZSKID) == 0 || len(selector.KSKID) == 0 {
+		return fmt.Errorf("invalid key selector: the ZSK and KSK IDs cannot be empty")
+	}
+	if bytes.Equal(selector.ZSKID, selector.KSKID) {
+		return fmt.Errorf("invalid key selector: the ZSK and KSK IDs are the same (%x)", selector.ZSKID)
+	}
+	return nil
+}
+
+// keyCriteria are the attributes a key must have to be used for signing.
+type keyCriteria struct {
+	class uint       // CKA_CLASS: CKO_PUBLIC_KEY or CKO_PRIVATE_KEY
+	alg   *Algorithm // CKA_KEY_TYPE and, for ECDSA and EdDSA, CKA_EC_PARAMS
+	label string     // CKA_LABEL
+	id    []byte     // CKA_ID
+}
+
+// template returns the attribute template matching the keys with the criteria.
+func (criteria keyCriteria) template() []*pkcs11.Attribute {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, criteria.class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, criteria.alg.KeyType),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, criteria.label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, criteria.id),
+	}
+	if len(criteria.alg.ECParams) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, criteria.alg.ECParams))
+	}
+	return template
+}
+
+// String describes the criteria in error messages.
+func (criteria keyCriteria) String() string {
+	class := "public"
+	if criteria.class == pkcs11.CKO_PRIVATE_KEY {
+		class = "private"
+	}
+	return fmt.Sprintf("%s %s key with label %s and ID %x", criteria.alg, class, criteria.label, criteria.id)
+}
+
+// keyIdentifiers returns the CKA_LABEL of the keys of the zone and the CKA_ID of its ZSK and KSK pairs, following
+// the key template of the session, or its key selector if it has one.
+func (session *Session) keyIdentifiers(zone string) (label string, zskID, kskID []byte, err error) {
+	template := session.keyTemplate()
+	label = template.format(template.Label, session.Label, zone, "")
+	zskID = []byte(template.format(template.ID, session.Label, zone, "zsk"))
+	kskID = []byte(template.format(template.ID, session.Label, zone, "ksk"))
+	if selector := session.KeySelector; selector != nil {
+		if err := selector.Validate(); err != nil {
+			return "", nil, nil, err
+		}
+		if len(selector.Label) > 0 {
+			label = selector.Label
+		}
+		zskID, kskID = selector.ZSKID, selector.KSKID
+	}
+	return label, zskID, kskID, nil
+}
+
+// checkKeys returns an error if the valid keys of the zone found for the algorithm (see searchKeys) do not have a
+// public and a private key for both the ZSK and the KSK, or only for the ZSK if offlineKSK is true (see
+// SignArgs.OfflineKSK). If a key is missing, the valid keys with its label and ID are searched for the other key types
+// and curves, so the error says if the zone has keys of another algorithm, instead of suggesting to create new keys
+// next to them.
+func (session *Session) checkKeys(alg *Algorithm, zone string, keys *ValidKeys, offlineKSK bool) error {
+	for _, pair := range []struct {
+		role            string
+		public, private *Key
+	}{
+		{"ZSK", keys.PublicZSK, keys.PrivateZSK},
+		{"KSK", keys.PublicKSK, keys.PrivateKSK},
+	} {
+		if pair.public != nil && pair.private == nil {
+			return fmt.Errorf("the %s %s of zone %s has a valid public key in the HSM, but not a private key", alg, pair.role, zone)
+		}
+		if pair.public == nil && pair.private != nil {
+			return fmt.Errorf("the %s %s of zone %s has a valid private key in the HSM, but not a public key", alg, pair.role, zone)
+		}
+	}
+	if keys.PublicZSK != nil && (keys.PublicKSK != nil || offlineKSK) {
+		return nil
+	}
+	label, zskID, kskID, err := session.keyIdentifiers(zone)
+	if err != nil {
+		return err
+	}
+	for _, number := range []uint8{dns.RSASHA256, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519} {
+		other := algorithms[number]
+		if other.KeyType == alg.KeyType && bytes.Equal(other.ECParams, alg.ECParams) {
+			continue
+		}
+		for _, id := range [][]byte{zskID, kskID} {
+			key, err := session.findKey(keyCriteria{class: pkcs11.CKO_PUBLIC_KEY, alg: other, label: label, id: id})
+			if err != nil {
+				return err
+			}
+			if key != nil {
+				return fmt.Errorf("valid keys of zone %s for algorithm %s not found, but the HSM has %s keys with label %s: sign with --algorithm %s, or expire them before creating new keys", zone, alg, keyTypeName(other), label, other)
+			}
+		}
+	}
+	missing := "ZSK and KSK"
+	if offlineKSK {
+		missing = "ZSK"
+	} else if keys.PublicZSK != nil {
+		missing = "KSK"
+	} else if keys.PublicKSK != nil {
+		missing = "ZSK"
+	}
+	return fmt.Errorf("valid %s %s of zone %s not found (label %s). If you have not keys stored in the HSM, you can create a new pair with --create-keys flag", alg, missing, zone, label)
+}
+
+// keyTypeName describes the key type and curve of the algorithm in error messages.
+func keyTypeName(alg *Algorithm) string {
+	switch {
+	case alg.IsEdDSA():
+		return "Ed25519"
+	case alg.IsECDSA():
+		return fmt.Sprintf("ECDSA P-%d", alg.ZSKBits)
+	default:
+		return "RSA"
+	}
+}
+
+// findKey returns the valid key matching the criteria (the one whose start and end dates include today),
+// or nil if there is none. Expired keys are ignored, because they are kept in the token after a key rollover.
+// It returns an error if many valid keys match the criteria, because the key to sign with would be ambiguous.
+func (session *Session) findKey(criteria keyCriteria) (*Key, error) {
+	objects, err := session.FindObject(criteria.template())
+	if err != nil {
+		return nil, err
+	}
+	dateTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, nil),
+	}
+	today := time.Now().Format("20060102")
+	var found *Key
+	for _, object := range objects {
+		session.countHSMCalls(1)
+		attr, err := session.Ctx.GetAttributeValue(session.Handle, object, dateTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get attributes: %s", err)
+		}
+		// Some HSMs ignore the attributes of the template they do not know, so the class is checked again.
+		if len(attr[0].Value) < 4 || uint(binary.LittleEndian.Uint32(attr[0].Value)) != criteria.class {
+			continue
+		}
+		start, end := string(attr[1].Value), string(attr[2].Value)
+		valid := start <= today && today <= end
+		session.logger().Debug("Checking key", "key", criteria, "valid", valid)
+		if !valid {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("many valid keys match the %s, the key to sign with is ambiguous", criteria)
+		}
+		endTime, _ := time.Parse("20060102", end)
+		found = &Key{
+			Handle:  object,
+			ExpDate: endTime,
+		}
+	}
+	return found, nil
+}
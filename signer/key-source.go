@@ -0,0 +1,63 @@
+package signer
+
+import (
+	"github.com/miekg/dns"
+	"time"
+)
+
+// KeySource provides the key pairs signing a zone, so SignWithKeys can sign it with keys that are not in an HSM.
+// SoftSession (keys in memory) and FileKey (keys in PEM files) implement it.
+type KeySource interface {
+	// KeyPairs returns the ZSK and the KSK of the algorithm for the zone of args, with DNSKEYs of the zone
+	// (with the DNSKEY TTL of args), or an error if the source has no keys of the algorithm.
+	KeyPairs(args *SignArgs, alg *Algorithm) (zsk, ksk *KeyPair, err error)
+}
+
+// SignWithKeys parses the zone file, adds its NSEC or NSEC3 records, signs the zone with the key pairs of the source
+// for each algorithm of args and outputs the result into args.Output. It returns the DS of the KSK (of the first
+// algorithm, if there are many). If DryRun is true, it only plans the signature (use PlanSign to get the plan).
+// The zone can be provided as a zone file in args.File or as RRs in args.RRs, but not both.
+// If args.Stream is true, the zone file is signed and written name by name (see SignArgs.Stream).
+// If args.OfflineKSK is not empty, the KSKs of the source are not used.
+func SignWithKeys(args *SignArgs, source KeySource, log Logger) (ds *dns.DS, err error) {
+	log = orNop(log)
+	algs, err := args.signingAlgorithms()
+	if err != nil {
+		return nil, err
+	}
+	if args.DryRun {
+		_, err = PlanSign(args)
+		return nil, err
+	}
+	var stream *zoneStream
+	if args.Stream {
+		stream, err = newZoneStream(args, log)
+	} else {
+		err = prepareZone(args, log)
+	}
+	if err != nil {
+		return nil, err
+	}
+	zsks := make([]*KeyPair, 0, len(algs))
+	ksks := make([]*KeyPair, 0, len(algs))
+	for _, alg := range algs {
+		start := time.Now()
+		zsk, ksk, err := source.KeyPairs(args, alg)
+		if err != nil {
+			return nil, err
+		}
+		// The KSKs signing offline replace the ones of the source, which do not sign.
+		if len(args.OfflineKSK) > 0 {
+			if ksk, err = args.offlineKSK(alg); err != nil {
+				return nil, err
+			}
+		}
+		args.observe(StageKeygen, start)
+		zsks = append(zsks, zsk)
+		ksks = append(ksks, ksk)
+	}
+	if stream != nil {
+		return stream.sign(zsks, ksks)
+	}
+	return signRRs(args, zsks, ksks, log)
+}
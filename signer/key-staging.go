@@ -0,0 +1,276 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyInfo describes a key object stored in the HSM, as listed by ListKeys.
+type KeyInfo struct {
+	Handle    pkcs11.ObjectHandle // Handle of the key object
+	Private   bool                // If true, it is a private key. Otherwise, it is a public key
+	Label     string              // CKA_LABEL of the key
+	ID        []byte              // CKA_ID of the key
+	KeyType   uint                // CKA_KEY_TYPE of the key, as CKK_RSA or CKK_EC
+	StartDate time.Time           // CKA_START_DATE of the key (zero if it is not set)
+	EndDate   time.Time           // CKA_END_DATE of the key (zero if it is not set)
+}
+
+// Valid returns true if the key can be used to sign at the time provided. Keys without dates are always valid.
+func (info KeyInfo) Valid(now time.Time) bool {
+	day := now.Format("20060102")
+	return (info.StartDate.IsZero() || info.StartDate.Format("20060102") <= day) &&
+		(info.EndDate.IsZero() || day <= info.EndDate.Format("20060102"))
+}
+
+// GenerateKey creates a key pair of the algorithm in the HSM, with the label and ID provided and the security
+// attributes of the key template of the session, and returns its public key as a DNSKEY with the flags provided
+// (256 for a ZSK, 257 for a KSK), without signing anything. So the next keys of a rollover can be generated and
+// published in advance: Sign uses them later if their label and ID are the ones of the key template for the zone
+// and role of the key, or the ones of the key selector of the session. keySize is the size in bits of RSA keys,
+// and if it is zero, the default ZSK or KSK size of the algorithm is used. ECDSA and EdDSA curves have a fixed
+// size, so it must be zero or the size of the curve. The keys are valid for a year from today. The owner name of
+// the DNSKEY is the root and its TTL is zero, so they must be set to the zone and its DNSKEY TTL before publishing
+// it (the key tag does not depend on them).
+func (session *Session) GenerateKey(algorithm uint8, keySize int, flags uint16, label, id string) (*dns.DNSKEY, error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	alg, err := GetAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	dnskey, _, _, err := session.generateKey(alg, keySize, flags, label, id)
+	return dnskey, err
+}
+
+// generateKey generates a key pair as GenerateKey, returning the handles of its public and private keys too.
+func (session *Session) generateKey(alg *Algorithm, keySize int, flags uint16, label, id string) (*dns.DNSKEY, pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if flags&dns.ZONE == 0 {
+		return nil, 0, 0, fmt.Errorf("invalid DNSKEY flags %d: the zone key flag (256) is not set", flags)
+	}
+	if len(label) == 0 || len(id) == 0 {
+		return nil, 0, 0, fmt.Errorf("the label and the ID of the generated key cannot be empty")
+	}
+	if err := session.CheckAlgorithm(alg); err != nil {
+		return nil, 0, 0, err
+	}
+	var publicAttrs []*pkcs11.Attribute
+	if len(alg.ECParams) > 0 {
+		if keySize != 0 && keySize != alg.ZSKBits {
+			return nil, 0, 0, fmt.Errorf("algorithm %s uses %d bits keys, not %d", alg, alg.ZSKBits, keySize)
+		}
+		publicAttrs = ecAttributes(alg.ECParams)
+	} else {
+		if keySize == 0 {
+			keySize = alg.ZSKBits
+			if flags&dns.SEP != 0 {
+				keySize = alg.KSKBits
+			}
+		}
+		if err := session.CheckKeySize(alg, DigestHost, keySize); err != nil {
+			return nil, 0, 0, err
+		}
+		publicAttrs = rsaAttributes(keySize)
+	}
+	public, private, err := session.generateWithTemplate(session.keyTemplate(), alg.KeyGen, alg.KeyType, label, id, time.Now().AddDate(1, 0, 0), publicAttrs)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	keyBytes, err := session.getPublicKeyBytes(alg, public)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return CreateNewDNSKEY(".", flags, alg.Number, 0, base64.StdEncoding.EncodeToString(keyBytes)), public, private, nil
+}
+
+// ListKeys returns the public and private keys stored in the token, with any label, sorted by label, ID and
+// class (public keys first). It returns at most 1024 keys of each class, as FindObject.
+func (session *Session) ListKeys() ([]KeyInfo, error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	query := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, nil),
+	}
+	keys := make([]KeyInfo, 0)
+	for _, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_PRIVATE_KEY} {
+		objects, err := session.FindObject([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			session.countHSMCalls(1)
+			attr, err := session.Ctx.GetAttributeValue(session.Handle, object, query)
+			if err != nil {
+				return nil, fmt.Errorf("cannot get attributes: %s", err)
+			}
+			info := KeyInfo{
+				Handle:  object,
+				Private: class == pkcs11.CKO_PRIVATE_KEY,
+				Label:   string(attr[0].Value),
+				ID:      attr[1].Value,
+			}
+			if len(attr[2].Value) >= 4 {
+				info.KeyType = uint(binary.LittleEndian.Uint32(attr[2].Value))
+			}
+			info.StartDate, _ = time.Parse("20060102", string(attr[3].Value))
+			info.EndDate, _ = time.Parse("20060102", string(attr[4].Value))
+			keys = append(keys, info)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Label != keys[j].Label {
+			return keys[i].Label < keys[j].Label
+		}
+		if c := bytes.Compare(keys[i].ID, keys[j].ID); c != 0 {
+			return c < 0
+		}
+		return !keys[i].Private && keys[j].Private
+	})
+	return keys, nil
+}
+
+// String describes the key in logs and listings.
+func (info KeyInfo) String() string {
+	class := "public"
+	if info.Private {
+		class = "private"
+	}
+	return fmt.Sprintf("%s key with label %s and ID %x", class, info.Label, info.ID)
+}
+
+// KeyFilter selects the keys of the token destroyed by DestroyKeys. A key must match all the fields set, and at
+// least one must be set, so a filter cannot select every key of the token by mistake.
+type KeyFilter struct {
+	Label  string // CKA_LABEL of the keys
+	Zone   string // Zone of the keys: they have the label and the ZSK or KSK ID of the key template of the session for it, or the ID of the new ZSK of a rollover
+	Role   string // zsk or ksk: the keys have the ID of the key template for the role (and Zone, if it is set). The new ZSK of a rollover is a ZSK too
+	KeyTag uint16 // If not zero, the key tag of the DNSKEY of the public key, with the ZSK or KSK flags and any algorithm of its key type. Private keys match with the public key of their pair (with the same label and ID)
+}
+
+// empty returns true if no field of the filter is set.
+func (filter KeyFilter) empty() bool {
+	return len(filter.Label) == 0 && len(filter.Zone) == 0 && len(filter.Role) == 0 && filter.KeyTag == 0
+}
+
+// DestroyKeys destroys the public and private keys of the token selected by the filter, and returns them, as
+// listed by ListKeys. If dryRun is true, the keys are only returned, so the keys to destroy can be reviewed before.
+// Unlike DestroyAllKeys, it lets the keys of other zones or roles with the same label in the token. It returns an
+// error if the filter is empty or invalid, or if a key cannot be destroyed (the keys destroyed before are returned).
+func (session *Session) DestroyKeys(filter KeyFilter, dryRun bool) ([]KeyInfo, error) {
+	if filter.empty() {
+		return nil, fmt.Errorf("the key filter is empty, so it would select all the keys of the token")
+	}
+	keys, err := session.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	selected, err := session.filterKeys(keys, filter)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return selected, nil
+	}
+	for i, key := range selected {
+		session.logger().Info("Deleting key", "key", key)
+		session.countHSMCalls(1)
+		if err := session.Ctx.DestroyObject(session.Handle, key.Handle); err != nil {
+			return selected[:i], fmt.Errorf("cannot destroy %s: %s", key, err)
+		}
+	}
+	return selected, nil
+}
+
+// filterKeys returns the keys matching the filter (see KeyFilter), in the order provided.
+func (session *Session) filterKeys(keys []KeyInfo, filter KeyFilter) ([]KeyInfo, error) {
+	template := session.keyTemplate()
+	role := strings.ToLower(filter.Role)
+	roles := []string{"zsk", "ksk"}
+	switch role {
+	case "":
+	case "zsk", "ksk":
+		roles = []string{role}
+	default:
+		return nil, fmt.Errorf("unknown key role %s (it should be zsk or ksk)", filter.Role)
+	}
+	var zoneLabel string
+	ids := make(map[string]bool)
+	if len(filter.Zone) > 0 || len(role) > 0 {
+		if len(filter.Zone) == 0 && strings.Contains(template.ID, "{zone}") {
+			return nil, fmt.Errorf("the key IDs depend on the zone (%s), so keys cannot be selected by role without a zone", template.ID)
+		}
+		for _, r := range roles {
+			id := template.format(template.ID, session.Label, filter.Zone, r)
+			ids[id] = true
+			if r == "zsk" {
+				ids[id+"-next"] = true
+			}
+		}
+	}
+	if len(filter.Zone) > 0 {
+		zoneLabel = template.format(template.Label, session.Label, filter.Zone, "")
+	}
+	matches := func(key KeyInfo) bool {
+		return (len(filter.Label) == 0 || key.Label == filter.Label) &&
+			(len(zoneLabel) == 0 || key.Label == zoneLabel) &&
+			(len(ids) == 0 || ids[string(key.ID)])
+	}
+	// The private keys match the key tag if the public key of their pair does.
+	tagged := make(map[string]bool)
+	if filter.KeyTag != 0 {
+		for _, key := range keys {
+			if key.Private || !matches(key) {
+				continue
+			}
+			tags, err := session.keyTags(key)
+			if err != nil {
+				return nil, err
+			}
+			if tags[filter.KeyTag] {
+				tagged[key.Label+"\x00"+string(key.ID)] = true
+			}
+		}
+	}
+	selected := make([]KeyInfo, 0)
+	for _, key := range keys {
+		if matches(key) && (filter.KeyTag == 0 || tagged[key.Label+"\x00"+string(key.ID)]) {
+			selected = append(selected, key)
+		}
+	}
+	return selected, nil
+}
+
+// keyTags returns the key tags of the DNSKEYs of the public key with the ZSK and KSK flags and each algorithm of its
+// key type, because the token does not store the algorithm of the key. Keys of unsupported types have no key tags.
+func (session *Session) keyTags(key KeyInfo) (map[uint16]bool, error) {
+	tags := make(map[uint16]bool)
+	var keyBytes []byte
+	for _, alg := range algorithms {
+		if alg.KeyType != key.KeyType {
+			continue
+		}
+		if keyBytes == nil {
+			var err error
+			if keyBytes, err = session.getPublicKeyBytes(alg, key.Handle); err != nil {
+				return nil, fmt.Errorf("cannot get the public key of the %s: %s", key, err)
+			}
+		}
+		for _, flags := range []uint16{dns.ZONE, dns.ZONE | dns.SEP} {
+			tags[CreateNewDNSKEY(".", flags, alg.Number, 0, base64.StdEncoding.EncodeToString(keyBytes)).KeyTag()] = true
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,168 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+	"strings"
+	"time"
+)
+
+// KeyTemplate defines the attributes of the key pairs generated in the HSM, so they follow its security policy.
+// Label and ID are formats where {label} is replaced by the key label of the session, {zone} by the zone name
+// (lowercased, without the final dot) and, only in the ID, {role} by zsk or ksk. The keys are found by the same
+// label and ID, so the formats should not change after the keys of a zone are generated. DestroyAllKeys only
+// destroys the keys labeled with the key label of the session.
+type KeyTemplate struct {
+	Token       bool                `json:"token"`       // CKA_TOKEN: if false, the keys are destroyed when the session ends
+	Sensitive   bool                `json:"sensitive"`   // CKA_SENSITIVE of the private keys: their value cannot be read from the HSM
+	Extractable bool                `json:"extractable"` // CKA_EXTRACTABLE of the private keys: they can be wrapped and exported from the HSM
+	Label       string              `json:"label"`       // Format of the CKA_LABEL of the keys
+	ID          string              `json:"id"`          // Format of the CKA_ID of the keys
+	Attributes  []*pkcs11.Attribute `json:"-"`           // Other attributes of the private keys, as CKA_MODIFIABLE
+}
+
+// DefaultKeyTemplate generates persistent, sensitive and non extractable keys, labeled with the key label of the
+// session and identified by their role, as the keys generated by previous versions.
+var DefaultKeyTemplate = KeyTemplate{
+	Token:     true,
+	Sensitive: true,
+	Label:     "{label}",
+	ID:        "{role}",
+}
+
+// UnmarshalJSON decodes a key template, using the values of DefaultKeyTemplate for the fields not set.
+// Unknown fields are an error.
+func (template *KeyTemplate) UnmarshalJSON(data []byte) error {
+	type plain KeyTemplate // without the UnmarshalJSON method
+	decoded := plain(DefaultKeyTemplate)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+	*template = KeyTemplate(decoded)
+	return nil
+}
+
+// Validate returns an error if the label or the ID formats are empty, if the label format depends on the key
+// role (the keys of a zone are searched by label) or if the ID format does not, because the ZSK and the KSK would
+// be indistinguishable.
+func (template *KeyTemplate) Validate() error {
+	if len(template.Label) == 0 || len(template.ID) == 0 {
+		return fmt.Errorf("invalid key template: label and id cannot be empty")
+	}
+	if strings.Contains(template.Label, "{role}") {
+		return fmt.Errorf("invalid key template: label %s cannot contain {role}", template.Label)
+	}
+	if !strings.Contains(template.ID, "{role}") {
+		return fmt.Errorf("invalid key template: id %s does not contain {role}", template.ID)
+	}
+	return nil
+}
+
+// format replaces the placeholders of a label or ID format.
+func (template *KeyTemplate) format(format, label, zone, role string) string {
+	zone = strings.TrimSuffix(strings.ToLower(dns.Fqdn(zone)), ".")
+	return strings.NewReplacer("{label}", label, "{zone}", zone, "{role}", role).Replace(format)
+}
+
+// keyPairTemplates returns the public and private key templates of a key pair with the label and ID provided.
+// publicAttrs are the attributes of the public key specific to its key type, as its size or curve.
+func (template *KeyTemplate) keyPairTemplates(keyType uint, label, id string, expDate time.Time, publicAttrs []*pkcs11.Attribute) (public, private []*pkcs11.Attribute) {
+	today := time.Now()
+	public = []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, template.Token),
+		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, today),
+		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, expDate),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	public = append(public, publicAttrs...)
+	private = []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, template.Token),
+		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, today),
+		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, expDate),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, template.Sensitive),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, template.Extractable),
+	}
+	private = append(private, template.Attributes...)
+	return public, private
+}
+
+// keyTemplate returns the key template of the session, or DefaultKeyTemplate if it is not set.
+func (session *Session) keyTemplate() *KeyTemplate {
+	if session.KeyTemplate != nil {
+		return session.KeyTemplate
+	}
+	return &DefaultKeyTemplate
+}
+
+// generateWithTemplate generates a key pair with the key template, returning an error if the HSM rejects the
+// template or if the generated private key does not have the requested CKA_TOKEN, CKA_SENSITIVE and
+// CKA_EXTRACTABLE values. In that case, the key pair is destroyed.
+func (session *Session) generateWithTemplate(template *KeyTemplate, keyGen Mechanism, keyType uint, label, id string, expDate time.Time, publicAttrs []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if session == nil || session.Ctx == nil {
+		return 0, 0, fmt.Errorf("session not initialized")
+	}
+	publicTemplate, privateTemplate := template.keyPairTemplates(keyType, label, id, expDate, publicAttrs)
+	session.countHSMCalls(1)
+	pubKey, privKey, err := session.Ctx.GenerateKeyPair(
+		session.Handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(keyGen.Type, nil)},
+		publicTemplate,
+		privateTemplate,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot generate %s key pair with the key template: %s", id, err)
+	}
+	if err := session.checkKeyTemplate(template, privKey); err != nil {
+		for _, handle := range []pkcs11.ObjectHandle{pubKey, privKey} {
+			if e := session.Ctx.DestroyObject(session.Handle, handle); e != nil {
+				session.logger().Error("Cannot destroy key generated without the key template", "error", e)
+			}
+		}
+		return 0, 0, fmt.Errorf("%s key pair generated without the key template: %s", id, err)
+	}
+	return pubKey, privKey, nil
+}
+
+// checkKeyTemplate returns an error if the security attributes of the private key are not the ones of the
+// template, because some HSMs ignore the attributes they do not support instead of rejecting them.
+func (session *Session) checkKeyTemplate(template *KeyTemplate, privKey pkcs11.ObjectHandle) error {
+	expected := []struct {
+		attr  uint
+		name  string
+		value bool
+	}{
+		{pkcs11.CKA_TOKEN, "CKA_TOKEN", template.Token},
+		{pkcs11.CKA_SENSITIVE, "CKA_SENSITIVE", template.Sensitive},
+		{pkcs11.CKA_EXTRACTABLE, "CKA_EXTRACTABLE", template.Extractable},
+	}
+	query := make([]*pkcs11.Attribute, len(expected))
+	for i, e := range expected {
+		query[i] = pkcs11.NewAttribute(e.attr, nil)
+	}
+	session.countHSMCalls(1)
+	attrs, err := session.Ctx.GetAttributeValue(session.Handle, privKey, query)
+	if err != nil {
+		return fmt.Errorf("cannot get attributes: %s", err)
+	}
+	for i, e := range expected {
+		value := len(attrs[i].Value) > 0 && attrs[i].Value[0] != 0
+		if value != e.value {
+			return fmt.Errorf("%s is %t, but the template requires %t", e.name, value, e.value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package signer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is the logging interface used by the session and the verification.
+// Each message can be followed by key-value pairs with structured fields, as zone or key tag.
+// It can be implemented as an adapter to other logging libraries.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Level represents the verbosity of a StdLogger.
+type Level int
+
+const (
+	LevelDebug Level = iota // Logs everything, including per RRset and per key messages
+	LevelInfo               // Logs signing and verification progress
+	LevelWarn               // Logs only warnings and errors
+	LevelError              // Logs only errors
+)
+
+// levelNames are the names of the levels, as written by JSONLogger and read by ParseLevel.
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// String returns the name of the level.
+func (level Level) String() string {
+	if name, ok := levelNames[level]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(level))
+}
+
+// ParseLevel returns the level with the name provided (debug, info, warn or error).
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s (it should be debug, info, warn or error)", name)
+}
+
+// StdLogger is a Logger that writes into a standard library logger, ignoring the messages below its level.
+// Structured fields are written as key=value after the message. If the standard library logger is nil,
+// every message is discarded.
+type StdLogger struct {
+	Logger *log.Logger // Standard library logger
+	Level  Level       // Minimum level of the logged messages
+}
+
+// NewStdLogger returns a StdLogger that logs the messages with at least the level provided.
+func NewStdLogger(logger *log.Logger, level Level) *StdLogger {
+	return &StdLogger{
+		Logger: logger,
+		Level:  level,
+	}
+}
+
+// Debug logs a debug message.
+func (l *StdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, "", msg, keyvals)
+}
+
+// Info logs an informative message.
+func (l *StdLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, "", msg, keyvals)
+}
+
+// Warn logs a warning.
+func (l *StdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, "Warning: ", msg, keyvals)
+}
+
+// Error logs an error.
+func (l *StdLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, "Error: ", msg, keyvals)
+}
+
+func (l *StdLogger) log(level Level, prefix, msg string, keyvals []interface{}) {
+	if l == nil || l.Logger == nil || level < l.Level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+	l.Logger.Print(b.String())
+}
+
+// JSONLogger is a Logger that writes each message with at least its level as a JSON object in a line, so the
+// events of a signature (as the keys created, the progress of the RRsets signed and the signing latency) can be
+// sent to a log collector. The objects have the time (in RFC3339 format), the level and the message in the time,
+// level and msg fields, followed by the structured fields. Errors and values with a String method (as the RR types)
+// are written as strings. It can be used by many goroutines at the same time.
+type JSONLogger struct {
+	Writer io.Writer // Where the messages are written
+	Level  Level     // Minimum level of the logged messages
+	mutex  sync.Mutex
+}
+
+// NewJSONLogger returns a JSONLogger that writes the messages with at least the level provided into writer.
+func NewJSONLogger(writer io.Writer, level Level) *JSONLogger {
+	return &JSONLogger{
+		Writer: writer,
+		Level:  level,
+	}
+}
+
+// Debug logs a debug message.
+func (l *JSONLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info logs an informative message.
+func (l *JSONLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn logs a warning.
+func (l *JSONLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error logs an error.
+func (l *JSONLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *JSONLogger) log(level Level, msg string, keyvals []interface{}) {
+	if l == nil || l.Writer == nil || level < l.Level {
+		return
+	}
+	// The fields are written in order, so they are encoded one by one instead of as a map.
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"time":%s,"level":%s,"msg":%s`, jsonValue(time.Now().Format(time.RFC3339Nano)), jsonValue(level.String()), jsonValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := fmt.Sprint(keyvals[i]), interface{}(nil)
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, ",%s:%s", jsonValue(key), jsonValue(value))
+	}
+	b.WriteString("}\n")
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.Writer, b.String())
+}
+
+// jsonValue returns the JSON encoding of a field of a JSONLogger message. Errors and values with a String method
+// are encoded as strings, and the values that cannot be encoded, as their default format.
+func jsonValue(value interface{}) string {
+	switch x := value.(type) {
+	case error:
+		value = x.Error()
+	case fmt.Stringer:
+		value = x.String()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return string(encoded)
+}
+
+// newLogger returns the Logger used by the sessions and the verification for a standard library logger:
+// a StdLogger logging every level, or a nopLogger if it is nil, so callers not interested in the logs can pass nil.
+func newLogger(log *log.Logger) Logger {
+	if log == nil {
+		return nopLogger{}
+	}
+	return NewStdLogger(log, LevelDebug)
+}
+
+// orNop returns the logger, or a nopLogger if it is nil.
+func orNop(log Logger) Logger {
+	if log == nil {
+		return nopLogger{}
+	}
+	return log
+}
+
+// nopLogger is a Logger that discards every message.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
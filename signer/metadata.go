@@ -0,0 +1,142 @@
+package signer
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ZoneMetadata summarizes the DNSSEC data of a signed zone, so monitoring systems can check which keys signed it
+// and track its DS records and signature validity without parsing the zone.
+type ZoneMetadata struct {
+	Zone            string              `json:"zone"`                 // Zone name
+	Serial          uint32              `json:"serial"`               // SOA serial
+	Algorithms      []string            `json:"algorithms"`           // Algorithms of the DNSKEYs, sorted by number
+	Keys            []KeyMetadata       `json:"keys"`                 // DNSKEYs at the apex
+	DS              []DSMetadata        `json:"ds"`                   // DS records of the KSKs, with SHA-1 and SHA-256 digests
+	NSEC3Param      *NSEC3ParamMetadata `json:"nsec3param,omitempty"` // NSEC3 parameters, if the zone uses NSEC3
+	FirstInception  time.Time           `json:"first_inception"`      // Earliest RRSIG inception
+	FirstExpiration time.Time           `json:"first_expiration"`     // Earliest RRSIG expiration, when the zone must be signed again
+	LastExpiration  time.Time           `json:"last_expiration"`      // Latest RRSIG expiration
+	Records         map[string]int      `json:"records"`              // Number of records by type
+	TotalRecords    int                 `json:"total_records"`        // Number of records of the zone
+}
+
+// KeyMetadata describes a DNSKEY of the zone.
+type KeyMetadata struct {
+	Role      string `json:"role"`      // ksk (if its SEP flag is set) or zsk
+	KeyTag    uint16 `json:"key_tag"`   // Key tag (RFC4034 Appendix B)
+	Algorithm string `json:"algorithm"` // Algorithm name
+	Flags     uint16 `json:"flags"`     // DNSKEY flags
+}
+
+// DSMetadata describes a DS record of a KSK of the zone, to be published in the parent zone.
+type DSMetadata struct {
+	KeyTag     uint16 `json:"key_tag"`     // Key tag of the KSK
+	Algorithm  string `json:"algorithm"`   // Algorithm name
+	DigestType uint8  `json:"digest_type"` // 1 (SHA-1) or 2 (SHA-256)
+	Digest     string `json:"digest"`      // Digest in hex
+	Record     string `json:"record"`      // DS record in zone file format
+}
+
+// NSEC3ParamMetadata describes the NSEC3PARAM record of the zone.
+type NSEC3ParamMetadata struct {
+	Hash       uint8  `json:"hash"`       // Hash algorithm
+	Flags      uint8  `json:"flags"`      // Flags
+	Iterations uint16 `json:"iterations"` // Additional hash iterations
+	Salt       string `json:"salt"`       // Salt in hex, or - if it is empty
+}
+
+// SignedZoneMetadata returns the DNSSEC metadata of a signed zone. Its DNSKEYs, DS records and NSEC3 parameters
+// are the ones at the apex of the zone.
+func SignedZoneMetadata(zone string, rrs RRArray) *ZoneMetadata {
+	zone = dns.Fqdn(zone)
+	metadata := &ZoneMetadata{
+		Zone:       zone,
+		Algorithms: make([]string, 0),
+		Keys:       make([]KeyMetadata, 0),
+		DS:         make([]DSMetadata, 0),
+		Records:    make(map[string]int),
+	}
+	algorithms := make(map[uint8]bool)
+	for _, rr := range rrs {
+		metadata.Records[dns.Type(rr.Header().Rrtype).String()]++
+		metadata.TotalRecords++
+		apex := strings.EqualFold(rr.Header().Name, zone)
+		switch x := rr.(type) {
+		case *dns.SOA:
+			if apex {
+				metadata.Serial = x.Serial
+			}
+		case *dns.DNSKEY:
+			if !apex {
+				continue
+			}
+			algorithms[x.Algorithm] = true
+			role := "zsk"
+			if x.Flags&dns.SEP != 0 {
+				role = "ksk"
+				for _, digestType := range []uint8{dns.SHA1, dns.SHA256} {
+					if ds := x.ToDS(digestType); ds != nil {
+						metadata.DS = append(metadata.DS, DSMetadata{
+							KeyTag:     ds.KeyTag,
+							Algorithm:  algorithmName(ds.Algorithm),
+							DigestType: ds.DigestType,
+							Digest:     ds.Digest,
+							Record:     ds.String(),
+						})
+					}
+				}
+			}
+			metadata.Keys = append(metadata.Keys, KeyMetadata{
+				Role:      role,
+				KeyTag:    x.KeyTag(),
+				Algorithm: algorithmName(x.Algorithm),
+				Flags:     x.Flags,
+			})
+		case *dns.NSEC3PARAM:
+			if apex {
+				metadata.NSEC3Param = &NSEC3ParamMetadata{
+					Hash:       x.Hash,
+					Flags:      x.Flags,
+					Iterations: x.Iterations,
+					Salt:       x.Salt,
+				}
+				if len(x.Salt) == 0 {
+					metadata.NSEC3Param.Salt = "-"
+				}
+			}
+		case *dns.RRSIG:
+			inception := time.Unix(int64(x.Inception), 0).UTC()
+			expiration := time.Unix(int64(x.Expiration), 0).UTC()
+			if metadata.FirstInception.IsZero() || inception.Before(metadata.FirstInception) {
+				metadata.FirstInception = inception
+			}
+			if metadata.FirstExpiration.IsZero() || expiration.Before(metadata.FirstExpiration) {
+				metadata.FirstExpiration = expiration
+			}
+			if expiration.After(metadata.LastExpiration) {
+				metadata.LastExpiration = expiration
+			}
+		}
+	}
+	numbers := make([]int, 0, len(algorithms))
+	for number := range algorithms {
+		numbers = append(numbers, int(number))
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		metadata.Algorithms = append(metadata.Algorithms, algorithmName(uint8(number)))
+	}
+	return metadata
+}
+
+// WriteJSON writes the metadata into writer as indented JSON.
+func (metadata *ZoneMetadata) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(metadata)
+}
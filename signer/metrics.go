@@ -0,0 +1,44 @@
+package signer
+
+import "time"
+
+// Stages of a signature observed by Metrics.
+const (
+	StageParse       = "parse"        // Reading and parsing the zone, updating its serial and validating it
+	StageClassify    = "classify"     // Grouping the RRs in RRsets and selecting the authoritative ones to sign
+	StageKeygen      = "keygen"       // Searching the keys in the HSM, or generating them
+	StageSignRRsets  = "sign-rrsets"  // Signing the RRsets and the DNSKEY RRset, and checking the signatures
+	StageBuildDenial = "build-denial" // Building the NSEC or NSEC3 chain
+	StageSerialize   = "serialize"    // Sorting the signed zone, checking its coverage and response sizes, and writing it
+)
+
+// Metrics receives the durations of the stages of a signature and the number of PKCS#11 calls it makes,
+// so they can be exported to a monitoring system (as Prometheus histograms and counters).
+// Its methods are called from the signing goroutine, while the signature is in progress. With SignArgs.Concurrency,
+// IncHSMCalls is called from the goroutines signing the RRsets too, but from one at a time.
+type Metrics interface {
+	ObserveDuration(stage string, d time.Duration) // Called when a stage (one of the Stage constants) ends
+	IncHSMCalls(n int)                             // Called with the number of PKCS#11 calls made by the session
+}
+
+// observe reports the time elapsed since start as the duration of the stage, if args.Metrics is set.
+func (args *SignArgs) observe(stage string, start time.Time) {
+	if args.Metrics != nil {
+		args.Metrics.ObserveDuration(stage, time.Since(start))
+	}
+}
+
+// countHSMCalls reports PKCS#11 calls made by the session, if it is signing with Metrics.
+func (session *Session) countHSMCalls(n int) {
+	if session.metrics != nil {
+		session.metrics.IncHSMCalls(n)
+	}
+}
+
+// observeSignature reports the time elapsed since start as the latency of an HSM signature, if the session is
+// signing with Metrics that implement SignatureMetrics.
+func (session *Session) observeSignature(start time.Time) {
+	if metrics, ok := session.metrics.(SignatureMetrics); ok {
+		metrics.ObserveHSMSignature(time.Since(start))
+	}
+}
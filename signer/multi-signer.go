@@ -0,0 +1,72 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// keepForeignSignatures keeps the RRSIGs of args.RRs in args.foreignSigs if args.MultiSigner is true, before
+// removeDNSSECRecords removes them, so the ones made by the other signers of the zone are added to the signed zone.
+func (args *SignArgs) keepForeignSignatures() {
+	args.foreignSigs = nil
+	if !args.MultiSigner {
+		return
+	}
+	for _, rr := range args.RRs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			args.foreignSigs = append(args.foreignSigs, rr)
+		}
+	}
+}
+
+// foreignSignatures returns the RRSIGs of the zone made by other signers (RFC8901 Model 2) that are still valid
+// for the RRsets of the signed zone, sets and dnskeys. The RRSIGs made by the keys of the signer are left out,
+// because the RRsets are signed again with them, and so are the RRSIGs that do not verify with a DNSKEY
+// of the signed zone, as the ones covering RRsets changed by the signer (like the SOA with a new serial).
+func (args *SignArgs) foreignSignatures(sets RRSet, dnskeys RRArray, ownKeys []*dns.DNSKEY, log Logger) RRArray {
+	if len(args.foreignSigs) == 0 {
+		return nil
+	}
+	rrSets := make(map[string]RRArray, len(sets)+1)
+	for _, set := range sets {
+		rrSets[rrSetKey(set[0].Header().Name, set[0].Header().Rrtype)] = set
+	}
+	rrSets[rrSetKey(dnskeys[0].Header().Name, dns.TypeDNSKEY)] = dnskeys
+	keys := make([]*dns.DNSKEY, 0, len(dnskeys))
+	for _, rr := range dnskeys {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	now := time.Now()
+	sigs := make(RRArray, 0, len(args.foreignSigs))
+	dropped := 0
+	for _, rr := range args.foreignSigs {
+		sig := rr.(*dns.RRSIG)
+		if signingKey(ownKeys, sig) != nil {
+			continue
+		}
+		valid := fmt.Errorf("it covers no RRset of the signed zone")
+		if set, ok := rrSets[rrSetKey(sig.Header().Name, sig.TypeCovered)]; ok {
+			if key := signingKey(keys, sig); key == nil {
+				valid = fmt.Errorf("no DNSKEY with key tag %d", sig.KeyTag)
+			} else if !sig.ValidityPeriod(now) {
+				valid = fmt.Errorf("it is not in its validity period")
+			} else {
+				valid = sig.Verify(key, set)
+			}
+		}
+		if valid != nil {
+			log.Warn("removed the RRSIG of another signer", "name", sig.Header().Name, "type", dns.Type(sig.TypeCovered), "keytag", sig.KeyTag, "error", valid)
+			dropped++
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	log.Info("kept the RRSIGs of the other signers of the zone", "zone", args.Zone, "records", len(sigs), "removed", dropped)
+	return sigs
+}
+
+// rrSetKey identifies an RRset by its owner name and type, ignoring the case of the name.
+func rrSetKey(name string, rrType uint16) string {
+	return fmt.Sprintf("%s#%d", dns.CanonicalName(name), rrType)
+}
@@ -0,0 +1,109 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// OutOfZonePolicy defines what the signer does with the records whose owner name is not in the zone.
+type OutOfZonePolicy int
+
+const (
+	OutOfZoneError OutOfZonePolicy = iota // The signature fails
+	OutOfZoneDrop                         // The records are removed from the zone, logging a warning
+)
+
+// ParseOutOfZonePolicy returns the out-of-zone policy with the name provided (error or drop).
+func ParseOutOfZonePolicy(name string) (OutOfZonePolicy, error) {
+	switch strings.ToLower(name) {
+	case "error":
+		return OutOfZoneError, nil
+	case "drop":
+		return OutOfZoneDrop, nil
+	default:
+		return OutOfZoneError, fmt.Errorf("unknown out-of-zone policy %s (it should be error or drop)", name)
+	}
+}
+
+// String returns the name of the out-of-zone policy.
+func (policy OutOfZonePolicy) String() string {
+	if policy == OutOfZoneDrop {
+		return "drop"
+	}
+	return "error"
+}
+
+// OutOfZone returns the RRs of the array whose owner name is not the zone apex or a name below it.
+func (rrArray RRArray) OutOfZone(zone string) RRArray {
+	zone = dns.Fqdn(zone)
+	rrs := make(RRArray, 0)
+	for _, rr := range rrArray {
+		if !dns.IsSubDomain(zone, dns.Fqdn(rr.Header().Name)) {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// RemoveOccluded returns a new RRArray with the RRs of the array, excluding the ones occluded by a delegation
+// (RFC5936 3.5): the records below a delegation point, and the ones at it other than NS, DS and NSEC (and their
+// RRSIGs). Glue records (A and AAAA records at the target of an NS record) are kept, because the delegations
+// need them. Occluded records are never served by the zone, so they must not be signed nor be in its chain.
+func (rrArray RRArray) RemoveOccluded(zone string) RRArray {
+	nsNames := getAllNSNames(rrArray)
+	targets := make(map[string]bool)
+	for _, rr := range rrArray {
+		if ns, ok := rr.(*dns.NS); ok {
+			targets[strings.ToLower(dns.Fqdn(ns.Ns))] = true
+		}
+	}
+	rrs := make(RRArray, 0, len(rrArray))
+	for _, rr := range rrArray {
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		point := delegationPoint(name, zone, nsNames)
+		rrType := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrType = sig.TypeCovered
+		}
+		switch {
+		case point == "":
+		case (rrType == dns.TypeA || rrType == dns.TypeAAAA) && targets[name]:
+		case point == name && (rrType == dns.TypeNS || rrType == dns.TypeDS || rrType == dns.TypeNSEC):
+		default:
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// removeOutOfZone removes from args.RRs the records that are not in the zone, following args.OutOfZone, and logs
+// a warning if the zone has records occluded by its delegations (see RRArray.RemoveOccluded). The occluded records
+// are kept in the output, as in the zone files loaded by name servers, but they are never signed nor covered by the
+// chain, because CreateRRSet leaves them out. Out-of-zone records cannot be dropped if the text of the zone is
+// preserved, because they would still be in the output.
+func (args *SignArgs) removeOutOfZone(log Logger) error {
+	if outside := args.RRs.OutOfZone(args.Zone); len(outside) > 0 {
+		if args.OutOfZone != OutOfZoneDrop {
+			return fmt.Errorf("zone %s has %d records out of the zone, as %s (use the drop out-of-zone policy to remove them)", args.Zone, len(outside), outside[0].Header().Name)
+		}
+		if args.PreserveText {
+			return fmt.Errorf("the text of zone %s cannot be preserved without its %d records out of the zone", args.Zone, len(outside))
+		}
+		for _, rr := range outside {
+			log.Warn("removed a record out of the zone", "zone", args.Zone, "name", rr.Header().Name, "type", dns.Type(rr.Header().Rrtype))
+		}
+		rrs := make(RRArray, 0, len(args.RRs)-len(outside))
+		for _, rr := range args.RRs {
+			if dns.IsSubDomain(args.Zone, dns.Fqdn(rr.Header().Name)) {
+				rrs = append(rrs, rr)
+			}
+		}
+		args.RRs = rrs
+	}
+	if occluded := len(args.RRs) - len(args.RRs.RemoveOccluded(args.Zone)); occluded > 0 {
+		log.Warn("the zone has records occluded by delegations, they are not signed nor in the chain", "zone", args.Zone, "records", occluded)
+	}
+	return nil
+}
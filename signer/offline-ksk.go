@@ -0,0 +1,150 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"strings"
+	"time"
+)
+
+// ReadOfflineKSK reads the DNSKEY RRset of the zone and its RRSIGs made by the KSKs from a zone file, as the ones
+// returned by a KSK signing ceremony when the KSKs are kept offline (as the signed key responses of the root zone),
+// so they can be published with SignArgs.OfflineKSK. It returns an error if the file has other records, or if it has
+// no DNSKEY or RRSIG records.
+func ReadOfflineKSK(zone string, r io.Reader) (RRArray, error) {
+	zone = dns.Fqdn(zone)
+	parser := dns.NewZoneParser(r, zone, "")
+	rrs := make(RRArray, 0)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse the offline DNSKEY RRset of zone %s: %s", zone, err)
+	}
+	if _, _, err := splitOfflineKSK(zone, rrs); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// splitOfflineKSK returns the DNSKEYs and the RRSIGs of the offline DNSKEY RRset of the zone. It returns an error if
+// the RRs have other records or records out of the apex, or if they have no DNSKEY or RRSIG records.
+func splitOfflineKSK(zone string, rrs RRArray) (RRArray, []*dns.RRSIG, error) {
+	keys := make(RRArray, 0, len(rrs))
+	sigs := make([]*dns.RRSIG, 0, len(rrs))
+	for _, rr := range rrs {
+		if !strings.EqualFold(dns.Fqdn(rr.Header().Name), zone) {
+			return nil, nil, fmt.Errorf("the offline DNSKEY RRset of zone %s has a record of %s, out of the apex", zone, rr.Header().Name)
+		}
+		switch x := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, x)
+		case *dns.RRSIG:
+			if x.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, x)
+				continue
+			}
+			return nil, nil, fmt.Errorf("the offline DNSKEY RRset of zone %s has an RRSIG covering %s, but it can only cover DNSKEY", zone, dns.Type(x.TypeCovered))
+		default:
+			return nil, nil, fmt.Errorf("the offline DNSKEY RRset of zone %s has a %s record, but it can only have DNSKEY and RRSIG records", zone, dns.Type(rr.Header().Rrtype))
+		}
+	}
+	if len(keys) == 0 || len(sigs) == 0 {
+		return nil, nil, fmt.Errorf("the offline DNSKEY RRset of zone %s needs DNSKEY and RRSIG records, but it has %d and %d", zone, len(keys), len(sigs))
+	}
+	return keys, sigs, nil
+}
+
+// offlineKSK returns the KSK of the algorithm in args.OfflineKSK: a key pair without a private key, because it is
+// only used for its DNSKEY. It is the first DNSKEY with the SEP flag of the algorithm signing the RRset.
+func (args *SignArgs) offlineKSK(alg *Algorithm) (*KeyPair, error) {
+	keys, sigs, err := splitOfflineKSK(args.Zone, args.OfflineKSK)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range keys {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.SEP == 0 || key.Algorithm != alg.Number {
+			continue
+		}
+		for _, sig := range sigs {
+			if sig.KeyTag == key.KeyTag() && sig.Algorithm == key.Algorithm {
+				return &KeyPair{DNSKEY: key}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("the offline DNSKEY RRset of zone %s is not signed by a KSK of algorithm %s", args.Zone, alg)
+}
+
+// offlineDNSKEYs returns the DNSKEY RRset in args.OfflineKSK and its RRSIGs, to publish them instead of signing the
+// RRset with the KSKs. The RRset must have the DNSKEYs of the ZSKs, and it must have an RRSIG of each KSK valid now.
+// The RRSIGs out of their validity period (as the ones of other periods of a signed key response) are left out,
+// and the ones that do not verify are an error.
+func (args *SignArgs) offlineDNSKEYs(zsks, ksks []*KeyPair, log Logger) (RRArray, RRArray, error) {
+	keys, sigs, err := splitOfflineKSK(args.Zone, args.OfflineKSK)
+	if err != nil {
+		return nil, nil, err
+	}
+	set := make(RRArray, 0, len(keys))
+	dnskeys := make([]*dns.DNSKEY, 0, len(keys))
+	for _, rr := range keys {
+		key := dns.Copy(rr).(*dns.DNSKEY)
+		set = append(set, key)
+		dnskeys = append(dnskeys, key)
+	}
+	set.sortCanonical()
+	for _, zsk := range zsks {
+		found := false
+		for _, key := range dnskeys {
+			found = found || dns.IsDuplicate(key, zsk.DNSKEY)
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("the offline DNSKEY RRset of zone %s does not have the ZSK %d, so its signatures could not be validated", args.Zone, zsk.DNSKEY.KeyTag())
+		}
+	}
+	now := time.Now()
+	valid := make(RRArray, 0, len(sigs))
+	for _, sig := range sigs {
+		key := signingKey(dnskeys, sig)
+		if key == nil {
+			return nil, nil, fmt.Errorf("the offline RRSIG of the DNSKEY RRset of zone %s is made by key %d, which is not in the RRset", args.Zone, sig.KeyTag)
+		}
+		if !sig.ValidityPeriod(now) {
+			log.Warn("offline RRSIG of the DNSKEY RRset left out, because it is not in its validity period", "zone", args.Zone, "keytag", sig.KeyTag, "inception", dns.TimeToString(sig.Inception), "expiration", dns.TimeToString(sig.Expiration))
+			continue
+		}
+		if err := sig.Verify(key, set); err != nil {
+			return nil, nil, fmt.Errorf("the offline RRSIG of the DNSKEY RRset of zone %s by key %d does not verify: %s", args.Zone, sig.KeyTag, err)
+		}
+		valid = append(valid, sig)
+	}
+	for _, ksk := range ksks {
+		found := false
+		for _, rr := range valid {
+			sig := rr.(*dns.RRSIG)
+			found = found || sig.KeyTag == ksk.DNSKEY.KeyTag() && sig.Algorithm == ksk.DNSKEY.Algorithm
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("the offline DNSKEY RRset of zone %s has no RRSIG of the KSK %d valid now", args.Zone, ksk.DNSKEY.KeyTag())
+		}
+	}
+	return set, valid, nil
+}
+
+// sameSignatures returns true if both arrays have the same RRSIGs, whatever their order.
+func sameSignatures(kept []*dns.RRSIG, sigs RRArray) bool {
+	if len(kept) != len(sigs) {
+		return false
+	}
+	for _, rr := range sigs {
+		found := false
+		for _, sig := range kept {
+			found = found || dns.IsDuplicate(sig, rr)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
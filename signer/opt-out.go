@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// CheckSecureDelegations returns an error if a secure delegation of the zone (a delegation point with DS records)
+// has no NSEC3 record in the chain. Opt-Out only leaves the insecure delegations out of the chain (RFC5155 6),
+// because the NSEC3 of a secure delegation proves that its DS RRset exists (or the type bitmap of its name),
+// and without it the validators cannot trust the delegated zone. The names are hashed with the parameters
+// of the NSEC3PARAM at the apex of the zone. It returns nil if the zone has no NSEC3PARAM.
+func (rrArray RRArray) CheckSecureDelegations(zone string) error {
+	zone = dns.Fqdn(zone)
+	var param *dns.NSEC3PARAM
+	owners := make(map[string]bool)
+	for _, rr := range rrArray {
+		switch x := rr.(type) {
+		case *dns.NSEC3PARAM:
+			if strings.EqualFold(x.Hdr.Name, zone) {
+				param = x
+			}
+		case *dns.NSEC3:
+			owners[strings.ToLower(dns.Fqdn(x.Hdr.Name))] = true
+		}
+	}
+	if param == nil {
+		return nil
+	}
+	nsNames := getAllNSNames(rrArray)
+	missing := make([]string, 0)
+	checked := make(map[string]bool)
+	for _, rr := range rrArray {
+		if rr.Header().Rrtype != dns.TypeDS {
+			continue
+		}
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		if checked[name] || delegationPoint(name, zone, nsNames) != name {
+			continue
+		}
+		checked[name] = true
+		owner := strings.ToLower(dns.HashName(name, param.Hash, param.Iterations, param.Salt)) + "." + strings.ToLower(zone)
+		if !owners[owner] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the NSEC3 chain of zone %s has no records for %d secure delegations, as %s", zone, len(missing), missing[0])
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// OutputOrder defines the order of the records in the signed zone file.
+type OutputOrder int
+
+const (
+	OrderCanonical OutputOrder = iota // Records sorted by owner name in canonical order and by type, as RRArray sorts them
+	OrderBIND                         // Records in the layout of the signed zones written by BIND's named-compilezone (see RRArray.SortBIND)
+)
+
+// ParseOutputOrder returns the output order with the name provided: canonical or bind.
+func ParseOutputOrder(name string) (OutputOrder, error) {
+	switch strings.ToLower(name) {
+	case "canonical":
+		return OrderCanonical, nil
+	case "bind":
+		return OrderBIND, nil
+	default:
+		return OrderCanonical, fmt.Errorf("unknown output order %s (it should be canonical or bind)", name)
+	}
+}
+
+// String returns the name of the output order.
+func (order OutputOrder) String() string {
+	if order == OrderBIND {
+		return "bind"
+	}
+	return "canonical"
+}
+
+// ordered returns the RRs sorted in the order provided. The RRArray is not modified.
+func (rrArray RRArray) ordered(order OutputOrder) RRArray {
+	if order != OrderBIND {
+		return rrArray
+	}
+	rrs := make(RRArray, len(rrArray))
+	copy(rrs, rrArray)
+	rrs.SortBIND()
+	return rrs
+}
+
+// SortBIND sorts the RRArray in the layout of the signed zones written by BIND's named-compilezone:
+// the owner names in canonical order, with the NSEC3 records and their RRSIGs after all the other names,
+// in the order of their hashes. At each name, the SOA RRset is first, the NS RRset second and the other RRsets
+// follow in type order, each one followed by its RRSIGs (sorted by algorithm and key tag). The RRs of an RRset
+// are sorted by their RDATA in wire format.
+func (rrArray RRArray) SortBIND() {
+	keys := make(map[dns.RR][]byte, len(rrArray))
+	for _, rr := range rrArray {
+		if _, ok := rr.(*dns.RRSIG); !ok {
+			keys[rr] = rdataWire(rr)
+		}
+	}
+	sort.SliceStable(rrArray, func(i, j int) bool {
+		a, b := rrArray[i], rrArray[j]
+		if na, nb := isNSEC3Record(a), isNSEC3Record(b); na != nb {
+			return nb
+		}
+		if cmp := CompareNames(a.Header().Name, b.Header().Name); cmp != 0 {
+			return cmp < 0
+		}
+		if oa, ob := bindTypeOrder(a), bindTypeOrder(b); oa != ob {
+			return oa < ob
+		}
+		if a.Header().Class != b.Header().Class {
+			return a.Header().Class < b.Header().Class
+		}
+		sigA, okA := a.(*dns.RRSIG)
+		sigB, okB := b.(*dns.RRSIG)
+		if okA && okB {
+			if sigA.Algorithm != sigB.Algorithm {
+				return sigA.Algorithm < sigB.Algorithm
+			}
+			return sigA.KeyTag < sigB.KeyTag
+		}
+		return bytes.Compare(keys[a], keys[b]) < 0
+	})
+}
+
+// isNSEC3Record returns true if the RR is an NSEC3 record or its RRSIG.
+func isNSEC3Record(rr dns.RR) bool {
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		return sig.TypeCovered == dns.TypeNSEC3
+	}
+	return rr.Header().Rrtype == dns.TypeNSEC3
+}
+
+// bindTypeOrder returns the position of an RR at its name in the BIND layout: SOA first, NS second, the other types
+// after them, and every RRSIG right after the type it covers (as dump_order in BIND's masterdump.c).
+func bindTypeOrder(rr dns.RR) int {
+	rrType, sig := rr.Header().Rrtype, 0
+	if x, ok := rr.(*dns.RRSIG); ok {
+		rrType, sig = x.TypeCovered, 1
+	}
+	order := int(rrType) + 2
+	switch rrType {
+	case dns.TypeSOA:
+		order = 0
+	case dns.TypeNS:
+		order = 1
+	}
+	return order<<1 + sig
+}
+
+// rdataWire returns the RDATA of the RR in wire format, or nil if it cannot be packed.
+func rdataWire(rr dns.RR) []byte {
+	_, rdata, err := packRR(rr)
+	if err != nil {
+		return nil
+	}
+	return rdata
+}
@@ -0,0 +1,93 @@
+package signer
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PINProvider returns the user PIN of the HSM when a session is opened, so it does not have to be passed on the
+// command line, where it would end up in the shell history and in the process listings.
+type PINProvider interface {
+	PIN() (string, error)
+}
+
+// StaticPIN is a PIN known beforehand, as the one of a test token.
+type StaticPIN string
+
+// PIN returns the PIN.
+func (pin StaticPIN) PIN() (string, error) {
+	return string(pin), nil
+}
+
+// EnvPIN is the name of an environment variable with the PIN.
+type EnvPIN string
+
+// PIN returns the value of the variable, or an error if it is not set.
+func (env EnvPIN) PIN() (string, error) {
+	pin, ok := os.LookupEnv(string(env))
+	if !ok {
+		return "", fmt.Errorf("PIN environment variable %s is not set", string(env))
+	}
+	return pin, nil
+}
+
+// FilePIN is the path of a file with the PIN, which should only be readable by the user running the signer.
+type FilePIN string
+
+// PIN returns the contents of the file, without its trailing whitespace (as the newline added by editors).
+func (path FilePIN) PIN() (string, error) {
+	pin, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return "", fmt.Errorf("cannot read PIN file: %s", err)
+	}
+	return strings.TrimRight(string(pin), " \t\r\n"), nil
+}
+
+// PromptPIN asks the PIN to the user. If the input is a terminal the PIN is read without echo, and otherwise
+// (as when it is piped to the command) its first line is read.
+type PromptPIN struct {
+	Prompt string    // Message written before reading the PIN. If empty, "HSM user PIN: " is used.
+	Input  *os.File  // Where the PIN is read from. If nil, os.Stdin is used.
+	Output io.Writer // Where the prompt is written. If nil, os.Stderr is used, so it is not mixed with the output of the command.
+}
+
+// PIN writes the prompt and reads the PIN. It returns an error if the PIN is empty.
+func (prompt *PromptPIN) PIN() (string, error) {
+	input, output := prompt.Input, prompt.Output
+	if input == nil {
+		input = os.Stdin
+	}
+	if output == nil {
+		output = os.Stderr
+	}
+	message := prompt.Prompt
+	if len(message) == 0 {
+		message = "HSM user PIN: "
+	}
+	fmt.Fprint(output, message)
+	var pin string
+	if fd := int(input.Fd()); terminal.IsTerminal(fd) {
+		read, err := terminal.ReadPassword(fd)
+		// The newline typed by the user is not echoed either.
+		fmt.Fprintln(output)
+		if err != nil {
+			return "", fmt.Errorf("cannot read PIN: %s", err)
+		}
+		pin = string(read)
+	} else {
+		line, err := bufio.NewReader(input).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("cannot read PIN: %s", err)
+		}
+		pin = strings.TrimRight(line, "\r\n")
+	}
+	if len(pin) == 0 {
+		return "", fmt.Errorf("cannot read PIN: no PIN entered")
+	}
+	return pin, nil
+}
@@ -0,0 +1,67 @@
+package signer
+
+import (
+	"github.com/miekg/dns"
+	"sort"
+)
+
+// SignPlan summarizes what a signing process would do with a zone, without using any key.
+type SignPlan struct {
+	Zone          string   // Zone name
+	RRSets        int      // Number of RRsets that would be signed (NSEC/NSEC3 RRsets included)
+	Skipped       []string // Delegation and glue names, which are not signed
+	Types         []string // Record types present in the zone
+	NSEC3         bool     // If true, the zone uses NSEC3 instead of NSEC
+	OptOut        bool     // If true, the NSEC3 records use the OptOut flag
+	DenialRecords int      // Number of NSEC or NSEC3 records added to the zone
+	RRSigs        int      // Number of RRSIGs that would be created (DNSKEY RRset included), one per RRset and algorithm
+}
+
+// PlanSign reads and parses the zone in args.File (or takes it from args.RRs) and adds its NSEC or NSEC3 records,
+// returning a summary of what would be signed. It does not use any PKCS#11 operation.
+func PlanSign(args *SignArgs) (*SignPlan, error) {
+	algs, err := args.signingAlgorithms()
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareZone(args, nopLogger{}); err != nil {
+		return nil, err
+	}
+	plan := &SignPlan{
+		Zone:   args.Zone,
+		NSEC3:  args.NSEC3,
+		OptOut: args.NSEC3 && args.OptOut,
+	}
+	nsNames := getAllNSNames(args.RRs)
+	skipped := make(map[string]bool)
+	types := make(map[uint16]bool)
+	for _, rr := range args.RRs {
+		types[rr.Header().Rrtype] = true
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			plan.DenialRecords++
+		}
+		if !isSignable(rr, args.Zone, nsNames) {
+			name := dns.Fqdn(rr.Header().Name)
+			if !skipped[name] {
+				skipped[name] = true
+				plan.Skipped = append(plan.Skipped, name)
+			}
+		}
+	}
+	// The DNSKEY RRset is added and signed after planning.
+	types[dns.TypeDNSKEY] = true
+	typeArray := make([]uint16, 0)
+	for k := range types {
+		typeArray = append(typeArray, k)
+	}
+	sort.Slice(typeArray, func(i, j int) bool {
+		return typeArray[i] < typeArray[j]
+	})
+	for _, t := range typeArray {
+		plan.Types = append(plan.Types, dns.Type(t).String())
+	}
+	plan.RRSets = len(args.RRs.CreateRRSet(args.Zone, true)) + 1
+	plan.RRSigs = plan.RRSets * len(algs)
+	return plan, nil
+}
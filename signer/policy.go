@@ -0,0 +1,144 @@
+package signer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"math/big"
+	"sort"
+)
+
+// Severity indicates how serious a policy violation is.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota // The zone works, but it should be changed
+	SeverityError                   // The zone should not be published
+)
+
+// String returns the name of the severity.
+func (severity Severity) String() string {
+	if severity == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Policy defines the algorithms and parameters accepted in a signed zone, beyond its signatures being valid.
+type Policy struct {
+	DeprecatedAlgorithms []uint8 // DNSKEY algorithms that must not be used. Their use is an error.
+	MinRSABits           int     // Minimum size of RSA keys. Smaller keys are warnings. If zero, key sizes are not checked.
+	MaxNSEC3Iterations   uint16  // Maximum NSEC3 iterations. More iterations are warnings.
+}
+
+// DefaultPolicy rejects the algorithms that must not be used for signing (RFC8624 3.1), warns about RSA keys
+// smaller than 2048 bits and about NSEC3 with more than 100 iterations, which validators may treat as insecure (RFC9276 3.2).
+var DefaultPolicy = Policy{
+	DeprecatedAlgorithms: []uint8{dns.RSAMD5, dns.DSA, dns.RSASHA1, dns.DSANSEC3SHA1, dns.RSASHA1NSEC3SHA1, dns.ECCGOST},
+	MinRSABits:           2048,
+	MaxNSEC3Iterations:   100,
+}
+
+// Violation is a policy problem found in a zone.
+type Violation struct {
+	Severity Severity // Severity of the problem
+	Name     string   // Owner name of the record with the problem
+	Message  string   // Description of the problem
+}
+
+// String returns the violation as "severity: name: message".
+func (violation Violation) String() string {
+	return fmt.Sprintf("%s: %s: %s", violation.Severity, violation.Name, violation.Message)
+}
+
+// CheckPolicy inspects the DNSKEY, NSEC3 and NSEC3PARAM records of a zone and returns the violations of the policy
+// provided. Its checks are independent of the verification of the zone: a zone can have valid signatures and
+// still violate the policy. Each different violation is reported once, even if many records have it.
+func CheckPolicy(rrs RRArray, policy Policy) []Violation {
+	deprecated := make(map[uint8]bool)
+	for _, alg := range policy.DeprecatedAlgorithms {
+		deprecated[alg] = true
+	}
+	violations := make([]Violation, 0)
+	reported := make(map[Violation]bool)
+	report := func(severity Severity, name, format string, a ...interface{}) {
+		violation := Violation{Severity: severity, Name: name, Message: fmt.Sprintf(format, a...)}
+		if !reported[violation] {
+			reported[violation] = true
+			violations = append(violations, violation)
+		}
+	}
+	checkIterations := func(name string, iterations uint16) {
+		if iterations > policy.MaxNSEC3Iterations {
+			report(SeverityWarning, name, "NSEC3 uses %d iterations, more than the maximum of %d", iterations, policy.MaxNSEC3Iterations)
+		}
+	}
+	for _, rr := range rrs {
+		name := rr.Header().Name
+		switch r := rr.(type) {
+		case *dns.DNSKEY:
+			if deprecated[r.Algorithm] {
+				report(SeverityError, name, "DNSKEY %d uses the deprecated algorithm %s (%d)", r.KeyTag(), algorithmName(r.Algorithm), r.Algorithm)
+			}
+			if policy.MinRSABits > 0 && isRSA(r.Algorithm) {
+				bits, err := rsaKeyBits(r)
+				if err != nil {
+					report(SeverityError, name, "DNSKEY %d has an invalid RSA public key: %s", r.KeyTag(), err)
+				} else if bits < policy.MinRSABits {
+					report(SeverityWarning, name, "DNSKEY %d has a %d bit RSA key, smaller than the minimum of %d bits", r.KeyTag(), bits, policy.MinRSABits)
+				}
+			}
+		case *dns.NSEC3PARAM:
+			checkIterations(name, r.Iterations)
+		case *dns.NSEC3:
+			// All the NSEC3 records share the parameters, so they are reported at the apex, as the NSEC3PARAM.
+			if next, end := dns.NextLabel(name, 0); !end {
+				name = name[next:]
+			}
+			checkIterations(name, r.Iterations)
+		}
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Severity > violations[j].Severity
+	})
+	return violations
+}
+
+// isRSA returns true if the DNSSEC algorithm uses RSA keys.
+func isRSA(alg uint8) bool {
+	switch alg {
+	case dns.RSAMD5, dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512:
+		return true
+	}
+	return false
+}
+
+// algorithmName returns the mnemonic of a DNSSEC algorithm, or "unknown".
+func algorithmName(alg uint8) string {
+	if name, ok := dns.AlgorithmToString[alg]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// rsaKeyBits returns the size in bits of the modulus of an RSA DNSKEY, encoded as defined in RFC3110 2.
+func rsaKeyBits(key *dns.DNSKEY) (int, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(keyBytes) < 1 {
+		return 0, fmt.Errorf("empty key")
+	}
+	expLen, offset := int(keyBytes[0]), 1
+	if expLen == 0 {
+		if len(keyBytes) < 3 {
+			return 0, fmt.Errorf("key too short")
+		}
+		expLen, offset = int(keyBytes[1])<<8|int(keyBytes[2]), 3
+	}
+	if len(keyBytes) <= offset+expLen {
+		return 0, fmt.Errorf("key too short")
+	}
+	return new(big.Int).SetBytes(keyBytes[offset+expLen:]).BitLen(), nil
+}
@@ -0,0 +1,180 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"sync"
+)
+
+// Signer signs many zones in one process, loading the PKCS#11 library and logging into the HSM once.
+// It keeps a pool of PKCS#11 sessions sharing the same context, so SignZone can be called concurrently
+// from many goroutines: each signature uses its own session, created on demand up to the pool size.
+// Concurrent signatures must not create keys (SignArgs.CreateKeys) with the same label at the same time.
+// Sessions lost by the HSM are reconnected when they fail, and KeepAlive keeps the idle ones open.
+type Signer struct {
+	Log      Logger      // Logger (for output)
+	ctx      Context     // Shared PKCS#11 context
+	ownsCtx  bool        // If true, the context was initialized by the signer and Close finalizes it
+	slot     uint        // Slot of the sessions
+	key      string      // HSM user key
+	label    string      // Key label
+	logger   *log.Logger // Standard library logger of the sessions
+	sessions chan *Session
+	mutex    sync.Mutex // Protects open and closed
+	open     int        // Number of open sessions
+	size     int        // Maximum number of open sessions
+	closed   bool
+	done     chan struct{} // Closed by Close, so the signatures waiting for a session stop waiting
+	stop     chan struct{} // Closed to stop the keepalive (see KeepAlive)
+	stopped  chan struct{} // Closed when the keepalive stops
+}
+
+// NewSigner loads the PKCS#11 library, logs into the token of its first slot and returns a Signer
+// with a pool of at most size sessions (at least one). The arguments are the same as in NewSession.
+// The Signer must be closed after use.
+func NewSigner(p11lib, key, label string, log *log.Logger, size int) (*Signer, error) {
+	p, err := initContext(p11lib)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := p.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		p.Finalize()
+		p.Destroy()
+		return nil, fmt.Errorf("Error checking slots: no slot with a token found (%v)\n", err)
+	}
+	signer, err := NewSignerWithContext(p, slots[0], key, label, log, size)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, err
+	}
+	signer.ownsCtx = true
+	return signer, nil
+}
+
+// NewSignerWithContext returns a Signer with a pool of at most size sessions (at least one) on a slot of an
+// already initialized pkcs#11 context, as NewSessionWithContext. The other arguments are the same as in NewSigner.
+// Closing the Signer does not log out nor finalize the context, which must be done by its owner.
+func NewSignerWithContext(p Context, slot uint, key, label string, log *log.Logger, size int) (*Signer, error) {
+	if size < 1 {
+		size = 1
+	}
+	signer := &Signer{
+		Log:      newLogger(log),
+		ctx:      p,
+		slot:     slot,
+		key:      key,
+		label:    label,
+		logger:   log,
+		sessions: make(chan *Session, size),
+		size:     size,
+		done:     make(chan struct{}),
+	}
+	// The first session logs in, and checks the key before any zone is signed.
+	session, err := signer.newSession()
+	if err != nil {
+		return nil, err
+	}
+	signer.sessions <- session
+	return signer, nil
+}
+
+// SignZone signs the zone with the keys of the HSM, as Session.Sign, using a session of the pool.
+// It returns the DS of the KSK.
+func (signer *Signer) SignZone(args *SignArgs) (*dns.DS, error) {
+	session, err := signer.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer signer.release(session)
+	session.Log = signer.Log
+	return session.Sign(&SessionSignArgs{SignArgs: args})
+}
+
+// Close ends all the sessions of the pool, logs out and finalizes the PKCS#11 library.
+// It waits for the running signatures to finish.
+func (signer *Signer) Close() error {
+	signer.mutex.Lock()
+	if signer.closed {
+		signer.mutex.Unlock()
+		return fmt.Errorf("signer already closed")
+	}
+	signer.closed = true
+	close(signer.done)
+	open := signer.open
+	stop, stopped := signer.stop, signer.stopped
+	signer.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+
+	var session *Session
+	for i := 0; i < open; i++ {
+		session = <-signer.sessions
+		if i < open-1 {
+			if err := session.End(); err != nil {
+				orNop(signer.Log).Warn("cannot end session", "error", err)
+			}
+		}
+	}
+	// The last session owns the context of NewSigner, so ending it logs out and finalizes the library.
+	session.ownsCtx = signer.ownsCtx
+	return session.End()
+}
+
+// acquire returns an idle session of the pool, opening a new one if all are busy and the pool is not full.
+// If the pool is full, it waits for a session to be released, and returns an error if the signer is closed meanwhile.
+func (signer *Signer) acquire() (*Session, error) {
+	select {
+	case session := <-signer.sessions:
+		return signer.checkOpen(session)
+	default:
+	}
+	if session, err := signer.newSession(); session != nil || err != nil {
+		return session, err
+	}
+	select {
+	case session := <-signer.sessions:
+		return signer.checkOpen(session)
+	case <-signer.done:
+		return nil, fmt.Errorf("signer closed")
+	}
+}
+
+// checkOpen returns the session if the signer is not closed. Otherwise, it returns the session to the pool
+// (so Close can end it) and an error.
+func (signer *Signer) checkOpen(session *Session) (*Session, error) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	if signer.closed {
+		signer.sessions <- session
+		return nil, fmt.Errorf("signer closed")
+	}
+	return session, nil
+}
+
+// newSession opens a new session if the pool is not full. It returns a nil session and error if it is full.
+func (signer *Signer) newSession() (*Session, error) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	if signer.closed {
+		return nil, fmt.Errorf("signer closed")
+	}
+	if signer.open >= signer.size {
+		return nil, nil
+	}
+	session, err := NewSessionWithContext(signer.ctx, signer.slot, signer.key, signer.label, signer.logger)
+	if err != nil {
+		return nil, err
+	}
+	signer.open++
+	return session, nil
+}
+
+// release returns the session to the pool.
+func (signer *Signer) release(session *Session) {
+	signer.sessions <- session
+}
@@ -0,0 +1,139 @@
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Markers of the block of DNSSEC records appended to the zone text when SignArgs.PreserveText is true.
+const (
+	generatedBlockStart = "; BEGIN DNSSEC records generated by hsm-tools. Do not edit, they are replaced when the zone is signed again."
+	generatedBlockEnd   = "; END DNSSEC records generated by hsm-tools."
+)
+
+// readZoneText reads the zone file in args.File, keeping its text without the DNSSEC records generated by a
+// previous signature, and replaces args.File with a reader of that text.
+func (args *SignArgs) readZoneText() error {
+	text, err := ioutil.ReadAll(args.File)
+	if err != nil {
+		return fmt.Errorf("cannot read zone %s: %s", args.Zone, err)
+	}
+	args.zoneText = stripGeneratedBlock(text)
+	args.File = bytes.NewReader(args.zoneText)
+	return nil
+}
+
+// checkZoneText returns an error if the RRs parsed from the zone text have DNSSEC records, because they would
+// be written again with the text, next to the new ones.
+func (args *SignArgs) checkZoneText() error {
+	for _, rr := range args.RRs {
+		if isGenerated(rr) {
+			return fmt.Errorf("zone %s has %s records outside the generated DNSSEC block, so its text cannot be preserved", args.Zone, dns.Type(rr.Header().Rrtype))
+		}
+	}
+	return nil
+}
+
+// isGenerated returns true if the RR has one of the types created by the signer: DNSKEY, RRSIG, NSEC, NSEC3
+// or NSEC3PARAM.
+func isGenerated(rr dns.RR) bool {
+	return rr.Header().Rrtype == dns.TypeDNSKEY || signatureTypes[rr.Header().Rrtype]
+}
+
+// stripGeneratedBlock returns the zone text without the block of generated DNSSEC records, if it has one.
+func stripGeneratedBlock(text []byte) []byte {
+	start := bytes.Index(text, []byte(generatedBlockStart))
+	if start < 0 {
+		return text
+	}
+	end := bytes.Index(text[start:], []byte(generatedBlockEnd))
+	if end < 0 {
+		return text[:start]
+	}
+	end += start + len(generatedBlockEnd)
+	if end < len(text) && text[end] == '\n' {
+		end++
+	}
+	return append(text[:start:start], text[end:]...)
+}
+
+// writePreservedZone writes the original zone text into args.Output, with the serial of its SOA record replaced
+// by the serial of the signed zone, followed by the DNSSEC records of the signed RRs in a marked block.
+func (args *SignArgs) writePreservedZone(rrs RRArray) error {
+	text := string(args.zoneText)
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			var err error
+			if text, err = replaceSOASerial(text, soa.Serial); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	var b strings.Builder
+	b.WriteString(text)
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		b.WriteString("\n")
+	}
+	b.WriteString(generatedBlockStart + "\n")
+	for _, rr := range rrs {
+		if isGenerated(rr) {
+			b.WriteString(rr.String() + "\n")
+		}
+	}
+	b.WriteString(generatedBlockEnd + "\n")
+	_, err := args.Output.Write([]byte(b.String()))
+	return err
+}
+
+// replaceSOASerial returns the zone text with the serial of the first SOA record replaced. The serial is the third
+// field after the SOA type, skipping comments, quoted strings, and parentheses of multi-line records,
+// so the rest of the text, including its formatting, is kept.
+func replaceSOASerial(text string, serial uint32) (string, error) {
+	fields := -1 // fields after the SOA type, or -1 if it has not been found
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ';':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(' || c == ')':
+			i++
+		default:
+			start := i
+			if c == '"' {
+				for i++; i < len(text) && text[i] != '"'; i++ {
+					if text[i] == '\\' {
+						i++
+					}
+				}
+				i++
+			} else {
+				for i < len(text) && !strings.ContainsRune(" \t\r\n();", rune(text[i])) {
+					i++
+				}
+			}
+			if i > len(text) {
+				i = len(text)
+			}
+			token := text[start:i]
+			switch {
+			case fields < 0 && strings.EqualFold(token, "SOA"):
+				fields = 0
+			case fields >= 0:
+				fields++
+				if fields == 3 {
+					if _, err := strconv.ParseUint(token, 10, 32); err != nil {
+						return "", fmt.Errorf("cannot find the SOA serial in the zone text: %s is not a serial", token)
+					}
+					return text[:start] + strconv.FormatUint(uint64(serial), 10) + text[i:], nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("cannot find the SOA serial in the zone text")
+}
@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"sync"
+	"time"
+)
+
+// progressStep is the percentage of the RRsets of a zone signed between two progress messages.
+const progressStep = 10
+
+// progress logs the progress of the signature of the RRsets of a zone every progressStep percent, with the number of
+// RRsets signed and the average and maximum time taken to sign an RRset (with an HSM, mostly the latency of its
+// calls), so a long signature can be followed and its latency monitored. It can be used by many goroutines.
+type progress struct {
+	log     Logger
+	zone    string
+	total   int           // RRsets to sign
+	mutex   sync.Mutex    // Protects the fields below
+	signed  int           // RRsets signed
+	elapsed time.Duration // Total time taken by the signed RRsets
+	slowest time.Duration // Maximum time taken by a signed RRset
+	next    int           // Percentage of the next message
+}
+
+// newProgress returns the progress of the signature of total RRsets of the zone.
+func newProgress(log Logger, zone string, total int) *progress {
+	return &progress{log: log, zone: zone, total: total, next: progressStep}
+}
+
+// add counts an RRset signed in the duration provided, and logs the progress if it reached the next step. The last
+// RRset is always logged.
+func (p *progress) add(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.signed++
+	p.elapsed += d
+	if d > p.slowest {
+		p.slowest = d
+	}
+	percent := p.signed * 100 / p.total
+	if percent < p.next && p.signed < p.total {
+		return
+	}
+	p.next = percent - percent%progressStep + progressStep
+	p.log.Info("Signing progress", "zone", p.zone, "rrsets", p.signed, "total", p.total, "percent", percent,
+		"latency_ms", milliseconds(p.elapsed/time.Duration(p.signed)), "max_latency_ms", milliseconds(p.slowest))
+}
+
+// milliseconds returns the duration in milliseconds, with the fraction.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
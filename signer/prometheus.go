@@ -0,0 +1,205 @@
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets of the HSM signature latency histogram of
+// PrometheusMetrics when it does not specify them.
+var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// SignatureMetrics is implemented by the Metrics that also receive the latency of each signature made by the HSM
+// (the C_SignInit and C_Sign calls), as PrometheusMetrics.
+type SignatureMetrics interface {
+	Metrics
+	ObserveHSMSignature(d time.Duration) // Called after each HSM signature, with the time it took
+}
+
+// PrometheusMetrics keeps the metrics of the signatures of a long-running signer (as the serve command) and
+// exposes them in the Prometheus text format, as an http.Handler: the RRSIGs made and the failed signatures of each
+// zone, the time of the last successful signature and of the first RRSIG expiration of each zone (its signature
+// expiration horizon), the latency of the HSM signatures as a histogram, the duration of the signing stages and
+// the PKCS#11 calls. It is set as SignArgs.Metrics of each signature, and ObserveSignedZone or ObserveFailure are
+// called when it ends. It can be used by many goroutines at the same time.
+type PrometheusMetrics struct {
+	Buckets       []float64 // Upper bounds of the buckets of the latency histogram, in seconds, sorted. If nil, DefaultLatencyBuckets are used.
+	mutex         sync.Mutex
+	stages        map[string]*stageMetrics
+	hsmCalls      uint64
+	latencyCounts []uint64 // Signatures of each bucket (not cumulative), and of none of them in the last position
+	latencySum    float64
+	zones         map[string]*zoneMetrics
+}
+
+// stageMetrics are the durations of a signing stage.
+type stageMetrics struct {
+	count uint64
+	sum   float64
+}
+
+// zoneMetrics are the metrics of the signatures of a zone.
+type zoneMetrics struct {
+	signatures  uint64    // RRSIGs made
+	failures    uint64    // Failed signatures
+	lastSuccess time.Time // End of the last successful signature
+	expiration  time.Time // First expiration of the RRSIGs of the last successful signature
+}
+
+// ObserveDuration adds the duration of a signing stage.
+func (metrics *PrometheusMetrics) ObserveDuration(stage string, d time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if metrics.stages == nil {
+		metrics.stages = make(map[string]*stageMetrics)
+	}
+	s, ok := metrics.stages[stage]
+	if !ok {
+		s = &stageMetrics{}
+		metrics.stages[stage] = s
+	}
+	s.count++
+	s.sum += d.Seconds()
+}
+
+// IncHSMCalls adds PKCS#11 calls.
+func (metrics *PrometheusMetrics) IncHSMCalls(n int) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.hsmCalls += uint64(n)
+}
+
+// ObserveHSMSignature adds the latency of an HSM signature to the histogram.
+func (metrics *PrometheusMetrics) ObserveHSMSignature(d time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	buckets := metrics.buckets()
+	if metrics.latencyCounts == nil {
+		metrics.latencyCounts = make([]uint64, len(buckets)+1)
+	}
+	seconds := d.Seconds()
+	metrics.latencyCounts[sort.SearchFloat64s(buckets, seconds)]++
+	metrics.latencySum += seconds
+}
+
+// ObserveSignedZone adds the RRSIGs made by a successful signature (args.Refreshed), and sets the time of the last
+// signature of the zone and the first expiration of the RRSIGs of the signed zone (args.RRs).
+func (metrics *PrometheusMetrics) ObserveSignedZone(args *SignArgs) {
+	expiration := SignedZoneMetadata(args.Zone, args.RRs).FirstExpiration
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	zone := metrics.zone(args.Zone)
+	zone.signatures += uint64(args.Refreshed)
+	zone.lastSuccess = time.Now()
+	zone.expiration = expiration
+}
+
+// ObserveFailure counts a failed signature of the zone.
+func (metrics *PrometheusMetrics) ObserveFailure(zone string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.zone(zone).failures++
+}
+
+// zone returns the metrics of the zone, creating them if needed. The mutex must be locked.
+func (metrics *PrometheusMetrics) zone(name string) *zoneMetrics {
+	if metrics.zones == nil {
+		metrics.zones = make(map[string]*zoneMetrics)
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	zone, ok := metrics.zones[name]
+	if !ok {
+		zone = &zoneMetrics{}
+		metrics.zones[name] = zone
+	}
+	return zone
+}
+
+// buckets returns the upper bounds of the buckets of the latency histogram.
+func (metrics *PrometheusMetrics) buckets() []float64 {
+	if metrics.Buckets == nil {
+		return DefaultLatencyBuckets
+	}
+	return metrics.Buckets
+}
+
+// WriteTo writes the metrics into writer in the Prometheus text format (version 0.0.4), sorted by zone and stage.
+func (metrics *PrometheusMetrics) WriteTo(writer io.Writer) (int64, error) {
+	var b bytes.Buffer
+	metrics.mutex.Lock()
+	zones := make([]string, 0, len(metrics.zones))
+	for name := range metrics.zones {
+		zones = append(zones, name)
+	}
+	sort.Strings(zones)
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	zoneFamily := func(name, kind, help string, value func(*zoneMetrics) (string, bool)) {
+		family(name, kind, help)
+		for _, zone := range zones {
+			if v, ok := value(metrics.zones[zone]); ok {
+				fmt.Fprintf(&b, "%s{zone=%q} %s\n", name, zone, v)
+			}
+		}
+	}
+	zoneFamily("hsm_tools_signatures_total", "counter", "RRSIGs made by the signatures of the zone.", func(zone *zoneMetrics) (string, bool) {
+		return strconv.FormatUint(zone.signatures, 10), true
+	})
+	zoneFamily("hsm_tools_sign_failures_total", "counter", "Failed signatures of the zone.", func(zone *zoneMetrics) (string, bool) {
+		return strconv.FormatUint(zone.failures, 10), true
+	})
+	zoneFamily("hsm_tools_last_success_timestamp_seconds", "gauge", "Unix time of the last successful signature of the zone.", func(zone *zoneMetrics) (string, bool) {
+		return strconv.FormatInt(zone.lastSuccess.Unix(), 10), !zone.lastSuccess.IsZero()
+	})
+	zoneFamily("hsm_tools_signature_expiration_timestamp_seconds", "gauge", "Unix time of the first expiration of the RRSIGs of the last signature of the zone.", func(zone *zoneMetrics) (string, bool) {
+		return strconv.FormatInt(zone.expiration.Unix(), 10), !zone.expiration.IsZero()
+	})
+
+	family("hsm_tools_hsm_signature_duration_seconds", "histogram", "Latency of the signatures made by the HSM.")
+	var count uint64
+	buckets := metrics.buckets()
+	for i, bound := range buckets {
+		if metrics.latencyCounts != nil {
+			count += metrics.latencyCounts[i]
+		}
+		fmt.Fprintf(&b, "hsm_tools_hsm_signature_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	if metrics.latencyCounts != nil {
+		count += metrics.latencyCounts[len(buckets)]
+	}
+	fmt.Fprintf(&b, "hsm_tools_hsm_signature_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(&b, "hsm_tools_hsm_signature_duration_seconds_sum %s\n", strconv.FormatFloat(metrics.latencySum, 'g', -1, 64))
+	fmt.Fprintf(&b, "hsm_tools_hsm_signature_duration_seconds_count %d\n", count)
+
+	family("hsm_tools_hsm_calls_total", "counter", "PKCS#11 calls made by the signatures.")
+	fmt.Fprintf(&b, "hsm_tools_hsm_calls_total %d\n", metrics.hsmCalls)
+
+	stages := make([]string, 0, len(metrics.stages))
+	for stage := range metrics.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	family("hsm_tools_stage_duration_seconds", "summary", "Duration of the stages of the signatures.")
+	for _, stage := range stages {
+		s := metrics.stages[stage]
+		fmt.Fprintf(&b, "hsm_tools_stage_duration_seconds_sum{stage=%q} %s\n", stage, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "hsm_tools_stage_duration_seconds_count{stage=%q} %d\n", stage, s.count)
+	}
+	metrics.mutex.Unlock()
+	return b.WriteTo(writer)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format, as the response of a scrape.
+func (metrics *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
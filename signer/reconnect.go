@@ -0,0 +1,146 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"time"
+)
+
+// sessionErrors are the PKCS#11 errors returned when the session was lost, as when a network-attached HSM
+// closes the sessions idle for too long, its connection is restarted or the token is removed and inserted again.
+// They do not disappear by repeating the operation, but by opening the session and logging in again
+// (see Session.Reconnect).
+var sessionErrors = map[uint]bool{
+	pkcs11.CKR_SESSION_HANDLE_INVALID: true,
+	pkcs11.CKR_SESSION_CLOSED:         true,
+	pkcs11.CKR_USER_NOT_LOGGED_IN:     true,
+	pkcs11.CKR_DEVICE_REMOVED:         true,
+}
+
+// isSessionLost returns true if err is a PKCS#11 error of a lost session.
+func isSessionLost(err error) bool {
+	p11Err, ok := err.(pkcs11.Error)
+	return ok && sessionErrors[uint(p11Err)]
+}
+
+// canReconnect returns true if reopening a lost session failed with an error that can disappear by trying again, as
+// when the connection of a network-attached HSM is coming back. A wrong or locked PIN is never retried.
+func canReconnect(err error) bool {
+	return isTransient(err) || isSessionLost(err) || isPKCS11Error(err, pkcs11.CKR_TOKEN_NOT_PRESENT)
+}
+
+// Reconnect closes the session handle (ignoring the error, because it is usually invalid already), opens a new
+// session on the same slot of the context and logs in with the stored user key. The key handles found before are
+// usually still valid, because most libraries keep the handles of the token objects while the context is initialized,
+// but PKCS#11 does not guarantee it when the token was removed (CKR_DEVICE_REMOVED). Then, the operations with them
+// fail with CKR_KEY_HANDLE_INVALID or CKR_OBJECT_HANDLE_INVALID, and the keys must be found again.
+// It only works with sessions created by NewSession, NewSessionWithContext or a Signer.
+func (session *Session) Reconnect() error {
+	if session == nil || session.Ctx == nil {
+		return fmt.Errorf("session not initialized")
+	}
+	if !session.opened {
+		return fmt.Errorf("session was not opened by the signer, so it cannot be reopened")
+	}
+	if err := session.reopen(); err != nil {
+		return fmt.Errorf("cannot reopen session: %s", err)
+	}
+	return nil
+}
+
+// reopen closes the session handle and opens and logs in a new one, as Reconnect, returning the PKCS#11 errors
+// as they are, so they can be retried.
+func (session *Session) reopen() error {
+	_ = session.Ctx.CloseSession(session.Handle)
+	handle, err := session.Ctx.OpenSession(session.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return err
+	}
+	err = session.Ctx.Login(handle, pkcs11.CKU_USER, session.pin)
+	if err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		session.Ctx.CloseSession(handle)
+		return err
+	}
+	session.Handle = handle
+	return nil
+}
+
+// withReconnect runs the operation, and if it fails because the session was lost, it reconnects the session
+// and runs the operation again, so a session closed by the HSM does not make the signature fail. The reconnection
+// is retried with the policy, as the connection of a network-attached HSM can take a while to come back, and the
+// session is reconnected at most once per attempt of the policy (once if it is nil).
+func (session *Session) withReconnect(operation string, policy *RetryPolicy, fn func() error) error {
+	err := fn()
+	for reconnections := 1; err != nil && isSessionLost(err) && session.opened; reconnections++ {
+		if reconnections > policy.attempts() {
+			return fmt.Errorf("%s failed after reconnecting the session %d times: %s", operation, reconnections-1, err)
+		}
+		session.logger().Warn("HSM session lost, reconnecting", "operation", operation, "reconnection", reconnections, "error", err)
+		if rerr := policy.do(session.logger(), "reconnection", session.reopen, canReconnect); rerr != nil {
+			return fmt.Errorf("%s failed: %s, and the session could not be reopened: %s", operation, err, rerr)
+		}
+		session.logger().Info("HSM session reconnected", "operation", operation)
+		err = fn()
+	}
+	return err
+}
+
+// sessionInfo returns the information of the session, reconnecting it once if it was lost, so the checks done
+// before signing (as the mechanisms of the token) do not fail with a session closed by the HSM since the last signature.
+func (session *Session) sessionInfo() (pkcs11.SessionInfo, error) {
+	var info pkcs11.SessionInfo
+	err := session.withReconnect("session info", nil, func() (err error) {
+		info, err = session.Ctx.GetSessionInfo(session.Handle)
+		return err
+	})
+	return info, err
+}
+
+// KeepAlive checks the idle sessions of the pool every interval with a cheap HSM call (see Session.HealthCheck),
+// reconnecting the ones that fail, so network-attached HSMs do not close them for being idle. The interval
+// should be shorter than the idle timeout of the HSM. The checks stop when the Signer is closed.
+// It does nothing if the interval is not positive or the keepalive is already running.
+func (signer *Signer) KeepAlive(interval time.Duration) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+	if interval <= 0 || signer.closed || signer.stop != nil {
+		return
+	}
+	signer.stop = make(chan struct{})
+	signer.stopped = make(chan struct{})
+	go signer.keepAlive(interval)
+}
+
+// keepAlive checks the idle sessions every interval until signer.stop is closed.
+func (signer *Signer) keepAlive(interval time.Duration) {
+	defer close(signer.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-signer.stop:
+			return
+		case <-ticker.C:
+			signer.checkIdle()
+		}
+	}
+}
+
+// checkIdle checks the sessions idle in the pool, taking each one so no signature uses it meanwhile.
+func (signer *Signer) checkIdle() {
+	for idle := len(signer.sessions); idle > 0; idle-- {
+		var session *Session
+		select {
+		case session = <-signer.sessions:
+		default:
+			return
+		}
+		if err := session.HealthCheck(); err != nil {
+			orNop(signer.Log).Warn("idle HSM session lost, reconnecting", "error", err)
+			if err := session.Reconnect(); err != nil {
+				orNop(signer.Log).Error("cannot reconnect idle HSM session", "error", err)
+			}
+		}
+		signer.release(session)
+	}
+}
@@ -0,0 +1,119 @@
+package signer
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// keepRefreshSignatures keeps the RRSIGs of args.RRs if args.RefreshWindow or args.DNSKEYReuseWindow is positive,
+// and the NSEC3PARAM at its apex if args.RefreshWindow is, before removeDNSSECRecords removes them, so the RRSIGs
+// that do not need to be refreshed are reused and the NSEC3 chain is built again with the same salt.
+func (args *SignArgs) keepRefreshSignatures() {
+	args.refreshSigs = nil
+	args.refreshParam = nil
+	if args.RefreshWindow <= 0 && args.DNSKEYReuseWindow <= 0 {
+		return
+	}
+	args.refreshSigs = make(map[string][]*dns.RRSIG)
+	for _, rr := range args.RRs {
+		switch x := rr.(type) {
+		case *dns.RRSIG:
+			key := rrSetKey(x.Hdr.Name, x.TypeCovered)
+			args.refreshSigs[key] = append(args.refreshSigs[key], x)
+		case *dns.NSEC3PARAM:
+			if args.RefreshWindow > 0 && strings.EqualFold(x.Hdr.Name, args.Zone) {
+				args.refreshParam = x
+			}
+		}
+	}
+}
+
+// reusableSignatures returns an RRSIG of the RRset for each key pair, taken from the signatures of the zone kept by
+// keepRefreshSignatures, or nil if a key pair has no RRSIG that can be kept. An RRSIG is kept if it is valid now,
+// it expires after window from now, its original TTL is the TTL of the RRset and it verifies with the DNSKEY of the
+// key pair, so the RRSIGs of RRsets changed since the last signature are made again.
+func (args *SignArgs) reusableSignatures(set RRArray, pairs []*KeyPair, window time.Duration) RRArray {
+	if window <= 0 || len(args.refreshSigs) == 0 {
+		return nil
+	}
+	now := args.startTime()
+	refresh := now.Add(window)
+	candidates := args.refreshSigs[rrSetKey(set[0].Header().Name, set[0].Header().Rrtype)]
+	sigs := make(RRArray, 0, len(pairs))
+	for _, pair := range pairs {
+		var found *dns.RRSIG
+		for _, sig := range candidates {
+			if sig.KeyTag != pair.DNSKEY.KeyTag() || sig.Algorithm != pair.DNSKEY.Algorithm || sig.OrigTtl != set[0].Header().Ttl {
+				continue
+			}
+			expiration := time.Unix(int64(sig.Expiration), 0)
+			if sig.ValidityPeriod(now) && expiration.After(refresh) && sig.Verify(pair.DNSKEY, set) == nil {
+				found = sig
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		sigs = append(sigs, found)
+	}
+	return sigs
+}
+
+// refreshedSets returns the RRSIGs kept for the RRsets of the zone that do not need to be signed again, by their index
+// in sets, and the ones kept for the DNSKEY RRset, or nil if it must be signed again. If an RRset must be signed again,
+// the serial of the zone is updated, so the SOA is signed again too. RRsets other than the DNSKEY one are only kept
+// if args.RefreshWindow is positive. The RRSIGs of the DNSKEY RRset are kept if it did not change and they expire
+// after args.DNSKEYReuseWindow (or if it is not positive, args.RefreshWindow), so the KSKs are not used. If the
+// DNSKEY RRset was signed offline (offlineSigs is not nil), they are kept only if they are the offline RRSIGs.
+// The RRsets must be sorted canonically.
+func (args *SignArgs) refreshedSets(sets RRSet, dnskeys, offlineSigs RRArray, zsks, ksks []*KeyPair) (map[int]RRArray, RRArray, error) {
+	reused := make(map[int]RRArray)
+	dnskeyWindow := args.DNSKEYReuseWindow
+	if dnskeyWindow <= 0 {
+		dnskeyWindow = args.RefreshWindow
+	}
+	dnskeySigs := args.reusableSignatures(dnskeys, ksks, dnskeyWindow)
+	if offlineSigs != nil {
+		dnskeySigs = nil
+		if sameSignatures(args.refreshSigs[rrSetKey(args.Zone, dns.TypeDNSKEY)], offlineSigs) {
+			dnskeySigs = offlineSigs
+		}
+	}
+	if args.RefreshWindow <= 0 {
+		return reused, dnskeySigs, nil
+	}
+	for i, set := range sets {
+		if sigs := args.reusableSignatures(set, zsks, args.RefreshWindow); sigs != nil {
+			reused[i] = sigs
+		}
+	}
+	if len(reused) == len(sets) && dnskeySigs != nil {
+		return reused, dnskeySigs, nil
+	}
+	if err := args.refreshSerial(args.RRs); err != nil {
+		return nil, nil, err
+	}
+	for i, set := range sets {
+		if set[0].Header().Rrtype == dns.TypeSOA {
+			delete(reused, i)
+		}
+	}
+	return reused, dnskeySigs, nil
+}
+
+// refreshSerial updates the serial of the SOA at the apex of the RRs following args.Serial. It is used when some
+// RRSIGs are refreshed, because the zone read for a refresh keeps its serial, so it only changes if the zone does.
+func (args *SignArgs) refreshSerial(rrs RRArray) error {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, args.Zone) {
+			serial, err := args.newSerial(soa.Serial)
+			if err != nil {
+				return err
+			}
+			soa.Serial = serial
+		}
+	}
+	return nil
+}
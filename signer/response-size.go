@@ -0,0 +1,136 @@
+package signer
+
+import (
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// DefaultMaxResponseSize is the response size threshold used when SignArgs does not specify one.
+// It is the EDNS buffer size recommended to avoid IP fragmentation (DNS Flag Day 2020).
+const DefaultMaxResponseSize = 1232
+
+// ResponseSizes contains estimates, in bytes, of the largest DNSSEC responses a signed zone produces.
+// The estimates use name compression and include an EDNS0 OPT record with the DO bit set.
+type ResponseSizes struct {
+	DNSKEY int // Response to a DNSKEY query: the DNSKEY RRset and its RRSIGs
+	Denial int // Worst-case NXDOMAIN response: the SOA and the NSEC or NSEC3 records of the proof, with their RRSIGs
+}
+
+// Max returns the largest of the estimated sizes.
+func (sizes *ResponseSizes) Max() int {
+	if sizes.DNSKEY > sizes.Denial {
+		return sizes.DNSKEY
+	}
+	return sizes.Denial
+}
+
+// EstimateResponseSizes estimates the sizes of the largest DNSSEC responses of a signed zone.
+// The worst-case denial of existence proof uses the largest NSEC or NSEC3 records of the zone:
+// two NSEC records (covering the name and the wildcard) or three NSEC3 records (closest encloser,
+// next closer name and wildcard, RFC5155 7.2.1).
+func EstimateResponseSizes(zone string, rrs RRArray) *ResponseSizes {
+	zone = dns.Fqdn(zone)
+	sigs := make(map[string]RRArray)
+	var soa, dnskeys, nsecs, nsec3s RRArray
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG:
+			sig := rr.(*dns.RRSIG)
+			key := responseKey(sig.Hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+		case dns.TypeSOA:
+			soa = append(soa, rr)
+		case dns.TypeDNSKEY:
+			if strings.EqualFold(rr.Header().Name, zone) {
+				dnskeys = append(dnskeys, rr)
+			}
+		case dns.TypeNSEC:
+			nsecs = append(nsecs, rr)
+		case dns.TypeNSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	withSigs := func(rrType uint16, rrs ...dns.RR) RRArray {
+		result := make(RRArray, 0)
+		covered := make(map[string]bool)
+		for _, rr := range rrs {
+			result = append(result, rr)
+			key := responseKey(rr.Header().Name, rrType)
+			if !covered[key] {
+				covered[key] = true
+				result = append(result, sigs[key]...)
+			}
+		}
+		return result
+	}
+
+	sizes := &ResponseSizes{}
+	dnskeyMsg := newResponse(zone, dns.TypeDNSKEY)
+	dnskeyMsg.Answer = withSigs(dns.TypeDNSKEY, dnskeys...)
+	sizes.DNSKEY = dnskeyMsg.Len()
+
+	denialType, denialRRs, proofLen := uint16(dns.TypeNSEC), nsecs, 2
+	if len(nsec3s) > 0 {
+		denialType, denialRRs, proofLen = dns.TypeNSEC3, nsec3s, 3
+	}
+	proofs := make([]RRArray, 0, len(denialRRs))
+	for _, rr := range denialRRs {
+		proofs = append(proofs, withSigs(denialType, rr))
+	}
+	sort.Slice(proofs, func(i, j int) bool {
+		return rrsLen(proofs[i]) > rrsLen(proofs[j])
+	})
+	denialMsg := newResponse(zone, dns.TypeA)
+	denialMsg.Rcode = dns.RcodeNameError
+	denialMsg.Ns = withSigs(dns.TypeSOA, soa...)
+	for i := 0; i < proofLen && i < len(proofs); i++ {
+		denialMsg.Ns = append(denialMsg.Ns, proofs[i]...)
+	}
+	sizes.Denial = denialMsg.Len()
+	return sizes
+}
+
+// checkResponseSizes logs a warning if the estimated size of the largest DNSSEC response of the signed zone
+// in args.RRs exceeds args.MaxResponseSize (or DefaultMaxResponseSize, if it is zero).
+// Such responses are fragmented or truncated, making resolvers fall back to TCP.
+func checkResponseSizes(args *SignArgs, log Logger) {
+	maxSize := args.MaxResponseSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxResponseSize
+	}
+	if maxSize < 0 {
+		return
+	}
+	sizes := EstimateResponseSizes(args.Zone, args.RRs)
+	log.Debug("estimated response sizes", "zone", args.Zone, "dnskey", sizes.DNSKEY, "denial", sizes.Denial)
+	if sizes.Max() > maxSize {
+		log.Warn("largest DNSSEC response exceeds the maximum response size, it could be fragmented or need TCP",
+			"zone", args.Zone, "dnskey", sizes.DNSKEY, "denial", sizes.Denial, "max", maxSize)
+	}
+}
+
+// newResponse returns a response to a query for the name and type, with an EDNS0 OPT record with the DO bit set.
+func newResponse(name string, rrType uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, rrType)
+	msg.Response = true
+	msg.Authoritative = true
+	msg.Compress = true
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	return msg
+}
+
+// responseKey identifies the RRSIGs covering the RRset with the name and type.
+func responseKey(name string, rrType uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "#" + dns.Type(rrType).String()
+}
+
+// rrsLen returns the uncompressed wire length of the RRs.
+func rrsLen(rrs RRArray) int {
+	length := 0
+	for _, rr := range rrs {
+		length += dns.Len(rr)
+	}
+	return length
+}
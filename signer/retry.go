@@ -0,0 +1,74 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"time"
+)
+
+// DefaultRetryDelay is the delay before the first retry when RetryPolicy does not specify one.
+const DefaultRetryDelay = 100 * time.Millisecond
+
+// transientErrors are the PKCS#11 errors that can disappear by repeating the operation,
+// as the ones returned by network-attached HSMs losing their connection for a moment.
+// Other errors (as CKR_PIN_INCORRECT or CKR_KEY_HANDLE_INVALID) fail on the first attempt.
+var transientErrors = map[uint]bool{
+	pkcs11.CKR_DEVICE_ERROR:    true,
+	pkcs11.CKR_DEVICE_MEMORY:   true,
+	pkcs11.CKR_FUNCTION_FAILED: true,
+}
+
+// RetryPolicy defines how the PKCS#11 signing and key generation operations are retried when they fail
+// with transient errors, and how many times a lost session is reopened (see Session.Reconnect).
+// The delay between attempts grows exponentially.
+type RetryPolicy struct {
+	MaxAttempts int           // Maximum number of attempts of each operation. If lower than 2, operations are not retried.
+	BaseDelay   time.Duration // Delay before the first retry, doubled after each one. If zero, DefaultRetryDelay is used.
+	MaxDelay    time.Duration // Maximum delay between attempts. If zero, the delay is not limited.
+}
+
+// attempts returns the maximum number of attempts of each operation, which is 1 for a nil policy.
+func (policy *RetryPolicy) attempts() int {
+	if policy == nil || policy.MaxAttempts < 1 {
+		return 1
+	}
+	return policy.MaxAttempts
+}
+
+// Do runs the operation until it succeeds, it fails with an error that is not transient or the policy
+// runs out of attempts. The retries are logged as warnings. A nil policy runs the operation once.
+func (policy *RetryPolicy) Do(log Logger, operation string, fn func() error) error {
+	return policy.do(log, operation, fn, isTransient)
+}
+
+// do runs the operation as Do, but retrying the errors for which retriable returns true.
+func (policy *RetryPolicy) do(log Logger, operation string, fn func() error, retriable func(error) bool) error {
+	attempts, delay := policy.attempts(), DefaultRetryDelay
+	if policy != nil && policy.BaseDelay > 0 {
+		delay = policy.BaseDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retriable(err) {
+			return err
+		}
+		if attempt >= attempts {
+			if attempt > 1 {
+				return fmt.Errorf("%s failed after %d attempts: %s", operation, attempt, err)
+			}
+			return err
+		}
+		log.Warn("transient HSM error, retrying", "operation", operation, "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+		if policy != nil && policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+// isTransient returns true if err is a transient PKCS#11 error.
+func isTransient(err error) bool {
+	p11Err, ok := err.(pkcs11.Error)
+	return ok && transientErrors[uint(p11Err)]
+}
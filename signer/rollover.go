@@ -0,0 +1,113 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// RolloverPhase is the phase of a key rollover (RFC6781 4.1) of the zone verified, which changes the conditions
+// Verify considers errors, so a zone in a planned rollover is not reported as broken.
+type RolloverPhase int
+
+const (
+	RolloverNone            RolloverPhase = iota // Every RRset must be signed with each algorithm of the DNSKEYs (RFC4035 2.2)
+	RolloverPrePublish                           // New DNSKEYs may be published before they sign, so their algorithms are not required
+	RolloverDoubleSignature                      // Every RRset must be signed by all the keys signing the RRsets of its kind (the DNSKEY RRset or the others)
+	RolloverPostPublish                          // Old DNSKEYs may stay published after they stop signing, so their algorithms are not required
+)
+
+// rolloverPhases maps the names of the rollover phases to their values.
+var rolloverPhases = map[string]RolloverPhase{
+	"none":             RolloverNone,
+	"pre-publish":      RolloverPrePublish,
+	"double-signature": RolloverDoubleSignature,
+	"post-publish":     RolloverPostPublish,
+}
+
+// ParseRolloverPhase returns the rollover phase with the name provided (none, pre-publish, double-signature or post-publish).
+func ParseRolloverPhase(name string) (RolloverPhase, error) {
+	phase, ok := rolloverPhases[strings.ToLower(name)]
+	if !ok {
+		return RolloverNone, fmt.Errorf("unknown rollover phase %s (it should be none, pre-publish, double-signature or post-publish)", name)
+	}
+	return phase, nil
+}
+
+// String returns the name of the rollover phase.
+func (phase RolloverPhase) String() string {
+	switch phase {
+	case RolloverPrePublish:
+		return "pre-publish"
+	case RolloverDoubleSignature:
+		return "double-signature"
+	case RolloverPostPublish:
+		return "post-publish"
+	default:
+		return "none"
+	}
+}
+
+// MarshalText encodes the rollover phase as its name, as in the rollover state files (see RolloverState).
+func (phase RolloverPhase) MarshalText() ([]byte, error) {
+	return []byte(phase.String()), nil
+}
+
+// UnmarshalText decodes a rollover phase from its name.
+func (phase *RolloverPhase) UnmarshalText(text []byte) (err error) {
+	*phase, err = ParseRolloverPhase(string(text))
+	return err
+}
+
+// requiredAlgorithms returns the algorithms every RRset must be signed with in the rollover phase: the algorithms
+// of the keys, and in the pre-publish and post-publish phases, only the ones of the keys signing some RRset.
+func (phase RolloverPhase) requiredAlgorithms(keys []*dns.DNSKEY, tuples map[string]*RRSigTuple) map[uint8]bool {
+	required := make(map[uint8]bool)
+	for _, key := range keys {
+		required[key.Algorithm] = true
+	}
+	if phase != RolloverPrePublish && phase != RolloverPostPublish {
+		return required
+	}
+	signing := make(map[uint8]bool)
+	for _, tuple := range tuples {
+		for _, sig := range tuple.RRSigs {
+			if signingKey(keys, sig) != nil {
+				signing[sig.Algorithm] = true
+			}
+		}
+	}
+	for alg := range required {
+		if !signing[alg] {
+			delete(required, alg)
+		}
+	}
+	return required
+}
+
+// signingKeys returns the keys of the double-signature phase that sign the RRsets of each kind, by whether
+// the kind is the DNSKEY RRset, identified by their algorithm and key tag (see keyID).
+func signingKeys(keys []*dns.DNSKEY, tuples map[string]*RRSigTuple) map[bool]map[string]bool {
+	signers := map[bool]map[string]bool{true: {}, false: {}}
+	for _, tuple := range tuples {
+		if len(tuple.RRArray) == 0 {
+			continue
+		}
+		// The CDS and CDNSKEY RRsets are signed by the keys of both kinds (see SignArgs.CDS).
+		if cdsTypes[tuple.RRArray[0].Header().Rrtype] {
+			continue
+		}
+		isDNSKEY := tuple.RRArray[0].Header().Rrtype == dns.TypeDNSKEY
+		for _, sig := range tuple.RRSigs {
+			if signingKey(keys, sig) != nil {
+				signers[isDNSKEY][keyID(sig.Algorithm, sig.KeyTag)] = true
+			}
+		}
+	}
+	return signers
+}
+
+// keyID identifies a key by its algorithm and key tag.
+func keyID(alg uint8, keyTag uint16) string {
+	return fmt.Sprintf("%s/%d", algorithmName(alg), keyTag)
+}
@@ -10,8 +10,24 @@ import (
 
 // RRArray represents an array of RRs
 // It implements Swapper interface, and is sortable.
+// The signer expects the RRs of a zone sorted by owner name in canonical order (RFC4034 6.1), then by class and
+// then by type (see Less), so the RRs of each name and each RRset are contiguous. ReadAndParseZone and NewRRArray
+// return them in that order.
 type RRArray []dns.RR
 
+// NewRRArray returns a new RRArray with copies of the RRs provided, without duplicates (see Dedup) and sorted
+// in the order expected by the signer, so programmatically built records can be signed or compared
+// as the ones parsed from a zone file. The RRs provided are not modified.
+func NewRRArray(rrs []dns.RR) RRArray {
+	rrArray := make(RRArray, len(rrs))
+	for i, rr := range rrs {
+		rrArray[i] = dns.Copy(rr)
+	}
+	rrArray = rrArray.Dedup()
+	sort.Sort(rrArray)
+	return rrArray
+}
+
 // RRArray is an array of RRArrays.
 type RRSet []RRArray
 
@@ -26,19 +42,11 @@ func (rrArray RRArray) Swap(i, j int) {
 }
 
 // Less returns true if the element in the position i of RRArray is less than the element in position j of RRArray.
+// Names are compared in canonical order (RFC4034 6.1): label by label, starting from the rightmost one,
+// so a name is always followed by its subdomains (including its wildcard) and then by its next sibling.
 func (rrArray RRArray) Less(i, j int) bool {
-	si := strings.Split(strings.ToLower(rrArray[i].Header().Name), ".")
-	sj := strings.Split(strings.ToLower(rrArray[j].Header().Name), ".")
-	if len(si) < len(sj) || len(si) > len(sj) {
-		return len(si) < len(sj)
-	}
-	// Equal length, check from left to right omiting .[nothing]
-	for k := len(si) - 2; k >= 0; k-- {
-		if si[k] < sj[k] {
-			return true
-		} else if si[k] > sj[k] {
-			return false
-		}
+	if cmp := CompareNames(rrArray[i].Header().Name, rrArray[j].Header().Name); cmp != 0 {
+		return cmp < 0
 	}
 	if rrArray[i].Header().Class == rrArray[j].Header().Class {
 		return rrArray[i].Header().Rrtype < rrArray[j].Header().Rrtype
@@ -47,6 +55,114 @@ func (rrArray RRArray) Less(i, j int) bool {
 	}
 }
 
+// CompareNames compares two domain names in canonical order (RFC4034 6.1), ignoring their case.
+// It returns -1 if a is before b, 1 if a is after b and 0 if they are the same name.
+// It does not allocate memory, because sorting a zone compares its names O(n log n) times.
+func CompareNames(a, b string) int {
+	// Most comparisons while sorting a zone are between the RRs of the same name, as the RRs of a large RRset.
+	if strings.EqualFold(a, b) {
+		return 0
+	}
+	a, b = trimRootLabel(a), trimRootLabel(b)
+	ea, eb := len(a), len(b) // ends of the labels to compare, or -1 if the name has no more labels
+	if ea == 0 {
+		ea = -1
+	}
+	if eb == 0 {
+		eb = -1
+	}
+	for ea >= 0 && eb >= 0 {
+		sa, sb := labelStart(a, ea), labelStart(b, eb)
+		if cmp := compareLabels(a[sa:ea], b[sb:eb]); cmp != 0 {
+			return cmp
+		}
+		ea, eb = sa-1, sb-1
+	}
+	switch {
+	case ea < 0 && eb >= 0:
+		return -1
+	case ea >= 0 && eb < 0:
+		return 1
+	}
+	return 0
+}
+
+// trimRootLabel returns the name without its final dot, if it is not escaped.
+func trimRootLabel(name string) string {
+	if n := len(name); n > 0 && name[n-1] == '.' && !isEscaped(name, n-1) {
+		return name[:n-1]
+	}
+	return name
+}
+
+// labelStart returns the index where the label of the name ending at end starts.
+func labelStart(name string, end int) int {
+	i := end - 1
+	for i >= 0 && (name[i] != '.' || isEscaped(name, i)) {
+		i--
+	}
+	return i + 1
+}
+
+// isEscaped returns true if the character at i is preceded by an odd number of backslashes.
+func isEscaped(name string, i int) bool {
+	escaped := false
+	for i--; i >= 0 && name[i] == '\\'; i-- {
+		escaped = !escaped
+	}
+	return escaped
+}
+
+// compareLabels compares two labels in presentation format by the bytes of their wire format, ignoring the case of
+// ASCII letters. The \DDD and \X escapes are decoded, so \255 sorts after z and \. before /, as in the wire format.
+func compareLabels(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		var ca, cb byte
+		ca, i = labelByte(a, i)
+		cb, j = labelByte(b, j)
+		if ca, cb = lowerASCII(ca), lowerASCII(cb); ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case j < len(b):
+		return -1
+	case i < len(a):
+		return 1
+	}
+	return 0
+}
+
+// labelByte returns the byte of the wire format of the label at i, decoding its escape (\DDD or \X) if it has
+// one, and the index of the next one.
+func labelByte(label string, i int) (byte, int) {
+	if label[i] != '\\' || i+1 == len(label) {
+		return label[i], i + 1
+	}
+	if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+		return (label[i+1]-'0')*100 + (label[i+2]-'0')*10 + label[i+3] - '0', i + 4
+	}
+	return label[i+1], i + 2
+}
+
+// isDigit returns true if c is an ASCII decimal digit.
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// lowerASCII returns c in lower case if it is an ASCII upper case letter, the only letters whose case is ignored
+// by the canonical order (RFC4034 6.2), or c otherwise.
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
 // WriteZone prints on writer all the RRs on the array.
 // The format of the text printed is the format of a DNS zone.
 func (rrArray RRArray) WriteZone(writer io.Writer) error {
@@ -58,6 +174,55 @@ func (rrArray RRArray) WriteZone(writer io.Writer) error {
 	return nil
 }
 
+// dnssecRecordTypes are the types removed by StripDNSSEC.
+var dnssecRecordTypes = map[uint16]bool{
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeNSEC3PARAM: true,
+	dns.TypeDNSKEY:     true,
+	dns.TypeCDS:        true,
+	dns.TypeCDNSKEY:    true,
+}
+
+// StripDNSSEC returns a new RRArray with the RRs of the array, excluding the RRSIG, NSEC, NSEC3, NSEC3PARAM, DNSKEY,
+// CDS and CDNSKEY records, so a signed zone becomes an unsigned zone. The DS records of delegations are kept,
+// because they are data of the zone.
+func (rrArray RRArray) StripDNSSEC() RRArray {
+	return rrArray.withoutTypes(dnssecRecordTypes)
+}
+
+// withoutTypes returns a new RRArray with the RRs of the array whose type is not in types.
+func (rrArray RRArray) withoutTypes(types map[uint16]bool) RRArray {
+	rrs := make(RRArray, 0, len(rrArray))
+	for _, rr := range rrArray {
+		if !types[rr.Header().Rrtype] {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// Dedup returns a new RRArray with the RRs of the array, excluding the duplicates of a previous RR: the ones with
+// the same owner name, class, type and RDATA in canonical form (RFC4034 6.2), whatever their TTL, because they
+// are the same RR in the RRset (RFC2181 5). The first RR of each group of duplicates is kept.
+func (rrArray RRArray) Dedup() RRArray {
+	rrs := make(RRArray, 0, len(rrArray))
+	seen := make(map[string]bool, len(rrArray))
+	for _, rr := range rrArray {
+		// The key has no TTL, so the same RR with other TTL is a duplicate too.
+		wire, _, err := packRR(canonicalRR(rr, &dns.RRSIG{Labels: 255}))
+		if err == nil {
+			if seen[string(wire)] {
+				continue
+			}
+			seen[string(wire)] = true
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
 // CreateRRSet groups the RRs by label and class if byType is false, or label, class and type if byType is true
 // NSEC/NSEC3 uses the version with byType = false, and RRSIG uses the other version.
 // It assumes the rrarray is sorted.
@@ -83,68 +248,117 @@ func (rrArray RRArray) CreateRRSet(zone string, byType bool) (set RRSet) {
 	return set
 }
 
+// createDenialSet groups the RRs by label and class, as CreateRRSet does with byType = false,
+// but it also includes the NS records of the delegations, secure or not, because the delegation points
+// must be covered by the NSEC and NSEC3 chains (RFC4035 2.3, RFC5155 7.1). Glue records are not included.
+// It assumes the rrarray is sorted.
+func (rrArray RRArray) createDenialSet(zone string) (set RRSet) {
+	set = make(RRSet, 0)
+	nsNames := getAllNSNames(rrArray)
+	var lastRR dns.RR
+	for _, rr := range rrArray {
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		delegation := rr.Header().Rrtype == dns.TypeNS && delegationPoint(name, zone, nsNames) == name
+		if isSignable(rr, zone, nsNames) || delegation {
+			if !sameRRSet(lastRR, rr, false) {
+				set = append(set, make(RRArray, 0))
+			}
+			set[len(set)-1] = append(set[len(set)-1], rr)
+			lastRR = rr
+		}
+	}
+	return set
+}
+
 // AddNSECRecords edits an RRArray and adds the respective NSEC records to it.
+// Their type bitmaps include NSEC and RRSIG, and DNSKEY at the apex, because the signer adds those records.
+// The chain includes every delegation point, with its NS and DS records (RFC4035 2.3): the NSEC record of an
+// insecure delegation has the NS, RRSIG and NSEC types, proving that it has no DS records.
 func (rrArray *RRArray) AddNSECRecords(zone string) {
 
-	set := rrArray.CreateRRSet(zone, false)
+	set := rrArray.createDenialSet(zone)
 
 	n := len(set)
 	for i, rrs := range set {
-		typeMap := make(map[uint16]bool)
-		typeArray := make([]uint16, 0)
-		for _, rr := range rrs {
-			typeMap[rr.Header().Rrtype] = true
-		}
-		typeMap[dns.TypeNSEC] = true
-
-		for k := range typeMap {
-			typeArray = append(typeArray, k)
-		}
+		*rrArray = append(*rrArray, nsecRecord(rrs, set[(i+1)%n][0].Header().Name))
+	}
 
-		sort.Slice(typeArray, func(i, j int) bool {
-			return typeArray[i] < typeArray[j]
-		})
+	sort.Sort(*rrArray)
+}
 
-		nsec := &dns.NSEC{}
-		nsec.Hdr.Name = rrs[0].Header().Name
-		nsec.Hdr.Rrtype = dns.TypeNSEC
-		nsec.Hdr.Class = dns.ClassINET
-		nsec.Hdr.Ttl = rrs[0].Header().Ttl
-		nsec.NextDomain = set[(i+1)%n][0].Header().Name
-		nsec.TypeBitMap = typeArray
+// nsecRecord returns the NSEC record of the RRs of a name of the chain, pointing to the next name. It has the TTL of
+// the first RR.
+func nsecRecord(rrs RRArray, next string) *dns.NSEC {
+	typeMap := make(map[uint16]bool)
+	typeArray := make([]uint16, 0)
+	for _, rr := range rrs {
+		typeMap[rr.Header().Rrtype] = true
+	}
+	// The names of the chain are signed, and the DNSKEYs are added to the apex after the NSEC records (RFC4034 4.1.2).
+	if typeMap[dns.TypeSOA] {
+		typeMap[dns.TypeDNSKEY] = true
+	}
+	typeMap[dns.TypeNSEC] = true
+	typeMap[dns.TypeRRSIG] = true
 
-		*rrArray = append(*rrArray, nsec)
+	for k := range typeMap {
+		typeArray = append(typeArray, k)
 	}
 
-	sort.Sort(*rrArray)
+	sort.Slice(typeArray, func(i, j int) bool {
+		return typeArray[i] < typeArray[j]
+	})
+
+	nsec := &dns.NSEC{}
+	nsec.Hdr.Name = rrs[0].Header().Name
+	nsec.Hdr.Rrtype = dns.TypeNSEC
+	nsec.Hdr.Class = dns.ClassINET
+	nsec.Hdr.Ttl = rrs[0].Header().Ttl
+	nsec.NextDomain = next
+	nsec.TypeBitMap = typeArray
+	return nsec
 }
 
 // AddNSECRecords edits an RRArray and adds the respective NSEC3 records to it.
-// If optOut is true, it sets the flag for NSEC3PARAM RR, following RFC5155 section 6.
-// It returns an error if there is a colission on the hashes.
+// If optOut is true, the insecure delegations (the ones without a DS record) are not covered by the NSEC3 chain,
+// and the NSEC3 records whose span covers them have the opt-out flag, following RFC5155 section 6.
+// Secure delegations and authoritative names are always covered. The NSEC3PARAM flags are always zero (RFC5155 4.1.2).
+// It uses a new random salt and DefaultNSEC3Iterations. If two names hash to the same NSEC3 owner with it,
+// the RRArray is not modified and an *NSEC3CollisionError is returned, so the records can be added again with
+// another salt.
 func (rrArray *RRArray) AddNSEC3Records(zone string, optOut bool) error {
-	set := rrArray.CreateRRSet(zone, false)
+	return rrArray.addNSEC3Records(zone, optOut, generateSalt(), DefaultNSEC3Iterations)
+}
+
+// NSEC3CollisionError is returned when two names of a zone hash to the same NSEC3 owner name.
+type NSEC3CollisionError struct {
+	Names [2]string // Colliding names
+	Hash  string    // Hashed owner name of both names
+	Salt  string    // Salt used for hashing
+}
 
-	h := make(map[string]bool)
-	collision := false
+func (e *NSEC3CollisionError) Error() string {
+	return fmt.Sprintf("NSEC3 hash collision between %s and %s (hash %s, salt %s)", e.Names[0], e.Names[1], e.Hash, e.Salt)
+}
+
+// addNSEC3Records adds the NSEC3 records to the RRArray, as AddNSEC3Records, using the salt and iterations provided.
+// All the names are hashed before adding any record, so collisions leave the RRArray untouched.
+func (rrArray *RRArray) addNSEC3Records(zone string, optOut bool, salt string, iterations uint16) error {
+	set := rrArray.createDenialSet(zone)
 
 	param := &dns.NSEC3PARAM{}
 	param.Hdr.Class = dns.ClassINET
 	param.Hdr.Rrtype = dns.TypeNSEC3PARAM
 	param.Hash = dns.SHA1
-	if optOut {
-		param.Flags = 1
-	}
-	param.Iterations = 100 // 100 is enough!
-	param.Salt = generateSalt()
-	// Possible library bug: for some reason the library does not parse the value in NSEC3PARAM as octets, but RFC5155 4.2
-	// specifies that the behaviour of this field is the same as NSEC3 case (3.1.4).
-	param.SaltLength = uint8(len(param.Salt))
+	param.Iterations = iterations
+	param.Salt = salt
+	param.SaltLength = uint8(len(param.Salt)) / 2 // length is in octets and salt is an hex value (RFC5155 4.2).
 	apex := ""
 	minttl := uint32(8600)
 
-	n := len(set)
-	last := -1
+	owners := make(map[string]string) // hashed name -> name
+	nsec3s := make(RRArray, 0, len(set))
+	optedOut := make([]string, 0) // hashed names of the insecure delegations left out of the chain
 
 	for _, rrs := range set {
 		typeMap := make(map[uint16]bool)
@@ -157,11 +371,18 @@ func (rrArray *RRArray) AddNSEC3Records(zone string, optOut bool) error {
 				minttl = rr.(*dns.SOA).Minttl
 				param.Hdr.Ttl = minttl
 				typeMap[dns.TypeNSEC3PARAM] = true
+				typeMap[dns.TypeDNSKEY] = true
 			}
 		}
-		if optOut && !typeMap[dns.TypeDS] && !typeMap[dns.TypeDNSKEY] {
+		insecureDelegation := typeMap[dns.TypeNS] && !typeMap[dns.TypeSOA] && !typeMap[dns.TypeDS]
+		if optOut && insecureDelegation {
+			optedOut = append(optedOut, dns.HashName(rrs[0].Header().Name, param.Hash, param.Iterations, param.Salt))
 			continue
 		}
+		// Only the NS records of insecure delegations are not signed (RFC5155 3.2).
+		if !insecureDelegation {
+			typeMap[dns.TypeRRSIG] = true
+		}
 
 		typeArray := make([]uint16, 0)
 		for k := range typeMap {
@@ -172,60 +393,73 @@ func (rrArray *RRArray) AddNSEC3Records(zone string, optOut bool) error {
 			return typeArray[i] < typeArray[j]
 		})
 
+		name := rrs[0].Header().Name
+		hName := dns.HashName(name, param.Hash, param.Iterations, param.Salt)
+		if other, ok := owners[hName]; ok {
+			return &NSEC3CollisionError{
+				Names: [2]string{other, name},
+				Hash:  hName,
+				Salt:  param.Salt,
+			}
+		}
+		owners[hName] = name
+
 		nsec3 := &dns.NSEC3{}
 		nsec3.Hdr.Class = dns.ClassINET
 		nsec3.Hdr.Rrtype = dns.TypeNSEC3
 		nsec3.Hash = param.Hash
-		nsec3.Flags = param.Flags
 		nsec3.Iterations = param.Iterations
 		nsec3.SaltLength = uint8(len(param.Salt)) / 2 // length is in octets and salt is an hex value.
 		nsec3.Salt = param.Salt
-		hName := dns.HashName(rrs[0].Header().Name, param.Hash,
-			param.Iterations, param.Salt)
-
-		if h[hName] {
-			collision = true
-			last = -1
-			break
-		}
-		h[hName] = true
-
 		nsec3.Hdr.Name = hName
 		nsec3.TypeBitMap = typeArray
+		nsec3.HashLength = 20 // It's the length of the hash, not the encoding
 
-		if last >= 0 { // not the first NSEC3 record
-			set[n+last][0].(*dns.NSEC3).NextDomain = nsec3.Hdr.Name
-			set[n+last][0].(*dns.NSEC3).HashLength = 20 // It's the length of the hash, not the encoding
-		}
-		last = last + 1
-
-		set = append(set, RRArray{nsec3})
+		nsec3s = append(nsec3s, nsec3)
 	}
 
-	if last >= 0 {
-		set[n+last][0].(*dns.NSEC3).NextDomain = set[n][0].Header().Name
-		set[n+last][0].(*dns.NSEC3).HashLength = 20 // It's the length of the hash, not the encoding
-
-		for i := n; i < len(set); i++ {
-			set[i][0].Header().Name = set[i][0].Header().Name + "." + apex
-			set[i][0].Header().Ttl = minttl
-			*rrArray = append(*rrArray, set[i][0])
+	if len(nsec3s) == 0 {
+		return nil
+	}
+	// The chain links the records in hash order (RFC5155 7.1).
+	sort.Slice(nsec3s, func(i, j int) bool {
+		return nsec3s[i].Header().Name < nsec3s[j].Header().Name
+	})
+	for i, rr := range nsec3s {
+		nsec3 := rr.(*dns.NSEC3)
+		nsec3.NextDomain = nsec3s[(i+1)%len(nsec3s)].Header().Name
+		for _, hName := range optedOut {
+			if nsec3Covers(nsec3.Hdr.Name, nsec3.NextDomain, hName) {
+				nsec3.Flags = 1 // Opt-Out flag
+				break
+			}
 		}
-
-		*rrArray = append(*rrArray, param)
-		sort.Sort(*rrArray)
 	}
-	if collision {
-		return fmt.Errorf("collision detected")
+	for _, rr := range nsec3s {
+		rr.Header().Name = rr.Header().Name + "." + apex
+		rr.Header().Ttl = minttl
+		*rrArray = append(*rrArray, rr)
 	}
+
+	*rrArray = append(*rrArray, param)
+	sort.Sort(*rrArray)
 	return nil
 }
 
+// nsec3Covers returns true if the hashed name is between the hashed owner and next names of an NSEC3 record.
+// The last record of the chain covers the names after its owner and before the first owner.
+func nsec3Covers(owner, next, hName string) bool {
+	if owner < next {
+		return owner < hName && hName < next
+	}
+	return owner < hName || hName < next
+}
+
 func getAllNSNames(rrArray RRArray) map[string]struct{} {
 	m := make(map[string]struct{})
 	for _, elem := range rrArray {
 		if _, ok := elem.(*dns.NS); ok {
-			m[dns.Fqdn(elem.Header().Name)] = struct{}{}
+			m[strings.ToLower(dns.Fqdn(elem.Header().Name))] = struct{}{}
 		}
 	}
 	return m
@@ -233,15 +467,83 @@ func getAllNSNames(rrArray RRArray) map[string]struct{} {
 
 // isSignable returns true if the rr requires to be signed.
 // The design of DNSSEC stipulates that delegations (non-apex NS records)
-// are not signed, and neither are any glue records.
+// are not signed, and neither are any glue records, at or below the delegation point.
+// The DS and NSEC records of a delegation point (and their RRSIGs) are authoritative data of the zone,
+// so they are signed (RFC4035 2.2).
+// Names are compared case insensitively, so nsNames must have lowercased keys, as returned by getAllNSNames.
 func isSignable(rr dns.RR, zone string, nsNames map[string]struct{}) bool {
-	rrName := dns.Fqdn(rr.Header().Name)
-	if _, ok := nsNames[rrName]; ok &&
-		rrName != dns.Fqdn(zone) {
+	rrName := strings.ToLower(dns.Fqdn(rr.Header().Name))
+	switch delegationPoint(rrName, zone, nsNames) {
+	case "":
+		return true
+	case rrName:
+		rrType := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrType = sig.TypeCovered
+		}
+		return rrType == dns.TypeDS || rrType == dns.TypeNSEC
+	default:
 		return false
 	}
-	// It could be a IPv6 glue, too
-	return true
+}
+
+// delegationPoint returns the highest delegation point (a name with non-apex NS records) at or above the lowercased
+// name, or an empty string if the name is not delegated.
+func delegationPoint(name, zone string, nsNames map[string]struct{}) string {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	point := ""
+	for n := name; n != zone && dns.IsSubDomain(zone, n); {
+		if _, ok := nsNames[n]; ok {
+			point = n
+		}
+		next, end := dns.NextLabel(n, 0)
+		if end {
+			break
+		}
+		n = n[next:]
+	}
+	return point
+}
+
+// CheckNSEC3Fields returns an error if any NSEC3 or NSEC3PARAM record of the zone uses a hash algorithm other than
+// SHA-1 (the only one defined), if a NSEC3PARAM record has flags (they must be zero, RFC5155 4.1.2), if a NSEC3
+// record has flags other than Opt-Out, or if the records do not share the same salt and iterations.
+func (rrArray RRArray) CheckNSEC3Fields() error {
+	params := ""
+	checkParams := func(name string, iterations uint16, salt string) error {
+		current := fmt.Sprintf("%d %s", iterations, strings.ToUpper(salt))
+		if params == "" {
+			params = current
+		} else if params != current {
+			return fmt.Errorf("%s has NSEC3 iterations and salt %s, but other records have %s", name, current, params)
+		}
+		return nil
+	}
+	for _, rr := range rrArray {
+		switch r := rr.(type) {
+		case *dns.NSEC3PARAM:
+			if r.Hash != dns.SHA1 {
+				return fmt.Errorf("NSEC3PARAM %s uses the unknown hash algorithm %d", r.Hdr.Name, r.Hash)
+			}
+			if r.Flags != 0 {
+				return fmt.Errorf("NSEC3PARAM %s has flags %d, but they must be 0", r.Hdr.Name, r.Flags)
+			}
+			if err := checkParams(r.Hdr.Name, r.Iterations, r.Salt); err != nil {
+				return err
+			}
+		case *dns.NSEC3:
+			if r.Hash != dns.SHA1 {
+				return fmt.Errorf("NSEC3 %s uses the unknown hash algorithm %d", r.Hdr.Name, r.Hash)
+			}
+			if r.Flags&^1 != 0 {
+				return fmt.Errorf("NSEC3 %s has flags %d, but only the Opt-Out flag (1) is defined", r.Hdr.Name, r.Flags)
+			}
+			if err := checkParams(r.Hdr.Name, r.Iterations, r.Salt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // sameRRSet returns true if both rrs provided should be on the same RRSet.
@@ -250,7 +552,7 @@ func sameRRSet(rr1, rr2 dns.RR, byType bool) bool {
 		return false
 	}
 	return rr1.Header().Class == rr2.Header().Class &&
-		strings.ToLower(dns.Fqdn(rr1.Header().Name)) == strings.ToLower(dns.Fqdn(rr2.Header().Name)) &&
+		strings.EqualFold(dns.Fqdn(rr1.Header().Name), dns.Fqdn(rr2.Header().Name)) &&
 		(!byType || rr1.Header().Rrtype == rr2.Header().Rrtype)
 }
 
@@ -2,9 +2,12 @@ package signer
 
 import (
 	"crypto"
+	"encoding/asn1"
 	"fmt"
 	"github.com/miekg/pkcs11"
 	"io"
+	"math/big"
+	"time"
 )
 
 // This prefixes are used for PKCS#1 padding of signatures.
@@ -18,8 +21,10 @@ var pkcs1Prefix = map[crypto.Hash][]byte{
 
 // RRSigner Implements crypto.Signer Interface.
 type RRSigner struct {
-	Session *Session            // PKCS#11 Session
-	SK, PK  pkcs11.ObjectHandle // Secret and Public Key handles
+	Session   *Session            // PKCS#11 Session
+	SK, PK    pkcs11.ObjectHandle // Secret and Public Key handles
+	Algorithm *Algorithm          // Algorithm of the keys. If nil, DefaultAlgorithm is used.
+	Retry     *RetryPolicy        // Retries of the signing operations failing with transient errors. If nil, they are not retried.
 }
 
 // Public returns the signer public key.
@@ -28,26 +33,99 @@ func (rs RRSigner) Public() crypto.PublicKey {
 }
 
 // Sign signs the content from the reader and returns a signature, or an error if it fails.
+// The content is a digest, except with EdDSA algorithms, which sign the whole data covered by the RRSIG.
 func (rs RRSigner) Sign(rand io.Reader, rr []byte, opts crypto.SignerOpts) ([]byte, error) {
 	if rs.Session == nil || rs.Session.Ctx == nil {
 		return nil, fmt.Errorf("session not initialized")
 	}
-	// Inspired in https://github.com/ThalesIgnite/crypto11/blob/38ef75346a1dc2094ffdd919341ef9827fb041c0/rsa.go#L281
-	oid := pkcs1Prefix[opts.HashFunc()]
-	T := make([]byte, len(oid)+len(rr))
-	copy(T[0:len(oid)], oid)
-	copy(T[len(oid):], rr)
+	alg := rs.Algorithm
+	if alg == nil {
+		alg = algorithms[DefaultAlgorithm]
+	}
+	if opts.HashFunc() != alg.Hash {
+		return nil, fmt.Errorf("digest %s does not match algorithm %s", opts.HashFunc(), alg)
+	}
+	T := rr
+	if alg.KeyType == pkcs11.CKK_RSA {
+		// Inspired in https://github.com/ThalesIgnite/crypto11/blob/38ef75346a1dc2094ffdd919341ef9827fb041c0/rsa.go#L281
+		oid := pkcs1Prefix[opts.HashFunc()]
+		T = make([]byte, len(oid)+len(rr))
+		copy(T[0:len(oid)], oid)
+		copy(T[len(oid):], rr)
+	}
 
 	mechanisms := []*pkcs11.Mechanism{
-		pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil),
+		pkcs11.NewMechanism(alg.Sign.Type, nil),
 	}
-	err := rs.Session.Ctx.SignInit(rs.Session.Handle, mechanisms, rs.SK)
+	var sig []byte
+	// A failed C_Sign terminates the operation, so each attempt initializes it again.
+	// If the session was lost, it is reconnected (as many times as the retries) and the signature is tried again.
+	err := rs.Session.withReconnect("signature", rs.Retry, func() error {
+		return rs.Retry.Do(rs.Session.logger(), "signature", func() (err error) {
+			start := time.Now()
+			rs.Session.countHSMCalls(1)
+			if err = rs.Session.Ctx.SignInit(rs.Session.Handle, mechanisms, rs.SK); err != nil {
+				return err
+			}
+			rs.Session.countHSMCalls(1)
+			if sig, err = rs.Session.Ctx.Sign(rs.Session.Handle, T); err == nil {
+				rs.Session.observeSignature(start)
+			}
+			return err
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
-	sig, err := rs.Session.Ctx.Sign(rs.Session.Handle, T)
-	if err != nil {
-		return nil, err
+	if alg.IsECDSA() {
+		// PKCS#11 returns R || S, but crypto.Signer (and miekg/dns) expects an ASN.1 signature.
+		return ecdsaRawToASN1(sig)
 	}
 	return sig, nil
 }
+
+// SignData digests and signs the data with the combined mechanism of the algorithm (as CKM_SHA256_RSA_PKCS),
+// for HSMs which digest the data themselves (DigestHSM). ECDSA signatures are returned as R || S, the format of DNSSEC.
+// EdDSA always signs the data, so it uses CKM_EDDSA in both digest modes.
+func (rs RRSigner) SignData(data []byte) ([]byte, error) {
+	if rs.Session == nil || rs.Session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	alg := rs.Algorithm
+	if alg == nil {
+		alg = algorithms[DefaultAlgorithm]
+	}
+	mechanisms := []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(alg.DigestSign.Type, nil),
+	}
+	var sig []byte
+	err := rs.Session.withReconnect("signature", rs.Retry, func() error {
+		return rs.Retry.Do(rs.Session.logger(), "signature", func() (err error) {
+			start := time.Now()
+			rs.Session.countHSMCalls(1)
+			if err = rs.Session.Ctx.SignInit(rs.Session.Handle, mechanisms, rs.SK); err != nil {
+				return err
+			}
+			rs.Session.countHSMCalls(1)
+			if sig, err = rs.Session.Ctx.Sign(rs.Session.Handle, data); err == nil {
+				rs.Session.observeSignature(start)
+			}
+			return err
+		})
+	})
+	return sig, err
+}
+
+// ecdsaRawToASN1 transforms an ECDSA signature in the R || S format into an ASN.1 DER signature.
+func ecdsaRawToASN1(sig []byte) ([]byte, error) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature length: %d", len(sig))
+	}
+	half := len(sig) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(sig[:half]),
+		S: new(big.Int).SetBytes(sig[half:]),
+	})
+}
@@ -0,0 +1,41 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// RRSetError is the failure to sign an RRset of the zone, collected when SignArgs.ContinueOnError is true.
+type RRSetError struct {
+	Name string // Owner name of the RRset
+	Type uint16 // Type of the RRset
+	Err  error  // Error signing the RRset or checking its RRSIGs
+}
+
+func (e *RRSetError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Name, dns.Type(e.Type), e.Err)
+}
+
+// RRSetErrors are the RRsets that could not be signed when SignArgs.ContinueOnError is true. Sign returns them
+// after writing the signed zone, where those RRsets have no RRSIGs.
+type RRSetErrors []*RRSetError
+
+func (errs RRSetErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("cannot sign %d RRsets: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// recoverable returns true if the zone can still be signed without the RRSIGs of the RRset, as when
+// SignArgs.ContinueOnError is true. The SOA and the denial of existence records must always be signed,
+// because resolvers cannot validate any response of the zone without them.
+func recoverable(set RRArray) bool {
+	switch set[0].Header().Rrtype {
+	case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package signer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SerialPolicy defines how the SOA serial of the zone is updated when it is signed.
+type SerialPolicy int
+
+const (
+	SerialIncrement SerialPolicy = iota // The serial is incremented by one
+	SerialKeep                          // The serial is not changed, so secondaries do not transfer the zone again
+	SerialUnixTime                      // The serial is the current Unix time
+	SerialValue                         // The serial is SignArgs.SerialValue
+	SerialDate                          // The serial is the current date (UTC) as YYYYMMDDnn, incrementing nn if it is already that date
+)
+
+// serialPolicies maps the names of the serial policies to their values.
+var serialPolicies = map[string]SerialPolicy{
+	"increment": SerialIncrement,
+	"keep":      SerialKeep,
+	"unixtime":  SerialUnixTime,
+	"date":      SerialDate,
+}
+
+// ParseSerialPolicy returns the serial policy with the name provided (increment, keep, unixtime or date).
+// If the name is a number, it returns SerialValue and the number as the value of the serial.
+func ParseSerialPolicy(name string) (SerialPolicy, uint32, error) {
+	if policy, ok := serialPolicies[strings.ToLower(name)]; ok {
+		return policy, 0, nil
+	}
+	value, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unknown serial policy %s (it should be increment, keep, unixtime, date or a serial number)", name)
+	}
+	return SerialValue, uint32(value), nil
+}
+
+// newSerial returns the serial of the signed zone, following args.Serial. The unixtime and date policies use the
+// time at which the signature started (see startTime), as the inception of the RRSIGs.
+// The date policy works as in BIND: the serial is YYYYMMDD00 if the old one is lower, and it is incremented by one
+// otherwise, so the counter can move into the next date when the zone is signed more than 100 times in a day.
+// The increment, unixtime and date policies return an error if the new serial would not be greater than
+// the old one in serial number arithmetic (RFC1982), because secondaries would ignore the new zone.
+func (args *SignArgs) newSerial(old uint32) (uint32, error) {
+	var serial uint32
+	switch args.Serial {
+	case SerialKeep:
+		return old, nil
+	case SerialValue:
+		return args.SerialValue, nil
+	case SerialUnixTime:
+		serial = uint32(args.startTime().Unix())
+	case SerialDate:
+		if serial = dateSerial(args.startTime()); !serialGreater(serial, old) {
+			serial = old + 1
+		}
+	default:
+		serial = old + 1
+	}
+	if !serialGreater(serial, old) {
+		return 0, fmt.Errorf("new serial %d is not greater than the zone serial %d", serial, old)
+	}
+	return serial, nil
+}
+
+// dateSerial returns the YYYYMMDD00 serial of the date of t in UTC.
+func dateSerial(t time.Time) uint32 {
+	t = t.UTC()
+	return uint32(t.Year()*1000000 + int(t.Month())*10000 + t.Day()*100)
+}
+
+// serialGreater returns true if s1 is greater than s2 in serial number arithmetic (RFC1982 3.2).
+func serialGreater(s1, s2 uint32) bool {
+	return s1 != s2 && s1-s2 < 1<<31
+}
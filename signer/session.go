@@ -1,6 +1,8 @@
 package signer
 
 import (
+	"crypto/ed25519"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
@@ -8,17 +10,28 @@ import (
 	"github.com/miekg/pkcs11"
 //	"io"
 	"log"
-	"sort"
 	"time"
 )
 
 // Session represents a PKCS#11 session. It includes the context, the session handle and a Label String,
 // used in creation and retrieval of DNS keys.
 type Session struct {
-	Ctx    *pkcs11.Ctx          // PKCS#11 Context
-	Handle pkcs11.SessionHandle // Session Handle
-	Label  string               // Key Label
-	Log    *log.Logger          // Logger (for output)
+	Ctx     Context              // PKCS#11 Context
+	Handle  pkcs11.SessionHandle // Session Handle
+	Label   string               // Key Label
+	Log     Logger               // Logger (for output)
+	KeyTemplate *KeyTemplate     // Attributes of the generated keys. If nil, DefaultKeyTemplate is used.
+	KeySelector *KeySelector     // If not nil, the signing keys are the existing keys with its label and IDs
+	metrics Metrics              // Metrics of the signature in progress, which counts the PKCS#11 calls
+	ownsCtx bool                 // If true, the context was initialized by the session and End finalizes it
+	opened  bool                 // If true, the session was opened on slot with pin, so Reconnect can open it again
+	slot    uint                 // Slot of the session
+	pin     string               // HSM user key, to login again when reconnecting
+}
+
+// logger returns the logger of the session, or a logger discarding every message if Log is nil.
+func (session *Session) logger() Logger {
+	return orNop(session.Log)
 }
 
 // Key represents a structure with a handle and an expiration date.
@@ -41,11 +54,45 @@ type SessionSignArgs struct {
         Keys	    *ValidKeys // Signature keys
         Zsk	    *dns.DNSKEY  // ZSK
         Ksk	    *dns.DNSKEY  // KSK
+        Plan	    *SignPlan    // Signing plan, set only on dry runs
+        rollover    *RolloverState        // Phase of the ZSK rollover of the signature, set by Rollover
+        createdKeys []pkcs11.ObjectHandle // Keys created by GetKeys
+        expiredKeys []*Key                // Keys expired by GetKeys, with their original expiration dates
 }
 
 // NewSession creates a new session, using the pkcs#11 library defined in the arguments.
 // The arguments also define the HSM user key and the label the keys will use when created or retrieved.
+// The standard library logger is wrapped in a StdLogger that logs every level, and if it is nil the messages
+// are discarded. Other Logger implementations can be set replacing the Log field of the session.
+// The library is loaded and initialized by the session, and it is finalized when the session ends.
 func NewSession(p11lib, key, label string, log *log.Logger) (*Session, error) {
+	p, err := initContext(p11lib)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("Error checking slots: %s\n", err)
+	}
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("Error checking slots: no slot with a token found\n")
+	}
+	session, err := NewSessionWithContext(p, slots[0], key, label, log)
+	if err != nil {
+		return nil, err
+	}
+	session.ownsCtx = true
+	return session, nil
+}
+
+// NewSessionWithPIN creates a new session as NewSession, but the user PIN is read from the provider (as an
+// environment variable, a file or a prompt) before loading the library.
+func NewSessionWithPIN(p11lib string, pin PINProvider, label string, log *log.Logger) (*Session, error) {
+	return NewSessionWithToken(p11lib, TokenSelector{}, pin, label, log)
+}
+
+// initContext loads and initializes the pkcs#11 library.
+func initContext(p11lib string) (*pkcs11.Ctx, error) {
 	p := pkcs11.New(p11lib)
 	if p == nil {
 		return nil, fmt.Errorf("Error initializing %s: file not found\n", p11lib)
@@ -54,31 +101,54 @@ func NewSession(p11lib, key, label string, log *log.Logger) (*Session, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing %s: %s. (Has the .db RW permission?)\n", p11lib, err)
 	}
-	slots, err := p.GetSlotList(true)
-	if err != nil {
-		return nil, fmt.Errorf("Error checking slots: %s\n", err)
+	return p, nil
+}
+
+// NewSessionWithContext creates a new session on a slot of an already initialized pkcs#11 context,
+// so many sessions can share the same loaded library. The other arguments are the same as in NewSession.
+// If the user is already logged in the token by another session of the context, the login is reused.
+// Ending the session does not log out nor finalize the context, which must be done by its owner
+// after all its sessions end.
+func NewSessionWithContext(p Context, slot uint, key, label string, log *log.Logger) (*Session, error) {
+	if ctx, ok := p.(*pkcs11.Ctx); p == nil || ok && ctx == nil {
+		return nil, fmt.Errorf("Error creating session: context not initialized\n")
 	}
-	session, err := p.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating session: %s\n", err)
 	}
 	err = p.Login(session, pkcs11.CKU_USER, key)
-	if err != nil {
+	if err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		p.CloseSession(session)
 		return nil, fmt.Errorf("Error login with provided key: %s\n", err)
 	}
 	return &Session{
 		Ctx:    p,
 		Handle: session,
 		Label:  label,
-		Log:    log,
+		Log:    newLogger(log),
+		opened: true,
+		slot:   slot,
+		pin:    key,
 	}, nil
 }
 
+// isPKCS11Error returns true if err is the PKCS#11 error with the code provided.
+func isPKCS11Error(err error, code uint) bool {
+	p11Err, ok := err.(pkcs11.Error)
+	return ok && uint(p11Err) == code
+}
+
 // End finishes a session execution, logging out and clossing the session.
+// If the session was created with NewSessionWithContext, it only closes the session,
+// because logging out would affect the other sessions of the context.
 func (session *Session) End() error {
 	if session.Ctx == nil {
 		return fmt.Errorf("session not initialized")
 	}
+	if !session.ownsCtx {
+		return session.Ctx.CloseSession(session.Handle)
+	}
 	if err := session.Ctx.Logout(session.Handle); err != nil {
 		return err
 	}
@@ -92,6 +162,33 @@ func (session *Session) End() error {
 	return nil
 }
 
+// Session states of PKCS#11 sessions with a logged in user (CK_STATE), not defined by miekg/pkcs11.
+const (
+	cksROUserFunctions = 1 // CKS_RO_USER_FUNCTIONS
+	cksRWUserFunctions = 3 // CKS_RW_USER_FUNCTIONS
+)
+
+// HealthCheck returns an error if the session cannot be used to sign anymore: if the token was removed,
+// the session was closed or invalidated, or the user is no longer logged in. It only asks the HSM for the
+// session and token information, so it is cheap enough to be called periodically. If it fails, the session
+// should be ended and a new one created with NewSession.
+func (session *Session) HealthCheck() error {
+	if session == nil || session.Ctx == nil {
+		return fmt.Errorf("session not initialized")
+	}
+	info, err := session.Ctx.GetSessionInfo(session.Handle)
+	if err != nil {
+		return fmt.Errorf("cannot get session info: %s", err)
+	}
+	if info.State != cksROUserFunctions && info.State != cksRWUserFunctions {
+		return fmt.Errorf("session is not logged in (state %d)", info.State)
+	}
+	if _, err := session.Ctx.GetTokenInfo(info.SlotID); err != nil {
+		return fmt.Errorf("cannot get token info of slot %d: %s", info.SlotID, err)
+	}
+	return nil
+}
+
 // DestroyAllKeys destroys all the keys using the label defined in the session struct.
 func (session *Session) DestroyAllKeys() error {
 	if session == nil || session.Ctx == nil {
@@ -106,7 +203,7 @@ func (session *Session) DestroyAllKeys() error {
 		return err
 	}
 	if len(objects) > 0 {
-		session.Log.Printf("Keys found. Deleting...\n")
+		session.logger().Info("Keys found. Deleting...", "label", session.Label)
 		foundDeleteTemplate := []*pkcs11.Attribute{
 			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
 			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
@@ -121,10 +218,10 @@ func (session *Session) DestroyAllKeys() error {
 			} else if uint(attr[2].Value[0]) == pkcs11.CKO_PRIVATE_KEY {
 				class = "private"
 			}
-			session.Log.Printf("Deleting key with label=%s, id=%s and type=%s\n", string(attr[0].Value), string(attr[1].Value), class)
+			session.logger().Info("Deleting key", "label", string(attr[0].Value), "id", string(attr[1].Value), "type", class)
 
 			if e := session.Ctx.DestroyObject(session.Handle, object); e != nil {
-				session.Log.Printf("Destroy Key failed %s\n", e)
+				session.logger().Error("Destroy Key failed", "error", e)
 			}
 		}
 	} else {
@@ -134,39 +231,75 @@ func (session *Session) DestroyAllKeys() error {
 }
 
 // GetKeys get the public key string and private key habdler from HSM
+// If CreateKeys is true, the current keys are expired and new keys are created. The expired and created
+// keys are recorded in args, so Sign can restore the token state if signing fails. CreateZSK and CreateKSK
+// do the same only with the keys of their role, reusing the keys of the other one. The sizes of the RSA keys
+// created must be supported by the mechanisms of the token (see CheckKeySize).
 // returns: error, if any
 
 func (session *Session) GetKeys(args *SessionSignArgs) (error) {
-	keys, err := session.SearchValidKeys()
+	alg, err := GetAlgorithm(args.Algorithm)
+	if err != nil {
+		return err
+	}
+	if err := session.CheckDigestMode(alg, args.Digest); err != nil {
+		return err
+	}
+	if err := session.keyTemplate().Validate(); err != nil {
+		return err
+	}
+	if session.KeySelector != nil && (args.createKeys(false) || args.createKeys(true)) {
+		return fmt.Errorf("keys cannot be created when they are selected by ID with a key selector")
+	}
+	keys, err := session.searchKeys(alg, args.Zone)
 	if err != nil {
 		return err
 	}
 
-	if args.CreateKeys {
-		defaultExpDate := time.Now().AddDate(1, 0, 0)
-		var public, private pkcs11.ObjectHandle
+	zskBits, err := args.keyBits(alg, false)
+	if err != nil {
+		return err
+	}
+	kskBits, err := args.keyBits(alg, true)
+	if err != nil {
+		return err
+	}
+	for _, created := range []struct {
+		ksk  bool
+		bits int
+	}{{false, zskBits}, {true, kskBits}} {
+		if !args.createKeys(created.ksk) {
+			continue
+		}
+		if err := session.CheckKeySize(alg, args.Digest, created.bits); err != nil {
+			return err
+		}
+	}
+	defaultExpDate := time.Now().AddDate(1, 0, 0)
+	var public, private pkcs11.ObjectHandle
+	if args.createKeys(false) {
 		if keys.PublicZSK != nil {
-			err = session.ExpireKey(keys.PublicZSK.Handle)
+			err = session.expireKey(args, keys.PublicZSK)
 			if err != nil {
 				return err
 			}
 		}
 		if keys.PrivateZSK != nil {
-			err = session.ExpireKey(keys.PrivateZSK.Handle)
+			err = session.expireKey(args, keys.PrivateZSK)
 			if err != nil {
 				return err
 			}
 		}
-		session.Log.Printf("generating zsk\n")
-		public, private, err = session.GenerateRSAKeyPair(
-			"zsk",
-			true,
-			defaultExpDate,
-			1024,
-		)
+		session.logger().Info("generating zsk", "algorithm", alg)
+		err = args.Retry.Do(session.logger(), "zsk generation", func() (err error) {
+			public, private, err = session.generateKeyPair(alg, args.Zone, "zsk", defaultExpDate, zskBits)
+			return err
+		})
 		if err != nil {
 			return err
 		}
+		session.logger().Info("Key created", "zone", args.Zone, "role", "zsk", "algorithm", alg, "bits", zskBits)
+		args.createdKeys = append(args.createdKeys, public, private)
 		keys.PublicZSK = &Key{
 			Handle:  public,
 			ExpDate: defaultExpDate,
@@ -175,29 +308,30 @@ func (session *Session) GetKeys(args *SessionSignArgs) (error) {
 			Handle:  private,
 			ExpDate: defaultExpDate,
 		}
-
+	}
+	if args.createKeys(true) {
 		if keys.PublicKSK != nil {
-			err = session.ExpireKey(keys.PublicKSK.Handle)
+			err = session.expireKey(args, keys.PublicKSK)
 			if err != nil {
 				return err
 			}
 		}
 		if keys.PrivateKSK != nil {
-			err = session.ExpireKey(keys.PrivateKSK.Handle)
+			err = session.expireKey(args, keys.PrivateKSK)
 			if err != nil {
 				return err
 			}
 		}
-		session.Log.Printf("generating ksk\n")
-		public, private, err = session.GenerateRSAKeyPair(
-			"ksk",
-			true,
-			defaultExpDate,
-			2048,
-		)
+		session.logger().Info("generating ksk", "algorithm", alg)
+		err = args.Retry.Do(session.logger(), "ksk generation", func() (err error) {
+			public, private, err = session.generateKeyPair(alg, args.Zone, "ksk", defaultExpDate, kskBits)
+			return err
+		})
 		if err != nil {
 			return err
 		}
+		session.logger().Info("Key created", "zone", args.Zone, "role", "ksk", "algorithm", alg, "bits", kskBits)
+		args.createdKeys = append(args.createdKeys, public, private)
 		keys.PublicKSK = &Key{
 			Handle:  public,
 			ExpDate: defaultExpDate,
@@ -206,173 +340,301 @@ func (session *Session) GetKeys(args *SessionSignArgs) (error) {
 			Handle:  private,
 			ExpDate: defaultExpDate,
 		}
-		session.Log.Printf("keys generated.\n")
 	}
 
-	if keys.PublicZSK == nil || keys.PublicKSK == nil {
-		err = fmt.Errorf(
-			"valid keys not found. If you have not keys stored " +
-                        "in the HSM, you can create a new pair with " +
-                        "--create-keys flag",
-		)
+	offline := len(args.OfflineKSK) > 0
+	if err := session.checkKeys(alg, args.Zone, keys, offline); err != nil {
 		return err
 	}
         args.Keys = keys
 
         // ok, we create DNSKEYS
 
-	zskBytes, err := session.GetKeyBytes(keys.PublicZSK.Handle)
+	zskBytes, err := session.getPublicKeyBytes(alg, keys.PublicZSK.Handle)
 	if err != nil {
 		return err
 	}
 	args.Zsk = CreateNewDNSKEY(
 		args.Zone,
 		256,
-		8, // RSA/SHA256 (https://www.iana.org/assignments/dns-sec-alg-numbers/dns-sec-alg-numbers.xhtml)
-		args.MinTTL,
+		alg.Number,
+		args.dnskeyTTL(),
 		base64.StdEncoding.EncodeToString(zskBytes),
 	)
 
-	kskBytes, err := session.GetKeyBytes(keys.PublicKSK.Handle)
+	// The KSK signing offline is not in the HSM, so its DNSKEY is the one of the offline RRset.
+	if offline {
+		ksk, err := args.offlineKSK(alg)
+		if err != nil {
+			return err
+		}
+		args.Ksk = ksk.DNSKEY
+		return nil
+	}
+	kskBytes, err := session.getPublicKeyBytes(alg, keys.PublicKSK.Handle)
 	if err != nil {
 		return err
 	}
 	args.Ksk = CreateNewDNSKEY(
 		args.Zone,
 		257,
-		8,      // RSA/SHA256 (https://www.iana.org/assignments/dns-sec-alg-numbers/dns-sec-alg-numbers.xhtml)
-		args.MinTTL, // SOA -> minimum TTL
+		alg.Number,
+		args.dnskeyTTL(), // SOA -> minimum TTL, unless DNSKEYTTL is set
 		base64.StdEncoding.EncodeToString(kskBytes),
 	)
 
 	return nil
 }
 
-// Sign signs a zone file and outputs the result into out path (if its length is more than zero).
-// It also dumps the new signed filezone to the standard output.
+// Sign parses the zone file, adds its NSEC or NSEC3 records, gets the signing keys (creating them if
+// CreateKeys is true), signs the zone and outputs the result into args.Output. It returns the SHA-256 DS of the KSK.
+// If DryRun is true, it only plans the signature: the plan is stored in args.Plan and the HSM is not used.
+// If signing fails, the keys created during the process are destroyed and the keys expired by it are restored,
+// leaving the pre-existing keys untouched. The keys are kept if it only returns RRSetErrors (see ContinueOnError).
+// The zone can be provided as a zone file in args.File or as RRs in args.RRs, but not both.
+// If args.Algorithms has many algorithms, the zone is signed with the keys of each one and the DS of the first
+// algorithm is returned. The algorithms must use different key types, because the keys are found by label and type.
+// If args.Stream is true, the zone file is signed and written name by name (see SignArgs.Stream).
+// If args.Concurrency is greater than one, the RRsets are signed concurrently in that many sessions of the context.
+// If args.OfflineKSK is not empty, only the ZSKs must be in the HSM.
 func (session *Session) Sign(args *SessionSignArgs) (ds *dns.DS, err error) {
-
-	session.Log.Printf("Start signing...\n")
-	zskSigner := RRSigner{
-		Session: session,
-		PK:      args.Keys.PublicZSK.Handle,
-		SK:      args.Keys.PrivateZSK.Handle,
+	algs, err := args.signingAlgorithms()
+	if err != nil {
+		return nil, err
 	}
-
-	kskSigner := RRSigner{
-		Session: session,
-		PK:      args.Keys.PublicKSK.Handle,
-		SK:      args.Keys.PrivateKSK.Handle,
+	for i, alg := range algs {
+		for _, other := range algs[:i] {
+			if alg.KeyType == other.KeyType && string(alg.ECParams) == string(other.ECParams) {
+				return nil, fmt.Errorf("algorithms %s and %s use the same HSM keys, so they cannot sign the zone at the same time", other, alg)
+			}
+		}
 	}
-
-	rrSet := args.RRs.CreateRRSet(args.Zone, true)
-
-	for _, v := range rrSet {
-		rrSig := CreateNewRRSIG(args.Zone, 
-					args.Zsk, 
-					args.SignExpDate, 
-					v[0].Header().Ttl)
-		err = rrSig.Sign(zskSigner, v)
-		if err != nil {
-			err = fmt.Errorf("cannot sign RRSig: %s", err)
+	if args.DryRun {
+		args.Plan, err = PlanSign(args.SignArgs)
+		return nil, err
+	}
+	session.metrics = args.Metrics
+	defer func() {
+		session.metrics = nil
+	}()
+	var stream *zoneStream
+	if args.Stream {
+		stream, err = newZoneStream(args.SignArgs, session.logger())
+	} else {
+		err = prepareZone(args.SignArgs, session.logger())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// With ContinueOnError, the zone is written with the keys even if some RRsets fail, so they are kept.
+		if _, partial := err.(RRSetErrors); err != nil && !partial {
+			session.rollbackKeys(args)
+		}
+		args.createdKeys = nil
+		args.expiredKeys = nil
+	}()
+	// GetKeys works with args.Algorithm, so it is set to each algorithm and restored later.
+	// The algorithms are taken in reverse order, so Keys, Zsk and Ksk end with the keys of the first one.
+	algorithm := args.Algorithm
+	defer func() {
+		args.Algorithm = algorithm
+	}()
+	zsks := make([]*KeyPair, 0, len(algs))
+	ksks := make([]*KeyPair, 0, len(algs))
+	for i := len(algs) - 1; i >= 0; i-- {
+		alg := algs[i]
+		args.Algorithm = alg.Number
+		start := time.Now()
+		if err = session.GetKeys(args); err != nil {
 			return nil, err
 		}
-		err = rrSig.Verify(args.Zsk, v)
-		if err != nil {
-			err = fmt.Errorf("cannot check RRSig: %s", err)
+		args.observe(StageKeygen, start)
+		zsk := session.keyPair(args, alg, args.Zsk, args.Keys.PublicZSK.Handle, args.Keys.PrivateZSK.Handle)
+		ksk := &KeyPair{DNSKEY: args.Ksk}
+		if len(args.OfflineKSK) == 0 {
+			ksk = session.keyPair(args, alg, args.Ksk, args.Keys.PublicKSK.Handle, args.Keys.PrivateKSK.Handle)
+		}
+		if args.rollover != nil {
+			if zsk, err = session.rolloverZSK(args, alg, zsk); err != nil {
+				return nil, err
+			}
+		}
+		zsks = append([]*KeyPair{zsk}, zsks...)
+		ksks = append([]*KeyPair{ksk}, ksks...)
+	}
+	if stream != nil {
+		return stream.sign(zsks, ksks)
+	}
+	if args.Concurrency > 1 {
+		if args.workers, err = session.openWorkers(args.Concurrency-1, args.Metrics); err != nil {
 			return nil, err
 		}
-		args.RRs = append(args.RRs, rrSig)
+		defer func() {
+			closeWorkers(args.workers)
+			args.workers = nil
+		}()
 	}
+	return signRRs(args.SignArgs, zsks, ksks, session.logger())
+}
 
-	rrDNSKeys := RRArray{args.Zsk, args.Ksk}
-
-	rrDNSKeySig := CreateNewRRSIG(args.Zone, 
-				      args.Ksk, 
-				      args.SignExpDate, 
-				      args.Ksk.Hdr.Ttl)
-	err = rrDNSKeySig.Sign(kskSigner, rrDNSKeys)
-	if err != nil {
-		return nil, err
+// keyPair returns the key pair of the DNSKEY with the public and private keys of the HSM provided.
+func (session *Session) keyPair(args *SessionSignArgs, alg *Algorithm, dnskey *dns.DNSKEY, public, private pkcs11.ObjectHandle) *KeyPair {
+	signer := RRSigner{
+		Session:   session,
+		PK:        public,
+		SK:        private,
+		Algorithm: alg,
+		Retry:     &args.Retry,
 	}
-	err = rrDNSKeySig.Verify(args.Ksk, rrDNSKeys)
-	if err != nil {
-		err = fmt.Errorf("cannot check ksk RRSig: %s", err)
-		return nil, err
+	pair := &KeyPair{
+		DNSKEY: dnskey,
+		Signer: signer,
 	}
-
-	args.RRs = append(args.RRs, args.Zsk, args.Ksk, rrDNSKeySig)
-
-	sort.Sort(args.RRs)
-	ds = args.Ksk.ToDS(1)
-	session.Log.Printf("DS: %s\n", ds) // SHA256
-	err = args.RRs.WriteZone(args.Output)
-	return ds, err
+	if args.Digest == DigestHSM {
+		pair.SignData = signer.SignData
+	}
+	return pair
 }
 
 // FindObject returns an object from the HSM following an specific template.
-// It returns at most 1024 objects.
+// It returns at most 1024 objects. If the session was lost, it is reconnected and the search is repeated once.
 // If it fails, it returns a null array and an error.
 func (session *Session) FindObject(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
 	if session == nil || session.Ctx == nil {
 		return nil, fmt.Errorf("session not initialized")
 	}
-	if err := session.Ctx.FindObjectsInit(session.Handle, template); err != nil {
-		return nil, err
-	}
-	obj, _, err := session.Ctx.FindObjects(session.Handle, 1024)
+	var obj []pkcs11.ObjectHandle
+	err := session.withReconnect("find objects", nil, func() (err error) {
+		session.countHSMCalls(1)
+		if err = session.Ctx.FindObjectsInit(session.Handle, template); err != nil {
+			return err
+		}
+		session.countHSMCalls(1)
+		if obj, _, err = session.Ctx.FindObjects(session.Handle, 1024); err != nil {
+			return err
+		}
+		session.countHSMCalls(1)
+		return session.Ctx.FindObjectsFinal(session.Handle)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if err := session.Ctx.FindObjectsFinal(session.Handle); err != nil {
-		return nil, err
-	}
 	return removeDuplicates(obj), nil
 }
 
 // GenerateRSAKeyPair creates a RSA key pair, or returns an error if it cannot create the key pair.
+// The keys are labeled with the key label of the session and have the security attributes of its key template.
 func (session *Session) GenerateRSAKeyPair(tokenLabel string, tokenPersistent bool, expDate time.Time, bits int) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
 	if session == nil || session.Ctx == nil {
 		return 0, 0, fmt.Errorf("session not initialized")
 	}
-	today := time.Now()
-	publicKeyTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, session.Label),
-		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(tokenLabel)),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
-		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, tokenPersistent),
-		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, today),
-		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, expDate),
-		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	template := *session.keyTemplate()
+	template.Token = tokenPersistent
+	return session.generateWithTemplate(&template, algorithms[dns.RSASHA256].KeyGen, pkcs11.CKK_RSA, session.Label, tokenLabel, expDate, rsaAttributes(bits))
+}
+
+// GenerateECDSAKeyPair creates an ECDSA key pair over the curve defined by the DER encoded ecParams,
+// or returns an error if it cannot create the key pair.
+// The keys are labeled with the key label of the session and have the security attributes of its key template.
+func (session *Session) GenerateECDSAKeyPair(tokenLabel string, tokenPersistent bool, expDate time.Time, ecParams []byte) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if session == nil || session.Ctx == nil {
+		return 0, 0, fmt.Errorf("session not initialized")
+	}
+	template := *session.keyTemplate()
+	template.Token = tokenPersistent
+	return session.generateWithTemplate(&template, algorithms[dns.ECDSAP384SHA384].KeyGen, pkcs11.CKK_EC, session.Label, tokenLabel, expDate, ecAttributes(ecParams))
+}
+
+// rsaAttributes returns the public key attributes of an RSA key pair of the size provided.
+func rsaAttributes(bits int) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
 		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
 	}
+}
 
-	privateKeyTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, session.Label),
-		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(tokenLabel)),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
-		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, tokenPersistent),
-		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, today),
-		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, expDate),
-		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
-	}
-
-	pubKey, privKey, err := session.Ctx.GenerateKeyPair(
-		session.Handle,
-		[]*pkcs11.Mechanism{
-			pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil),
-		},
-		publicKeyTemplate,
-		privateKeyTemplate,
-	)
+// ecAttributes returns the public key attributes of an ECDSA key pair over the curve provided.
+func ecAttributes(ecParams []byte) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+	}
+}
+
+// generateKeyPair creates a key pair of the zone for the algorithm, with the role provided (zsk or ksk)
+// and the label, ID and attributes of the key template of the session.
+// bits is only used by RSA algorithms, and the other ones use the curve of the algorithm.
+func (session *Session) generateKeyPair(alg *Algorithm, zone, role string, expDate time.Time, bits int) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	template := session.keyTemplate()
+	label := template.format(template.Label, session.Label, zone, role)
+	id := template.format(template.ID, session.Label, zone, role)
+	publicAttrs := rsaAttributes(bits)
+	if len(alg.ECParams) > 0 {
+		publicAttrs = ecAttributes(alg.ECParams)
+	}
+	return session.generateWithTemplate(template, alg.KeyGen, alg.KeyType, label, id, expDate, publicAttrs)
+}
+
+// getPublicKeyBytes returns the bytes of the public key identified by the handle, in the DNSKEY format of the algorithm.
+func (session *Session) getPublicKeyBytes(alg *Algorithm, object pkcs11.ObjectHandle) ([]byte, error) {
+	if alg.IsECDSA() {
+		return session.GetECKeyBytes(object)
+	}
+	if alg.IsEdDSA() {
+		return session.GetEdDSAKeyBytes(object)
+	}
+	return session.GetKeyBytes(object)
+}
+
+// GetEdDSAKeyBytes returns the bytes of the Ed25519 key identified by the handle in the format specified by RFC8080
+// (the 32 bytes of the public key, as encoded in RFC8032).
+func (session *Session) GetEdDSAKeyBytes(object pkcs11.ObjectHandle) ([]byte, error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	session.countHSMCalls(1)
+	attr, err := session.Ctx.GetAttributeValue(session.Handle, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	return pubKey, privKey, nil
+	point := attr[0].Value
+	// As with ECDSA, the point should be a DER encoded OCTET STRING, but some HSMs return it raw.
+	var octets []byte
+	if rest, err := asn1.Unmarshal(point, &octets); err == nil && len(rest) == 0 {
+		point = octets
+	}
+	if len(point) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key length: %d", len(point))
+	}
+	return point, nil
+}
+
+// GetECKeyBytes returns the bytes of the ECDSA key identified by the handle in the format specified by RFC6605
+// (the X and Y coordinates of the point, concatenated).
+func (session *Session) GetECKeyBytes(object pkcs11.ObjectHandle) ([]byte, error) {
+	if session == nil || session.Ctx == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+	session.countHSMCalls(1)
+	attr, err := session.Ctx.GetAttributeValue(session.Handle, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	point := attr[0].Value
+	// The point should be a DER encoded OCTET STRING, but some HSMs return it raw.
+	var octets []byte
+	if rest, err := asn1.Unmarshal(point, &octets); err == nil && len(rest) == 0 {
+		point = octets
+	}
+	// Only uncompressed points (0x04 || X || Y) are supported.
+	if len(point) == 0 || point[0] != 0x04 || len(point)%2 != 1 {
+		return nil, fmt.Errorf("invalid EC point. It must be uncompressed")
+	}
+	return point[1:], nil
 }
 
 // GetKeyBytes returns the bytes of the key identified by the handle in the format specified by RFC3110.
@@ -387,6 +649,7 @@ func (session *Session) GetKeyBytes(object pkcs11.ObjectHandle) ([]byte, error)
 		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
 	}
 
+	session.countHSMCalls(1)
 	attr, err := session.Ctx.GetAttributeValue(session.Handle, object, PKTemplate)
 	if err != nil {
 		return nil, err
@@ -410,92 +673,83 @@ func (session *Session) GetKeyBytes(object pkcs11.ObjectHandle) ([]byte, error)
 	return a, nil
 }
 
-// SearchValidKeys returns an array with the valid keys stored in the HSM.
-func (session *Session) SearchValidKeys() (*ValidKeys, error) {
+// SearchValidKeys returns an array with the valid keys stored in the HSM for the algorithm provided.
+// The labels and IDs of the keys are the ones of the key template of the session for no zone, so the keys
+// of key templates depending on the zone are not found.
+func (session *Session) SearchValidKeys(alg *Algorithm) (*ValidKeys, error) {
+	return session.searchKeys(alg, "")
+}
+
+// searchKeys returns the valid keys of the zone stored in the HSM for the algorithm provided,
+// as SearchValidKeys, with the labels and IDs of the key template of the session for the zone,
+// or with the ones of its key selector if it has one. Each key is matched by its class, key type, label and ID,
+// and it is an error if many valid keys match. With a key selector, it is also an error if a key is missing.
+func (session *Session) searchKeys(alg *Algorithm, zone string) (*ValidKeys, error) {
 	if session == nil || session.Ctx == nil {
 		return nil, fmt.Errorf("session not initialized")
 	}
-	AllTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, session.Label),
-	}
-
-	DateTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
-	}
-	objects, err := session.FindObject(AllTemplate)
+	label, zskID, kskID, err := session.keyIdentifiers(zone)
 	if err != nil {
 		return nil, err
 	}
 
-	// I'm not sure if objects start at 0 or 1, so
-	// I'm adding a boolean to tell if that key is present
 	validKeys := &ValidKeys{}
-	if len(objects) > 0 {
-		t := time.Now()
-		sToday := t.Format("20060102")
-		session.Log.Printf("Keys found... checking validity\n")
-		for _, object := range objects {
-			attr, err := session.Ctx.GetAttributeValue(session.Handle, object, DateTemplate)
-			if err != nil {
-				return nil, fmt.Errorf("cannot get attributes: %s\n", err)
-			} else {
-				class := uint(binary.LittleEndian.Uint32(attr[0].Value))
-				id := string(attr[1].Value)
-				start := string(attr[2].Value)
-				end := string(attr[3].Value)
-				valid := start <= sToday && sToday <= end
-				endTime, _ := time.Parse("20060102", end)
-
-				session.Log.Printf("Checking key class %v id %s and valid %t\n", class, id, valid)
-
-				if !valid {
-					continue
-				}
-
-				if class == pkcs11.CKO_PUBLIC_KEY {
-					if id == "zsk" {
-						if valid {
-							session.Log.Printf("Found valid Public ZSK\n")
-							validKeys.PublicZSK = &Key{
-								Handle:  object,
-								ExpDate: endTime,
-							}
-						}
-					}
-					if id == "ksk" {
-						if valid {
-							session.Log.Printf("Found valid Public KSK\n")
-							validKeys.PublicKSK = &Key{
-								Handle:  object,
-								ExpDate: endTime,
-							}
-						}
-					}
-				} else if class == pkcs11.CKO_PRIVATE_KEY {
-					if id == "zsk" {
-						session.Log.Printf("Found valid Private ZSK\n")
-						validKeys.PrivateZSK = &Key{
-							Handle:  object,
-							ExpDate: endTime,
-						}
-					} else if id == "ksk" {
-						session.Log.Printf("Found valid Private KSK\n")
-						validKeys.PrivateKSK = &Key{
-							Handle:  object,
-							ExpDate: endTime,
-						}
-					}
-				}
-			}
+	for _, k := range []struct {
+		key   **Key
+		class uint
+		id    []byte
+	}{
+		{&validKeys.PublicZSK, pkcs11.CKO_PUBLIC_KEY, zskID},
+		{&validKeys.PrivateZSK, pkcs11.CKO_PRIVATE_KEY, zskID},
+		{&validKeys.PublicKSK, pkcs11.CKO_PUBLIC_KEY, kskID},
+		{&validKeys.PrivateKSK, pkcs11.CKO_PRIVATE_KEY, kskID},
+	} {
+		criteria := keyCriteria{class: k.class, alg: alg, label: label, id: k.id}
+		key, err := session.findKey(criteria)
+		if err != nil {
+			return nil, err
 		}
+		if key == nil && session.KeySelector != nil {
+			return nil, fmt.Errorf("no valid %s selected by the key selector", criteria)
+		}
+		*k.key = key
+	}
+	if validKeys.PublicZSK != nil || validKeys.PublicKSK != nil {
+		session.logger().Info("Valid keys found", "label", label, "zsk", validKeys.PublicZSK != nil, "ksk", validKeys.PublicKSK != nil)
 	}
 	return validKeys, nil
 }
 
+// expireKey expires a key into the HSM, recording it in args so it can be restored later.
+func (session *Session) expireKey(args *SessionSignArgs, key *Key) error {
+	if err := session.ExpireKey(key.Handle); err != nil {
+		return err
+	}
+	args.expiredKeys = append(args.expiredKeys, key)
+	return nil
+}
+
+// rollbackKeys destroys the keys created by GetKeys and restores the expiration date of the keys it expired.
+// Errors are logged, because the rollback is done while handling another error.
+func (session *Session) rollbackKeys(args *SessionSignArgs) {
+	for _, handle := range removeDuplicates(args.createdKeys) {
+		if err := session.Ctx.DestroyObject(session.Handle, handle); err != nil {
+			session.logger().Error("Cannot destroy key created during signing", "error", err)
+		}
+	}
+	for _, key := range args.expiredKeys {
+		restoreTemplate := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_END_DATE, key.ExpDate),
+		}
+		if err := session.Ctx.SetAttributeValue(session.Handle, key.Handle, restoreTemplate); err != nil {
+			session.logger().Error("Cannot restore expiration date of key", "error", err)
+		}
+	}
+	if len(args.createdKeys) > 0 || len(args.expiredKeys) > 0 {
+		session.logger().Warn("Signing failed: keys created during signing were destroyed and expired keys were restored.")
+	}
+}
+
 // ExpireKey expires a key into the HSM.
 func (session *Session) ExpireKey(handle pkcs11.ObjectHandle) error {
 
@@ -506,5 +760,6 @@ func (session *Session) ExpireKey(handle pkcs11.ObjectHandle) error {
 		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, yesterday),
 	}
 
+	session.countHSMCalls(1)
 	return session.Ctx.SetAttributeValue(session.Handle, handle, expireTemplate)
 }
@@ -0,0 +1,462 @@
+package signertest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/niclabs/hsm-tools/signer"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Responder is a minimal authoritative DNS server of a signed zone. It answers as RFC4035 3.1 defines:
+// positive answers, NODATA and NXDOMAIN responses with their NSEC or NSEC3 proofs, answers synthesized from
+// wildcards and referrals to the delegations. It is meant to test signed zones end to end, not to serve them.
+type Responder struct {
+	Zone string          // Name of the zone
+	TSIG *signer.TSIGKey // If not nil, queries must be signed with this key, and responses are signed with it
+
+	rrsets      map[string]map[uint16][]dns.RR // non RRSIG records, by name and type
+	sigs        map[string]map[uint16][]dns.RR // RRSIG records, by name and covered type
+	nsec3Sigs   map[string][]dns.RR            // RRSIG records of the NSEC3 records, by name
+	exists      map[string]bool                // names of the zone, including the empty non-terminals
+	delegations map[string]bool                // names with non-apex NS records
+	nsecs       []*dns.NSEC
+	nsec3s      []*dns.NSEC3
+}
+
+// NewResponder returns a responder that answers the queries for the zone with the signed RRs provided.
+func NewResponder(zone string, rrs signer.RRArray) *Responder {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	resp := &Responder{
+		Zone:        zone,
+		rrsets:      make(map[string]map[uint16][]dns.RR),
+		sigs:        make(map[string]map[uint16][]dns.RR),
+		nsec3Sigs:   make(map[string][]dns.RR),
+		exists:      make(map[string]bool),
+		delegations: make(map[string]bool),
+	}
+	add := func(index map[string]map[uint16][]dns.RR, name string, rrType uint16, rr dns.RR) {
+		if index[name] == nil {
+			index[name] = make(map[uint16][]dns.RR)
+		}
+		index[name][rrType] = append(index[name][rrType], rr)
+	}
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		switch r := rr.(type) {
+		case *dns.NSEC3:
+			resp.nsec3s = append(resp.nsec3s, r)
+			continue
+		case *dns.RRSIG:
+			if r.TypeCovered == dns.TypeNSEC3 {
+				resp.nsec3Sigs[name] = append(resp.nsec3Sigs[name], rr)
+			} else {
+				add(resp.sigs, name, r.TypeCovered, rr)
+			}
+			continue
+		case *dns.NSEC:
+			resp.nsecs = append(resp.nsecs, r)
+		case *dns.NS:
+			if name != zone {
+				resp.delegations[name] = true
+			}
+		}
+		add(resp.rrsets, name, rr.Header().Rrtype, rr)
+		for n := name; dns.IsSubDomain(zone, n) && !resp.exists[n]; n = parentName(n) {
+			resp.exists[n] = true
+		}
+	}
+	return resp
+}
+
+// ServeDNS answers a query for the zone, implementing dns.Handler. The DNSSEC records are added only if the
+// query has the DO bit.
+func (resp *Responder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	if resp.TSIG != nil && (r.IsTsig() == nil || w.TsigStatus() != nil) {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+	m.SetReply(r)
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	resp.answer(m, q)
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() {
+		m.Answer = withoutDNSSEC(m.Answer, q.Qtype)
+		m.Ns = withoutDNSSEC(m.Ns, q.Qtype)
+	}
+	if opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+	if tsig := r.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+// answer fills the sections of the response to the question.
+func (resp *Responder) answer(m *dns.Msg, q dns.Question) {
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(resp.Zone, name) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	if cut := resp.delegation(name); cut != "" && !(cut == name && q.Qtype == dns.TypeDS) {
+		m.Ns = appendUnique(m.Ns, resp.rrsets[cut][dns.TypeNS]...)
+		if len(resp.rrsets[cut][dns.TypeDS]) > 0 {
+			m.Ns = appendUnique(m.Ns, resp.signed(cut, dns.TypeDS)...)
+		} else {
+			m.Ns = appendUnique(m.Ns, resp.nodataProof(cut)...)
+		}
+		return
+	}
+	m.Authoritative = true
+	if resp.exists[name] {
+		if rrs := resp.signed(name, q.Qtype); len(rrs) > 0 {
+			m.Answer = rrs
+		} else if rrs := resp.signed(name, dns.TypeCNAME); len(rrs) > 0 {
+			m.Answer = rrs
+		} else {
+			m.Ns = appendUnique(resp.signed(resp.Zone, dns.TypeSOA), resp.nodataProof(name)...)
+		}
+		return
+	}
+	encloser := resp.closestEncloser(name)
+	wildcard := "*." + encloser
+	if !resp.exists[wildcard] {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = resp.signed(resp.Zone, dns.TypeSOA)
+		m.Ns = appendUnique(m.Ns, resp.encloserProof(name, encloser)...)
+		m.Ns = appendUnique(m.Ns, resp.noNameProof(wildcard)...)
+		return
+	}
+	rrs := resp.signed(wildcard, q.Qtype)
+	if len(rrs) == 0 {
+		rrs = resp.signed(wildcard, dns.TypeCNAME)
+	}
+	if len(rrs) == 0 {
+		m.Ns = resp.signed(resp.Zone, dns.TypeSOA)
+		m.Ns = appendUnique(m.Ns, resp.encloserProof(name, encloser)...)
+		m.Ns = appendUnique(m.Ns, resp.nodataProof(wildcard)...)
+		return
+	}
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		m.Answer = append(m.Answer, rr)
+	}
+	// The source of synthesis is proven by the labels of the RRSIGs, so only the next closer name
+	// must be proven not to exist (RFC5155 7.2.6).
+	if len(resp.nsec3s) > 0 {
+		m.Ns = appendUnique(m.Ns, resp.nsec3Covering(nextCloser(name, encloser))...)
+	} else {
+		m.Ns = appendUnique(m.Ns, resp.noNameProof(name)...)
+	}
+}
+
+// delegation returns the delegation point at or above the name, or an empty string if the name is authoritative.
+func (resp *Responder) delegation(name string) string {
+	for n := name; n != resp.Zone && dns.IsSubDomain(resp.Zone, n); n = parentName(n) {
+		if resp.delegations[n] {
+			return n
+		}
+	}
+	return ""
+}
+
+// closestEncloser returns the longest existing ancestor of the name.
+func (resp *Responder) closestEncloser(name string) string {
+	for n := parentName(name); n != resp.Zone; n = parentName(n) {
+		if resp.exists[n] {
+			return n
+		}
+	}
+	return resp.Zone
+}
+
+// signed returns the RRset of the name and type, followed by its RRSIGs.
+func (resp *Responder) signed(name string, rrType uint16) []dns.RR {
+	rrs := resp.rrsets[name][rrType]
+	if len(rrs) == 0 {
+		return nil
+	}
+	return append(append([]dns.RR{}, rrs...), resp.sigs[name][rrType]...)
+}
+
+// signedNSEC3 returns the NSEC3 record followed by its RRSIGs.
+func (resp *Responder) signedNSEC3(nsec3 *dns.NSEC3) []dns.RR {
+	return append([]dns.RR{nsec3}, resp.nsec3Sigs[strings.ToLower(nsec3.Hdr.Name)]...)
+}
+
+// nodataProof returns the denial records proving that the existing name does not have other types.
+// The insecure delegations left out of an opt-out NSEC3 chain are proven with the closest provable encloser
+// and the opt-out NSEC3 record covering the next closer name (RFC5155 7.2.4).
+func (resp *Responder) nodataProof(name string) []dns.RR {
+	if len(resp.nsec3s) > 0 {
+		if proof := resp.nsec3Matching(name); len(proof) > 0 {
+			return proof
+		}
+		for encloser := parentName(name); dns.IsSubDomain(resp.Zone, encloser); encloser = parentName(encloser) {
+			if proof := resp.nsec3Matching(encloser); len(proof) > 0 {
+				return appendUnique(proof, resp.nsec3Covering(nextCloser(name, encloser))...)
+			}
+		}
+		return nil
+	}
+	if len(resp.rrsets[name][dns.TypeNSEC]) > 0 {
+		return resp.signed(name, dns.TypeNSEC)
+	}
+	// Empty non-terminals do not have an NSEC record, but they are covered by the previous one.
+	return resp.noNameProof(name)
+}
+
+// noNameProof returns the denial records proving that the name does not exist.
+func (resp *Responder) noNameProof(name string) []dns.RR {
+	if len(resp.nsec3s) > 0 {
+		return resp.nsec3Covering(name)
+	}
+	for _, nsec := range resp.nsecs {
+		if nsecCovers(nsec, name) {
+			return resp.signed(strings.ToLower(nsec.Hdr.Name), dns.TypeNSEC)
+		}
+	}
+	return nil
+}
+
+// encloserProof returns the denial records proving that the name does not exist and that its closest encloser
+// does: the NSEC covering the name, or the NSEC3 matching the closest encloser and the one covering the next
+// closer name (RFC5155 7.2.1).
+func (resp *Responder) encloserProof(name, encloser string) []dns.RR {
+	if len(resp.nsec3s) == 0 {
+		return resp.noNameProof(name)
+	}
+	return appendUnique(resp.nsec3Matching(encloser), resp.nsec3Covering(nextCloser(name, encloser))...)
+}
+
+func (resp *Responder) nsec3Matching(name string) []dns.RR {
+	for _, nsec3 := range resp.nsec3s {
+		if nsec3.Match(name) {
+			return resp.signedNSEC3(nsec3)
+		}
+	}
+	return nil
+}
+
+func (resp *Responder) nsec3Covering(name string) []dns.RR {
+	for _, nsec3 := range resp.nsec3s {
+		if nsec3Covers(nsec3, name) {
+			return resp.signedNSEC3(nsec3)
+		}
+	}
+	return nil
+}
+
+// Serve starts a DNS server on a localhost TCP port with the responder, and returns its address.
+// The server is shut down when the test ends. If it cannot listen, the test is skipped.
+func Serve(t testing.TB, resp *Responder) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on localhost: %s", err)
+	}
+	server := &dns.Server{
+		Listener: listener,
+		Handler:  resp,
+	}
+	if resp.TSIG != nil {
+		server.TsigSecret = map[string]string{dns.Fqdn(resp.TSIG.Name): resp.TSIG.Secret}
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return listener.Addr().String()
+}
+
+// CheckResponses serves the signed zone with a Responder authenticated with a random TSIG key, and queries it
+// with the DO bit as a validating resolver would: every type of every authoritative name, a type that each name
+// does not have, a name below each one that does not exist and the DS records of the delegations. Every response
+// must validate with the DNSKEYs of the zone (see ValidateResponse), and the type bitmap of the record proving a
+// NODATA response must list exactly the types of the name. Failures are reported as test errors.
+func CheckResponses(t testing.TB, zone string, rrs signer.RRArray) {
+	t.Helper()
+	zone = strings.ToLower(dns.Fqdn(zone))
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatalf("Error generating TSIG secret: %s", err)
+	}
+	key := &signer.TSIGKey{Name: "hsm-tools-test.", Algorithm: dns.HmacSHA256, Secret: base64.StdEncoding.EncodeToString(secret)}
+	resp := NewResponder(zone, rrs)
+	resp.TSIG = key
+	addr := Serve(t, resp)
+	keys := make([]*dns.DNSKEY, 0)
+	for _, rr := range rrs {
+		if dnskey, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(dnskey.Hdr.Name, zone) {
+			keys = append(keys, dnskey)
+		}
+	}
+	client := &dns.Client{
+		Net:        "tcp",
+		TsigSecret: map[string]string{key.Name: key.Secret},
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.SetEdns0(dns.DefaultMsgSize, true)
+		m.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+		r, _, err := client.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("Error querying %s %s: %s", name, dns.Type(qtype), err)
+		}
+		if err := ValidateResponse(zone, keys, r); err != nil {
+			t.Errorf("Invalid response to %s %s: %s", name, dns.Type(qtype), err)
+		}
+		return r
+	}
+
+	names := make([]string, 0, len(resp.rrsets))
+	for name := range resp.rrsets {
+		if resp.delegation(name) == "" {
+			names = append(names, name)
+		}
+	}
+	// The parent zone answers for the DS records of the delegations, or proves they do not exist.
+	for name := range resp.delegations {
+		r := query(name, dns.TypeDS)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 != (len(resp.rrsets[name][dns.TypeDS]) == 0) {
+			t.Errorf("Query for %s DS should be answered by the zone, but it has rcode %s and %d answers", name, dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return signer.CompareNames(names[i], names[j]) < 0
+	})
+	for _, name := range names {
+		types := resp.rrsets[name]
+		for rrType := range types {
+			if r := query(name, rrType); r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 {
+				t.Errorf("Query for %s %s should have an answer, but it has rcode %s", name, dns.Type(rrType), dns.RcodeToString[r.Rcode])
+			}
+		}
+		if len(types[dns.TypeCNAME]) == 0 {
+			missing := uint16(dns.TypeTXT)
+			for types[missing] != nil {
+				missing++
+			}
+			r := query(name, missing)
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+				t.Errorf("Query for %s %s should be a NODATA response, but it has rcode %s and %d answers", name, dns.Type(missing), dns.RcodeToString[r.Rcode], len(r.Answer))
+			} else if err := checkBitmap(resp, name, r); err != nil {
+				t.Errorf("Wrong NODATA proof for %s: %s", name, err)
+			}
+		}
+		if !strings.HasPrefix(name, "*.") {
+			nxName := "nx-hsm-tools." + name
+			if r := query(nxName, dns.TypeA); r.Rcode != dns.RcodeNameError && !resp.exists["*."+name] {
+				t.Errorf("Query for %s should be a NXDOMAIN response, but it has rcode %s", nxName, dns.RcodeToString[r.Rcode])
+			}
+		}
+	}
+}
+
+// checkBitmap returns an error if the NSEC or NSEC3 record of the name in the authority section of a NODATA
+// response does not list exactly the types of the name in the zone and RRSIG, because the name is signed.
+func checkBitmap(resp *Responder, name string, r *dns.Msg) error {
+	expected := make([]uint16, 0)
+	for rrType := range resp.rrsets[name] {
+		expected = append(expected, rrType)
+	}
+	if len(resp.sigs[name]) > 0 {
+		expected = append(expected, dns.TypeRRSIG)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i] < expected[j]
+	})
+	var bitmap []uint16
+	for _, rr := range r.Ns {
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(x.Hdr.Name, name) {
+				bitmap = x.TypeBitMap
+			}
+		case *dns.NSEC3:
+			if x.Match(name) {
+				bitmap = x.TypeBitMap
+			}
+		}
+	}
+	if bitmap == nil {
+		return fmt.Errorf("no NSEC or NSEC3 record of the name in the response")
+	}
+	if typesString(bitmap) != typesString(expected) {
+		return fmt.Errorf("type bitmap is %s, but the name has %s", typesString(bitmap), typesString(expected))
+	}
+	return nil
+}
+
+func typesString(types []uint16) string {
+	names := make([]string, len(types))
+	for i, rrType := range types {
+		names[i] = dns.Type(rrType).String()
+	}
+	return strings.Join(names, " ")
+}
+
+// appendUnique appends the RRs that are not already in the section.
+func appendUnique(section []dns.RR, rrs ...dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		found := false
+		for _, other := range section {
+			if dns.IsDuplicate(rr, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			section = append(section, rr)
+		}
+	}
+	return section
+}
+
+// withoutDNSSEC returns the section without the DNSSEC records that are only sent when the DO bit is set,
+// unless they were explicitly queried.
+func withoutDNSSEC(section []dns.RR, qtype uint16) []dns.RR {
+	filtered := make([]dns.RR, 0, len(section))
+	for _, rr := range section {
+		switch rrType := rr.Header().Rrtype; rrType {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rrType != qtype {
+				continue
+			}
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+// parentName returns the name without its first label.
+func parentName(name string) string {
+	next, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[next:]
+}
+
+// nextCloser returns the ancestor of the name one label longer than its closest encloser (RFC5155 1.3).
+func nextCloser(name, encloser string) string {
+	labels := dns.SplitDomainName(name)
+	return strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], ".") + "."
+}
@@ -0,0 +1,85 @@
+// Package signertest provides fixtures and helpers to test zone signing configurations
+// without an HSM, using a signer.SoftSession or the sessions of an in-memory PKCS#11 Token.
+package signertest
+
+import (
+	"bytes"
+	"github.com/niclabs/hsm-tools/signer"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Zone is the name of the fixture zone.
+const Zone = "example.com"
+
+// ZoneFile is a fixture zone file for Zone. It includes a delegation with a glue record.
+const ZoneFile = `
+example.com.			86400	IN	SOA		ns1.example.com. hostmaster.example.com. 2019052103 10800 15 604800 10800
+delegate.example.com. 	86400 	IN 	NS 		other.domain.com.
+delegate.example.com. 	86400 	IN 	A 		127.0.0.4
+example.com.			86400	IN	NS		ns1.example.com.
+example.com.			86400	IN	MX	10 	localhost.
+ftp.example.com.		86400	IN	CNAME	www.example.com.
+ns1.example.com.		86400	IN	A		127.0.0.1
+www.example.com.		86400	IN	A		127.0.0.2
+yo.example.com.			86400	IN	A		127.0.0.3
+`
+
+// testWriter writes into the test log.
+type testWriter struct {
+	t testing.TB
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Helper()
+	w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// NewLogger returns a logger that writes into the test log.
+func NewLogger(t testing.TB) *log.Logger {
+	return log.New(testWriter{t}, "", 0)
+}
+
+// NewSession returns a software session that logs into the test log.
+func NewSession(t testing.TB) *signer.SoftSession {
+	return signer.NewSoftSession(NewLogger(t))
+}
+
+// SignAndVerify signs the zone configured in args with a new software session, verifies the result and returns
+// the signed RRs. If args.Zone is empty, Zone is used, and if args.File and args.RRs are not set,
+// ZoneFile is used. args.Output is replaced. Any failure is fatal for the test.
+func SignAndVerify(t testing.TB, args *signer.SignArgs) signer.RRArray {
+	t.Helper()
+	return SignAndVerifyWith(t, NewSession(t), args)
+}
+
+// SignAndVerifyWith is like SignAndVerify, but it signs using the session provided,
+// so many signatures can share the same keys.
+func SignAndVerifyWith(t testing.TB, session *signer.SoftSession, args *signer.SignArgs) signer.RRArray {
+	t.Helper()
+	if args.Zone == "" {
+		args.Zone = Zone
+	}
+	if args.File == nil && len(args.RRs) == 0 {
+		args.File = strings.NewReader(ZoneFile)
+	}
+	var out bytes.Buffer
+	args.Output = &out
+	if _, err := session.Sign(args); err != nil {
+		t.Fatalf("Error signing zone: %s", err)
+	}
+	signed := out.String()
+	rrs, err := signer.ReadAndParseZone(&signer.SignArgs{
+		Zone: args.Zone,
+		File: strings.NewReader(signed),
+	}, false)
+	if err != nil {
+		t.Fatalf("Error parsing signed zone: %s", err)
+	}
+	if err := signer.VerifyRRArray(args.Zone, rrs, NewLogger(t)); err != nil {
+		t.Fatalf("Error verifying signed zone: %s", err)
+	}
+	return rrs
+}
@@ -0,0 +1,660 @@
+package signertest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"github.com/miekg/pkcs11"
+	"github.com/niclabs/hsm-tools/signer"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// TokenPIN is the user PIN of the tokens returned by NewToken.
+const TokenPIN = "1234"
+
+// PKCS#11 3.0 EdDSA mechanisms, not defined by miekg/pkcs11.
+const (
+	ckmECEdwardsKeyPairGen = 0x1055 // CKM_EC_EDWARDS_KEY_PAIR_GEN
+	ckmEdDSA               = 0x1057 // CKM_EDDSA
+)
+
+// Session states of PKCS#11 read/write sessions (CK_STATE), not defined by miekg/pkcs11.
+const (
+	cksRWPublicSession = 2 // CKS_RW_PUBLIC_SESSION
+	cksRWUserFunctions = 3 // CKS_RW_USER_FUNCTIONS
+)
+
+// DER encoded OIDs of the curves of the ECDSA algorithms.
+var (
+	p256Params = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	p384Params = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}
+)
+
+// Token is an in-memory PKCS#11 token in slot 0, implementing signer.Context, so the sessions, the key searches
+// and generations, the rollovers and the reconnections can be tested without an HSM. It generates RSA, ECDSA and
+// Ed25519 key pairs which sign with the mechanisms of the signer, and stores the imported keys without their key
+// material, so they cannot sign. Fail injects errors into its calls. It can be used by many goroutines.
+type Token struct {
+	PIN  string                  // User PIN
+	Fail func(call string) error // If set, it is called with the name of each call (as "Sign"), and the call returns its error if it is not nil
+
+	mutex    sync.Mutex
+	objects  map[pkcs11.ObjectHandle][]*pkcs11.Attribute
+	keys     map[pkcs11.ObjectHandle]crypto.Signer // Private keys of the generated key pairs
+	sessions map[pkcs11.SessionHandle]*tokenSession
+	loggedIn bool
+	last     uint           // Last handle given to a session or an object
+	calls    map[string]int // Calls made, by name
+}
+
+// tokenSession is the state of the operations of a session of a Token.
+type tokenSession struct {
+	found    []pkcs11.ObjectHandle // Objects not yet returned by FindObjects
+	finding  bool                  // If true, FindObjectsInit was called and FindObjectsFinal was not
+	signKey  crypto.Signer         // Key of the signing operation, set by SignInit
+	signMech uint                  // Mechanism of the signing operation
+}
+
+// NewToken returns an empty token with TokenPIN as user PIN.
+func NewToken() *Token {
+	return &Token{PIN: TokenPIN}
+}
+
+// NewTokenSession returns a session of the token logged in with its PIN, using label as key label, which logs into
+// the test log and is ended when the test finishes. Any failure is fatal for the test.
+func NewTokenSession(t testing.TB, token *Token, label string) *signer.Session {
+	t.Helper()
+	session, err := signer.NewSessionWithContext(token, 0, token.PIN, label, NewLogger(t))
+	if err != nil {
+		t.Fatalf("Error creating session of the test token: %s", err)
+	}
+	t.Cleanup(func() { session.End() })
+	return session
+}
+
+// Calls returns the number of calls of the name provided (as "Login") made to the token.
+func (token *Token) Calls(name string) int {
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	return token.calls[name]
+}
+
+// Objects returns the handles of the objects of the token, sorted.
+func (token *Token) Objects() []pkcs11.ObjectHandle {
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	return token.sortedObjects(nil)
+}
+
+// CloseAllSessions closes the sessions of the token and logs the user out, as when a network-attached HSM
+// drops its connections, so the next calls of the sessions fail with CKR_SESSION_HANDLE_INVALID.
+func (token *Token) CloseAllSessions() {
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	token.sessions = nil
+	token.loggedIn = false
+}
+
+// call counts the call, and returns the error injected by Fail.
+func (token *Token) call(name string) error {
+	token.mutex.Lock()
+	if token.calls == nil {
+		token.calls = make(map[string]int)
+	}
+	token.calls[name]++
+	token.mutex.Unlock()
+	if token.Fail != nil {
+		return token.Fail(name)
+	}
+	return nil
+}
+
+// session returns the state of the session, or CKR_SESSION_HANDLE_INVALID if it is not open.
+func (token *Token) session(sh pkcs11.SessionHandle) (*tokenSession, error) {
+	s, ok := token.sessions[sh]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return s, nil
+}
+
+// userSession returns the state of the session as session, or CKR_USER_NOT_LOGGED_IN if the user is not logged in.
+func (token *Token) userSession(sh pkcs11.SessionHandle) (*tokenSession, error) {
+	s, err := token.session(sh)
+	if err != nil {
+		return nil, err
+	}
+	if !token.loggedIn {
+		return nil, pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	return s, nil
+}
+
+// OpenSession opens a session on slot 0.
+func (token *Token) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	if err := token.call("OpenSession"); err != nil {
+		return 0, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if slotID != 0 {
+		return 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	if token.sessions == nil {
+		token.sessions = make(map[pkcs11.SessionHandle]*tokenSession)
+	}
+	token.last++
+	sh := pkcs11.SessionHandle(token.last)
+	token.sessions[sh] = &tokenSession{}
+	return sh, nil
+}
+
+// CloseSession closes the session. Closing the last session logs the user out.
+func (token *Token) CloseSession(sh pkcs11.SessionHandle) error {
+	if err := token.call("CloseSession"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.session(sh); err != nil {
+		return err
+	}
+	delete(token.sessions, sh)
+	if len(token.sessions) == 0 {
+		token.loggedIn = false
+	}
+	return nil
+}
+
+// Login logs the user in, if the PIN is correct.
+func (token *Token) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	if err := token.call("Login"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.session(sh); err != nil {
+		return err
+	}
+	if token.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	}
+	if userType != pkcs11.CKU_USER || pin != token.PIN {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	token.loggedIn = true
+	return nil
+}
+
+// Logout logs the user out.
+func (token *Token) Logout(sh pkcs11.SessionHandle) error {
+	if err := token.call("Logout"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.userSession(sh); err != nil {
+		return err
+	}
+	token.loggedIn = false
+	return nil
+}
+
+// Finalize does nothing, because the token is not loaded from a library.
+func (token *Token) Finalize() error {
+	return token.call("Finalize")
+}
+
+// Destroy does nothing, because the token is not loaded from a library.
+func (token *Token) Destroy() {
+	token.call("Destroy")
+}
+
+// GetSessionInfo returns the slot and the state of the session.
+func (token *Token) GetSessionInfo(sh pkcs11.SessionHandle) (pkcs11.SessionInfo, error) {
+	if err := token.call("GetSessionInfo"); err != nil {
+		return pkcs11.SessionInfo{}, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.session(sh); err != nil {
+		return pkcs11.SessionInfo{}, err
+	}
+	info := pkcs11.SessionInfo{State: cksRWPublicSession, Flags: pkcs11.CKF_SERIAL_SESSION | pkcs11.CKF_RW_SESSION}
+	if token.loggedIn {
+		info.State = cksRWUserFunctions
+	}
+	return info, nil
+}
+
+// GetTokenInfo returns the description of the token.
+func (token *Token) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	if err := token.call("GetTokenInfo"); err != nil {
+		return pkcs11.TokenInfo{}, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if slotID != 0 {
+		return pkcs11.TokenInfo{}, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	return pkcs11.TokenInfo{Label: "signertest", ManufacturerID: "signertest", Model: "Token", SerialNumber: "1"}, nil
+}
+
+// tokenMechanisms are the mechanisms of the token, with their minimum and maximum key sizes (zero if they do not
+// depend on the key size).
+var tokenMechanisms = map[uint][2]uint{
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN: {1024, 4096},
+	pkcs11.CKM_RSA_PKCS:              {1024, 4096},
+	pkcs11.CKM_SHA256_RSA_PKCS:       {1024, 4096},
+	pkcs11.CKM_SHA512_RSA_PKCS:       {1024, 4096},
+	pkcs11.CKM_EC_KEY_PAIR_GEN:       {},
+	pkcs11.CKM_ECDSA:                 {},
+	pkcs11.CKM_ECDSA_SHA256:          {},
+	pkcs11.CKM_ECDSA_SHA384:          {},
+	ckmECEdwardsKeyPairGen:           {},
+	ckmEdDSA:                         {},
+}
+
+// GetMechanismList returns the mechanisms of the token, sorted.
+func (token *Token) GetMechanismList(slotID uint) ([]*pkcs11.Mechanism, error) {
+	if err := token.call("GetMechanismList"); err != nil {
+		return nil, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if slotID != 0 {
+		return nil, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	types := make([]uint, 0, len(tokenMechanisms))
+	for mechanism := range tokenMechanisms {
+		types = append(types, mechanism)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	mechanisms := make([]*pkcs11.Mechanism, len(types))
+	for i, mechanism := range types {
+		mechanisms[i] = pkcs11.NewMechanism(mechanism, nil)
+	}
+	return mechanisms, nil
+}
+
+// GetMechanismInfo returns the key sizes of the mechanism.
+func (token *Token) GetMechanismInfo(slotID uint, m []*pkcs11.Mechanism) (pkcs11.MechanismInfo, error) {
+	if err := token.call("GetMechanismInfo"); err != nil {
+		return pkcs11.MechanismInfo{}, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if slotID != 0 {
+		return pkcs11.MechanismInfo{}, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	sizes, ok := tokenMechanisms[m[0].Mechanism]
+	if !ok {
+		return pkcs11.MechanismInfo{}, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	return pkcs11.MechanismInfo{MinKeySize: sizes[0], MaxKeySize: sizes[1]}, nil
+}
+
+// CreateObject stores an object with the attributes of the template.
+func (token *Token) CreateObject(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := token.call("CreateObject"); err != nil {
+		return 0, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.userSession(sh); err != nil {
+		return 0, err
+	}
+	return token.store(temp, nil), nil
+}
+
+// store stores an object with copies of the attributes, and its private key if it is not nil.
+func (token *Token) store(attrs []*pkcs11.Attribute, key crypto.Signer) pkcs11.ObjectHandle {
+	if token.objects == nil {
+		token.objects = make(map[pkcs11.ObjectHandle][]*pkcs11.Attribute)
+		token.keys = make(map[pkcs11.ObjectHandle]crypto.Signer)
+	}
+	token.last++
+	oh := pkcs11.ObjectHandle(token.last)
+	var object []*pkcs11.Attribute
+	for _, attr := range attrs {
+		object = setAttribute(object, attr)
+	}
+	token.objects[oh] = object
+	if key != nil {
+		token.keys[oh] = key
+	}
+	return oh
+}
+
+// setAttribute replaces the attribute of the same type of the object with a copy of attr, or adds it.
+func setAttribute(object []*pkcs11.Attribute, attr *pkcs11.Attribute) []*pkcs11.Attribute {
+	value := append([]byte(nil), attr.Value...)
+	for _, a := range object {
+		if a.Type == attr.Type {
+			a.Value = value
+			return object
+		}
+	}
+	return append(object, &pkcs11.Attribute{Type: attr.Type, Value: value})
+}
+
+// attribute returns the attribute of the type provided of the object, or nil if it does not have it.
+func attribute(object []*pkcs11.Attribute, attrType uint) *pkcs11.Attribute {
+	for _, a := range object {
+		if a.Type == attrType {
+			return a
+		}
+	}
+	return nil
+}
+
+// DestroyObject destroys the object.
+func (token *Token) DestroyObject(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle) error {
+	if err := token.call("DestroyObject"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.userSession(sh); err != nil {
+		return err
+	}
+	if _, ok := token.objects[oh]; !ok {
+		return pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	delete(token.objects, oh)
+	delete(token.keys, oh)
+	return nil
+}
+
+// GetAttributeValue returns the values of the attributes of the object. It returns CKR_ATTRIBUTE_TYPE_INVALID if
+// the object does not have one of them.
+func (token *Token) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	if err := token.call("GetAttributeValue"); err != nil {
+		return nil, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.session(sh); err != nil {
+		return nil, err
+	}
+	object, ok := token.objects[o]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	values := make([]*pkcs11.Attribute, len(a))
+	for i, query := range a {
+		attr := attribute(object, query.Type)
+		if attr == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		values[i] = &pkcs11.Attribute{Type: attr.Type, Value: append([]byte(nil), attr.Value...)}
+	}
+	return values, nil
+}
+
+// SetAttributeValue sets the values of the attributes of the object.
+func (token *Token) SetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) error {
+	if err := token.call("SetAttributeValue"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.userSession(sh); err != nil {
+		return err
+	}
+	object, ok := token.objects[o]
+	if !ok {
+		return pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	for _, attr := range a {
+		object = setAttribute(object, attr)
+	}
+	token.objects[o] = object
+	return nil
+}
+
+// sortedObjects returns the handles of the objects with the attributes of the template, sorted.
+// The mutex must be locked.
+func (token *Token) sortedObjects(temp []*pkcs11.Attribute) []pkcs11.ObjectHandle {
+	var found []pkcs11.ObjectHandle
+	for oh, object := range token.objects {
+		matches := true
+		for _, want := range temp {
+			if attr := attribute(object, want.Type); attr == nil || !bytes.Equal(attr.Value, want.Value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = append(found, oh)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	return found
+}
+
+// FindObjectsInit starts a search of the objects with the attributes of the template.
+func (token *Token) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error {
+	if err := token.call("FindObjectsInit"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	s, err := token.session(sh)
+	if err != nil {
+		return err
+	}
+	if s.finding {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+	s.finding, s.found = true, token.sortedObjects(temp)
+	return nil
+}
+
+// FindObjects returns at most max objects of the search.
+func (token *Token) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	if err := token.call("FindObjects"); err != nil {
+		return nil, false, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	s, err := token.session(sh)
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.finding {
+		return nil, false, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	if max > len(s.found) {
+		max = len(s.found)
+	}
+	found := s.found[:max]
+	s.found = s.found[max:]
+	return found, len(s.found) > 0, nil
+}
+
+// FindObjectsFinal ends the search.
+func (token *Token) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	if err := token.call("FindObjectsFinal"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	s, err := token.session(sh)
+	if err != nil {
+		return err
+	}
+	if !s.finding {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	s.finding, s.found = false, nil
+	return nil
+}
+
+// GenerateKeyPair generates an RSA, ECDSA (over P-256 or P-384) or Ed25519 key pair, storing the public and
+// private keys with the attributes of the templates and the ones of their key material.
+func (token *Token) GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if err := token.call("GenerateKeyPair"); err != nil {
+		return 0, 0, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	if _, err := token.userSession(sh); err != nil {
+		return 0, 0, err
+	}
+	var key crypto.Signer
+	var material []*pkcs11.Attribute
+	switch m[0].Mechanism {
+	case pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:
+		bits := attribute(public, pkcs11.CKA_MODULUS_BITS)
+		if bits == nil {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCOMPLETE)
+		}
+		padded := make([]byte, 8)
+		copy(padded, bits.Value)
+		rsaKey, err := rsa.GenerateKey(rand.Reader, int(binary.LittleEndian.Uint64(padded)))
+		if err != nil {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_KEY_SIZE_RANGE)
+		}
+		key = rsaKey
+		material = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, rsaKey.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(rsaKey.E)).Bytes()),
+		}
+	case pkcs11.CKM_EC_KEY_PAIR_GEN:
+		params := attribute(public, pkcs11.CKA_EC_PARAMS)
+		var curve elliptic.Curve
+		switch {
+		case params == nil:
+			return 0, 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCOMPLETE)
+		case bytes.Equal(params.Value, p256Params):
+			curve = elliptic.P256()
+		case bytes.Equal(params.Value, p384Params):
+			curve = elliptic.P384()
+		default:
+			return 0, 0, pkcs11.Error(pkcs11.CKR_CURVE_NOT_SUPPORTED)
+		}
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED)
+		}
+		key = ecKey
+		material = []*pkcs11.Attribute{ecPoint(elliptic.Marshal(curve, ecKey.X, ecKey.Y))}
+	case ckmECEdwardsKeyPairGen:
+		pub, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED)
+		}
+		key = edKey
+		material = []*pkcs11.Attribute{ecPoint(pub)}
+	default:
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	publicKey := token.store(append(public, material...), nil)
+	privateKey := token.store(append(private, material...), key)
+	return publicKey, privateKey, nil
+}
+
+// ecPoint returns the CKA_EC_POINT attribute of the point, as a DER encoded OCTET STRING.
+func ecPoint(point []byte) *pkcs11.Attribute {
+	der, _ := asn1.Marshal(point)
+	return pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, der)
+}
+
+// SignInit starts a signature with the private key.
+func (token *Token) SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	if err := token.call("SignInit"); err != nil {
+		return err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	s, err := token.userSession(sh)
+	if err != nil {
+		return err
+	}
+	if s.signKey != nil {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+	key, ok := token.keys[o]
+	if !ok {
+		return pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+	}
+	if _, ok := tokenMechanisms[m[0].Mechanism]; !ok {
+		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	s.signKey, s.signMech = key, m[0].Mechanism
+	return nil
+}
+
+// Sign signs the message with the key and the mechanism of SignInit, ending the signature. ECDSA signatures are
+// returned as R || S, as PKCS#11 does.
+func (token *Token) Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	if err := token.call("Sign"); err != nil {
+		return nil, err
+	}
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+	session, err := token.userSession(sh)
+	if err != nil {
+		return nil, err
+	}
+	key, mechanism := session.signKey, session.signMech
+	if key == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	session.signKey = nil
+	hash := map[uint]crypto.Hash{
+		pkcs11.CKM_SHA256_RSA_PKCS: crypto.SHA256,
+		pkcs11.CKM_SHA512_RSA_PKCS: crypto.SHA512,
+		pkcs11.CKM_ECDSA_SHA256:    crypto.SHA256,
+		pkcs11.CKM_ECDSA_SHA384:    crypto.SHA384,
+	}[mechanism]
+	digest := message
+	if hash != 0 {
+		h := hash.New()
+		h.Write(message)
+		digest = h.Sum(nil)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if mechanism != pkcs11.CKM_RSA_PKCS && hash == 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+		}
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		if err != nil {
+			return nil, pkcs11.Error(pkcs11.CKR_DATA_LEN_RANGE)
+		}
+		return sig, nil
+	case *ecdsa.PrivateKey:
+		if mechanism != pkcs11.CKM_ECDSA && hash == 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rBytes):size], rBytes)
+		copy(sig[2*size-len(sBytes):], sBytes)
+		return sig, nil
+	case ed25519.PrivateKey:
+		if mechanism != ckmEdDSA {
+			return nil, pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+		}
+		return ed25519.Sign(k, message), nil
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+}
+
+var _ signer.Context = (*Token)(nil)
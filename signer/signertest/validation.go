@@ -0,0 +1,250 @@
+package signertest
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/niclabs/hsm-tools/signer"
+	"strings"
+	"time"
+)
+
+// ValidateResponse checks a response to a query for an authoritative name of the zone as a validating resolver
+// would with the DNSKEYs of the zone (RFC4035 5), returning an error if it would not be authenticated:
+//   - every RRset of the answer and authority sections must have a valid RRSIG made by one of the keys;
+//   - a positive answer must have the queried RRset or a CNAME and, if it was synthesized from a wildcard,
+//     the proof that the queried name does not exist;
+//   - a NODATA response must have an NSEC or NSEC3 record proving the name exists without the queried type,
+//     directly or through a wildcard;
+//   - a NXDOMAIN response must prove that the name and the wildcard at its closest encloser do not exist.
+func ValidateResponse(zone string, keys []*dns.DNSKEY, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return fmt.Errorf("response has %d questions", len(msg.Question))
+	}
+	zone = strings.ToLower(dns.Fqdn(zone))
+	q := msg.Question[0]
+	qname := strings.ToLower(q.Name)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		if err := verifySection(zone, keys, section); err != nil {
+			return err
+		}
+	}
+	nsecs := make([]*dns.NSEC, 0)
+	nsec3s := make([]*dns.NSEC3, 0)
+	for _, rr := range msg.Ns {
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, x)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, x)
+		}
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		var answerSig *dns.RRSIG
+		for _, rr := range msg.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, qname) {
+				continue
+			}
+			if sig, ok := rr.(*dns.RRSIG); ok && (sig.TypeCovered == q.Qtype || sig.TypeCovered == dns.TypeCNAME) {
+				answerSig = sig
+			}
+		}
+		if answerSig != nil {
+			labels := dns.CountLabel(qname)
+			// The RRSIGs of the wildcard names do not count their asterisk label.
+			if int(answerSig.Labels) >= labels || strings.HasPrefix(qname, "*.") && int(answerSig.Labels) == labels-1 {
+				return nil
+			}
+			// The answer was synthesized from a wildcard, so the queried name must not exist.
+			nextCloser := nextCloser(qname, strings.Join(dns.SplitDomainName(qname)[labels-int(answerSig.Labels):], ".")+".")
+			if coveredByNSEC(nsecs, qname) || coveredByNSEC3(nsec3s, nextCloser) {
+				return nil
+			}
+			return fmt.Errorf("wildcard answer without a proof that %s does not exist", qname)
+		}
+		if len(msg.Answer) > 0 {
+			return fmt.Errorf("answer without the queried RRset")
+		}
+		// NODATA, directly or from a wildcard (RFC4035 5.4, RFC5155 8.5 and 8.7).
+		for _, nsec := range nsecs {
+			if strings.EqualFold(nsec.Hdr.Name, qname) && !bitmapAnswers(nsec.TypeBitMap, q.Qtype) {
+				return nil
+			}
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(qname) && !bitmapAnswers(nsec3.TypeBitMap, q.Qtype) {
+				return nil
+			}
+		}
+		if encloser, ok := nsecEncloser(nsecs, qname); ok {
+			for _, nsec := range nsecs {
+				if strings.EqualFold(nsec.Hdr.Name, "*."+encloser) && !bitmapAnswers(nsec.TypeBitMap, q.Qtype) {
+					return nil
+				}
+			}
+		}
+		if encloser, ok := nsec3Encloser(nsec3s, zone, qname); ok {
+			for _, nsec3 := range nsec3s {
+				if nsec3.Match("*."+encloser) && !bitmapAnswers(nsec3.TypeBitMap, q.Qtype) {
+					return nil
+				}
+				// The delegation is insecure, left out of an opt-out chain (RFC5155 8.6).
+				if q.Qtype == dns.TypeDS && nsec3.Flags&1 == 1 && nsec3Covers(nsec3, nextCloser(qname, encloser)) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("NODATA response without a proof that %s %s does not exist", qname, dns.Type(q.Qtype))
+	case dns.RcodeNameError:
+		if encloser, ok := nsecEncloser(nsecs, qname); ok {
+			if coveredByNSEC(nsecs, "*."+encloser) {
+				return nil
+			}
+			return fmt.Errorf("NXDOMAIN response without a proof that *.%s does not exist", encloser)
+		}
+		if encloser, ok := nsec3Encloser(nsec3s, zone, qname); ok {
+			if coveredByNSEC3(nsec3s, "*."+encloser) {
+				return nil
+			}
+			return fmt.Errorf("NXDOMAIN response without a proof that *.%s does not exist", encloser)
+		}
+		return fmt.Errorf("NXDOMAIN response without a proof that %s does not exist", qname)
+	default:
+		return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[msg.Rcode])
+	}
+}
+
+// verifySection returns an error if an RRset of the section does not have a valid RRSIG made by one of the keys.
+func verifySection(zone string, keys []*dns.DNSKEY, section []dns.RR) error {
+	type rrsetKey struct {
+		name   string
+		rrType uint16
+	}
+	rrsets := make(map[rrsetKey][]dns.RR)
+	order := make([]rrsetKey, 0)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := rrsetKey{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := rrsets[k]; !ok {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+	now := time.Now()
+	for _, k := range order {
+		valid := false
+		lastErr := fmt.Errorf("no RRSIG")
+		for _, sig := range sigs[k] {
+			if !strings.EqualFold(sig.SignerName, zone) {
+				lastErr = fmt.Errorf("RRSIG signer %s is not the zone", sig.SignerName)
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				lastErr = fmt.Errorf("RRSIG of key %d is not in its validity period", sig.KeyTag)
+				continue
+			}
+			for _, key := range keys {
+				if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+					continue
+				}
+				if lastErr = sig.Verify(key, rrsets[k]); lastErr == nil {
+					valid = true
+					break
+				}
+			}
+			if valid {
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%s %s is not signed by a DNSKEY of the zone: %s", k.name, dns.Type(k.rrType), lastErr)
+		}
+	}
+	return nil
+}
+
+// nsecEncloser returns the closest encloser of a name proven not to exist by an NSEC record covering it,
+// which is the longest common ancestor of the name with the owner or the next name of the record (RFC4035 5.4).
+func nsecEncloser(nsecs []*dns.NSEC, name string) (string, bool) {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			encloser := commonAncestor(name, nsec.Hdr.Name)
+			if other := commonAncestor(name, nsec.NextDomain); dns.CountLabel(other) > dns.CountLabel(encloser) {
+				encloser = other
+			}
+			return encloser, true
+		}
+	}
+	return "", false
+}
+
+// nsec3Encloser returns the closest encloser of a name that does not exist, proven by an NSEC3 record matching it
+// and another covering the next closer name (RFC5155 8.3).
+func nsec3Encloser(nsec3s []*dns.NSEC3, zone, name string) (string, bool) {
+	for candidate := name; dns.IsSubDomain(zone, candidate); candidate = parentName(candidate) {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(candidate) {
+				if candidate == name {
+					return "", false
+				}
+				return candidate, coveredByNSEC3(nsec3s, nextCloser(name, candidate))
+			}
+		}
+	}
+	return "", false
+}
+
+func coveredByNSEC(nsecs []*dns.NSEC, name string) bool {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func coveredByNSEC3(nsec3s []*dns.NSEC3, name string) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3Covers(nsec3, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers returns true if the name is between the owner and the next name of the NSEC record in canonical order.
+// The last NSEC record of the zone covers the names after its owner.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	if signer.CompareNames(nsec.Hdr.Name, name) >= 0 {
+		return false
+	}
+	return signer.CompareNames(name, nsec.NextDomain) < 0 || signer.CompareNames(nsec.NextDomain, nsec.Hdr.Name) <= 0
+}
+
+// nsec3Covers returns true if the hash of the name is strictly between the owner and next hashes of the NSEC3
+// record. dns.NSEC3.Cover is also true if the hashes match.
+func nsec3Covers(nsec3 *dns.NSEC3, name string) bool {
+	return !nsec3.Match(name) && nsec3.Cover(name)
+}
+
+// commonAncestor returns the longest name that is an ancestor of both names, or one of them.
+func commonAncestor(a, b string) string {
+	return strings.Join(dns.SplitDomainName(strings.ToLower(a))[dns.CountLabel(a)-dns.CompareDomainName(a, b):], ".") + "."
+}
+
+// bitmapAnswers returns true if the type bitmap has the type, or CNAME, which answers the queries of any type.
+func bitmapAnswers(bitmap []uint16, rrType uint16) bool {
+	for _, t := range bitmap {
+		if t == rrType || t == dns.TypeCNAME {
+			return true
+		}
+	}
+	return false
+}
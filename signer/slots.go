@@ -0,0 +1,167 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"log"
+	"strings"
+)
+
+// TokenSelector selects the slot of the token where a session is opened, by slot ID, token serial number or token
+// label. At most one of them can be set, and if none is set the first slot with a token is used. HSM partitions
+// often share their label, so a label must match only one token, and the slot or the serial number must be used
+// to tell them apart.
+type TokenSelector struct {
+	Slot   *uint  // Slot ID of the token
+	Serial string // Serial number of the token
+	Label  string // Label of the token
+}
+
+// SlotInfo describes a slot with a token, as returned by ListSlots.
+type SlotInfo struct {
+	ID           uint   // Slot ID
+	Description  string // Description of the slot
+	TokenLabel   string // Label of the token
+	TokenSerial  string // Serial number of the token
+	Manufacturer string // Manufacturer of the token
+	Model        string // Model of the token
+}
+
+// String returns the slot ID and the label and serial number of its token.
+func (info SlotInfo) String() string {
+	return fmt.Sprintf("slot %d: token %q (serial %s, %s %s)", info.ID, info.TokenLabel, info.TokenSerial, info.Manufacturer, info.Model)
+}
+
+// trimTokenField removes the padding of the fixed length fields of the PKCS#11 token and slot info.
+func trimTokenField(field string) string {
+	return strings.TrimRight(field, " \x00")
+}
+
+// Validate returns an error if more than one of the slot, the serial number and the label are set.
+func (selector TokenSelector) Validate() error {
+	set := 0
+	if selector.Slot != nil {
+		set++
+	}
+	if len(selector.Serial) > 0 {
+		set++
+	}
+	if len(selector.Label) > 0 {
+		set++
+	}
+	if set > 1 {
+		return fmt.Errorf("only one of the slot, the token serial and the token label can be set")
+	}
+	return nil
+}
+
+// findSlot returns the slot selected in the pkcs#11 context. It returns an error if no token matches, or if many
+// tokens have the serial number or the label.
+func (selector TokenSelector) findSlot(p *pkcs11.Ctx) (uint, error) {
+	if err := selector.Validate(); err != nil {
+		return 0, fmt.Errorf("Error checking slots: %s\n", err)
+	}
+	slots, err := listSlots(p)
+	if err != nil {
+		return 0, err
+	}
+	var found []SlotInfo
+	for _, slot := range slots {
+		switch {
+		case selector.Slot != nil:
+			if slot.ID == *selector.Slot {
+				return slot.ID, nil
+			}
+		case len(selector.Serial) > 0:
+			if slot.TokenSerial == selector.Serial {
+				found = append(found, slot)
+			}
+		case len(selector.Label) > 0:
+			if slot.TokenLabel == selector.Label {
+				found = append(found, slot)
+			}
+		default:
+			return slot.ID, nil
+		}
+	}
+	switch len(found) {
+	case 0:
+		return 0, fmt.Errorf("Error checking slots: no slot with the selected token found\n")
+	case 1:
+		return found[0].ID, nil
+	}
+	ids := make([]string, 0, len(found))
+	for _, slot := range found {
+		ids = append(ids, fmt.Sprint(slot.ID))
+	}
+	return 0, fmt.Errorf("Error checking slots: the tokens of slots %s match, select the token by slot or serial number\n", strings.Join(ids, ", "))
+}
+
+// listSlots returns the slots with a token of the pkcs#11 context.
+func listSlots(p *pkcs11.Ctx) ([]SlotInfo, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("Error checking slots: %s\n", err)
+	}
+	infos := make([]SlotInfo, 0, len(slots))
+	for _, slot := range slots {
+		slotInfo, err := p.GetSlotInfo(slot)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking slot %d: %s\n", slot, err)
+		}
+		tokenInfo, err := p.GetTokenInfo(slot)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking token of slot %d: %s\n", slot, err)
+		}
+		infos = append(infos, SlotInfo{
+			ID:           slot,
+			Description:  trimTokenField(slotInfo.SlotDescription),
+			TokenLabel:   trimTokenField(tokenInfo.Label),
+			TokenSerial:  trimTokenField(tokenInfo.SerialNumber),
+			Manufacturer: trimTokenField(tokenInfo.ManufacturerID),
+			Model:        trimTokenField(tokenInfo.Model),
+		})
+	}
+	return infos, nil
+}
+
+// ListSlots loads the pkcs#11 library and returns its slots with a token, so the slot ID or the serial number of
+// the token to use can be found when many tokens share their label.
+func ListSlots(p11lib string) ([]SlotInfo, error) {
+	p, err := initContext(p11lib)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Destroy()
+	defer p.Finalize()
+	return listSlots(p)
+}
+
+// NewSessionWithToken creates a new session as NewSessionWithPIN, but on the slot of the token selected.
+func NewSessionWithToken(p11lib string, token TokenSelector, pin PINProvider, label string, log *log.Logger) (*Session, error) {
+	if pin == nil {
+		return nil, fmt.Errorf("Error creating session: PIN provider not specified\n")
+	}
+	key, err := pin.PIN()
+	if err != nil {
+		return nil, err
+	}
+	p, err := initContext(p11lib)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := token.findSlot(p)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, err
+	}
+	session, err := NewSessionWithContext(p, slot, key, label, log)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, err
+	}
+	session.ownsCtx = true
+	return session, nil
+}
@@ -0,0 +1,124 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"math/big"
+)
+
+// SoftSession signs zones like Session, but with keys generated and kept in memory instead of an HSM.
+// It is meant for testing signing configurations where an HSM is not available.
+// The keys of each algorithm are generated on the first signature (or when CreateKeys is true)
+// and reused by the following signatures of the session.
+type SoftSession struct {
+	Log  Logger                     // Logger (for output)
+	keys map[uint8][2]crypto.Signer // ZSK and KSK signers by algorithm
+	pubs map[uint8][2]string        // ZSK and KSK public keys by algorithm, in DNSKEY format
+}
+
+// NewSoftSession creates a new session with keys in memory.
+// The standard library logger is wrapped in a StdLogger that logs every level, and if it is nil the messages
+// are discarded.
+func NewSoftSession(log *log.Logger) *SoftSession {
+	return &SoftSession{
+		Log:  newLogger(log),
+		keys: make(map[uint8][2]crypto.Signer),
+		pubs: make(map[uint8][2]string),
+	}
+}
+
+// logger returns the logger of the session, or a logger discarding every message if Log is nil.
+func (session *SoftSession) logger() Logger {
+	return orNop(session.Log)
+}
+
+// Sign parses the zone file, adds its NSEC or NSEC3 records, signs the zone with the keys of the session
+// and outputs the result into args.Output. It returns the DS of the KSK (of the first algorithm, if there are many).
+// If DryRun is true, it only plans the signature (use PlanSign to get the plan).
+// The zone can be provided as a zone file in args.File or as RRs in args.RRs, but not both.
+// If args.Stream is true, the zone file is signed and written name by name (see SignArgs.Stream).
+func (session *SoftSession) Sign(args *SignArgs) (ds *dns.DS, err error) {
+	return SignWithKeys(args, session, session.logger())
+}
+
+// KeyPairs returns the ZSK and KSK of the algorithm, generating them if they don't exist or args.CreateKeys is true.
+// If only args.CreateZSK or args.CreateKSK is true, only the key of that role is generated again.
+func (session *SoftSession) KeyPairs(args *SignArgs, alg *Algorithm) (zsk, ksk *KeyPair, err error) {
+	_, exists := session.keys[alg.Number]
+	if !exists || args.createKeys(false) || args.createKeys(true) {
+		session.logger().Info("generating keys", "algorithm", alg)
+		signers := session.keys[alg.Number]
+		pubs := session.pubs[alg.Number]
+		for i, ksk := range []bool{false, true} {
+			if exists && !args.createKeys(ksk) {
+				continue
+			}
+			bits, err := args.keyBits(alg, ksk)
+			if err != nil {
+				return nil, nil, err
+			}
+			key := CreateNewDNSKEY(args.Zone, 256, alg.Number, args.dnskeyTTL(), "")
+			priv, err := key.Generate(bits)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot generate key: %s", err)
+			}
+			signer, ok := priv.(crypto.Signer)
+			if !ok {
+				return nil, nil, fmt.Errorf("algorithm %s keys cannot sign", alg)
+			}
+			signers[i] = signer
+			pubs[i] = key.PublicKey
+		}
+		session.keys[alg.Number] = signers
+		session.pubs[alg.Number] = pubs
+	}
+	signers := session.keys[alg.Number]
+	pubs := session.pubs[alg.Number]
+	zsk = &KeyPair{
+		DNSKEY: CreateNewDNSKEY(args.Zone, 256, alg.Number, args.dnskeyTTL(), pubs[0]),
+		Signer: signers[0],
+	}
+	ksk = &KeyPair{
+		DNSKEY: CreateNewDNSKEY(args.Zone, 257, alg.Number, args.dnskeyTTL(), pubs[1]),
+		Signer: signers[1],
+	}
+	if args.Digest == DigestHSM {
+		zsk.SignData = softSignData(signers[0], alg)
+		ksk.SignData = softSignData(signers[1], alg)
+	}
+	return zsk, ksk, nil
+}
+
+// softSignData returns a function which digests the data with the hash of the algorithm and signs it with a key
+// in memory, as an HSM does with the combined mechanism of the algorithm. ECDSA signatures are returned
+// as R || S, the format of DNSSEC and PKCS#11.
+func softSignData(signer crypto.Signer, alg *Algorithm) func(data []byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		if alg.IsEdDSA() {
+			// EdDSA signs the data itself, and its signatures are already in the DNSSEC format.
+			return signer.Sign(rand.Reader, data, crypto.Hash(0))
+		}
+		h := alg.Hash.New()
+		h.Write(data)
+		sig, err := signer.Sign(rand.Reader, h.Sum(nil), alg.Hash)
+		if err != nil || !alg.IsECDSA() {
+			return sig, err
+		}
+		var rs struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+			return nil, err
+		}
+		size := (alg.ZSKBits + 7) / 8
+		raw := make([]byte, 2*size)
+		r, s := rs.R.Bytes(), rs.S.Bytes()
+		copy(raw[size-len(r):size], r)
+		copy(raw[2*size-len(s):], s)
+		return raw, nil
+	}
+}
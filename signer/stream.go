@@ -0,0 +1,340 @@
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// spillSize is the number of bytes of text a spillBuffer keeps in memory before moving it to a temporary file.
+const spillSize = 1 << 20
+
+// zoneStream signs a zone file name by name, as SignArgs.Stream requires, so the memory used depends on the largest
+// name of the zone instead of its size. The zone file must be sorted in canonical order (as the zones written by sign),
+// because each NSEC record points to the next name of the chain: a name is signed and written when the next name of
+// the chain is read. The records out of the chain that follow it (the names below delegations, as the glue records)
+// are kept in a spillBuffer meanwhile.
+type zoneStream struct {
+	args       *SignArgs       // Arguments of the signature
+	log        Logger          // Logger (for output)
+	parser     *dns.ZoneParser // Parser of args.File
+	next       dns.RR          // First RR of the next name, read with the RRs of the previous one
+	last       string          // Name of the last RRs read, to check the order of the zone
+	apex       RRArray         // RRs at the apex, read before the keys are needed, without the DNSKEYs of the zone
+	delegation string          // Lowercased delegation point whose names are being read, if any
+	pending    RRArray         // RRs of the last name of the chain read, waiting for the next name
+	delegated  bool            // If true, the pending name is a delegation point, so only its DS and NSEC RRsets are signed
+	signed     RRArray         // RRs already signed at the pending name (the DNSKEY RRset and its RRSIGs at the apex)
+	after      *spillBuffer    // Records out of the chain read after the pending name
+	zsks       []*KeyPair      // ZSKs signing every RRset
+	failed     RRSetErrors     // RRsets left without RRSIGs, with ContinueOnError
+	duplicates int             // Number of duplicate RRs removed
+	dropped    int             // Number of RRSIG, NSEC, NSEC3 and NSEC3PARAM records removed
+}
+
+// newZoneStream checks the options of args for a streamed signature and reads the RRs at the apex of the zone in
+// args.File, setting args.MinTTL and updating the serial of its SOA following args.Serial, so the keys of the zone
+// can be found before the other names are read. The DNSKEYs at the apex follow args.ExistingDNSKEYs.
+func newZoneStream(args *SignArgs, log Logger) (*zoneStream, error) {
+	if err := args.checkStream(); err != nil {
+		return nil, err
+	}
+	args.start = timeNow()
+	if err := args.checkExpirations(); err != nil {
+		return nil, err
+	}
+	if err := args.checkValidity(log); err != nil {
+		return nil, err
+	}
+	args.Zone = dns.Fqdn(args.Zone)
+	parser := dns.NewZoneParser(args.File, args.Zone, "")
+	if args.DefaultTTL > 0 {
+		parser.SetDefaultTTL(args.DefaultTTL)
+	}
+	stream := &zoneStream{args: args, log: log, parser: parser, after: &spillBuffer{}}
+	apex, err := stream.readName()
+	if err != nil {
+		return nil, err
+	}
+	if len(apex) == 0 {
+		return nil, fmt.Errorf("no records parsed from input for zone %s", args.Zone)
+	}
+	var soa *dns.SOA
+	for _, rr := range apex {
+		if x, ok := rr.(*dns.SOA); ok {
+			soa = x
+		}
+	}
+	if !strings.EqualFold(apex[0].Header().Name, args.Zone) || soa == nil {
+		return nil, fmt.Errorf("a streamed zone must start with the records of its apex, but zone %s starts with %s", args.Zone, apex[0].Header().Name)
+	}
+	args.MinTTL = soa.Minttl
+	if soa.Serial, err = args.newSerial(soa.Serial); err != nil {
+		return nil, err
+	}
+	// The DNSKEY policy works with args.RRs, which only has the apex until the zone is signed.
+	args.RRs = apex
+	args.rolloverZSKs = nil
+	err = args.removeDNSKEYs()
+	stream.apex, args.RRs = args.RRs, nil
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// checkStream returns an error if args uses an option that needs the whole zone, so it cannot be streamed.
+func (args *SignArgs) checkStream() error {
+	unsupported := ""
+	switch {
+	case args.File == nil || len(args.RRs) > 0:
+		return fmt.Errorf("a streamed zone must be provided as a zone file, not as RRs")
+	case args.NSEC3:
+		unsupported = "NSEC3, whose chain is sorted by hash"
+	case !args.SkipValidation:
+		unsupported = "validation (use SkipValidation after validating it)"
+	case args.PreserveText:
+		unsupported = "preserved zone text"
+	case args.RefreshWindow > 0 || args.DNSKEYReuseWindow > 0:
+		unsupported = "refreshed signatures"
+	case args.MultiSigner:
+		unsupported = "multiple signers"
+	case args.CDS != CDSNone:
+		unsupported = "CDS records"
+	case args.ZONEMD:
+		unsupported = "ZONEMD records"
+	case len(args.OfflineKSK) > 0:
+		unsupported = "an offline KSK"
+	case args.RecordFilter != nil:
+		unsupported = "a record filter"
+	case args.MetadataOutput != nil:
+		unsupported = "metadata output"
+	case args.Order != OrderCanonical || args.Format != FormatText:
+		unsupported = "output orders and formats other than canonical text"
+	default:
+		return nil
+	}
+	return fmt.Errorf("zone %s cannot be streamed with %s", args.Zone, unsupported)
+}
+
+// readName returns the RRs of the next name of the zone, sorted and without duplicates, or nil at the end of the zone.
+// The RRSIG, NSEC, NSEC3 and NSEC3PARAM records are removed, because the zone is signed again, and so are the
+// records out of the zone if args.OutOfZone is OutOfZoneDrop. It returns an error if the name is not after the
+// previous one in canonical order.
+func (stream *zoneStream) readName() (RRArray, error) {
+	args := stream.args
+	rrs := make(RRArray, 0)
+	for {
+		rr := stream.next
+		stream.next = nil
+		if rr == nil {
+			var ok bool
+			if rr, ok = stream.parser.Next(); !ok {
+				if err := stream.parser.Err(); err != nil {
+					return nil, zoneParseError(args.Zone, err, nil)
+				}
+				break
+			}
+		}
+		name := dns.Fqdn(rr.Header().Name)
+		if !dns.IsSubDomain(args.Zone, name) {
+			if args.OutOfZone != OutOfZoneDrop {
+				return nil, fmt.Errorf("zone %s has records out of the zone, as %s (use the drop out-of-zone policy to remove them)", args.Zone, name)
+			}
+			stream.log.Warn("removed a record out of the zone", "zone", args.Zone, "name", name, "type", dns.Type(rr.Header().Rrtype))
+			continue
+		}
+		if signatureTypes[rr.Header().Rrtype] {
+			stream.dropped++
+			continue
+		}
+		if len(rrs) > 0 && CompareNames(rrs[0].Header().Name, name) != 0 {
+			stream.next = rr
+			break
+		}
+		rrs = append(rrs, rr)
+	}
+	if len(rrs) == 0 {
+		return nil, nil
+	}
+	name := rrs[0].Header().Name
+	if len(stream.last) > 0 && CompareNames(stream.last, name) >= 0 {
+		return nil, fmt.Errorf("zone %s is not sorted in canonical order: %s is after %s, but it should be before", args.Zone, name, stream.last)
+	}
+	stream.last = name
+	unique := rrs.Dedup()
+	stream.duplicates += len(rrs) - len(unique)
+	sort.Sort(unique)
+	return unique, nil
+}
+
+// sign signs the zone with the key pairs, writing each name into args.Output as it is signed, as signRRs does with the
+// RRs of a zone in memory. args.RRs is left empty. It returns the SHA-256 DS of the first KSK.
+func (stream *zoneStream) sign(zsks, ksks []*KeyPair) (ds *dns.DS, err error) {
+	args, log := stream.args, stream.log
+	defer stream.after.close()
+	if err = checkKeyPairs(zsks, ksks); err != nil {
+		return nil, err
+	}
+	log.Info("Start signing...", "zone", args.Zone, "stream", true)
+	dnskeys, signingZSKs := args.signingKeys(zsks, ksks)
+	stream.zsks = signingZSKs
+	rrDNSKeys := args.dnskeyRRSet(dnskeys)
+	dnskeySigs, err := args.signDNSKEYRRSet(rrDNSKeys, ksks)
+	if err != nil {
+		return nil, err
+	}
+	args.Refreshed = len(dnskeySigs)
+	stream.pending = stream.apex
+	stream.signed = append(append(RRArray{}, rrDNSKeys...), dnskeySigs...)
+	for {
+		rrs, err := stream.readName()
+		if err != nil {
+			return nil, err
+		}
+		if rrs == nil {
+			break
+		}
+		name := strings.ToLower(dns.Fqdn(rrs[0].Header().Name))
+		if len(stream.delegation) > 0 && dns.IsSubDomain(stream.delegation, name) {
+			// Names below a delegation are not signed nor in the chain, as the glue records.
+			if err = rrs.WriteZone(stream.after); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		stream.delegation = ""
+		if hasType(rrs, dns.TypeNS) {
+			// Secure and insecure delegation points are in the NSEC chain (see AddNSECRecords).
+			stream.delegation = name
+		}
+		if err = stream.writePending(rrs[0].Header().Name); err != nil {
+			return nil, err
+		}
+		stream.pending, stream.delegated, stream.signed = rrs, len(stream.delegation) > 0, nil
+	}
+	if err = stream.writePending(stream.apex[0].Header().Name); err != nil {
+		return nil, err
+	}
+	if stream.duplicates > 0 {
+		log.Warn("removed duplicate records from the zone", "zone", args.Zone, "records", stream.duplicates)
+	}
+	if stream.dropped > 0 {
+		log.Info("removed the signatures and denial of existence records of the zone", "zone", args.Zone, "records", stream.dropped)
+	}
+	for i, ksk := range ksks {
+		log.Info("Zone signed", "zone", args.Zone, "zsk", zsks[i].DNSKEY.KeyTag(), "ksk", ksk.DNSKEY.KeyTag(), "rrsigs", args.Refreshed)
+	}
+	ds = ksks[0].DNSKEY.ToDS(dns.SHA256)
+	if args.DSOutput != nil {
+		if err = args.writeDSRecords(rrDNSKeys); err != nil {
+			return nil, err
+		}
+	}
+	if len(stream.failed) > 0 {
+		return ds, stream.failed
+	}
+	return ds, nil
+}
+
+// writePending adds the NSEC record of the pending name of the chain, pointing to next, signs its RRsets and writes
+// them into args.Output with their RRSIGs, followed by the records out of the chain read after it. Only the DS and
+// NSEC RRsets of a delegation point are signed, and its NSEC record covers its NS and DS RRsets, as in AddNSECRecords.
+func (stream *zoneStream) writePending(next string) error {
+	args := stream.args
+	denial := stream.pending
+	if stream.delegated {
+		denial = make(RRArray, 0, len(stream.pending))
+		for _, rr := range stream.pending {
+			if rr.Header().Rrtype == dns.TypeNS || rr.Header().Rrtype == dns.TypeDS {
+				denial = append(denial, rr)
+			}
+		}
+	}
+	rrs := append(append(RRArray{}, stream.pending...), nsecRecord(denial, next))
+	sort.Sort(rrs)
+	out := append(append(RRArray{}, rrs...), stream.signed...)
+	for _, set := range rrs.CreateRRSet(args.Zone, true) {
+		set.sortCanonical()
+		rrSigs, err := args.signRRSet(set, stream.zsks)
+		if err != nil {
+			if !args.ContinueOnError || !recoverable(set) {
+				return err
+			}
+			stream.log.Warn("Cannot sign RRset, it is left without RRSIGs", "name", set[0].Header().Name, "type", dns.Type(set[0].Header().Rrtype), "error", err)
+			stream.failed = append(stream.failed, &RRSetError{Name: set[0].Header().Name, Type: set[0].Header().Rrtype, Err: err})
+			continue
+		}
+		out = append(out, rrSigs...)
+		args.Refreshed += len(rrSigs)
+	}
+	sort.Sort(out)
+	if err := out.WriteZone(args.Output); err != nil {
+		return err
+	}
+	return stream.after.flushTo(args.Output)
+}
+
+// hasType returns true if an RR of the array has the type provided.
+func hasType(rrs RRArray, rrType uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+// spillBuffer keeps the text written into it in memory up to spillSize bytes, and in a temporary file after that,
+// so the records waiting for a name of the chain to be written do not fill the memory.
+type spillBuffer struct {
+	memory bytes.Buffer
+	file   *os.File
+}
+
+// Write writes the text into the buffer, moving it to a temporary file if it grows over spillSize bytes.
+func (buffer *spillBuffer) Write(p []byte) (int, error) {
+	if buffer.file == nil && buffer.memory.Len()+len(p) > spillSize {
+		file, err := ioutil.TempFile("", "hsm-tools-stream")
+		if err != nil {
+			return 0, fmt.Errorf("cannot create temporary file: %s", err)
+		}
+		buffer.file = file
+		if _, err := buffer.memory.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+	if buffer.file != nil {
+		return buffer.file.Write(p)
+	}
+	return buffer.memory.Write(p)
+}
+
+// flushTo writes the text of the buffer into writer and empties the buffer.
+func (buffer *spillBuffer) flushTo(writer io.Writer) error {
+	if buffer.file == nil {
+		_, err := buffer.memory.WriteTo(writer)
+		return err
+	}
+	defer buffer.close()
+	if _, err := buffer.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(writer, buffer.file)
+	return err
+}
+
+// close removes the temporary file of the buffer, if it has one, and empties the buffer.
+func (buffer *spillBuffer) close() {
+	if buffer.file != nil {
+		buffer.file.Close()
+		os.Remove(buffer.file.Name())
+		buffer.file = nil
+	}
+	buffer.memory.Reset()
+}
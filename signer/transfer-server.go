@@ -0,0 +1,368 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transferChunk is the number of RRs sent in each message of an outgoing zone transfer.
+const transferChunk = 100
+
+// TransferServer serves signed zones to secondary servers with AXFR, so the signer can stand between a hidden primary
+// (whose zones are read with TransferZone) and the public secondaries, as a bump-in-the-wire signer. It answers the
+// AXFR and IXFR requests over TCP with the whole zone, the SOA queries of the zones it serves and the NOTIFY messages
+// (RFC1996) of its primaries, and refuses any other request. IXFR requests are answered as AXFR (RFC1995 4).
+type TransferServer struct {
+	Key         *TSIGKey          // If not nil, the transfers and the NOTIFY messages received must be signed with it (RFC8945), and so are the NOTIFY messages sent
+	Primaries   []string          // Servers (host or host:port) whose NOTIFY messages are accepted if Key is nil, resolved by Listen. The port is not checked, because NOTIFY messages are sent from any port.
+	Secondaries []string          // Servers (host:port) notified when a zone is set
+	OnNotify    func(zone string) // If not nil, it is called with the zone of the NOTIFY messages accepted, as when the hidden primary changes it. The messages received while it runs for a zone are coalesced into one more call.
+	Log         Logger            // Logger (for output)
+	mutex       sync.RWMutex      // Protects zones and notifying
+	zones       map[string]RRArray
+	notifying   map[string]bool // Zones whose OnNotify call is running, and whether another one is pending
+	primaryIPs  []net.IP        // Addresses of the Primaries
+	servers     []*dns.Server
+}
+
+// logger returns the logger of the server, or a logger discarding every message if Log is nil.
+func (server *TransferServer) logger() Logger {
+	return orNop(server.Log)
+}
+
+// SetZone replaces the RRs served for the zone with the signed RRs provided (as the SignArgs.RRs of a signature) and
+// notifies the secondaries. It returns an error if the RRs have no SOA at the apex of the zone.
+func (server *TransferServer) SetZone(zone string, rrs RRArray) error {
+	zone = dns.Fqdn(zone)
+	var soa *dns.SOA
+	body := make(RRArray, 0, len(rrs))
+	for _, rr := range rrs {
+		if x, ok := rr.(*dns.SOA); ok && strings.EqualFold(x.Hdr.Name, zone) {
+			soa = x
+			continue
+		}
+		body = append(body, rr)
+	}
+	if soa == nil {
+		return fmt.Errorf("zone %s has no SOA record to serve", zone)
+	}
+	server.mutex.Lock()
+	if server.zones == nil {
+		server.zones = make(map[string]RRArray)
+	}
+	// The zone is kept in transfer order: the SOA, the other RRs and the SOA again.
+	server.zones[strings.ToLower(zone)] = append(append(RRArray{soa}, body...), soa)
+	server.mutex.Unlock()
+	for _, secondary := range server.Secondaries {
+		if err := NotifyZone(secondary, zone, soa, server.Key); err != nil {
+			server.logger().Warn("cannot notify secondary", "zone", zone, "server", secondary, "error", err)
+		}
+	}
+	return nil
+}
+
+// zone returns the RRs served for the zone in transfer order, or nil if it is not served.
+func (server *TransferServer) zone(zone string) RRArray {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return server.zones[strings.ToLower(dns.Fqdn(zone))]
+}
+
+// ServeDNS answers a request received by the server.
+func (server *TransferServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		server.refuse(w, req, dns.RcodeFormatError)
+		return
+	}
+	q := req.Question[0]
+	if req.Opcode == dns.OpcodeNotify {
+		if rcode := server.checkNotify(w, req); rcode != dns.RcodeSuccess {
+			server.logger().Warn("NOTIFY refused", "zone", q.Name, "from", w.RemoteAddr(), "rcode", dns.RcodeToString[rcode])
+			server.refuse(w, req, rcode)
+			return
+		}
+		server.logger().Info("NOTIFY received", "zone", q.Name, "from", w.RemoteAddr())
+		if server.OnNotify != nil {
+			server.notify(q.Name)
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Authoritative = true
+		server.writeSigned(w, req, reply)
+		return
+	}
+	rrs := server.zone(q.Name)
+	if req.Opcode != dns.OpcodeQuery || rrs == nil {
+		server.refuse(w, req, dns.RcodeRefused)
+		return
+	}
+	switch q.Qtype {
+	case dns.TypeSOA:
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Authoritative = true
+		reply.Answer = []dns.RR{rrs[0]}
+		server.writeSigned(w, req, reply)
+	case dns.TypeAXFR, dns.TypeIXFR:
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			server.refuse(w, req, dns.RcodeRefused)
+			return
+		}
+		// miekg/dns verifies the TSIG with the algorithm of the request, so it is checked to be the one of the key.
+		if tsig := req.IsTsig(); server.Key != nil && (tsig == nil || w.TsigStatus() != nil || !strings.EqualFold(tsig.Algorithm, server.Key.algorithm())) {
+			server.logger().Warn("zone transfer refused without a valid TSIG", "zone", q.Name, "from", w.RemoteAddr())
+			server.refuse(w, req, dns.RcodeNotAuth)
+			return
+		}
+		server.transfer(w, req, rrs)
+	default:
+		server.refuse(w, req, dns.RcodeRefused)
+	}
+}
+
+// checkNotify returns the rcode of the answer to a NOTIFY message: NOTAUTH if Key is set and the message is not signed
+// with it, REFUSED if Key is nil and the message was not sent by one of the Primaries, or NOERROR if it is accepted.
+// Otherwise, anyone could make the signer transfer and sign the zone again as often as they want.
+func (server *TransferServer) checkNotify(w dns.ResponseWriter, req *dns.Msg) int {
+	if server.Key != nil {
+		// As for the transfers, the TSIG must be verified with the algorithm of the key.
+		if tsig := req.IsTsig(); tsig == nil || w.TsigStatus() != nil || !strings.EqualFold(tsig.Algorithm, server.Key.algorithm()) {
+			return dns.RcodeNotAuth
+		}
+		return dns.RcodeSuccess
+	}
+	var remote net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		remote = addr.IP
+	case *net.TCPAddr:
+		remote = addr.IP
+	}
+	for _, ip := range server.primaryIPs {
+		if ip.Equal(remote) {
+			return dns.RcodeSuccess
+		}
+	}
+	return dns.RcodeRefused
+}
+
+// resolvePrimaries returns the addresses of the Primaries, looking up the names of the hosts. They are resolved once,
+// when the server starts, instead of on each NOTIFY message received. It returns an error if a host cannot be resolved.
+func (server *TransferServer) resolvePrimaries() ([]net.IP, error) {
+	var ips []net.IP
+	for _, primary := range server.Primaries {
+		host := primary
+		if h, _, err := net.SplitHostPort(primary); err == nil {
+			host = h
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve primary %s: %s", primary, err)
+		}
+		ips = append(ips, addrs...)
+	}
+	return ips, nil
+}
+
+// notify calls OnNotify with the zone in the background, unless it is already running for the zone. In that case,
+// OnNotify is called once more when it returns, however many NOTIFY messages were received meanwhile, so a primary
+// sending many of them (as for many changes in a row) does not start a signature for each one.
+func (server *TransferServer) notify(zone string) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	server.mutex.Lock()
+	if server.notifying == nil {
+		server.notifying = make(map[string]bool)
+	}
+	_, running := server.notifying[zone]
+	server.notifying[zone] = running
+	server.mutex.Unlock()
+	if running {
+		return
+	}
+	go func() {
+		for {
+			server.OnNotify(zone)
+			server.mutex.Lock()
+			pending := server.notifying[zone]
+			if !pending {
+				delete(server.notifying, zone)
+			} else {
+				server.notifying[zone] = false
+			}
+			server.mutex.Unlock()
+			if !pending {
+				return
+			}
+		}
+	}()
+}
+
+// transfer sends the RRs of the zone to w, in messages of at most transferChunk RRs.
+func (server *TransferServer) transfer(w dns.ResponseWriter, req *dns.Msg, rrs RRArray) {
+	ch := make(chan *dns.Envelope)
+	done := make(chan error)
+	go func() {
+		done <- new(dns.Transfer).Out(w, req, ch)
+	}()
+	for start := 0; start < len(rrs); start += transferChunk {
+		end := start + transferChunk
+		if end > len(rrs) {
+			end = len(rrs)
+		}
+		ch <- &dns.Envelope{RR: rrs[start:end]}
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		server.logger().Warn("cannot transfer zone", "zone", req.Question[0].Name, "to", w.RemoteAddr(), "error", err)
+		return
+	}
+	server.logger().Info("zone transferred", "zone", req.Question[0].Name, "to", w.RemoteAddr(), "rrs", len(rrs)-1)
+	w.Hijack()
+}
+
+// writeSigned writes the reply, with a TSIG record if the request has one that verified.
+func (server *TransferServer) writeSigned(w dns.ResponseWriter, req, reply *dns.Msg) {
+	if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		reply.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	w.WriteMsg(reply)
+}
+
+// refuse answers the request with the rcode provided.
+func (server *TransferServer) refuse(w dns.ResponseWriter, req *dns.Msg, rcode int) {
+	reply := new(dns.Msg)
+	reply.SetRcode(req, rcode)
+	w.WriteMsg(reply)
+}
+
+// Listen serves the zones on the address provided (as :53) over TCP and UDP, in the background, until Close is called.
+// If the port is zero, a free port is used for both (see Addr). Without a Key, it returns an error if the Primaries
+// cannot be resolved.
+func (server *TransferServer) Listen(addr string) error {
+	if err := checkTSIG(server.Key); err != nil {
+		return err
+	}
+	if server.Key == nil {
+		ips, err := server.resolvePrimaries()
+		if err != nil {
+			return err
+		}
+		server.primaryIPs = ips
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %s", addr, err)
+	}
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("cannot listen on %s: %s", addr, err)
+	}
+	var secrets map[string]string
+	if server.Key != nil {
+		secrets = server.Key.secrets()
+	}
+	server.servers = []*dns.Server{
+		{Listener: listener, Handler: server, TsigSecret: secrets},
+		{PacketConn: conn, Handler: server, TsigSecret: secrets},
+	}
+	// Listen returns when both servers are started, so Close can shut them down.
+	started := make(chan error, len(server.servers))
+	for _, s := range server.servers {
+		s.NotifyStartedFunc = func() { started <- nil }
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				server.logger().Error("transfer server stopped", "error", err)
+				select {
+				case started <- err:
+				default:
+				}
+			}
+		}(s)
+	}
+	for range server.servers {
+		if err := <-started; err != nil {
+			server.Close()
+			return fmt.Errorf("cannot serve on %s: %s", addr, err)
+		}
+	}
+	return nil
+}
+
+// Addr returns the TCP address the server listens on, or nil if it is not listening.
+func (server *TransferServer) Addr() net.Addr {
+	if len(server.servers) == 0 {
+		return nil
+	}
+	return server.servers[0].Listener.Addr()
+}
+
+// Close stops serving the zones.
+func (server *TransferServer) Close() error {
+	var err error
+	for _, s := range server.servers {
+		if e := s.Shutdown(); e != nil && err == nil {
+			err = e
+		}
+	}
+	server.servers = nil
+	return err
+}
+
+// NotifyZone sends a NOTIFY message (RFC1996) for the zone to the server (as 192.0.2.1:53) over UDP, with the SOA
+// provided (if it is not nil), so the server transfers the new version of the zone. If key is not nil, the message
+// is signed with it. It returns an error if the server does not acknowledge the message.
+func NotifyZone(server, zone string, soa *dns.SOA, key *TSIGKey) error {
+	if err := checkTSIG(key); err != nil {
+		return err
+	}
+	msg := new(dns.Msg)
+	msg.SetNotify(dns.Fqdn(zone))
+	if soa != nil {
+		msg.Answer = []dns.RR{soa}
+	}
+	client := &dns.Client{}
+	if key != nil {
+		client.TsigSecret = key.sign(msg)
+	}
+	response, _, err := client.Exchange(msg, server)
+	if err != nil {
+		return fmt.Errorf("cannot notify %s of zone %s: %s", server, zone, err)
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("NOTIFY of zone %s rejected by %s: %s", zone, server, dns.RcodeToString[response.Rcode])
+	}
+	return nil
+}
+
+// ZoneSerial queries the SOA of the zone to the server (as 192.0.2.1:53) and returns its serial, so a zone is only
+// transferred again when it changes. If key is not nil, the query is signed with it.
+func ZoneSerial(server, zone string, key *TSIGKey) (uint32, error) {
+	if err := checkTSIG(key); err != nil {
+		return 0, err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	client := &dns.Client{}
+	if key != nil {
+		client.TsigSecret = key.sign(msg)
+	}
+	response, _, err := client.Exchange(msg, server)
+	if err != nil {
+		return 0, fmt.Errorf("cannot query SOA of zone %s to %s: %s", zone, server, err)
+	}
+	for _, rr := range response.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, dns.Fqdn(zone)) {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("server %s did not return the SOA of zone %s (%s)", server, zone, dns.RcodeToString[response.Rcode])
+}
@@ -0,0 +1,108 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+)
+
+// updateTypes are the types managed by the signer in a dynamic zone. The SOA is included because
+// its RRSIG is only valid for the signed serial, the CDS and CDNSKEY records because the signer
+// replaces them (see CDSMode), and the ZONEMD because its digest changes with the signature.
+var updateTypes = map[uint16]bool{
+	dns.TypeSOA:        true,
+	dns.TypeDNSKEY:     true,
+	dns.TypeCDS:        true,
+	dns.TypeCDNSKEY:    true,
+	dns.TypeZONEMD:     true,
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeNSEC3PARAM: true,
+}
+
+// UpdateMessages returns the DNS UPDATE messages (RFC2136) that replace the DNSSEC records of oldRRs
+// (the zone in the server) with the ones of newRRs (the signed zone), so a signed zone can be published
+// in a server that owns the zone data. Only the SOA, DNSKEY, CDS, CDNSKEY, ZONEMD, RRSIG, NSEC, NSEC3 and
+// NSEC3PARAM records are changed, using IncrementalDiff: the superseded records are deleted and the new ones are
+// added.
+// If maxChanges is positive, the changes are split in messages with at most maxChanges records each,
+// and the SOA goes in the last one. Otherwise, a single message is returned, so the update is atomic.
+// It returns no messages if there are no changes.
+func UpdateMessages(zone string, oldRRs, newRRs RRArray, maxChanges int) []*dns.Msg {
+	zone = dns.Fqdn(zone)
+	deleted, added := IncrementalDiff(oldRRs, newRRs)
+	type change struct {
+		rr     dns.RR
+		delete bool
+	}
+	changes := make([]change, 0)
+	var soa, oldSOA dns.RR
+	for _, rr := range deleted {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			oldSOA = rr
+		}
+		if rr.Header().Rrtype != dns.TypeSOA && updateTypes[rr.Header().Rrtype] {
+			changes = append(changes, change{rr, true})
+		}
+	}
+	for _, rr := range added {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			// Adding a SOA replaces the old one (RFC2136 3.4.2.2), so it is only sent if it changed.
+			if oldSOA == nil || rrKey(oldSOA) != rrKey(rr) {
+				soa = rr
+			}
+		} else if updateTypes[rr.Header().Rrtype] {
+			changes = append(changes, change{rr, false})
+		}
+	}
+	if len(changes) == 0 && soa == nil {
+		return nil
+	}
+	if soa != nil {
+		changes = append(changes, change{soa, false})
+	}
+	if maxChanges <= 0 {
+		maxChanges = len(changes)
+	}
+	msgs := make([]*dns.Msg, 0)
+	for start := 0; start < len(changes); start += maxChanges {
+		end := start + maxChanges
+		if end > len(changes) {
+			end = len(changes)
+		}
+		msg := new(dns.Msg)
+		msg.SetUpdate(zone)
+		for _, c := range changes[start:end] {
+			if c.delete {
+				msg.Remove([]dns.RR{c.rr})
+			} else {
+				msg.Insert([]dns.RR{c.rr})
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// SendUpdates sends the DNS UPDATE messages to the server (as 192.0.2.1:53) over TCP, in order.
+// If key is not nil, the messages are signed with it and the TSIG records of the responses are verified.
+// It returns an error if a message cannot be sent or the server does not accept it.
+func SendUpdates(server string, msgs []*dns.Msg, key *TSIGKey) error {
+	if err := checkTSIG(key); err != nil {
+		return err
+	}
+	client := &dns.Client{Net: "tcp"}
+	for i, msg := range msgs {
+		if key != nil {
+			client.TsigSecret = key.sign(msg)
+		}
+		response, _, err := client.Exchange(msg, server)
+		if err != nil {
+			return fmt.Errorf("cannot send update %d of %d to %s: %s", i+1, len(msgs), server, err)
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("update %d of %d rejected by %s: %s", i+1, len(msgs), server, dns.RcodeToString[response.Rcode])
+		}
+	}
+	return nil
+}
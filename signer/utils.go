@@ -1,13 +1,18 @@
 package signer
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/miekg/pkcs11"
+	"math"
 	"math/rand"
 	"os"
 	"io"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,37 +23,165 @@ type SignArgs struct {
         File        io.Reader // File path
         Output      io.Writer // Out path
         SignExpDate time.Time // Expiration date for the signature.
+        KSKSignExpDuration time.Duration // If positive, the RRSIGs of the DNSKEY RRset (made with the KSKs) expire this duration after the signature, instead of on SignExpDate. They cannot expire before the others.
+        ZSKSignExpDuration time.Duration // If positive, the RRSIGs of the other RRsets (made with the ZSKs) expire this duration after the signature, instead of on SignExpDate.
         CreateKeys  bool      // If True, the sign process creates new keys for the signature.
-        NSEC3       bool      // If true, the zone is signed using NSEC3
+        CreateZSK   bool      // If true, new ZSKs are created and the KSKs are reused (as in a ZSK rollover), unless CreateKeys or CreateKSK is true too.
+        CreateKSK   bool      // If true, new KSKs are created and the ZSKs are reused (as in a KSK rollover), unless CreateKeys or CreateZSK is true too.
+        ZSKBits     int       // Size in bits of the RSA ZSKs created. If zero, the ZSK size of the algorithm is used. ECDSA and EdDSA keys have the size of their curve.
+        KSKBits     int       // Size in bits of the RSA KSKs created. If zero, the KSK size of the algorithm is used.
+        NSEC3       bool      // If true, the zone is signed using NSEC3. A signed zone can be re-signed with the other mode, because its chain is replaced.
         OptOut      bool      // If true and NSEC3 is true, the zone is signed using OptOut NSEC3 flag.
+        NSEC3Salt   string    // If not empty, the NSEC3 salt as a hex string ("-" for no salt), instead of a random one, so the chain can be reproduced. A hash collision with it fails the signature instead of rotating the salt.
+        NSEC3SaltLength int   // Length in octets of the random NSEC3 salts. If zero, DefaultNSEC3SaltLength is used, and if negative, the salt is empty (as RFC9276 3.1 recommends). It cannot be used with NSEC3Salt.
+        NSEC3Iterations int   // Additional iterations of the NSEC3 hash. If zero, DefaultNSEC3Iterations is used, and if negative, there are no additional iterations (as RFC9276 3.1 recommends).
         MinTTL      uint32 // Min TTL ;-)
+        DNSKEYTTL   uint32 // TTL of the DNSKEY RRset (as lower to speed up rollovers). If zero, MinTTL (the minimum TTL of the SOA) is used.
         RRs         RRArray     // RRs
+        ExpirationJitter time.Duration // If positive, each RRSIG expiration is moved back randomly up to this value.
+        InceptionOffset time.Duration // If positive, the RRSIG inceptions are moved back this duration (as an hour), so resolvers whose clocks are behind the signer's accept the new signatures.
+        MinValidity time.Duration // If positive, a warning is logged if the earliest RRSIG expiration (with ExpirationJitter) is less than this after the inception.
+        StrictValidity bool   // If true, a validity shorter than MinValidity fails the signature instead of being logged as a warning.
+        Rand        *rand.Rand // Randomness source. If nil, a source seeded on current time is used.
+        DryRun      bool      // If true, the zone is parsed and its NSEC/NSEC3 records are planned, but nothing is signed.
+        Algorithm   uint8     // DNSSEC algorithm of the keys. If zero, DefaultAlgorithm is used.
+        Algorithms  []uint8   // If not empty, the zone is signed with the keys of all these algorithms (as during an algorithm rollover), instead of Algorithm.
+        SkipValidation bool   // If true, the zone is not validated (see RRArray.Validate) before signing.
+        ExistingDNSKEYs DNSKEYPolicy // What to do with the DNSKEY records already in the zone. By default, they are an error.
+        ZONEMD      bool      // If true, a ZONEMD record (RFC8976) with the SHA-384 digest of the signed zone is added at its apex. The ZONEMD records of the zone are always replaced, because signing it changes its digest.
+        CDS         CDSMode   // CDS and CDNSKEY records published at the apex (RFC7344), signed by the ZSKs and the KSKs. By default, the ones of the zone are signed as the other records.
+        OfflineKSK  RRArray   // If not empty, the DNSKEY RRset of the zone and its RRSIGs made by the KSKs kept offline (see ReadOfflineKSK). They replace the DNSKEYs of the zone and are published as they are, so only the ZSKs are used. The RRset must have the DNSKEYs of the ZSKs.
+        OutOfZone   OutOfZonePolicy // What to do with the records whose owner is not in the zone. By default, they are an error. Records occluded by delegations are never signed.
+        MaxResponseSize int   // Size in bytes of the largest DNSSEC response allowed without a warning. If zero, DefaultMaxResponseSize is used, and if negative, sizes are not checked.
+        Retry       RetryPolicy // Retries of the HSM operations failing with transient errors. By default, they are not retried.
+        Serial      SerialPolicy // How the SOA serial is updated. By default, it is incremented by one.
+        SerialValue uint32    // Serial of the signed zone, used only with the SerialValue policy
+        Digest      DigestMode // Where the signed data is digested. By default, the signer digests it and the HSM signs the digest.
+        IgnoreCoverage bool   // If true, RRsets without RRSIGs (see RRArray.CoverageReport) are logged as a warning instead of failing the signature.
+        RefreshWindow time.Duration // If positive, the zone is already signed and only the RRSIGs expiring before this duration from now (or not valid anymore) are made again. The serial is only updated if an RRSIG changes.
+        DNSKEYReuseWindow time.Duration // If positive, the zone is already signed and the RRSIGs of its DNSKEY RRset are kept if the RRset did not change and they expire after this duration from now, so the KSKs are not used.
+        Refreshed   int       // Set by Sign to the number of RRSIGs it made (all of them, unless RefreshWindow is positive)
+        MultiSigner bool      // If true, the zone is signed by one of many signers (RFC8901 Model 2): its DNSKEYs are preserved (whatever ExistingDNSKEYs is), and the RRSIGs of the other signers still valid are kept.
+        ContinueOnError bool  // If true, the RRsets that cannot be signed are left without RRSIGs and returned as RRSetErrors after writing the zone, instead of failing the signature. The SOA, DNSKEY and NSEC or NSEC3 RRsets must always be signed.
+        Order       OutputOrder // Order of the records in the output. By default, they are sorted in canonical order.
+        Format      OutputFormat // Format of the records in the output. By default, they are written as text.
+        PreserveText bool     // If true, the output is the text of the zone file (with comments and directives) and its SOA serial updated, followed by the DNSSEC records in a marked block.
+        Metrics     Metrics   // If not nil, it receives the duration of each signing stage and the number of PKCS#11 calls.
+        MetadataOutput io.Writer // If not nil, the DNSSEC metadata of the signed zone (see SignedZoneMetadata) is written into it as JSON.
+        DSOutput    io.Writer // If not nil, the DS records of the KSKs of the signed zone (see KSKDSRecords) are written into it in zone file format, to add them to the parent zone.
+        Stream      bool      // If true, the zone file is read, signed and written name by name, so very large zones do not fill the memory. It must be sorted in canonical order and signed with NSEC, validation must be skipped, and options needing the whole zone (as MetadataOutput or RefreshWindow) cannot be used. args.RRs is left empty, and if signing fails, the output has the names signed so far.
+        Concurrency int       // Number of RRsets signed at the same time. With a Session, it opens Concurrency-1 more PKCS#11 sessions with the same keys while signing. If it is zero or one, the RRsets are signed one by one. The signed zone does not depend on it, and it is not used with Stream.
+        RecordFilter func(dns.RR) bool // If not nil, only the RRs of the zone for which it returns true are signed (as the records of a view). It cannot remove the SOA, nor the NS and DNSKEY records of the apex.
+        DefaultTTL  uint32    // If not zero, the TTL of the records before the first one with a TTL in a zone without $TTL. Otherwise, they are a parser error.
+        preservedKeys RRArray // DNSKEYs of the zone kept by DNSKEYPreserve, added to the signed DNSKEY RRset
+        workers     []*Session // Sessions opened by Session.Sign to sign the RRsets concurrently (see Concurrency)
+        rolloverZSKs []*KeyPair // ZSKs signing every RRset besides the ones of each algorithm, as the new ZSK of a double-signature rollover
+        refreshSigs map[string][]*dns.RRSIG // RRSIGs of the zone by RRset (see rrSetKey), kept by RefreshWindow and DNSKEYReuseWindow to reuse the ones that do not expire soon
+        refreshParam *dns.NSEC3PARAM // NSEC3PARAM of the zone kept by RefreshWindow, so the NSEC3 chain is built again with its salt and iterations
+        foreignSigs RRArray   // RRSIGs of the zone kept by MultiSigner, added to the signed zone if they are made by other signers
+        start       time.Time // Time at which the signature started (see startTime)
+        duplicates  int       // Number of duplicate RRs removed from the zone when it was parsed
+        zoneText    []byte    // Text of the zone file, without generated DNSSEC records, kept when PreserveText is true
+}
+
+// DNSKEYPolicy defines what the signer does when the zone to sign already contains DNSKEY records at its apex.
+type DNSKEYPolicy int
+
+const (
+	DNSKEYError    DNSKEYPolicy = iota // The signature fails
+	DNSKEYReplace                      // The DNSKEYs are removed and replaced by the keys of the session
+	DNSKEYPreserve                     // The DNSKEYs are kept with the keys of the session, and signed with them
+)
+
+// dnskeyPolicies maps the names of the DNSKEY policies to their values.
+var dnskeyPolicies = map[string]DNSKEYPolicy{
+	"error":    DNSKEYError,
+	"replace":  DNSKEYReplace,
+	"preserve": DNSKEYPreserve,
+}
+
+// ParseDNSKEYPolicy returns the DNSKEY policy with the name provided (error, replace or preserve).
+func ParseDNSKEYPolicy(name string) (DNSKEYPolicy, error) {
+	policy, ok := dnskeyPolicies[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown DNSKEY policy %s (it should be error, replace or preserve)", name)
+	}
+	return policy, nil
 }
 
 
 // ReadAndParseZone parses a DNS zone file and returns an array of RRs and the zone minTTL.
-// It also updates the serial in the SOA record if updateSerial is true.
+// It also updates the serial in the SOA record if updateSerial is true, following args.Serial.
+// If the zone cannot be parsed, the error has the number and the content of the line where the parser failed.
+// It returns an error if the file has a syntax error or has no records (as a file with only comments).
+// Duplicate records are removed (see RRArray.Dedup).
 func ReadAndParseZone(args *SignArgs, updateSerial bool) (RRArray, error) {
 
 	rrs := make(RRArray, 0)
 
-        if args.Zone[len(args.Zone)-1] != '.' {
-                args.Zone = args.Zone + "."
-        }
-
-	zone := dns.NewZoneParser(args.File, "", "")
+	// Relative names are expanded against the zone apex, as the origin of a zone file loaded by BIND.
+	origin := ""
+	if len(args.Zone) > 0 {
+		origin = dns.Fqdn(args.Zone)
+	}
+	// The text read is kept to show the line where the parser fails.
+	var text bytes.Buffer
+	zone := dns.NewZoneParser(io.TeeReader(args.File, &text), origin, "")
+	if args.DefaultTTL > 0 {
+		zone.SetDefaultTTL(args.DefaultTTL)
+	}
 	if err := zone.Err(); err != nil {
-		return nil, err
+		return nil, zoneParseError(args.Zone, err, text.Bytes())
 	}
 	for rr, ok := zone.Next(); ok; rr, ok = zone.Next() {
 		rrs = append(rrs, rr)
+	}
+	// The parser stops on the first error, which is only available after the last record.
+	if err := zone.Err(); err != nil {
+		return nil, zoneParseError(args.Zone, err, text.Bytes())
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("no records parsed from input for zone %s", args.Zone)
+	}
+	return parseRRs(args, rrs, updateSerial)
+}
+
+// parseErrorLine matches the position at the end of the errors of the zone parser, whose fields are not exported.
+var parseErrorLine = regexp.MustCompile(`at line: (\d+):\d+$`)
+
+// zoneParseError returns the error of the parser of zone with the number and the content of the line where it failed,
+// taken from the text read by the parser, so the records that miekg/dns rejects can be found and fixed.
+func zoneParseError(zone string, err error, text []byte) error {
+	if match := parseErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		lines := bytes.Split(text, []byte("\n"))
+		if line >= 1 && line <= len(lines) {
+			return fmt.Errorf("cannot parse zone %s at line %d (%s): %s", zone, line, strings.TrimSpace(string(lines[line-1])), err)
+		}
+	}
+	return fmt.Errorf("cannot parse zone %s: %s", zone, err)
+}
+
+// parseRRs sets the zone minTTL in args from the SOA of the RRs, updating its serial following args.Serial
+// if updateSerial is true, and returns the RRs sorted, without duplicates (see RRArray.Dedup). The number of
+// duplicates removed is kept in args.duplicates.
+func parseRRs(args *SignArgs, rrs RRArray, updateSerial bool) (RRArray, error) {
+	args.Zone = dns.Fqdn(args.Zone)
+	unique := rrs.Dedup()
+	args.duplicates = len(rrs) - len(unique)
+	rrs = unique
+	for _, rr := range rrs {
 		if rr.Header().Rrtype == dns.TypeSOA {
 			var soa *dns.SOA
 			soa = rr.(*dns.SOA)
 			args.MinTTL = soa.Minttl
 			// UPDATING THE SERIAL
 			if updateSerial {
-				rr.(*dns.SOA).Serial += 2
+				serial, err := args.newSerial(soa.Serial)
+				if err != nil {
+					return nil, err
+				}
+				soa.Serial = serial
 			}
 		}
 	}
@@ -56,16 +189,352 @@ func ReadAndParseZone(args *SignArgs, updateSerial bool) (RRArray, error) {
 	return rrs, nil
 }
 
-func AddNSEC13(args *SignArgs)  {
-	if args.NSEC3 {
-                for {
-                        if err := args.RRs.AddNSEC3Records(args.Zone, args.OptOut); err == nil {
-                                break
-                        }
-                }
-        } else {
-                args.RRs.AddNSECRecords(args.Zone)
-        }
+// maxNSEC3Attempts is the number of salts tried before giving up on NSEC3 hash collisions.
+const maxNSEC3Attempts = 10
+
+// DefaultNSEC3Iterations is the number of additional iterations of the NSEC3 hash when SignArgs does not set them.
+const DefaultNSEC3Iterations = 100
+
+// DefaultNSEC3SaltLength is the length in octets of the random NSEC3 salts when SignArgs does not set it.
+const DefaultNSEC3SaltLength = 4
+
+// AddNSEC13 adds the NSEC or NSEC3 records to args.RRs. For NSEC3, a new salt is generated on each
+// hash collision, and an error is returned if no salt without collisions is found after maxNSEC3Attempts.
+// If args.NSEC3Salt is set or the salt is empty (see NSEC3SaltLength), a collision is an error.
+func AddNSEC13(args *SignArgs) error {
+	return addDenialRecords(args, nopLogger{})
+}
+
+// addDenialRecords adds the NSEC or NSEC3 records to args.RRs as AddNSEC13 does, logging the salt rotations.
+func addDenialRecords(args *SignArgs, log Logger) error {
+	if !args.NSEC3 {
+		args.RRs.AddNSECRecords(args.Zone)
+		return nil
+	}
+	iterations, err := args.nsec3Iterations()
+	if err != nil {
+		return err
+	}
+	length, err := args.nsec3SaltLength()
+	if err != nil {
+		return err
+	}
+	if len(args.NSEC3Salt) > 0 {
+		if args.NSEC3SaltLength != 0 {
+			return fmt.Errorf("NSEC3 salt %s and salt length %d cannot be set at the same time", args.NSEC3Salt, args.NSEC3SaltLength)
+		}
+		salt, err := parseNSEC3Salt(args.NSEC3Salt)
+		if err != nil {
+			return err
+		}
+		// A fixed salt is never rotated, so the chain is the same on each signature.
+		if err := args.RRs.addNSEC3Records(args.Zone, args.OptOut, salt, iterations); err != nil {
+			return fmt.Errorf("cannot use NSEC3 salt %s: %s", args.NSEC3Salt, err)
+		}
+		return nil
+	}
+	if length == 0 {
+		// There is no other empty salt to rotate to.
+		if err := args.RRs.addNSEC3Records(args.Zone, args.OptOut, "", iterations); err != nil {
+			return fmt.Errorf("cannot use an empty NSEC3 salt: %s", err)
+		}
+		return nil
+	}
+	for attempt := 1; attempt <= maxNSEC3Attempts; attempt++ {
+		if attempt == 1 && args.refreshParam != nil {
+			// The chain of a refreshed zone keeps its salt and iterations, so the RRSIGs of its NSEC3 records can be reused.
+			err = args.RRs.addNSEC3Records(args.Zone, args.OptOut, args.refreshParam.Salt, args.refreshParam.Iterations)
+		} else {
+			err = args.RRs.addNSEC3Records(args.Zone, args.OptOut, args.randomSalt(length), iterations)
+		}
+		if _, collision := err.(*NSEC3CollisionError); !collision {
+			if err == nil && attempt > 1 {
+				log.Info("NSEC3 salt rotated after hash collisions", "zone", args.Zone, "attempts", attempt)
+			}
+			return err
+		}
+		log.Warn("NSEC3 hash collision, rotating salt", "zone", args.Zone, "attempt", attempt, "error", err)
+	}
+	return fmt.Errorf("no NSEC3 salt without hash collisions found after %d attempts, last collision: %s", maxNSEC3Attempts, err)
+}
+
+// prepareZone reads and parses the zone in args.File, storing its RRs in args.RRs,
+// validates them (unless SkipValidation is true) and then adds the NSEC or NSEC3 records to them,
+// logging into log. If args.File is nil, the zone RRs are taken from args.RRs instead. They are copied, so the RRs provided
+// are not modified. Exactly one of args.File and args.RRs must be set.
+func prepareZone(args *SignArgs, log Logger) (err error) {
+	args.start = timeNow()
+	if err := args.checkExpirations(); err != nil {
+		return err
+	}
+	if err := args.checkValidity(log); err != nil {
+		return err
+	}
+	if args.PreserveText && args.Format == FormatWire {
+		return fmt.Errorf("the text of zone %s cannot be preserved in wire format", args.Zone)
+	}
+	if args.PreserveText && args.RefreshWindow > 0 {
+		return fmt.Errorf("the text of zone %s cannot be preserved when its signatures are refreshed", args.Zone)
+	}
+	if args.PreserveText && args.CDS != CDSNone {
+		return fmt.Errorf("the text of zone %s cannot be preserved when its CDS records are replaced", args.Zone)
+	}
+	if args.PreserveText && args.ZONEMD {
+		return fmt.Errorf("the text of zone %s cannot be preserved with a ZONEMD record", args.Zone)
+	}
+	if args.MultiSigner && args.ZONEMD {
+		return fmt.Errorf("zone %s cannot have a ZONEMD record with many signers, because each one signs a different zone", args.Zone)
+	}
+	if len(args.OfflineKSK) > 0 {
+		switch {
+		case args.createKeys(true):
+			return fmt.Errorf("the KSKs of zone %s are offline, so they cannot be created by the signer", args.Zone)
+		case args.MultiSigner:
+			return fmt.Errorf("the DNSKEY RRset of zone %s cannot be signed offline with many signers, because each one adds its DNSKEYs", args.Zone)
+		case args.CDS != CDSNone:
+			return fmt.Errorf("the CDS records of zone %s cannot be replaced with offline KSKs, because they must be signed by a KSK", args.Zone)
+		}
+	}
+	// When the signatures are refreshed, the serial is only updated if one of them changes (see signRRs).
+	updateSerial := args.RefreshWindow <= 0
+	start := time.Now()
+	switch {
+	case args.File != nil && len(args.RRs) > 0:
+		return fmt.Errorf("both a zone file and zone RRs were provided, only one of them should be set")
+	case args.File != nil:
+		if args.PreserveText {
+			if err = args.readZoneText(); err != nil {
+				return err
+			}
+		}
+		args.RRs, err = ReadAndParseZone(args, updateSerial)
+		if err != nil {
+			return err
+		}
+		if args.PreserveText {
+			if err = args.checkZoneText(); err != nil {
+				return err
+			}
+		}
+	case args.PreserveText:
+		return fmt.Errorf("the text of zone %s can only be preserved if it is provided as a zone file", args.Zone)
+	case len(args.RRs) > 0:
+		rrs := make(RRArray, len(args.RRs))
+		for i, rr := range args.RRs {
+			rrs[i] = dns.Copy(rr)
+		}
+		if args.RRs, err = parseRRs(args, rrs, updateSerial); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("neither a zone file nor zone RRs were provided")
+	}
+	if args.duplicates > 0 {
+		log.Warn("removed duplicate records from the zone", "zone", args.Zone, "records", args.duplicates)
+	}
+	if err := args.filterRecords(log); err != nil {
+		return err
+	}
+	if err := args.removeOutOfZone(log); err != nil {
+		return err
+	}
+	args.keepForeignSignatures()
+	args.keepRefreshSignatures()
+	args.removeDNSSECRecords(log)
+	args.rolloverZSKs = nil
+	if err := args.removeDNSKEYs(); err != nil {
+		return err
+	}
+	args.removeCDS()
+	if err := args.addZONEMD(); err != nil {
+		return err
+	}
+	if !args.SkipValidation {
+		if err := args.RRs.Validate(args.Zone); err != nil {
+			return err
+		}
+	}
+	args.observe(StageParse, start)
+	defer args.observe(StageBuildDenial, time.Now())
+	return addDenialRecords(args, log)
+}
+
+// filterRecords removes from args.RRs the RRs rejected by args.RecordFilter, if it is set, so the chain and the
+// signatures are made over the remaining RRs. It returns an error if the filter rejects the SOA or an NS or DNSKEY
+// record at the apex, because the zone would be broken, or if the text of the zone is preserved, because the
+// rejected RRs would still be in the output.
+func (args *SignArgs) filterRecords(log Logger) error {
+	if args.RecordFilter == nil {
+		return nil
+	}
+	if args.PreserveText {
+		return fmt.Errorf("the text of zone %s cannot be preserved if its records are filtered", args.Zone)
+	}
+	rrs := make(RRArray, 0, len(args.RRs))
+	for _, rr := range args.RRs {
+		if args.RecordFilter(rr) {
+			rrs = append(rrs, rr)
+			continue
+		}
+		h := rr.Header()
+		apex := strings.EqualFold(dns.Fqdn(h.Name), args.Zone)
+		if h.Rrtype == dns.TypeSOA || apex && (h.Rrtype == dns.TypeNS || h.Rrtype == dns.TypeDNSKEY) {
+			return fmt.Errorf("the record filter cannot remove the %s records of the apex of zone %s", dns.Type(h.Rrtype), args.Zone)
+		}
+	}
+	if removed := len(args.RRs) - len(rrs); removed > 0 {
+		log.Info("removed the records rejected by the record filter", "zone", args.Zone, "records", removed)
+	}
+	args.RRs = rrs
+	return nil
+}
+
+// signatureTypes are the types of the records created by the signer, other than the DNSKEYs.
+var signatureTypes = map[uint16]bool{
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeNSEC3PARAM: true,
+}
+
+// removeDNSSECRecords removes the RRSIG, NSEC, NSEC3 and NSEC3PARAM records of a previously signed zone from args.RRs,
+// so the zone is signed again with a new chain. This allows to move a signed zone from NSEC to NSEC3, or back,
+// in a single signing run.
+func (args *SignArgs) removeDNSSECRecords(log Logger) {
+	rrs := args.RRs.withoutTypes(signatureTypes)
+	if removed := len(args.RRs) - len(rrs); removed > 0 {
+		log.Info("removed the signatures and denial of existence records of the zone", "zone", args.Zone, "records", removed)
+	}
+	args.RRs = rrs
+}
+
+// Unsign reads a signed zone from in and writes it into out without its DNSSEC records (see RRArray.StripDNSSEC).
+func Unsign(in io.Reader, out io.Writer, zone string) error {
+	rrs, err := ReadAndParseZone(&SignArgs{Zone: zone, File: in}, false)
+	if err != nil {
+		return err
+	}
+	return rrs.StripDNSSEC().WriteZone(out)
+}
+
+// removeDNSKEYs removes the DNSKEY records at the zone apex from args.RRs, applying the ExistingDNSKEYs policy:
+// it returns an error if the policy is DNSKEYError, and it keeps the removed keys if the policy is DNSKEYPreserve,
+// so they are signed later in the same RRset as the keys of the session. If args.MultiSigner is true, they are always kept,
+// and if args.RefreshWindow or args.DNSKEYReuseWindow is positive, the DNSKEYError policy replaces them.
+func (args *SignArgs) removeDNSKEYs() error {
+	args.preservedKeys = nil
+	rrs := make(RRArray, 0, len(args.RRs))
+	keys := make(RRArray, 0)
+	for _, rr := range args.RRs {
+		if rr.Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(dns.Fqdn(rr.Header().Name), args.Zone) {
+			keys = append(keys, rr)
+		} else {
+			rrs = append(rrs, rr)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	policy := args.ExistingDNSKEYs
+	if args.MultiSigner {
+		policy = DNSKEYPreserve
+	} else if len(args.OfflineKSK) > 0 {
+		// The DNSKEY RRset signed offline replaces the one of the zone.
+		policy = DNSKEYReplace
+	} else if (args.RefreshWindow > 0 || args.DNSKEYReuseWindow > 0) && policy == DNSKEYError {
+		// A zone whose signatures are refreshed or reused is already signed, so it has the DNSKEYs of the signer.
+		policy = DNSKEYReplace
+	}
+	switch policy {
+	case DNSKEYReplace:
+	case DNSKEYPreserve:
+		args.preservedKeys = keys
+	default:
+		return fmt.Errorf("zone %s already contains %d DNSKEY records (use a replace or preserve DNSKEY policy to sign it)", args.Zone, len(keys))
+	}
+	args.RRs = rrs
+	return nil
+}
+
+// dnskeyRRSet returns the DNSKEY RRset of the signed zone: the keys of the signer (ZSKs and KSKs) and the preserved
+// DNSKEYs of the zone that are not copies of them. The preserved DNSKEYs take the TTL of the keys of the signer,
+// because all the RRs of a RRset must have the same TTL (RFC2181 5.2).
+func (args *SignArgs) dnskeyRRSet(keys []*dns.DNSKEY) RRArray {
+	rrSet := make(RRArray, 0, len(keys)+len(args.preservedKeys))
+	for _, key := range keys {
+		rrSet = append(rrSet, key)
+	}
+	for _, rr := range args.preservedKeys {
+		key := dns.Copy(rr).(*dns.DNSKEY)
+		key.Hdr.Name = keys[0].Hdr.Name
+		key.Hdr.Ttl = keys[0].Hdr.Ttl
+		duplicate := false
+		for _, other := range keys {
+			duplicate = duplicate || dns.IsDuplicate(key, other)
+		}
+		if !duplicate {
+			rrSet = append(rrSet, key)
+		}
+	}
+	return rrSet
+}
+
+// signingAlgorithms returns the algorithms of the keys signing the zone: the ones in args.Algorithms or,
+// if it is empty, args.Algorithm. It returns an error if an algorithm is not supported or is repeated.
+func (args *SignArgs) signingAlgorithms() ([]*Algorithm, error) {
+	numbers := args.Algorithms
+	if len(numbers) == 0 {
+		numbers = []uint8{args.Algorithm}
+	}
+	algs := make([]*Algorithm, 0, len(numbers))
+	seen := make(map[uint8]bool)
+	for _, number := range numbers {
+		alg, err := GetAlgorithm(number)
+		if err != nil {
+			return nil, err
+		}
+		if seen[alg.Number] {
+			return nil, fmt.Errorf("algorithm %s is repeated", alg)
+		}
+		seen[alg.Number] = true
+		algs = append(algs, alg)
+	}
+	return algs, nil
+}
+
+// dnskeyTTL returns the TTL of the DNSKEY RRset of the signed zone: args.DNSKEYTTL, or the minimum TTL of the SOA if it is zero.
+func (args *SignArgs) dnskeyTTL() uint32 {
+	if args.DNSKEYTTL > 0 {
+		return args.DNSKEYTTL
+	}
+	return args.MinTTL
+}
+
+// createKeys returns true if new keys of the role (KSK if ksk is true, ZSK otherwise) must be created.
+func (args *SignArgs) createKeys(ksk bool) bool {
+	if ksk {
+		return args.CreateKeys || args.CreateKSK
+	}
+	return args.CreateKeys || args.CreateZSK
+}
+
+// keyBits returns the size in bits of the keys of the role created for the algorithm: args.KSKBits or args.ZSKBits,
+// or the size of the algorithm if it is zero. It returns an error if the size cannot be used with the algorithm,
+// because RSA keys must have between 1024 and 4096 bits (RFC8624 3.1) and curves have a fixed size.
+func (args *SignArgs) keyBits(alg *Algorithm, ksk bool) (int, error) {
+	bits, defaultBits, role := args.ZSKBits, alg.ZSKBits, "ZSK"
+	if ksk {
+		bits, defaultBits, role = args.KSKBits, alg.KSKBits, "KSK"
+	}
+	switch {
+	case bits == 0:
+		return defaultBits, nil
+	case len(alg.ECParams) > 0 && bits != defaultBits:
+		return 0, fmt.Errorf("%s size %d cannot be used with algorithm %s, whose keys have %d bits", role, bits, alg, defaultBits)
+	case len(alg.ECParams) == 0 && (bits < 1024 || bits > 4096):
+		return 0, fmt.Errorf("%s size %d is invalid: %s keys must have between 1024 and 4096 bits", role, bits, alg)
+	}
+	return bits, nil
 }
 
 // CreateNewDNSKEY creates a new DNSKEY RR, using the parameters provided.
@@ -84,7 +553,23 @@ func CreateNewDNSKEY(zone string, flags uint16, algorithm uint8, ttl uint32, pub
 	}
 }
 
+// KeyTag returns the key tag of a DNSKEY (RFC4034 Appendix B). It does not need an HSM session.
+func KeyTag(key *dns.DNSKEY) uint16 {
+	return key.KeyTag()
+}
+
+// DSFromDNSKEY returns the DS record of a DNSKEY of the zone, using the digest type provided
+// (as dns.SHA1 or dns.SHA256). It returns nil if the digest type is not supported.
+// It does not need an HSM session, so it can check offline that a DS in the parent zone matches a DNSKEY.
+func DSFromDNSKEY(zone string, key *dns.DNSKEY, digest uint8) *dns.DS {
+	key = dns.Copy(key).(*dns.DNSKEY)
+	key.Hdr.Name = dns.Fqdn(zone)
+	return key.ToDS(digest)
+}
+
 // CreateNewRRSIG creates a new RRSIG RR, using the parameters provided.
+// Its owner name, type covered and labels are set when it signs a RRset. For wildcard owners, as *.example.com.,
+// the labels field does not count the asterisk (RFC4034 3.1.3), so resolvers can validate synthesized answers.
 func CreateNewRRSIG(zone string, dnsKeyRR *dns.DNSKEY, expDate time.Time, rrSetTTL uint32) *dns.RRSIG {
 	if expDate.IsZero() {
 		expDate = time.Now().AddDate(1, 0, 0)
@@ -96,6 +581,8 @@ func CreateNewRRSIG(zone string, dnsKeyRR *dns.DNSKEY, expDate time.Time, rrSetT
 			Ttl: rrSetTTL,
 		},
 		Algorithm:  dnsKeyRR.Algorithm,
+		// (RFC4034, 3.1.4: The Original TTL field specifies the TTL of the covered RRset as it appears in the authoritative zone)
+		OrigTtl:    rrSetTTL,
 		SignerName: strings.ToLower(zone),
 		KeyTag:     dnsKeyRR.KeyTag(),
 		Inception:  uint32(time.Now().Unix()),
@@ -103,11 +590,157 @@ func CreateNewRRSIG(zone string, dnsKeyRR *dns.DNSKEY, expDate time.Time, rrSetT
 	}
 }
 
+// random returns the randomness source of the args, creating a new one seeded on current time if it is not set.
+func (args *SignArgs) random() *rand.Rand {
+	if args.Rand == nil {
+		args.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return args.Rand
+}
+
+// timeNow returns the current time. The tests replace it to sign at a fixed time.
+var timeNow = time.Now
+
+// startTime returns the time at which the signature started, set when the zone is prepared, or now if it is not set yet.
+// It is the inception of every RRSIG and the base of their expirations, so the RRSIGs of a zone do not depend on
+// how long it takes to sign it.
+func (args *SignArgs) startTime() time.Time {
+	if args.start.IsZero() {
+		args.start = timeNow()
+	}
+	return args.start
+}
+
+// signatureExpDate returns the expiration date for the RRSIG covering an RRset of type rrType (see baseExpDate).
+// If ExpirationJitter is set, the expiration is moved back a random amount of time inside that window,
+// so the signatures of the zone don't expire at the same instant. The jitter never moves the
+// expiration before the current time, and it is never applied to SOA and DNSKEY RRsets:
+// their signatures always use the latest expiration, so they never expire before the data.
+func (args *SignArgs) signatureExpDate(rrType uint16) time.Time {
+	now := args.startTime()
+	expDate := args.baseExpDate(rrType == dns.TypeDNSKEY, now)
+	if args.ExpirationJitter <= 0 || rrType == dns.TypeSOA || rrType == dns.TypeDNSKEY {
+		return expDate
+	}
+	jitter := args.ExpirationJitter
+	if validity := expDate.Sub(now); validity < jitter {
+		jitter = validity
+	}
+	if jitter <= 0 {
+		return expDate
+	}
+	return expDate.Add(-time.Duration(args.random().Int63n(int64(jitter))))
+}
+
+// baseExpDate returns the expiration date of the RRSIGs made with the KSKs (covering the DNSKEY RRset) if ksk is true,
+// or with the ZSKs otherwise: args.KSKSignExpDuration or args.ZSKSignExpDuration after now if they are positive, or
+// args.SignExpDate. If SignExpDate is not set either, the RRSIGs expire a year after now.
+func (args *SignArgs) baseExpDate(ksk bool, now time.Time) time.Time {
+	duration := args.ZSKSignExpDuration
+	if ksk {
+		duration = args.KSKSignExpDuration
+	}
+	if duration > 0 {
+		return now.Add(duration)
+	}
+	if args.SignExpDate.IsZero() {
+		return now.AddDate(1, 0, 0)
+	}
+	return args.SignExpDate
+}
+
+// checkExpirations returns an error if the RRSIGs of the DNSKEY RRset would expire before the ones of the other
+// RRsets, because the DNSKEYs authorize the signatures of the data, and validators could not check them.
+func (args *SignArgs) checkExpirations() error {
+	now := args.startTime()
+	ksk, zsk := args.baseExpDate(true, now), args.baseExpDate(false, now)
+	if ksk.Before(zsk) {
+		return fmt.Errorf("the DNSKEY RRSIGs of zone %s would expire on %s, before the other RRSIGs (on %s)", args.Zone, ksk.Format(time.RFC3339), zsk.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkValidity returns an error if the earliest RRSIG expiration (the expiration date moved back by the whole
+// ExpirationJitter) is less than args.MinValidity after the inception (now), or only logs a warning if
+// args.StrictValidity is false. Such signatures can expire before the zone is signed again, or be rejected
+// by resolvers whose clocks are ahead of the signer's. It does nothing if MinValidity is not positive.
+func (args *SignArgs) checkValidity(log Logger) error {
+	if args.MinValidity <= 0 {
+		return nil
+	}
+	now := args.startTime()
+	validity := args.baseExpDate(false, now).Sub(now)
+	if args.ExpirationJitter > 0 {
+		validity -= args.ExpirationJitter
+	}
+	if validity >= args.MinValidity {
+		return nil
+	}
+	if validity < 0 {
+		validity = 0
+	}
+	validity = validity.Round(time.Second)
+	if !args.StrictValidity {
+		log.Warn(fmt.Sprintf("signatures can expire %s after their inception, less than the minimum validity of %s", validity, args.MinValidity), "zone", args.Zone)
+		return nil
+	}
+	return fmt.Errorf("signatures of zone %s can expire %s after their inception, less than the minimum validity of %s", args.Zone, validity, args.MinValidity)
+}
+
+// parseNSEC3Salt returns the salt provided as a hex string, or an empty salt if it is "-" (as in the text of
+// a NSEC3PARAM record). It returns an error if the salt is not hex or is longer than 255 octets (RFC5155 3.2).
+func parseNSEC3Salt(salt string) (string, error) {
+	if salt == "-" {
+		return "", nil
+	}
+	decoded, err := hex.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("NSEC3 salt %s is not a hex string", salt)
+	}
+	if len(decoded) > 255 {
+		return "", fmt.Errorf("NSEC3 salt %s is longer than 255 octets", salt)
+	}
+	return salt, nil
+}
+
+// nsec3Iterations returns the additional iterations of the NSEC3 hash (see SignArgs.NSEC3Iterations).
+func (args *SignArgs) nsec3Iterations() (uint16, error) {
+	switch {
+	case args.NSEC3Iterations == 0:
+		return DefaultNSEC3Iterations, nil
+	case args.NSEC3Iterations < 0:
+		return 0, nil
+	case args.NSEC3Iterations > math.MaxUint16:
+		return 0, fmt.Errorf("NSEC3 iterations %d are more than %d", args.NSEC3Iterations, math.MaxUint16)
+	}
+	return uint16(args.NSEC3Iterations), nil
+}
+
+// nsec3SaltLength returns the length in octets of the random NSEC3 salts (see SignArgs.NSEC3SaltLength).
+func (args *SignArgs) nsec3SaltLength() (int, error) {
+	switch {
+	case args.NSEC3SaltLength == 0:
+		return DefaultNSEC3SaltLength, nil
+	case args.NSEC3SaltLength < 0:
+		return 0, nil
+	case args.NSEC3SaltLength > 255:
+		return 0, fmt.Errorf("NSEC3 salt length %d is longer than 255 octets", args.NSEC3SaltLength)
+	}
+	return args.NSEC3SaltLength, nil
+}
+
+// randomSalt returns a random NSEC3 salt of length octets, as a hex string, taken from args.Rand.
+func (args *SignArgs) randomSalt(length int) string {
+	salt := make([]byte, length)
+	args.random().Read(salt)
+	return hex.EncodeToString(salt)
+}
+
 // generateSalt returns a salt based on a random string seeded on current time.
 func generateSalt() string {
 	rand.Seed(time.Now().UnixNano())
 	r := rand.Int31()
-	s := fmt.Sprintf("%x", r)
+	s := fmt.Sprintf("%08x", r) // zero padded, so it is always a valid hex string
 	return s
 }
 
@@ -0,0 +1,91 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// dnssecTypes are the types that can coexist with a CNAME record at the same name (RFC4035 2.5).
+var dnssecTypes = map[uint16]bool{
+	dns.TypeRRSIG: true,
+	dns.TypeNSEC:  true,
+	dns.TypeNSEC3: true,
+}
+
+// Validate checks that the zone does not contain configurations which would produce a broken signed zone:
+// CNAME records coexisting with other data at the same name (including a CNAME at the apex), more than one
+// CNAME or DNAME at the same name, a DNAME coexisting with a CNAME, names below a DNAME and in-zone NS targets
+// without glue records. It returns an error describing all the problems found.
+// DNAME records at the apex are allowed, as specified in RFC6672 2.3.
+func (rrArray RRArray) Validate(zone string) error {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	types := make(map[string]map[uint16]int)
+	for _, rr := range rrArray {
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		if types[name] == nil {
+			types[name] = make(map[uint16]int)
+		}
+		types[name][rr.Header().Rrtype]++
+	}
+
+	problems := make([]string, 0)
+	dnames := make([]string, 0)
+	for _, rr := range rrArray {
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		nameTypes := types[name]
+		switch rr.Header().Rrtype {
+		case dns.TypeCNAME:
+			if nameTypes[dns.TypeCNAME] > 1 {
+				problems = append(problems, fmt.Sprintf("%s has more than one CNAME record", name))
+			} else if name == zone {
+				problems = append(problems, fmt.Sprintf("%s has a CNAME record at the zone apex", name))
+			} else {
+				for t := range nameTypes {
+					if t != dns.TypeCNAME && !dnssecTypes[t] {
+						problems = append(problems, fmt.Sprintf("%s has a CNAME record and other data (%s)", name, dns.Type(t)))
+						break
+					}
+				}
+			}
+		case dns.TypeDNAME:
+			dnames = append(dnames, name)
+			if nameTypes[dns.TypeDNAME] > 1 {
+				problems = append(problems, fmt.Sprintf("%s has more than one DNAME record", name))
+			}
+			if nameTypes[dns.TypeCNAME] > 0 {
+				problems = append(problems, fmt.Sprintf("%s has a DNAME and a CNAME record", name))
+			}
+		case dns.TypeNS:
+			target := strings.ToLower(dns.Fqdn(rr.(*dns.NS).Ns))
+			if dns.IsSubDomain(zone, target) && types[target][dns.TypeA] == 0 && types[target][dns.TypeAAAA] == 0 {
+				problems = append(problems, fmt.Sprintf("%s has an NS record pointing to %s, which is in the zone but has no A or AAAA glue record", name, target))
+			}
+		}
+	}
+	for _, rr := range rrArray {
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		for _, dname := range dnames {
+			if name != dname && dns.IsSubDomain(dname, name) {
+				problems = append(problems, fmt.Sprintf("%s is below the DNAME record at %s", name, dname))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid zone %s: %s", zone, strings.Join(uniqueStrings(problems), "; "))
+	}
+	return nil
+}
+
+// uniqueStrings returns the strings of the array without duplicates, preserving their order.
+func uniqueStrings(strs []string) []string {
+	encountered := make(map[string]bool)
+	result := make([]string, 0)
+	for _, s := range strs {
+		if !encountered[s] {
+			encountered[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,266 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RRsetStatus is the result of the verification of the RRSIGs of an RRset.
+type RRsetStatus int
+
+const (
+	RRsetValid    RRsetStatus = iota // The RRset has a valid RRSIG with each algorithm (or by the expected key)
+	RRsetExpired                     // The RRset has no valid RRSIG, and the ones that failed had expired
+	RRsetInvalid                     // The RRset has RRSIGs, but they do not verify or do not meet the conditions of the verification
+	RRsetUnsigned                    // The RRset has no RRSIGs
+)
+
+// rrsetStatusNames are the names of the RRset statuses.
+var rrsetStatusNames = map[RRsetStatus]string{
+	RRsetValid:    "valid",
+	RRsetExpired:  "expired",
+	RRsetInvalid:  "invalid",
+	RRsetUnsigned: "unsigned",
+}
+
+// String returns the name of the status.
+func (status RRsetStatus) String() string {
+	if name, ok := rrsetStatusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("RRsetStatus(%d)", int(status))
+}
+
+// RRsetResult is the result of the verification of an RRset of the zone.
+type RRsetResult struct {
+	Name       string      // Owner name of the RRset
+	Type       uint16      // Type of the RRset
+	Status     RRsetStatus // Result of the verification of its RRSIGs
+	Expiration time.Time   // If the RRset is valid, when it stops being valid, as the first algorithm whose valid RRSIGs expire
+	Err        error       // If the RRset is not valid, why
+}
+
+// VerificationResult is the result of the verification of a signed zone by VerifyZone, with the problems found by
+// kind, so a monitoring system can tell an expired signature from a broken chain or a signature expiring soon.
+type VerificationResult struct {
+	Zone         string        // Zone verified
+	RRsets       []RRsetResult // Results of the signed RRsets of the zone, in canonical order of their names and by type
+	Expiring     []RRsetResult // Valid RRsets whose RRSIGs expire within VerifyArgs.ExpirationWarning
+	MissingLinks []string      // Problems of the NSEC or NSEC3 chain, as "name: problem", sorted
+	Orphans      []string      // RRSIGs without an RRset, as "name type covered", sorted
+	ZONEMD       error         // If not nil, why the ZONEMD records of the zone do not verify
+}
+
+// Valid returns true if the zone has no problems. RRsets expiring soon are still valid.
+func (result *VerificationResult) Valid() bool {
+	return result.Err() == nil
+}
+
+// Err returns the first problem of the zone as an error, or nil if it is valid: the first RRset that is not valid,
+// the orphan RRSIGs, the problems of the NSEC or NSEC3 chain and the ZONEMD error, in this order.
+func (result *VerificationResult) Err() error {
+	for _, rrset := range result.RRsets {
+		if rrset.Err != nil {
+			return rrset.Err
+		}
+	}
+	if len(result.Orphans) > 0 {
+		return fmt.Errorf("zone %s has RRSIGs without RRsets: %s", result.Zone, strings.Join(result.Orphans, ", "))
+	}
+	if len(result.MissingLinks) > 0 {
+		return fmt.Errorf("the denial of existence chain of zone %s is broken: %s", result.Zone, strings.Join(result.MissingLinks, "; "))
+	}
+	return result.ZONEMD
+}
+
+// Count returns the number of RRsets of the zone with the status provided.
+func (result *VerificationResult) Count(status RRsetStatus) int {
+	n := 0
+	for _, rrset := range result.RRsets {
+		if rrset.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// sort sorts the RRsets and the problems of the result, so it does not depend on the order they were verified, and
+// sets the RRsets expiring before the time provided. If it is zero, no RRset is expiring.
+func (result *VerificationResult) sort(warning time.Time) {
+	sort.Slice(result.RRsets, func(i, j int) bool {
+		if cmp := CompareNames(result.RRsets[i].Name, result.RRsets[j].Name); cmp != 0 {
+			return cmp < 0
+		}
+		return result.RRsets[i].Type < result.RRsets[j].Type
+	})
+	result.Expiring = make([]RRsetResult, 0)
+	for _, rrset := range result.RRsets {
+		if rrset.Status == RRsetValid && rrset.Expiration.Before(warning) {
+			result.Expiring = append(result.Expiring, rrset)
+		}
+	}
+	sort.Strings(result.Orphans)
+	result.Orphans = uniqueStrings(result.Orphans)
+}
+
+// ChainProblems returns the problems of the NSEC and NSEC3 chains of the signed zone, as "name: problem", sorted:
+// the names that must be covered by a chain without a record, and the records whose next name is not the next owner
+// of the chain, which must loop back to the apex. An NSEC chain must have a record at every authoritative name and
+// every delegation point, secure or not (RFC4035 2.3). An NSEC3 chain must have a record at the authoritative names
+// and the secure delegations, its insecure delegations must have a record or be covered by one with the opt-out flag
+// (RFC5155 6), and it must have the parameters of the NSEC3PARAM record of the apex. The empty non-terminals can be
+// in an NSEC3 chain, but they are not required. A zone without NSEC and NSEC3 records has no chain to check, so it
+// has no problems. The array must be sorted.
+func (rrArray RRArray) ChainProblems(zone string) []string {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	var params []*dns.NSEC3PARAM
+	for _, rr := range rrArray {
+		if !dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			continue
+		}
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, x)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, x)
+		case *dns.NSEC3PARAM:
+			if strings.EqualFold(x.Hdr.Name, zone) {
+				params = append(params, x)
+			}
+		}
+	}
+	problems := make([]string, 0)
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return problems
+	}
+	// The names of the chains are the ones with data, so the owners of the NSEC3 records and the names with
+	// RRSIGs only (reported as orphans) are left out.
+	var names, insecure []string
+	for _, set := range rrArray.createDenialSet(zone) {
+		types := make(map[uint16]bool)
+		for _, rr := range set {
+			if rrType := rr.Header().Rrtype; rrType != dns.TypeNSEC3 && rrType != dns.TypeNSEC && rrType != dns.TypeRRSIG {
+				types[rrType] = true
+			}
+		}
+		if len(types) == 0 {
+			continue
+		}
+		name := strings.ToLower(set[0].Header().Name)
+		if types[dns.TypeNS] && !types[dns.TypeSOA] && !types[dns.TypeDS] {
+			insecure = append(insecure, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	if len(nsecs) > 0 {
+		// Without opt-out, NSEC chains prove that the insecure delegations have no DS records.
+		problems = append(problems, nsecChainProblems(zone, append(append([]string{}, names...), insecure...), nsecs)...)
+	}
+	if len(nsec3s) > 0 {
+		problems = append(problems, nsec3ChainProblems(zone, names, insecure, nsec3s, params)...)
+	}
+	sort.Strings(problems)
+	return uniqueStrings(problems)
+}
+
+// nsecChainProblems returns the names without an NSEC record and the NSEC records not pointing to the next owner, or
+// to the apex if it is the last one.
+func nsecChainProblems(zone string, names []string, nsecs []*dns.NSEC) []string {
+	problems := make([]string, 0)
+	owners := make(map[string]bool, len(nsecs))
+	for _, nsec := range nsecs {
+		owners[strings.ToLower(nsec.Hdr.Name)] = true
+	}
+	for _, name := range names {
+		if !owners[name] {
+			problems = append(problems, fmt.Sprintf("%s: no NSEC record", name))
+		}
+	}
+	sort.Slice(nsecs, func(i, j int) bool {
+		return CompareNames(nsecs[i].Hdr.Name, nsecs[j].Hdr.Name) < 0
+	})
+	for i, nsec := range nsecs {
+		next := zone
+		if i+1 < len(nsecs) {
+			next = nsecs[i+1].Hdr.Name
+		}
+		if !strings.EqualFold(dns.Fqdn(nsec.NextDomain), next) {
+			problems = append(problems, fmt.Sprintf("%s: NSEC points to %s instead of %s", strings.ToLower(nsec.Hdr.Name), strings.ToLower(nsec.NextDomain), strings.ToLower(next)))
+		}
+	}
+	return problems
+}
+
+// nsec3ChainProblems returns the problems of the NSEC3 chain: the NSEC3PARAM record missing or with other parameters
+// than the NSEC3 records, the NSEC3 records out of the apex, the names without an NSEC3 record, the insecure
+// delegations without one and not covered by an opt-out record, and the records not pointing to the next hash of the
+// chain. The names are hashed with the parameters of the NSEC3PARAM record, or of the first NSEC3 record if there is
+// none.
+func nsec3ChainProblems(zone string, names, insecure []string, nsec3s []*dns.NSEC3, params []*dns.NSEC3PARAM) []string {
+	problems := make([]string, 0)
+	hash := func(nsec3 *dns.NSEC3) string {
+		return strings.ToUpper(strings.SplitN(nsec3.Hdr.Name, ".", 2)[0])
+	}
+	param := &dns.NSEC3PARAM{Hash: nsec3s[0].Hash, Iterations: nsec3s[0].Iterations, Salt: nsec3s[0].Salt}
+	if len(params) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: no NSEC3PARAM record", zone))
+	} else {
+		param = params[0]
+	}
+	chain := make([]*dns.NSEC3, 0, len(nsec3s))
+	for _, nsec3 := range nsec3s {
+		owner := strings.ToLower(nsec3.Hdr.Name)
+		if labels := strings.SplitN(owner, ".", 2); len(labels) < 2 || labels[1] != zone {
+			problems = append(problems, fmt.Sprintf("%s: NSEC3 record out of the apex", owner))
+			continue
+		}
+		if nsec3.Hash != param.Hash || nsec3.Iterations != param.Iterations || !strings.EqualFold(nsec3.Salt, param.Salt) {
+			problems = append(problems, fmt.Sprintf("%s: NSEC3 record with hash %d, %d iterations and salt %q, but the NSEC3PARAM has hash %d, %d iterations and salt %q", owner, nsec3.Hash, nsec3.Iterations, nsec3.Salt, param.Hash, param.Iterations, param.Salt))
+		}
+		chain = append(chain, nsec3)
+	}
+	if len(chain) == 0 {
+		return problems
+	}
+	sort.Slice(chain, func(i, j int) bool {
+		return hash(chain[i]) < hash(chain[j])
+	})
+	owners := make(map[string]*dns.NSEC3, len(chain))
+	for _, nsec3 := range chain {
+		owners[hash(nsec3)] = nsec3
+	}
+	for _, name := range names {
+		if hName := dns.HashName(name, param.Hash, param.Iterations, param.Salt); owners[hName] == nil {
+			problems = append(problems, fmt.Sprintf("%s: no NSEC3 record (hash %s)", name, hName))
+		}
+	}
+	for _, name := range insecure {
+		hName := dns.HashName(name, param.Hash, param.Iterations, param.Salt)
+		if owners[hName] != nil {
+			continue
+		}
+		optOut := false
+		for i, nsec3 := range chain {
+			if next := hash(chain[(i+1)%len(chain)]); nsec3Covers(hash(nsec3), next, hName) {
+				optOut = nsec3.Flags&1 == 1
+				break
+			}
+		}
+		if !optOut {
+			problems = append(problems, fmt.Sprintf("%s: no NSEC3 record (hash %s) and not covered by an opt-out NSEC3 record", name, hName))
+		}
+	}
+	for i, nsec3 := range chain {
+		next := hash(chain[(i+1)%len(chain)])
+		if !strings.EqualFold(nsec3.NextDomain, next) {
+			problems = append(problems, fmt.Sprintf("%s: NSEC3 points to %s instead of %s", hash(nsec3)+"."+zone, strings.ToUpper(nsec3.NextDomain), next))
+		}
+	}
+	return problems
+}
@@ -5,44 +5,99 @@ import (
 	"github.com/miekg/dns"
 	"io"
 	"log"
+	"sort"
 	"time"
 )
 
 // RRSigTuple combines an RRSIg and the set related to it.
+// If the set has more than one RRSIG (as during a key rollover), RRSigs has all of them and RRSig the last one.
 type RRSigTuple struct {
 	RRSig   *dns.RRSIG
+	RRSigs  []*dns.RRSIG
 	RRArray RRArray
 }
 
+// VerifyArgs contains all the args needed to verify a signed zone.
+type VerifyArgs struct {
+	Zone              string        // Zone name
+	File              io.Reader     // Signed zone file. It is only read if RRs is empty.
+	RRs               RRArray       // Signed zone RRs. They don't need to be sorted.
+	Log               Logger        // Logger (for output). If nil, nothing is logged
+	Keys              []*dns.DNSKEY // If not empty, the signatures are verified with these keys instead of the DNSKEYs of the zone
+	KSKTag            uint16        // If not zero, the DNSKEY RRset must be signed by the key with this key tag
+	ZSKTag            uint16        // If not zero, the other RRsets must be signed by the key with this key tag
+	Rollover          RolloverPhase // Phase of the key rollover of the zone, which relaxes or adds conditions (see RolloverPhase). By default, there is none.
+	ExpirationWarning time.Duration // If positive, the valid RRsets whose RRSIGs expire within this duration are reported (see VerificationResult.Expiring)
+}
+
 // VerifyFile verifies the signatures in an already signed zone file.
 func VerifyFile(zone string, reader io.Reader, logger *log.Logger) (err error) {
-	var args *SignArgs
-        args.Zone = zone
-	args.File = reader
+	return Verify(&VerifyArgs{
+		Zone: zone,
+		File: reader,
+		Log:  newLogger(logger),
+	})
+}
+
+// VerifyRRArray verifies the signatures in an already signed zone, represented as an array of RRs.
+// The array does not need to be sorted.
+func VerifyRRArray(zone string, rrs RRArray, logger *log.Logger) (err error) {
+	return Verify(&VerifyArgs{
+		Zone: zone,
+		RRs:  rrs,
+		Log:  newLogger(logger),
+	})
+}
 
-	rrZone, err := ReadAndParseZone(args, false)
+// Verify verifies the signatures of a signed zone. If args.RRs is empty, the zone is read from args.File.
+// It returns the first problem of the zone (see VerificationResult.Err), or nil if it is valid.
+func Verify(args *VerifyArgs) error {
+	result, err := VerifyZone(args)
 	if err != nil {
+		return err
+	}
+	return result.Err()
+}
+
+// VerifyZone verifies a signed zone as Verify, but it returns the result of each RRset and the other problems of
+// the zone, as the RRSIGs without RRsets, the problems of its NSEC or NSEC3 chain and the RRsets expiring within
+// args.ExpirationWarning. It only returns an error if the zone cannot be verified: if it cannot be read, its NSEC3
+// records have wrong fields or it has no DNSKEYs.
+func VerifyZone(args *VerifyArgs) (result *VerificationResult, err error) {
+	zone := args.Zone
+	logger := orNop(args.Log)
+	var rrZone RRArray
+	if len(args.RRs) == 0 {
+		rrZone, err = ReadAndParseZone(&SignArgs{
+			Zone: zone,
+			File: args.File,
+		}, false)
+		if err != nil {
+			return
+		}
+	} else {
+		rrZone = make(RRArray, len(args.RRs))
+		copy(rrZone, args.RRs)
+		sort.Sort(rrZone)
+	}
+
+	if err = rrZone.CheckNSEC3Fields(); err != nil {
 		return
 	}
+
 	rrSet := rrZone.CreateRRSet(zone, true)
 	nsNames := getAllNSNames(rrZone)
 
 	rrSigTuples := make(map[string]*RRSigTuple)
 
-	var pzsk, pksk *dns.DNSKEY
+	var keys []*dns.DNSKEY
 
 	// Pairing each RRArray with its RRSig
 	for _, rrArray := range rrSet {
 		if len(rrArray) > 0 && rrArray.IsSignable(zone, nsNames) {
 			if rrArray[0].Header().Rrtype == dns.TypeDNSKEY {
-				key1 := rrArray[0].(*dns.DNSKEY)
-				key2 := rrArray[1].(*dns.DNSKEY)
-				if key1.Flags == 256 {
-					pzsk = key1
-					pksk = key2
-				} else if key1.Flags == 257 {
-					pzsk = key2
-					pksk = key1
+				for _, rr := range rrArray {
+					keys = append(keys, rr.(*dns.DNSKEY))
 				}
 			}
 			firstRR := rrArray[0]
@@ -57,6 +112,7 @@ func VerifyFile(zone string, reader io.Reader, logger *log.Logger) (err error) {
 						rrSigTuples[setHash] = tuple
 					}
 					tuple.RRSig = sig
+					tuple.RRSigs = append(tuple.RRSigs, sig)
 				}
 			} else {
 				setHash = fmt.Sprintf("%s#%s#%s", firstRR.Header().Name, dns.Class(firstRR.Header().Class), dns.Type(firstRR.Header().Rrtype))
@@ -70,44 +126,186 @@ func VerifyFile(zone string, reader io.Reader, logger *log.Logger) (err error) {
 		}
 	}
 
-	if pzsk == nil || pksk == nil {
+	if len(args.Keys) > 0 {
+		keys = args.Keys
+	}
+	if len(keys) == 0 {
 		err = fmt.Errorf("couldn't find dnskeys")
-		return err
+		return
+	}
+
+	// Every RRset must be signed with each algorithm of the DNSKEYs (RFC4035 2.2), as during an algorithm rollover,
+	// except the ones of the keys published before or after they sign, if the zone is in those rollover phases.
+	keyAlgorithms := args.Rollover.requiredAlgorithms(keys, rrSigTuples)
+	doubleSignature := args.Rollover == RolloverDoubleSignature
+	var signers map[bool]map[string]bool
+	if doubleSignature {
+		signers = signingKeys(keys, rrSigTuples)
 	}
 
 	// Checking each RRset RRSignature.
-	fmt.Printf("number of signatures: %d\n", len(rrSigTuples))
+	// An RRset is valid if one of its signatures by each algorithm (or by the expected key, if there is one) is valid.
+	logger.Info("Verifying signatures", "zone", zone, "signatures", len(rrSigTuples))
+	result = &VerificationResult{Zone: zone, RRsets: make([]RRsetResult, 0, len(rrSigTuples)), Orphans: make([]string, 0)}
+	now := time.Now()
 	for setName, tuple := range rrSigTuples {
-		sig := tuple.RRSig
 		arr := tuple.RRArray
 		if len(arr) == 0 {
-			err = fmt.Errorf("the RRArray %s has no elements", setName)
-			return
+			logger.Error(fmt.Sprintf("the RRArray %s has no elements", setName), "zone", zone)
+			result.Orphans = append(result.Orphans, fmt.Sprintf("%s %s", tuple.RRSig.Hdr.Name, dns.Type(tuple.RRSig.TypeCovered)))
+			continue
 		}
-		if sig == nil {
-			err = fmt.Errorf("the RRArray %s does not have a Signature", setName)
-			return
-		}
-		expDate := time.Unix(int64(sig.Expiration), 0)
-		if expDate.Before(time.Now()) {
-			err = fmt.Errorf(
-				"the Signature for RRArray %s has already expired. Expiration date: %s",
-				setName,
-				expDate.Format("2006-01-02 15:04:05"),
-			)
-			logger.Printf("%s\n", err)
-			return
+		rrset := RRsetResult{Name: arr[0].Header().Name, Type: arr[0].Header().Rrtype, Status: RRsetInvalid}
+		if len(tuple.RRSigs) == 0 {
+			rrset.Status, rrset.Err = RRsetUnsigned, fmt.Errorf("the RRArray %s does not have a Signature", setName)
+			logger.Error(rrset.Err.Error(), "zone", zone)
+			result.RRsets = append(result.RRsets, rrset)
+			continue
 		}
+		expectedTag := args.ZSKTag
 		if arr[0].Header().Rrtype == dns.TypeDNSKEY {
-			err = sig.Verify(pksk, arr)
-		} else {
-			err = sig.Verify(pzsk, arr)
+			expectedTag = args.KSKTag
 		}
-		if err != nil {
-			logger.Printf("[Error] (%s) %s  \n", err, setName)
+		var setErr error
+		validAlgorithms := make(map[uint8]bool)
+		validKeys := make(map[string]bool)
+		expirations := make(map[uint8]time.Time) // latest expiration of the valid RRSIGs of each algorithm
+		expired, failed := 0, 0
+		for _, sig := range tuple.RRSigs {
+			// In the double-signature phase, every signature is checked, because each key must sign the RRset.
+			if !doubleSignature && (expectedTag != 0 && sig.KeyTag != expectedTag || validAlgorithms[sig.Algorithm]) {
+				continue
+			}
+			expiration := time.Unix(int64(sig.Expiration), 0)
+			if sigErr := verifySig(keys, sig, arr); sigErr != nil {
+				logger.Error(fmt.Sprintf("(%s) %s", sigErr, setName), "keytag", sig.KeyTag)
+				setErr = sigErr
+				if expiration.Before(now) {
+					expired++
+				} else {
+					failed++
+				}
+				continue
+			}
+			logger.Debug(fmt.Sprintf("[ OK  ] %s", setName), "keytag", sig.KeyTag)
+			if expiration.After(expirations[sig.Algorithm]) {
+				expirations[sig.Algorithm] = expiration
+			}
+			validAlgorithms[sig.Algorithm] = true
+			validKeys[keyID(sig.Algorithm, sig.KeyTag)] = true
+			if expectedTag != 0 && !doubleSignature {
+				break
+			}
+		}
+		if len(validAlgorithms) > 0 {
+			setErr = nil
+			if expectedTag == 0 {
+				for alg := range keyAlgorithms {
+					if !validAlgorithms[alg] {
+						setErr = fmt.Errorf("the RRArray %s has no valid signature with algorithm %s", setName, algorithmName(alg))
+						logger.Error(setErr.Error(), "zone", zone)
+						break
+					}
+				}
+			}
+		}
+		if setErr == nil && doubleSignature {
+			for id := range signers[arr[0].Header().Rrtype == dns.TypeDNSKEY] {
+				if !validKeys[id] {
+					setErr = fmt.Errorf("the RRArray %s has no valid signature by key %s, which signs other RRsets in the double-signature phase", setName, id)
+					logger.Error(setErr.Error(), "zone", zone)
+					break
+				}
+			}
+		}
+		if setErr == nil {
+			setErr = checkOrigTTL(tuple.RRSigs, arr)
+			if setErr != nil {
+				logger.Error(setErr.Error(), "zone", zone)
+			}
+		}
+		if setErr == nil && expectedTag != 0 && !hasKeyTag(tuple.RRSigs, expectedTag) {
+			setErr = fmt.Errorf("the RRArray %s is not signed by the key with key tag %d", setName, expectedTag)
+			logger.Error(setErr.Error(), "zone", zone)
+		}
+		if setErr != nil {
+			rrset.Err = setErr
+			if len(validAlgorithms) == 0 && expired > 0 && failed == 0 {
+				rrset.Status = RRsetExpired
+			}
 		} else {
-			logger.Printf("[ OK  ] %s\n", setName)
+			rrset.Status = RRsetValid
+			for _, expiration := range expirations {
+				if rrset.Expiration.IsZero() || expiration.Before(rrset.Expiration) {
+					rrset.Expiration = expiration
+				}
+			}
+		}
+		result.RRsets = append(result.RRsets, rrset)
+	}
+
+	var warning time.Time
+	if args.ExpirationWarning > 0 {
+		warning = now.Add(args.ExpirationWarning)
+	}
+	result.sort(warning)
+	for _, rrset := range result.Expiring {
+		logger.Warn("RRSIGs expiring soon", "name", rrset.Name, "type", dns.Type(rrset.Type), "expiration", rrset.Expiration.Format("2006-01-02 15:04:05"))
+	}
+	result.MissingLinks = rrZone.ChainProblems(zone)
+	for _, problem := range result.MissingLinks {
+		logger.Error(fmt.Sprintf("broken denial of existence chain: %s", problem), "zone", zone)
+	}
+	result.ZONEMD = verifyZONEMD(zone, rrZone, logger)
+	return result, nil
+}
+
+// checkOrigTTL returns an error if the Original TTL of an RRSIG is not the TTL of the RRset it covers (RFC4034 3.1.4).
+// The signature is still valid with another TTL, because the Original TTL is the one signed, but resolvers
+// reconstruct the signed data from it and would serve the RRset with a TTL it was not signed with.
+func checkOrigTTL(sigs []*dns.RRSIG, arr RRArray) error {
+	ttl := arr[0].Header().Ttl
+	for _, sig := range sigs {
+		if sig.OrigTtl != ttl {
+			return fmt.Errorf("the RRSIG of %s %s with key tag %d has original TTL %d, but the TTL of the RRset is %d",
+				arr[0].Header().Name, dns.Type(arr[0].Header().Rrtype), sig.KeyTag, sig.OrigTtl, ttl)
+		}
+	}
+	return nil
+}
+
+// verifySig verifies the signature of the RRset with the key of the signature, checking that it has not expired.
+func verifySig(keys []*dns.DNSKEY, sig *dns.RRSIG, arr RRArray) error {
+	expDate := time.Unix(int64(sig.Expiration), 0)
+	if expDate.Before(time.Now()) {
+		return fmt.Errorf(
+			"the Signature has already expired. Expiration date: %s",
+			expDate.Format("2006-01-02 15:04:05"),
+		)
+	}
+	key := signingKey(keys, sig)
+	if key == nil {
+		return fmt.Errorf("no DNSKEY with key tag %d for the signature", sig.KeyTag)
+	}
+	return sig.Verify(key, arr)
+}
+
+// hasKeyTag returns true if one of the signatures was made by the key with the key tag provided.
+func hasKeyTag(sigs []*dns.RRSIG, keyTag uint16) bool {
+	for _, sig := range sigs {
+		if sig.KeyTag == keyTag {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey returns the DNSKEY with the key tag and algorithm of the signature, or nil if there is none.
+func signingKey(keys []*dns.DNSKEY, sig *dns.RRSIG) *dns.DNSKEY {
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm {
+			return key
 		}
 	}
-	return
+	return nil
 }
@@ -0,0 +1,92 @@
+package signer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"strings"
+)
+
+// OutputFormat defines how the records of the signed zone are written.
+type OutputFormat int
+
+const (
+	FormatText OutputFormat = iota // Records in presentation format, one per line, as in a zone file
+	FormatWire                     // Records in uncompressed wire format, each one preceded by its length (see RRArray.WriteWire)
+)
+
+// ParseOutputFormat returns the output format with the name provided: text or wire.
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return FormatText, nil
+	case "wire":
+		return FormatWire, nil
+	default:
+		return FormatText, fmt.Errorf("unknown output format %s (it should be text or wire)", name)
+	}
+}
+
+// String returns the name of the output format.
+func (format OutputFormat) String() string {
+	if format == FormatWire {
+		return "wire"
+	}
+	return "text"
+}
+
+// WriteWire writes on writer all the RRs on the array in uncompressed wire format (RFC1035 4.1.3),
+// each one preceded by its length as a two byte unsigned integer in network order, as in a DNS message sent over TCP.
+// The owner names are written as they are in the RRs, so the zone read back with ReadWireZone is exactly the same.
+func (rrArray RRArray) WriteWire(writer io.Writer) error {
+	for _, rr := range rrArray {
+		wire, _, err := packRR(rr)
+		if err != nil {
+			return fmt.Errorf("cannot pack %s: %s", rr, err)
+		}
+		if len(wire) > dns.MaxMsgSize {
+			return fmt.Errorf("cannot write %s: its wire format is larger than %d bytes", rr.Header(), dns.MaxMsgSize)
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(wire)))
+		if _, err := writer.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := writer.Write(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadWireZone reads a zone written by RRArray.WriteWire and returns its RRs, which can be signed again
+// setting them as SignArgs.RRs. It returns an error if a record is truncated or cannot be unpacked,
+// or if the zone has no records.
+func ReadWireZone(reader io.Reader) (RRArray, error) {
+	rrs := make(RRArray, 0)
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(reader, length[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read length of record %d: %s", len(rrs)+1, err)
+		}
+		wire := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(reader, wire); err != nil {
+			return nil, fmt.Errorf("cannot read record %d: %s", len(rrs)+1, err)
+		}
+		rr, off, err := dns.UnpackRR(wire, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unpack record %d: %s", len(rrs)+1, err)
+		}
+		if off != len(wire) {
+			return nil, fmt.Errorf("record %d has %d bytes after its data", len(rrs)+1, len(wire)-off)
+		}
+		rrs = append(rrs, rr)
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("the wire format zone has no records")
+	}
+	return rrs, nil
+}
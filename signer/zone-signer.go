@@ -0,0 +1,270 @@
+package signer
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"time"
+)
+
+// KeyPair couples a DNSKEY with the signer of its private key.
+// The signer can use an HSM (as RRSigner) or keys in memory.
+type KeyPair struct {
+	DNSKEY   *dns.DNSKEY                       // Public key
+	Signer   crypto.Signer                     // Private key signer
+	SignData func(data []byte) ([]byte, error) // If not nil, it digests and signs the data covered by the RRSIGs (as with DigestHSM), and Signer is not used
+}
+
+// signRRs signs the RRsets in args.RRs with the ZSKs and the DNSKEY RRset (including the preserved DNSKEYs) with the KSKs,
+// adds the DNSKEYs and RRSIGs to args.RRs and writes the sorted zone into args.Output. It returns the DS of the first KSK,
+// with a SHA-256 digest. zsks and ksks have a key pair for each algorithm, in the same order, so every RRset is signed
+// with each algorithm (RFC4035 2.2), as during an algorithm rollover. The ZSKs of args.rolloverZSKs sign every RRset
+// too, and their DNSKEYs are published with the others.
+// It fails if an authoritative RRset of the signed zone has no RRSIG, unless args.IgnoreCoverage is true, and with
+// NSEC3 Opt-Out, if a secure delegation has no NSEC3 record (see RRArray.CheckSecureDelegations).
+// If args.ContinueOnError is true, the RRsets that cannot be signed (other than the SOA and the NSEC or NSEC3 records)
+// are left without RRSIGs, and they are returned as RRSetErrors after the zone is written.
+// If args.MultiSigner is true, the valid RRSIGs of the other signers of the zone are added too.
+// If args.OfflineKSK is not empty, its DNSKEY RRset and RRSIGs are published instead, and the KSKs do not sign.
+// If args.CDS is not CDSNone, the CDS and CDNSKEY records of the mode are added to the apex, and the KSKs sign them too.
+// The ZONEMD record at the apex, if the zone has one, gets the digest of the signed zone and is signed last.
+// If args.RefreshWindow is positive, the RRsets whose RRSIGs do not need to be refreshed keep them, and if
+// args.DNSKEYReuseWindow is, the DNSKEY RRset keeps its RRSIGs if it did not change.
+// args.RRs must already have its NSEC or NSEC3 records.
+func signRRs(args *SignArgs, zsks, ksks []*KeyPair, log Logger) (ds *dns.DS, err error) {
+	log.Info("Start signing...", "zone", args.Zone)
+
+	if err = checkKeyPairs(zsks, ksks); err != nil {
+		return nil, err
+	}
+	if err = args.addCDS(ksks); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	rrSet, zonemd := args.splitZONEMD(args.RRs.CreateRRSet(args.Zone, true))
+	args.observe(StageClassify, start)
+
+	start = time.Now()
+	dnskeys, signingZSKs := args.signingKeys(zsks, ksks)
+	rrDNSKeys := args.dnskeyRRSet(dnskeys)
+	var offlineSigs RRArray
+	if len(args.OfflineKSK) > 0 {
+		if rrDNSKeys, offlineSigs, err = args.offlineDNSKEYs(signingZSKs, ksks, log); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range rrSet {
+		v.sortCanonical()
+	}
+	reused, dnskeySigs, err := args.refreshedSets(rrSet, rrDNSKeys, offlineSigs, signingZSKs, ksks)
+	if err != nil {
+		return nil, err
+	}
+
+	args.Refreshed = 0
+	var failed RRSetErrors
+	signed, errs := args.signRRSets(rrSet, reused, signingZSKs, log)
+	for i, v := range rrSet {
+		if rrSigs, ok := reused[i]; ok {
+			args.RRs = append(args.RRs, rrSigs...)
+			continue
+		}
+		rrSigs, err := signed[i], errs[i]
+		if err != nil {
+			if !args.ContinueOnError || !recoverable(v) {
+				return nil, err
+			}
+			log.Warn("Cannot sign RRset, it is left without RRSIGs", "name", v[0].Header().Name, "type", dns.Type(v[0].Header().Rrtype), "error", err)
+			failed = append(failed, &RRSetError{Name: v[0].Header().Name, Type: v[0].Header().Rrtype, Err: err})
+			continue
+		}
+		args.RRs = append(args.RRs, rrSigs...)
+		args.Refreshed += len(rrSigs)
+	}
+
+	args.RRs = append(args.RRs, rrDNSKeys...)
+	if offlineSigs != nil {
+		args.RRs = append(args.RRs, offlineSigs...)
+		log.Info("DNSKEY RRset signed offline, its RRSIGs were published without using the KSKs", "zone", args.Zone, "rrsigs", len(offlineSigs))
+	} else if dnskeySigs != nil {
+		args.RRs = append(args.RRs, dnskeySigs...)
+		if args.DNSKEYReuseWindow > 0 {
+			log.Info("DNSKEY RRset unchanged, its RRSIGs were kept without using the KSKs", "zone", args.Zone, "rrsigs", len(dnskeySigs))
+		}
+	} else {
+		if dnskeySigs, err = args.signDNSKEYRRSet(rrDNSKeys, ksks); err != nil {
+			return nil, err
+		}
+		args.RRs = append(args.RRs, dnskeySigs...)
+		args.Refreshed += len(dnskeySigs)
+	}
+	cdsSigs, err := args.signCDS(rrSet, ksks)
+	if err != nil {
+		return nil, err
+	}
+	args.RRs = append(args.RRs, cdsSigs...)
+	args.RRs = append(args.RRs, args.foreignSignatures(rrSet, rrDNSKeys, dnskeys, log)...)
+	if zonemd != nil {
+		zonemdSigs, err := args.signZONEMD(zonemd, signingZSKs)
+		if err != nil {
+			return nil, err
+		}
+		args.RRs = append(args.RRs, zonemdSigs...)
+	}
+	if args.RefreshWindow > 0 {
+		log.Info("RRSIGs refreshed", "zone", args.Zone, "rrsigs", args.Refreshed)
+	}
+
+	args.observe(StageSignRRsets, start)
+
+	start = time.Now()
+	sort.Sort(args.RRs)
+	for i, ksk := range ksks {
+		log.Info("Zone signed", "zone", args.Zone, "zsk", zsks[i].DNSKEY.KeyTag(), "ksk", ksk.DNSKEY.KeyTag(), "rrsets", len(rrSet)+1)
+		log.Info(fmt.Sprintf("DS: %s", ksk.DNSKEY.ToDS(dns.SHA256)))
+	}
+	ds = ksks[0].DNSKEY.ToDS(dns.SHA256)
+	if err = checkCoverage(args, len(failed) > 0, log); err != nil {
+		return nil, err
+	}
+	if args.NSEC3 && args.OptOut {
+		if err = args.RRs.CheckSecureDelegations(args.Zone); err != nil {
+			log.Error("Opt-Out left a secure delegation out of the NSEC3 chain", "zone", args.Zone, "error", err)
+			return nil, err
+		}
+	}
+	checkResponseSizes(args, log)
+	if args.PreserveText {
+		err = args.writePreservedZone(args.RRs.ordered(args.Order))
+	} else if args.Format == FormatWire {
+		err = args.RRs.ordered(args.Order).WriteWire(args.Output)
+	} else {
+		err = args.RRs.ordered(args.Order).WriteZone(args.Output)
+	}
+	args.observe(StageSerialize, start)
+	if err == nil && args.MetadataOutput != nil {
+		if err = SignedZoneMetadata(args.Zone, args.RRs).WriteJSON(args.MetadataOutput); err != nil {
+			err = fmt.Errorf("cannot write metadata of zone %s: %s", args.Zone, err)
+		}
+	}
+	if err == nil && args.DSOutput != nil {
+		err = args.writeDSRecords(args.RRs)
+	}
+	if err == nil && len(failed) > 0 {
+		err = failed
+	}
+	return ds, err
+}
+
+// checkKeyPairs returns an error if the ZSKs and KSKs are not a key pair of each role for each algorithm, or if the
+// algorithms of a ZSK and its KSK do not match (see checkKeyAlgorithms).
+func checkKeyPairs(zsks, ksks []*KeyPair) error {
+	if len(zsks) == 0 || len(zsks) != len(ksks) {
+		return fmt.Errorf("each algorithm needs a ZSK and a KSK, but there are %d ZSKs and %d KSKs", len(zsks), len(ksks))
+	}
+	algs := make(map[uint8]bool)
+	for i := range zsks {
+		if err := checkKeyAlgorithms(zsks[i], ksks[i]); err != nil {
+			return err
+		}
+		if algs[zsks[i].DNSKEY.Algorithm] {
+			return fmt.Errorf("algorithm %d has more than one key pair", zsks[i].DNSKEY.Algorithm)
+		}
+		algs[zsks[i].DNSKEY.Algorithm] = true
+	}
+	return nil
+}
+
+// signingKeys returns the DNSKEYs of the key pairs and of args.rolloverZSKs, and the ZSKs signing every RRset:
+// zsks, followed by args.rolloverZSKs.
+func (args *SignArgs) signingKeys(zsks, ksks []*KeyPair) ([]*dns.DNSKEY, []*KeyPair) {
+	dnskeys := make([]*dns.DNSKEY, 0, 2*len(zsks)+len(args.rolloverZSKs))
+	for i := range zsks {
+		dnskeys = append(dnskeys, zsks[i].DNSKEY, ksks[i].DNSKEY)
+	}
+	if len(args.rolloverZSKs) == 0 {
+		return dnskeys, zsks
+	}
+	for _, zsk := range args.rolloverZSKs {
+		dnskeys = append(dnskeys, zsk.DNSKEY)
+	}
+	return dnskeys, append(append([]*KeyPair{}, zsks...), args.rolloverZSKs...)
+}
+
+// signDNSKEYRRSet returns the RRSIGs of the DNSKEY RRset with each KSK, checking them.
+func (args *SignArgs) signDNSKEYRRSet(dnskeys RRArray, ksks []*KeyPair) (RRArray, error) {
+	rrSigs := make(RRArray, 0, len(ksks))
+	for _, ksk := range ksks {
+		rrDNSKeySig := args.newRRSIG(ksk.DNSKEY, dns.TypeDNSKEY, ksk.DNSKEY.Hdr.Ttl)
+		if err := ksk.sign(rrDNSKeySig, dnskeys); err != nil {
+			return nil, err
+		}
+		if err := rrDNSKeySig.Verify(ksk.DNSKEY, dnskeys); err != nil {
+			return nil, fmt.Errorf("cannot check ksk RRSig: %s", err)
+		}
+		rrSigs = append(rrSigs, rrDNSKeySig)
+	}
+	return rrSigs, nil
+}
+
+// signRRSet returns the RRSIGs of the RRset with each ZSK, checking them. The RRset must be sorted canonically.
+func (args *SignArgs) signRRSet(set RRArray, zsks []*KeyPair) (RRArray, error) {
+	return signRRSIGs(set, args.newRRSIGs(set, zsks), zsks)
+}
+
+// newRRSIGs returns an RRSIG of the RRset for each ZSK, with its expiration date, but not signed yet. They are
+// created apart from the signatures, so the random expirations of ExpirationJitter follow the order of the RRsets
+// even if they are signed concurrently.
+func (args *SignArgs) newRRSIGs(set RRArray, zsks []*KeyPair) []*dns.RRSIG {
+	rrSigs := make([]*dns.RRSIG, 0, len(zsks))
+	for _, zsk := range zsks {
+		rrSigs = append(rrSigs, args.newRRSIG(zsk.DNSKEY, set[0].Header().Rrtype, set[0].Header().Ttl))
+	}
+	return rrSigs
+}
+
+// newRRSIG returns an RRSIG made with the key for an RRset of type rrType with the TTL provided, not signed yet.
+// It expires on the date of signatureExpDate, and its inception is the start of the signature (see startTime),
+// moved back args.InceptionOffset if it is positive.
+func (args *SignArgs) newRRSIG(key *dns.DNSKEY, rrType uint16, ttl uint32) *dns.RRSIG {
+	rrSig := CreateNewRRSIG(args.Zone, key, args.signatureExpDate(rrType), ttl)
+	rrSig.Inception = uint32(args.startTime().Unix())
+	if args.InceptionOffset > 0 {
+		rrSig.Inception -= uint32(args.InceptionOffset / time.Second)
+	}
+	return rrSig
+}
+
+// signRRSIGs signs each RRSIG of the RRset with the ZSK in the same position, checking them.
+func signRRSIGs(set RRArray, rrSigs []*dns.RRSIG, zsks []*KeyPair) (RRArray, error) {
+	signed := make(RRArray, 0, len(zsks))
+	for i, zsk := range zsks {
+		if err := zsk.sign(rrSigs[i], set); err != nil {
+			return nil, fmt.Errorf("cannot sign RRSig: %s", err)
+		}
+		if err := rrSigs[i].Verify(zsk.DNSKEY, set); err != nil {
+			return nil, fmt.Errorf("cannot check RRSig: %s", err)
+		}
+		signed = append(signed, rrSigs[i])
+	}
+	return signed, nil
+}
+
+// checkKeyAlgorithms returns an error if the ZSK and KSK do not use the same algorithm, or if it is not supported.
+// The RRSIG algorithm is taken from the DNSKEY and its digest from the algorithm, so a mismatch between them
+// would produce signatures that cannot be validated.
+func checkKeyAlgorithms(zsk, ksk *KeyPair) error {
+	if zsk.DNSKEY.Algorithm != ksk.DNSKEY.Algorithm {
+		return fmt.Errorf("ZSK algorithm %d does not match KSK algorithm %d", zsk.DNSKEY.Algorithm, ksk.DNSKEY.Algorithm)
+	}
+	alg, err := GetAlgorithm(zsk.DNSKEY.Algorithm)
+	if err != nil {
+		return err
+	}
+	if hash, ok := dns.AlgorithmToHash[alg.Number]; !ok || hash != alg.Hash {
+		return fmt.Errorf("digest %s does not match algorithm %s", alg.Hash, alg)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// zonemdHashes are the hash algorithms of the SIMPLE scheme of ZONEMD (RFC8976 5.3) that can be verified.
+var zonemdHashes = map[uint8]func() hash.Hash{
+	dns.ZoneMDHashAlgSHA384: sha512.New384,
+	dns.ZoneMDHashAlgSHA512: sha512.New,
+}
+
+// ZONEMDDigest returns the digest of the zone with the SIMPLE scheme of ZONEMD (RFC8976 3.3) and the hash algorithm
+// provided (dns.ZoneMDHashAlgSHA384 or dns.ZoneMDHashAlgSHA512). It hashes every RR once, in canonical form and order
+// (RFC4034 6), including the glue, the occluded records and the DNSSEC records, but not the ZONEMD records at the apex
+// of the zone and the RRSIGs covering them, which are made from the digest.
+func (rrArray RRArray) ZONEMDDigest(zone string, hashAlg uint8) ([]byte, error) {
+	newHash, ok := zonemdHashes[hashAlg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ZONEMD hash algorithm %d", hashAlg)
+	}
+	zone = dns.Fqdn(zone)
+	type keyedRR struct {
+		rr    dns.RR
+		wire  []byte
+		rdata []byte
+	}
+	keyed := make([]keyedRR, 0, len(rrArray))
+	for _, rr := range rrArray {
+		if isApexZONEMD(zone, rr) {
+			continue
+		}
+		rr = canonicalCopy(rr)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sig.SignerName = dns.CanonicalName(sig.SignerName)
+		}
+		wire, rdata, err := packRR(rr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot digest %s record of %s: %s", dns.Type(rr.Header().Rrtype), rr.Header().Name, err)
+		}
+		keyed = append(keyed, keyedRR{rr, wire, rdata})
+	}
+	sort.Slice(keyed, func(i, j int) bool {
+		a, b := keyed[i].rr.Header(), keyed[j].rr.Header()
+		if cmp := CompareNames(a.Name, b.Name); cmp != 0 {
+			return cmp < 0
+		}
+		if a.Class != b.Class {
+			return a.Class < b.Class
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+		return bytes.Compare(keyed[i].rdata, keyed[j].rdata) < 0
+	})
+	h := newHash()
+	for i, k := range keyed {
+		// Duplicate RRs are hashed once (RFC8976 3.3.1.2).
+		if i > 0 && bytes.Equal(k.wire, keyed[i-1].wire) {
+			continue
+		}
+		h.Write(k.wire)
+	}
+	return h.Sum(nil), nil
+}
+
+// isApexZONEMD returns true if the RR is a ZONEMD record at the apex of the zone, or an RRSIG covering them.
+func isApexZONEMD(zone string, rr dns.RR) bool {
+	rrType := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		rrType = sig.TypeCovered
+	}
+	return rrType == dns.TypeZONEMD && strings.EqualFold(rr.Header().Name, zone)
+}
+
+// addZONEMD replaces the ZONEMD records at the apex of the zone in args.RRs with a placeholder (RFC8976 3.1), so
+// the NSEC or NSEC3 record of the apex has its type. Its digest is set by signZONEMD. It does nothing if
+// args.ZONEMD is false and the zone has no ZONEMD records, whose digest would not match the signed zone.
+func (args *SignArgs) addZONEMD() error {
+	found := args.ZONEMD
+	var soa *dns.SOA
+	rrs := make(RRArray, 0, len(args.RRs)+1)
+	for _, rr := range args.RRs {
+		if isApexZONEMD(args.Zone, rr) {
+			found = true
+			continue
+		}
+		if x, ok := rr.(*dns.SOA); ok && strings.EqualFold(x.Hdr.Name, args.Zone) {
+			soa = x
+		}
+		rrs = append(rrs, rr)
+	}
+	if !found {
+		return nil
+	}
+	if soa == nil {
+		return fmt.Errorf("zone %s has no SOA record for its ZONEMD record", args.Zone)
+	}
+	rrs = append(rrs, &dns.ZONEMD{
+		Hdr:    dns.RR_Header{Name: soa.Hdr.Name, Rrtype: dns.TypeZONEMD, Class: dns.ClassINET, Ttl: soa.Hdr.Ttl},
+		Serial: soa.Serial,
+		Scheme: dns.ZoneMDSchemeSimple,
+		Hash:   dns.ZoneMDHashAlgSHA384,
+		Digest: strings.Repeat("00", sha512.Size384),
+	})
+	sort.Sort(rrs)
+	args.RRs = rrs
+	return nil
+}
+
+// splitZONEMD returns the RRsets of sets without the ZONEMD RRset at the apex of the zone (made by addZONEMD), and
+// that RRset, because it is signed by signZONEMD after the other RRsets. If there is none, it returns sets and nil.
+func (args *SignArgs) splitZONEMD(sets RRSet) (RRSet, RRArray) {
+	for i, set := range sets {
+		if isApexZONEMD(args.Zone, set[0]) {
+			return append(sets[:i:i], sets[i+1:]...), set
+		}
+	}
+	return sets, nil
+}
+
+// signZONEMD sets the serial and the SHA-384 digest of args.RRs in the ZONEMD record of the set provided (made by
+// addZONEMD), and returns its RRSIGs made with the ZSKs. As the RRSIGs of the other RRsets, they are kept if
+// args.RefreshWindow is positive and the record did not change. It must be called when args.RRs has every other
+// RRSIG of the zone.
+func (args *SignArgs) signZONEMD(set RRArray, zsks []*KeyPair) (RRArray, error) {
+	zonemd := set[0].(*dns.ZONEMD)
+	for _, rr := range args.RRs {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, args.Zone) {
+			zonemd.Serial = soa.Serial
+		}
+	}
+	digest, err := args.RRs.ZONEMDDigest(args.Zone, zonemd.Hash)
+	if err != nil {
+		return nil, err
+	}
+	zonemd.Digest = hex.EncodeToString(digest)
+	if sigs := args.reusableSignatures(set, zsks, args.RefreshWindow); sigs != nil {
+		return sigs, nil
+	}
+	signed, err := signRRSIGs(set, args.newRRSIGs(set, zsks), zsks)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign the ZONEMD record: %s", err)
+	}
+	args.Refreshed += len(signed)
+	return signed, nil
+}
+
+// verifyZONEMD verifies the ZONEMD records at the apex of the zone, if it has any (RFC8976 4): their serial must be
+// the one of the SOA, there must be at most one of each scheme and hash algorithm, and one of the records with the
+// SIMPLE scheme and a supported hash algorithm must have the digest of the zone. If none of them can be verified,
+// it only logs a warning.
+func verifyZONEMD(zone string, rrs RRArray, logger Logger) error {
+	zone = dns.Fqdn(zone)
+	var soa *dns.SOA
+	var records []*dns.ZONEMD
+	for _, rr := range rrs {
+		switch x := rr.(type) {
+		case *dns.SOA:
+			if strings.EqualFold(x.Hdr.Name, zone) {
+				soa = x
+			}
+		case *dns.ZONEMD:
+			if strings.EqualFold(x.Hdr.Name, zone) {
+				records = append(records, x)
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if soa == nil {
+		return fmt.Errorf("zone %s has ZONEMD records but no SOA record", zone)
+	}
+	seen := make(map[[2]uint8]bool)
+	for _, zonemd := range records {
+		if zonemd.Serial != soa.Serial {
+			return fmt.Errorf("the ZONEMD record of zone %s has serial %d, but the serial of the SOA is %d", zone, zonemd.Serial, soa.Serial)
+		}
+		key := [2]uint8{zonemd.Scheme, zonemd.Hash}
+		if seen[key] {
+			return fmt.Errorf("zone %s has many ZONEMD records with scheme %d and hash algorithm %d", zone, zonemd.Scheme, zonemd.Hash)
+		}
+		seen[key] = true
+	}
+	var digestErr error
+	supported := false
+	for _, zonemd := range records {
+		if _, ok := zonemdHashes[zonemd.Hash]; !ok || zonemd.Scheme != dns.ZoneMDSchemeSimple {
+			continue
+		}
+		supported = true
+		digest, err := rrs.ZONEMDDigest(zone, zonemd.Hash)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(hex.EncodeToString(digest), zonemd.Digest) {
+			logger.Info("ZONEMD verified", "zone", zone, "scheme", zonemd.Scheme, "hash", zonemd.Hash)
+			return nil
+		}
+		digestErr = fmt.Errorf("the ZONEMD record of zone %s with hash algorithm %d does not match the digest of the zone", zone, zonemd.Hash)
+	}
+	if !supported {
+		logger.Warn("ZONEMD records not verified, because their scheme or hash algorithm is not supported", "zone", zone)
+		return nil
+	}
+	return digestErr
+}